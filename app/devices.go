@@ -0,0 +1,66 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+// Exit codes of `imprint list`.
+const (
+	ListExitFound        = 0
+	ListExitError        = 1
+	ListExitNoneEligible = 2
+)
+
+// PrintDevices prints the devices for `imprint list`, either as a table or as a JSON array. The
+// reason devices were excluded is only printed if any devices in the list were excluded.
+func PrintDevices(output io.Writer, devices []imaging.Device, asJSON bool) error {
+	if asJSON {
+		if devices == nil {
+			devices = []imaging.Device{}
+		}
+		encoder := json.NewEncoder(output)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(devices)
+	}
+
+	showReason := false
+	for _, device := range devices {
+		showReason = showReason || device.ExcludedReason != ""
+	}
+	writer := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0)
+	header := "NAME\tMODEL\tSIZE\tBYTES\tREMOVABLE"
+	if showReason {
+		header += "\tEXCLUDED"
+	}
+	fmt.Fprintln(writer, header)
+	for _, device := range devices {
+		model := device.Model
+		if model == "" {
+			model = "-"
+		}
+		row := device.Name + "\t" + model + "\t" + device.Size + "\t" + strconv.Itoa(device.Bytes) +
+			"\t" + strconv.FormatBool(device.Removable)
+		if showReason {
+			row += "\t" + device.ExcludedReason
+		}
+		fmt.Fprintln(writer, row)
+	}
+	return writer.Flush()
+}
+
+// ListExitCode returns the exit code of `imprint list` for the given devices, which is
+// [ListExitFound] if any of them are eligible to flash to, or [ListExitNoneEligible] otherwise.
+func ListExitCode(devices []imaging.Device) int {
+	for _, device := range devices {
+		if device.ExcludedReason == "" {
+			return ListExitFound
+		}
+	}
+	return ListExitNoneEligible
+}
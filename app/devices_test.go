@@ -0,0 +1,91 @@
+package app_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/retrixe/imprint/app"
+	"github.com/retrixe/imprint/imaging"
+)
+
+var testDevices = []imaging.Device{
+	{Name: "/dev/sda", Model: "Cruzer", Size: "1.9 GB", Bytes: 2000748032, Removable: true},
+	{Name: "/dev/nvme0n1", Size: "954 GB", Bytes: 1024209543168, ExcludedReason: imaging.ExcludedNotRemovable},
+}
+
+func TestPrintDevices(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		devices  []imaging.Device
+		expected string
+	}{
+		{
+			"prints table of eligible devices",
+			testDevices[:1],
+			"NAME      MODEL   SIZE    BYTES       REMOVABLE\n" +
+				"/dev/sda  Cruzer  1.9 GB  2000748032  true\n",
+		},
+		{
+			"prints exclusion reasons",
+			testDevices,
+			"NAME          MODEL   SIZE    BYTES          REMOVABLE  EXCLUDED\n" +
+				"/dev/sda      Cruzer  1.9 GB  2000748032     true       \n" +
+				"/dev/nvme0n1  -       954 GB  1024209543168  false      not removable\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			var output bytes.Buffer
+			if err := app.PrintDevices(&output, testCase.devices, false); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			} else if output.String() != testCase.expected {
+				t.Errorf("expected output %q, got %q", testCase.expected, output.String())
+			}
+		})
+	}
+}
+
+func TestPrintDevicesJSON(t *testing.T) {
+	t.Parallel()
+	var output bytes.Buffer
+	if err := app.PrintDevices(&output, nil, true); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	} else if output.String() != "[]\n" {
+		t.Errorf("expected empty JSON array, got %q", output.String())
+	}
+
+	output.Reset()
+	if err := app.PrintDevices(&output, testDevices, true); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var devices []map[string]any
+	if err := json.Unmarshal(output.Bytes(), &devices); err != nil {
+		t.Fatalf("failed to parse JSON output: %v", err)
+	} else if len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devices))
+	} else if devices[0]["name"] != "/dev/sda" || devices[0]["removable"] != true ||
+		devices[0]["bytes"] != float64(2000748032) {
+		t.Errorf("unexpected device %v", devices[0])
+	} else if _, ok := devices[0]["excludedReason"]; ok {
+		t.Errorf("expected no exclusion reason for eligible device, got %v", devices[0])
+	} else if devices[1]["excludedReason"] != imaging.ExcludedNotRemovable {
+		t.Errorf("expected exclusion reason %q, got %v", imaging.ExcludedNotRemovable, devices[1])
+	}
+}
+
+func TestListExitCode(t *testing.T) {
+	t.Parallel()
+	if code := app.ListExitCode(testDevices); code != app.ListExitFound {
+		t.Errorf("expected exit code %d, got %d", app.ListExitFound, code)
+	}
+	if code := app.ListExitCode(testDevices[1:]); code != app.ListExitNoneEligible {
+		t.Errorf("expected exit code %d, got %d", app.ListExitNoneEligible, code)
+	}
+	if code := app.ListExitCode(nil); code != app.ListExitNoneEligible {
+		t.Errorf("expected exit code %d, got %d", app.ListExitNoneEligible, code)
+	}
+}
@@ -3,12 +3,12 @@ package app
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"io"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/retrixe/imprint/imaging"
 )
@@ -19,6 +19,15 @@ type DdProgress struct {
 	Speed string
 	Phase string
 	Error error
+	// SourceBytes is the number of compressed bytes read, when flashing a compressed image.
+	SourceBytes int
+	// Warning is a non-fatal error reported by the flash process.
+	Warning string
+	// Target is the device this progress is about, when flashing several devices at once. It is
+	// empty for progress about every device, e.g. when a new phase starts.
+	Target string
+	// TargetError is the error which made Target fail, while the other devices continue.
+	TargetError string
 }
 
 // DdError is a struct containing dd errors.
@@ -44,15 +53,34 @@ func (err *DdError) Error() string {
 // wraps `dd` and accepts "stop\n" stdin to terminate dd. This is
 // because killing the process doesn't work with pkexec/osascript,
 // and this approach enables us to reimplement dd fully.
-func CopyConvert(iff string, of string) (chan DdProgress, io.WriteCloser, error) {
+//
+// The Imprint process reports its progress using the JSON progress
+// protocol (see [ProgressEvent]), which is decoded into [DdProgress].
+// Any flags are passed to `imprint flash`, e.g. --checksum. With several
+// target devices, the progress of each device is reported separately.
+func CopyConvert(iff string, targets []string, flags ...string) (chan DdProgress, io.WriteCloser, error) {
 	// FIXME: Write unit tests
+	ddFlag := "--use-system-dd=" + strconv.FormatBool(os.Getenv("__USE_SYSTEM_DD") == "true")
+	args := append([]string{"flash", "--progress=json", ddFlag}, flags...)
+	return runElevated(append(append(args, iff), targets...)...)
+}
+
+// Restore executes `imprint restore` as admin to format the device with a single partition, and
+// provides its progress like [CopyConvert]. Any flags are passed to it, e.g. --fs and --label.
+func Restore(device string, flags ...string) (chan DdProgress, io.WriteCloser, error) {
+	args := append([]string{"restore", "--progress=json"}, flags...)
+	return runElevated(append(args, device)...)
+}
+
+// runElevated executes Imprint itself as admin with the given arguments, decoding its progress
+// into [DdProgress]. Writing "stop\n" to the returned stdin cancels the operation.
+func runElevated(args ...string) (chan DdProgress, io.WriteCloser, error) {
 	channel := make(chan DdProgress)
 	executable, err := os.Executable()
 	if err != nil {
 		return nil, nil, err
 	}
-	ddFlag := "--use-system-dd=" + strconv.FormatBool(os.Getenv("__USE_SYSTEM_DD") == "true")
-	cmd, err := ElevatedCommand(imaging.SystemPlatform, executable, "flash", ddFlag, iff, of)
+	cmd, err := ElevatedCommand(imaging.SystemPlatform, executable, args...)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -68,58 +96,98 @@ func CopyConvert(iff string, of string) (chan DdProgress, io.WriteCloser, error)
 		return nil, nil, err
 	}
 	// Wait for command to exit.
-	lastLine := ""
-	channelClosed := false
-	var mutex sync.Mutex
+	exitErr := make(chan error, 1)
+	go (func() {
+		exitErr <- cmd.Wait()
+		input.Close()
+	})()
+	// Read the output line by line, then report any error if the command failed.
 	go (func() {
-		defer input.Close()
-		err := cmd.Wait()
-		if err != nil {
+		defer close(channel)
+		lastLine, reported := ReadProgress(output, channel)
+		io.Copy(io.Discard, output) // Don't block the process if it writes after an error.
+		if err := <-exitErr; err != nil && !reported {
 			channel <- DdProgress{
 				Error: &DdError{Message: lastLine, Err: err},
 			}
 		}
-		mutex.Lock()
-		defer mutex.Unlock()
-		channelClosed = true
-		close(channel)
 	})()
-	// Read the output line by line.
-	go (func() {
-		phase := "Phase Unknown"
-		scanner := bufio.NewScanner(output)
-		scanner.Split(ScanCROrLFLines)
-		for scanner.Scan() {
-			text := scanner.Text()
-			println(text)
+	return channel, stdin, nil
+}
+
+// ReadProgress decodes the JSON progress protocol from the output of the
+// Imprint process, sending progress to the channel until output is closed.
+//
+// It returns the last line of output which wasn't a progress event (to
+// report when the process fails unexpectedly), and whether an error event
+// was reported. Output from the system dd is parsed as progress as well.
+func ReadProgress(output io.Reader, channel chan<- DdProgress) (string, bool) {
+	lastLine := ""
+	progress := DdProgress{Speed: "0 MB/s", Phase: "Phase Unknown"}
+	scanner := bufio.NewScanner(output)
+	scanner.Split(ScanCROrLFLines)
+	for scanner.Scan() {
+		text := scanner.Text()
+		println(text)
+		var event ProgressEvent
+		if !strings.HasPrefix(text, "{") || json.Unmarshal([]byte(text), &event) != nil {
 			lastLine = text
 			before, after, ok := strings.Cut(text, " ")
-			if strings.HasPrefix(text, "[flash] Phase") {
-				phase = after
-				channel <- DdProgress{
-					Bytes: 0,
-					Speed: "0 MB/s",
-					Phase: phase,
-				}
-			} else if ok && strings.HasPrefix(after, "bytes (") {
-				// TODO: Probably handle error, but we can't tell full dd behavior without seeing the code.
-				// Well, custom dd is the default now anyways.
-				bytes, _ := strconv.Atoi(before)
+			if ok && strings.HasPrefix(after, "bytes (") { // Progress output from the system dd.
 				split := strings.Split(text, ", ")
-				mutex.Lock()
-				if channelClosed {
-					return // We don't need to unlock as no deadlock is caused here.
-				}
-				channel <- DdProgress{
-					Bytes: bytes,
-					Speed: split[len(split)-1],
-					Phase: phase,
-				}
-				mutex.Unlock()
+				progress.Bytes, _ = strconv.Atoi(before)
+				progress.Speed = split[len(split)-1]
+				progress.Warning = ""
+				channel <- progress
 			}
+			continue
+		} else if event.Version != ProgressProtocolVersion {
+			channel <- DdProgress{Error: &ProgressError{
+				Code:    ErrorCodeProtocol,
+				Message: "Unsupported progress protocol version " + strconv.Itoa(event.Version) + "!",
+			}}
+			return lastLine, true
 		}
-	})()
-	return channel, stdin, nil
+		progress.Warning = ""
+		if event.Target != "" { // Progress of one of several devices doesn't affect the others.
+			target := DdProgress{Phase: progress.Phase, Target: event.Target}
+			switch event.Type {
+			case EventProgress:
+				target.Bytes = event.Bytes
+				target.SourceBytes = event.SourceBytes
+				target.Speed = imaging.BytesToString(event.Rate, false) + "/s"
+			case EventWarning:
+				target.Warning = event.Message
+			case EventTargetError:
+				target.TargetError = event.Message
+			default:
+				continue
+			}
+			channel <- target
+			continue
+		}
+		switch event.Type {
+		case EventPhase:
+			progress = DdProgress{
+				Speed: "0 MB/s",
+				Phase: "Phase " + strconv.Itoa(event.Phase) + "/" + strconv.Itoa(event.TotalPhases) +
+					": " + event.Message,
+			}
+		case EventProgress:
+			progress.Bytes = event.Bytes
+			progress.SourceBytes = event.SourceBytes
+			progress.Speed = imaging.BytesToString(event.Rate, false) + "/s"
+		case EventWarning:
+			progress.Warning = event.Message
+		case EventError:
+			channel <- DdProgress{Error: &ProgressError{Code: event.Code, Message: event.Message}}
+			return lastLine, true
+		default: // Done and unknown events don't affect progress.
+			continue
+		}
+		channel <- progress
+	}
+	return lastLine, false
 }
 
 // dropCR drops a terminal \r from the data.
@@ -0,0 +1,440 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/retrixe/imprint/flasher"
+	"github.com/retrixe/imprint/imaging"
+)
+
+// ProgressProtocolVersion is the version of the JSON progress protocol spoken between the
+// elevated `imprint flash` process and the GUI. It must be bumped on incompatible changes.
+const ProgressProtocolVersion = 1
+
+// ProgressEventType is the type of a [ProgressEvent].
+type ProgressEventType string
+
+const (
+	// EventPhase is emitted when a new phase of the operation starts.
+	EventPhase ProgressEventType = "phase"
+	// EventProgress is emitted periodically with the progress of the current phase.
+	EventProgress ProgressEventType = "progress"
+	// EventWarning is emitted when a non-fatal error occurs.
+	EventWarning ProgressEventType = "warning"
+	// EventError is emitted when a fatal error occurs, and is always the last event emitted.
+	EventError ProgressEventType = "error"
+	// EventDone is emitted when the operation completes successfully.
+	EventDone ProgressEventType = "done"
+	// EventTargetError is emitted when one of several targets fails, while the others continue.
+	EventTargetError ProgressEventType = "target_error"
+)
+
+// ErrorCode identifies the kind of error reported by an [EventError] event.
+type ErrorCode string
+
+const (
+	ErrorCodeUnknown           ErrorCode = "unknown"
+	ErrorCodeNotExists         ErrorCode = "not_exists"
+	ErrorCodeIsDirectory       ErrorCode = "is_directory"
+	ErrorCodeNotBlockDevice    ErrorCode = "not_block_device"
+	ErrorCodeReadOnly          ErrorCode = "read_only"
+	ErrorCodeInvalidArchive    ErrorCode = "invalid_archive"
+	ErrorCodeReadWriteMismatch ErrorCode = "read_write_mismatch"
+	ErrorCodeValidationFailed  ErrorCode = "validation_failed"
+	ErrorCodeInvalidChecksum   ErrorCode = "invalid_checksum"
+	ErrorCodeInvalidBmap       ErrorCode = "invalid_bmap"
+	ErrorCodeChecksumMismatch  ErrorCode = "checksum_mismatch"
+	ErrorCodeSignatureMissing  ErrorCode = "signature_missing"
+	ErrorCodeSignatureInvalid  ErrorCode = "signature_invalid"
+	ErrorCodeCancelled         ErrorCode = "cancelled"
+	ErrorCodeTargetsFailed     ErrorCode = "targets_failed"
+	ErrorCodeProtocol          ErrorCode = "protocol"
+)
+
+// ProgressEvent is a single event of the progress protocol. Events are encoded as JSON objects,
+// with one event per line.
+type ProgressEvent struct {
+	Version int               `json:"version"`
+	Type    ProgressEventType `json:"type"`
+	// Phase and TotalPhases are set for phase events.
+	Phase       int `json:"phase,omitempty"`
+	TotalPhases int `json:"totalPhases,omitempty"`
+	// Message is set for phase, warning and error events.
+	Message string `json:"message,omitempty"`
+	// Bytes, Total, SourceBytes, SourceTotal and Rate are set for progress events.
+	// See [imaging.Progress] for details.
+	Bytes       int `json:"bytes,omitempty"`
+	Total       int `json:"total,omitempty"`
+	SourceBytes int `json:"sourceBytes,omitempty"`
+	SourceTotal int `json:"sourceTotal,omitempty"`
+	Rate        int `json:"rate,omitempty"`
+	// Code is set for error and target error events.
+	Code ErrorCode `json:"code,omitempty"`
+	// Target is set for progress, warning and target error events about one of several targets.
+	Target string `json:"target,omitempty"`
+	// Checksum is set for done events of commands which write a file, e.g. `imprint backup`.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ProgressError is a fatal error reported through the progress protocol.
+type ProgressError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (err *ProgressError) Error() string {
+	return err.Message
+}
+
+// ErrorCodeOf returns the [ErrorCode] corresponding to an error returned by [imaging].
+func ErrorCodeOf(err error) ErrorCode {
+	var errNotExists *imaging.NotExistsError
+	var errIsDir *imaging.IsDirectoryError
+	var errMultipleImages *imaging.MultipleImagesError
+	var errEntryNotFound *imaging.EntryNotFoundError
+	var errChecksumNotFound *imaging.ChecksumNotFoundError
+	var errProgress *ProgressError
+	var errTargets *flasher.TargetsError
+	switch {
+	case errors.As(err, &errProgress):
+		return errProgress.Code
+	case errors.As(err, &errTargets):
+		return ErrorCodeTargetsFailed
+	case errors.As(err, &errNotExists):
+		return ErrorCodeNotExists
+	case errors.As(err, &errIsDir):
+		return ErrorCodeIsDirectory
+	case errors.Is(err, imaging.ErrNotBlockDevice):
+		return ErrorCodeNotBlockDevice
+	case errors.Is(err, imaging.ErrDeviceReadOnly):
+		return ErrorCodeReadOnly
+	case errors.Is(err, imaging.ErrNoImageInArchive),
+		errors.As(err, &errMultipleImages), errors.As(err, &errEntryNotFound):
+		return ErrorCodeInvalidArchive
+	case errors.Is(err, imaging.ErrReadWriteMismatch):
+		return ErrorCodeReadWriteMismatch
+	case errors.Is(err, imaging.ErrDeviceValidationFailed):
+		return ErrorCodeValidationFailed
+	case errors.Is(err, imaging.ErrInvalidChecksum), errors.As(err, &errChecksumNotFound):
+		return ErrorCodeInvalidChecksum
+	case errors.Is(err, imaging.ErrInvalidBmap):
+		return ErrorCodeInvalidBmap
+	case errors.Is(err, imaging.ErrChecksumMismatch):
+		return ErrorCodeChecksumMismatch
+	case errors.Is(err, imaging.ErrSignatureMissing):
+		return ErrorCodeSignatureMissing
+	case errors.Is(err, imaging.ErrSignatureInvalid):
+		return ErrorCodeSignatureInvalid
+	case errors.Is(err, imaging.ErrCancelled):
+		return ErrorCodeCancelled
+	}
+	return ErrorCodeUnknown
+}
+
+// ErrorMessage returns a user-friendly message describing an error returned by [imaging].
+func ErrorMessage(err error) string {
+	switch ErrorCodeOf(err) {
+	case ErrorCodeReadOnly:
+		return "The selected device is read-only or write-protected! " +
+			"If it is an SD card, check the lock switch on its side."
+	case ErrorCodeReadWriteMismatch:
+		return "Read/write mismatch! Is the dest too small!"
+	case ErrorCodeValidationFailed:
+		return "Read/write mismatch! Validation of image failed. It is unsafe to boot this device." +
+			validationDetails(err)
+	case ErrorCodeChecksumMismatch:
+		return "The disk image does not match the expected checksum! It may be corrupt or tampered " +
+			"with, download it again. It is unsafe to boot this device."
+	case ErrorCodeTargetsFailed:
+		var errTargets *flasher.TargetsError
+		errors.As(err, &errTargets)
+		message := strconv.Itoa(len(errTargets.Errors)) + " of " + strconv.Itoa(errTargets.Total) + " targets failed!"
+		for _, err := range errTargets.Errors {
+			message += "\n" + err.Target + ": " + ErrorMessage(err.Err)
+		}
+		return message
+	}
+	return imaging.CapitalizeString(err.Error())
+}
+
+// validationDetails describes where the device differs from the disk image, if known.
+func validationDetails(err error) string {
+	var errValidation *imaging.ValidationError
+	if !errors.As(err, &errValidation) {
+		return ""
+	} else if errValidation.Truncated && errValidation.MismatchedBlocks == 0 {
+		return " The device ran out of data at byte " + strconv.Itoa(errValidation.Offset) +
+			", before the end of the image. Is the device too small, or was the write cut short?"
+	}
+	details := " The first mismatch is at byte " + strconv.Itoa(errValidation.Offset) + ", and " +
+		strconv.Itoa(errValidation.MismatchedBlocks) + " blocks of " +
+		imaging.BytesToString(errValidation.BlockSize, true) + " differ"
+	if errValidation.Truncated {
+		details += ", then the device ran out of data before the end of the image"
+	}
+	return details + "."
+}
+
+// ProgressReporter reports the progress of `imprint flash`, either as human-readable text for
+// people running the CLI by hand, or as JSON events for the GUI to consume.
+type ProgressReporter struct {
+	json   bool
+	output io.Writer
+	logger *log.Logger
+	mutex  sync.Mutex
+	// targets is the progress of each target, in the order they were first reported, when
+	// writing to several targets. In text mode, it is shown on a single line, which is cleared
+	// before other output, and lineLength is its length.
+	targets    []targetProgress
+	lineLength int
+}
+
+type targetProgress struct {
+	target   string
+	progress string
+}
+
+// NewProgressReporter creates a [ProgressReporter] writing to the given output. If json is
+// false, the reporter outputs text prefixed with `[flash]`.
+func NewProgressReporter(output io.Writer, json bool) *ProgressReporter {
+	return &ProgressReporter{
+		json:   json,
+		output: output,
+		logger: log.New(output, "[flash] ", 0),
+	}
+}
+
+// SetCommand sets the command whose name prefixes text output, e.g. `verify` for `[verify]`.
+func (r *ProgressReporter) SetCommand(command string) {
+	r.logger.SetPrefix("[" + command + "] ")
+}
+
+// println prints a line of text output, clearing the progress of the targets first if needed.
+func (r *ProgressReporter) println(line string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clearLine()
+	r.logger.Println(line)
+}
+
+// clearLine clears the progress of the targets, if it is shown. The mutex must be held.
+func (r *ProgressReporter) clearLine() {
+	if r.lineLength > 0 {
+		io.WriteString(r.output, strings.Repeat(" ", r.lineLength)+"\r")
+		r.lineLength = 0
+	}
+}
+
+func (r *ProgressReporter) emit(event ProgressEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	event.Version = ProgressProtocolVersion
+	data, _ := json.Marshal(event) // ProgressEvent can always be marshalled.
+	r.output.Write(append(data, '\n'))
+}
+
+// Phase reports the start of a new phase of the operation.
+func (r *ProgressReporter) Phase(phase int, totalPhases int, message string) {
+	if r.json {
+		r.emit(ProgressEvent{Type: EventPhase, Phase: phase, TotalPhases: totalPhases, Message: message})
+	} else {
+		r.println("Phase " + strconv.Itoa(phase) + "/" + strconv.Itoa(totalPhases) + ": " + message)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.targets = nil // Every target starts the new phase afresh.
+}
+
+// Progress returns an [imaging.ProgressFunc] reporting the progress of the current phase. In text
+// mode, action is used to describe the progress, e.g. "copied" or "validated".
+func (r *ProgressReporter) Progress(action string) imaging.ProgressFunc {
+	return func(progress imaging.Progress) {
+		if r.json {
+			r.emit(ProgressEvent{
+				Type:        EventProgress,
+				Bytes:       progress.Bytes,
+				Total:       progress.Total,
+				SourceBytes: progress.SourceBytes,
+				SourceTotal: progress.SourceTotal,
+				Rate:        progress.Rate(),
+			})
+			return
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if progress.Done {
+			io.WriteString(r.output, progress.Format(action)+"\n")
+		} else {
+			io.WriteString(r.output, progress.Format(action)+"\r")
+		}
+	}
+}
+
+// TargetProgress returns an [imaging.ProgressFunc] reporting the progress of one of several
+// targets in the current phase. In text mode, the progress of every target is shown on a single
+// line, and action is used to describe the final progress of each target.
+func (r *ProgressReporter) TargetProgress(target string, action string) imaging.ProgressFunc {
+	return func(progress imaging.Progress) {
+		if r.json {
+			r.emit(ProgressEvent{
+				Type:        EventProgress,
+				Bytes:       progress.Bytes,
+				Total:       progress.Total,
+				SourceBytes: progress.SourceBytes,
+				SourceTotal: progress.SourceTotal,
+				Rate:        progress.Rate(),
+				Target:      target,
+			})
+			return
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if progress.Done {
+			r.clearLine()
+			io.WriteString(r.output, target+": "+progress.Format(action)+"\n")
+		}
+		r.setTargetProgress(target, shortProgress(progress))
+	}
+}
+
+// setTargetProgress updates the progress of a target, and prints the progress of every target
+// on a single line. The mutex must be held.
+func (r *ProgressReporter) setTargetProgress(target string, progress string) {
+	index := slices.IndexFunc(r.targets, func(t targetProgress) bool { return t.target == target })
+	if index == -1 {
+		r.targets = append(r.targets, targetProgress{target: target})
+		index = len(r.targets) - 1
+	}
+	r.targets[index].progress = progress
+	parts := make([]string, len(r.targets))
+	for i, t := range r.targets {
+		parts[i] = filepath.Base(t.target) + " " + t.progress
+	}
+	line := strings.Join(parts, " | ")
+	// Pad the line to overwrite the previous one, if it was longer.
+	io.WriteString(r.output, line+strings.Repeat(" ", max(0, r.lineLength-len(line)))+"\r")
+	r.lineLength = len(line)
+}
+
+// shortProgress formats progress briefly, to show the progress of several targets on one line.
+func shortProgress(progress imaging.Progress) string {
+	speed := imaging.BytesToString(progress.Rate(), false) + "/s"
+	if progress.Done {
+		return "done"
+	} else if progress.Total > 0 {
+		return strconv.Itoa(progress.Bytes*100/progress.Total) + "% " + speed
+	}
+	return imaging.BytesToString(progress.Bytes, false) + " " + speed
+}
+
+// TargetWarning reports a non-fatal error about one of several targets.
+func (r *ProgressReporter) TargetWarning(target string, err error) {
+	if r.json {
+		r.emit(ProgressEvent{Type: EventWarning, Target: target, Message: imaging.CapitalizeString(err.Error())})
+	} else {
+		r.println(target + ": " + imaging.CapitalizeString(err.Error()))
+	}
+}
+
+// TargetError reports that one of several targets failed, while the others continue.
+func (r *ProgressReporter) TargetError(target string, err error) {
+	if r.json {
+		r.emit(ProgressEvent{Type: EventTargetError, Target: target, Code: ErrorCodeOf(err), Message: ErrorMessage(err)})
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clearLine()
+	r.logger.Println(target + " failed: " + ErrorMessage(err))
+	if len(r.targets) > 0 {
+		r.setTargetProgress(target, "failed")
+	}
+}
+
+// TargetSummary reports which of several targets succeeded, given the error returned once every
+// target is done, if any. The targets which failed are listed by the error itself.
+func (r *ProgressReporter) TargetSummary(targets []string, err error) {
+	var errTargets *flasher.TargetsError
+	if r.json || (err != nil && !errors.As(err, &errTargets)) {
+		return
+	}
+	var succeeded []string
+	for _, target := range targets {
+		if errTargets == nil || !slices.ContainsFunc(errTargets.Errors, func(err *flasher.TargetError) bool {
+			return err.Target == target
+		}) {
+			succeeded = append(succeeded, target)
+		}
+	}
+	r.println("Succeeded on " + strconv.Itoa(len(succeeded)) + " of " + strconv.Itoa(len(targets)) +
+		" targets: " + strings.Join(succeeded, ", "))
+}
+
+// Event reports an event from [flasher.Flasher] in the appropriate form.
+func (r *ProgressReporter) Event(event flasher.Event) {
+	switch event.Type {
+	case flasher.EventPhase:
+		r.Phase(int(event.Phase), event.TotalPhases, event.Phase.String())
+	case flasher.EventProgress:
+		action := "copied"
+		if event.Phase == flasher.PhaseValidate {
+			action = "validated"
+		}
+		if event.Target != "" {
+			r.TargetProgress(event.Target, action)(event.Progress)
+		} else {
+			r.Progress(action)(event.Progress)
+		}
+	case flasher.EventWarning:
+		if event.Target != "" {
+			r.TargetWarning(event.Target, event.Warning)
+		} else {
+			r.Warning(event.Warning)
+		}
+	case flasher.EventTargetFailed:
+		r.TargetError(event.Target, event.Err)
+	}
+}
+
+// Warning reports a non-fatal error.
+func (r *ProgressReporter) Warning(err error) {
+	if r.json {
+		r.emit(ProgressEvent{Type: EventWarning, Message: imaging.CapitalizeString(err.Error())})
+	} else {
+		r.println(imaging.CapitalizeString(err.Error()))
+	}
+}
+
+// Error reports a fatal error. No further events should be reported after this.
+func (r *ProgressReporter) Error(err error) {
+	if r.json {
+		r.emit(ProgressEvent{Type: EventError, Code: ErrorCodeOf(err), Message: ErrorMessage(err)})
+	} else {
+		r.println(ErrorMessage(err))
+	}
+}
+
+// Done reports that the operation completed successfully.
+func (r *ProgressReporter) Done() {
+	if r.json {
+		r.emit(ProgressEvent{Type: EventDone})
+	}
+}
+
+// DoneWithChecksum reports that the operation completed successfully, along with the checksum of
+// the file it wrote.
+func (r *ProgressReporter) DoneWithChecksum(file string, checksum *imaging.Checksum) {
+	if r.json {
+		r.emit(ProgressEvent{Type: EventDone, Checksum: checksum.String()})
+	} else {
+		r.println("Checksum of " + file + ": " + checksum.String())
+	}
+}
@@ -0,0 +1,279 @@
+package app_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/retrixe/imprint/app"
+	"github.com/retrixe/imprint/flasher"
+	"github.com/retrixe/imprint/imaging"
+)
+
+func readAllProgress(t *testing.T, output string) ([]app.DdProgress, string, bool) {
+	t.Helper()
+	channel := make(chan app.DdProgress)
+	var lastLine string
+	var reported bool
+	go (func() {
+		defer close(channel)
+		lastLine, reported = app.ReadProgress(strings.NewReader(output), channel)
+	})()
+	progress := []app.DdProgress{}
+	for event := range channel {
+		progress = append(progress, event)
+	}
+	return progress, lastLine, reported
+}
+
+func TestProgressReporterJSON(t *testing.T) {
+	t.Parallel()
+	var output bytes.Buffer
+	reporter := app.NewProgressReporter(&output, true)
+	reporter.Phase(1, 3, "Unmounting disk.")
+	reporter.Warning(errors.New("unable to unmount disk"))
+	reporter.Phase(2, 3, "Writing ISO to disk.")
+	reporter.Progress("copied")(imaging.Progress{
+		Bytes: 2000, Total: 4000, SourceBytes: 500, SourceTotal: 1000, Duration: 2 * time.Second,
+	})
+	reporter.Error(imaging.ErrReadWriteMismatch)
+
+	expected := []app.DdProgress{
+		{Speed: "0 MB/s", Phase: "Phase 1/3: Unmounting disk."},
+		{Speed: "0 MB/s", Phase: "Phase 1/3: Unmounting disk.", Warning: "Unable to unmount disk"},
+		{Speed: "0 MB/s", Phase: "Phase 2/3: Writing ISO to disk."},
+		{Bytes: 2000, SourceBytes: 500, Speed: "1.0 KB/s", Phase: "Phase 2/3: Writing ISO to disk."},
+	}
+	progress, _, reported := readAllProgress(t, output.String())
+	if len(progress) != len(expected)+1 {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected)+1, len(progress), progress)
+	}
+	for i := range expected {
+		if progress[i] != expected[i] {
+			t.Errorf("expected progress %+v, got %+v", expected[i], progress[i])
+		}
+	}
+	var errProgress *app.ProgressError
+	if !reported {
+		t.Errorf("expected error to be reported")
+	} else if !errors.As(progress[len(progress)-1].Error, &errProgress) {
+		t.Errorf("expected ProgressError, got %v", progress[len(progress)-1].Error)
+	} else if errProgress.Code != app.ErrorCodeReadWriteMismatch {
+		t.Errorf("expected error code %s, got %s", app.ErrorCodeReadWriteMismatch, errProgress.Code)
+	} else if errProgress.Message != "Read/write mismatch! Is the dest too small!" {
+		t.Errorf("unexpected error message: %s", errProgress.Message)
+	}
+}
+
+func TestProgressReporterText(t *testing.T) {
+	t.Parallel()
+	var output bytes.Buffer
+	reporter := app.NewProgressReporter(&output, false)
+	reporter.Phase(2, 3, "Writing ISO to disk.")
+	reporter.Progress("copied")(imaging.Progress{Bytes: 512, Duration: 2 * time.Second})
+	reporter.Progress("copied")(imaging.Progress{Bytes: 512, Duration: 2 * time.Second, Done: true})
+	reporter.Error(errors.New("something went wrong"))
+	reporter.Done()
+
+	expected := "[flash] Phase 2/3: Writing ISO to disk.\n" +
+		"512 bytes (512 B, 512 B) copied, 2 s, 256 B/s\r" +
+		"512 bytes (512 B, 512 B) copied, 2.000 s, 256 B/s\n" +
+		"[flash] Something went wrong\n"
+	if output.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, output.String())
+	}
+
+	output.Reset()
+	reporter.SetCommand("verify")
+	reporter.Phase(1, 1, "Validating written image on disk.")
+	if expected := "[verify] Phase 1/1: Validating written image on disk.\n"; output.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, output.String())
+	}
+
+	output.Reset()
+	reporter.SetCommand("clone")
+	reporter.TargetProgress("/dev/sdb", "copied")(imaging.Progress{Bytes: 512, Total: 1024, Duration: 2 * time.Second})
+	reporter.TargetProgress("/dev/sdc", "copied")(imaging.Progress{Bytes: 256, Total: 1024, Duration: 2 * time.Second})
+	reporter.TargetError("/dev/sdc", errors.New("unplugged"))
+	reporter.TargetSummary([]string{"/dev/sdb", "/dev/sdc"}, &flasher.TargetsError{Total: 2, Errors: []*flasher.TargetError{
+		{Target: "/dev/sdc", Err: errors.New("unplugged")},
+	}})
+	expected = "sdb 50% 256 B/s\r" +
+		"sdb 50% 256 B/s | sdc 25% 128 B/s\r" +
+		"                                 \r[clone] /dev/sdc failed: Unplugged\n" +
+		"sdb 50% 256 B/s | sdc failed\r" +
+		"                            \r[clone] Succeeded on 1 of 2 targets: /dev/sdb\n"
+	if output.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, output.String())
+	}
+
+	output.Reset()
+	reporter.SetCommand("backup")
+	reporter.DoneWithChecksum("backup.img", &imaging.Checksum{Algorithm: "sha256", Digest: []byte{0xab, 0xcd}})
+	if expected := "[backup] Checksum of backup.img: sha256:abcd\n"; output.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, output.String())
+	}
+}
+
+func TestReadProgress(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name             string
+		output           string
+		expected         []app.DdProgress
+		expectedLastLine string
+		expectedReported bool
+	}{
+		{
+			"returns last line of unexpected output",
+			"{\"version\":1,\"type\":\"phase\",\"phase\":1,\"totalPhases\":2,\"message\":\"Unmounting disk.\"}\n" +
+				"panic: something went wrong\n",
+			[]app.DdProgress{{Speed: "0 MB/s", Phase: "Phase 1/2: Unmounting disk."}},
+			"panic: something went wrong",
+			false,
+		},
+		{
+			"parses progress from the system dd",
+			"{\"version\":1,\"type\":\"phase\",\"phase\":2,\"totalPhases\":2,\"message\":\"Writing ISO to disk.\"}\n" +
+				"1048576 bytes (1.0 MB, 1.0 MiB) copied, 1 s, 1.0 MB/s\r",
+			[]app.DdProgress{
+				{Speed: "0 MB/s", Phase: "Phase 2/2: Writing ISO to disk."},
+				{Bytes: 1048576, Speed: "1.0 MB/s", Phase: "Phase 2/2: Writing ISO to disk."},
+			},
+			"1048576 bytes (1.0 MB, 1.0 MiB) copied, 1 s, 1.0 MB/s",
+			false,
+		},
+		{
+			"reports progress of each target separately",
+			"{\"version\":1,\"type\":\"phase\",\"phase\":2,\"totalPhases\":2,\"message\":\"Writing ISO to disk.\"}\n" +
+				"{\"version\":1,\"type\":\"progress\",\"bytes\":1048576,\"rate\":1000000,\"target\":\"/dev/sdb\"}\n" +
+				"{\"version\":1,\"type\":\"target_error\",\"code\":\"read_only\",\"message\":\"Read-only!\",\"target\":\"/dev/sdc\"}\n" +
+				"{\"version\":1,\"type\":\"progress\",\"bytes\":2097152,\"rate\":1000000}\n",
+			[]app.DdProgress{
+				{Speed: "0 MB/s", Phase: "Phase 2/2: Writing ISO to disk."},
+				{Bytes: 1048576, Speed: "1.0 MB/s", Phase: "Phase 2/2: Writing ISO to disk.", Target: "/dev/sdb"},
+				{Phase: "Phase 2/2: Writing ISO to disk.", Target: "/dev/sdc", TargetError: "Read-only!"},
+				{Bytes: 2097152, Speed: "1.0 MB/s", Phase: "Phase 2/2: Writing ISO to disk."},
+			},
+			"",
+			false,
+		},
+		{
+			"ignores done and unknown events",
+			"{\"version\":1,\"type\":\"unknown\"}\n{\"version\":1,\"type\":\"done\"}\n",
+			[]app.DdProgress{},
+			"",
+			false,
+		},
+		{
+			"fails on unsupported protocol version",
+			fmt.Sprintf("{\"version\":%d,\"type\":\"done\"}\n", app.ProgressProtocolVersion+1),
+			[]app.DdProgress{{Error: &app.ProgressError{Code: app.ErrorCodeProtocol}}},
+			"",
+			true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			progress, lastLine, reported := readAllProgress(t, testCase.output)
+			if lastLine != testCase.expectedLastLine {
+				t.Errorf("expected last line %q, got %q", testCase.expectedLastLine, lastLine)
+			} else if reported != testCase.expectedReported {
+				t.Errorf("expected reported %v, got %v", testCase.expectedReported, reported)
+			} else if len(progress) != len(testCase.expected) {
+				t.Fatalf("expected %d events, got %d: %+v", len(testCase.expected), len(progress), progress)
+			}
+			for i := range progress {
+				if testCase.expected[i].Error != nil {
+					if app.ErrorCodeOf(progress[i].Error) != app.ErrorCodeOf(testCase.expected[i].Error) {
+						t.Errorf("expected error %v, got %v", testCase.expected[i].Error, progress[i].Error)
+					}
+				} else if progress[i] != testCase.expected[i] {
+					t.Errorf("expected progress %+v, got %+v", testCase.expected[i], progress[i])
+				}
+			}
+		})
+	}
+}
+
+func TestErrorCodeOf(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		err      error
+		expected app.ErrorCode
+	}{
+		{"unknown error", errors.New("unknown"), app.ErrorCodeUnknown},
+		{"file does not exist", &imaging.NotExistsError{Name: "file"}, app.ErrorCodeNotExists},
+		{"file is directory", &imaging.IsDirectoryError{Name: "file"}, app.ErrorCodeIsDirectory},
+		{"not a block device", imaging.ErrNotBlockDevice, app.ErrorCodeNotBlockDevice},
+		{"read-only device", imaging.ErrDeviceReadOnly, app.ErrorCodeReadOnly},
+		{"no image in archive", imaging.ErrNoImageInArchive, app.ErrorCodeInvalidArchive},
+		{"multiple images in archive", &imaging.MultipleImagesError{}, app.ErrorCodeInvalidArchive},
+		{"entry not found in archive", &imaging.EntryNotFoundError{}, app.ErrorCodeInvalidArchive},
+		{"wrapped read/write mismatch", fmt.Errorf("wrapped: %w", imaging.ErrReadWriteMismatch),
+			app.ErrorCodeReadWriteMismatch},
+		{"validation failed", imaging.ErrDeviceValidationFailed, app.ErrorCodeValidationFailed},
+		{"validation error", &imaging.ValidationError{Offset: 512}, app.ErrorCodeValidationFailed},
+		{"invalid checksum", fmt.Errorf("%w sha256:xyz", imaging.ErrInvalidChecksum), app.ErrorCodeInvalidChecksum},
+		{"checksum not found", &imaging.ChecksumNotFoundError{Name: "image.iso"}, app.ErrorCodeInvalidChecksum},
+		{"checksum mismatch", &imaging.ChecksumMismatchError{}, app.ErrorCodeChecksumMismatch},
+		{"invalid bmap", fmt.Errorf("%w! invalid range", imaging.ErrInvalidBmap), app.ErrorCodeInvalidBmap},
+		{"signature missing", imaging.ErrSignatureMissing, app.ErrorCodeSignatureMissing},
+		{"signature invalid", &imaging.SignatureError{Name: "SHA256SUMS"}, app.ErrorCodeSignatureInvalid},
+		{"cancelled", &imaging.CancelledError{Bytes: 1024}, app.ErrorCodeCancelled},
+		{"progress error", &app.ProgressError{Code: app.ErrorCodeProtocol}, app.ErrorCodeProtocol},
+		{"targets failed", &flasher.TargetsError{Total: 3, Errors: []*flasher.TargetError{
+			{Target: "/dev/sdc", Err: imaging.ErrDeviceReadOnly},
+			{Target: "/dev/sdd", Err: &imaging.CancelledError{}},
+		}}, app.ErrorCodeTargetsFailed},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			result := app.ErrorCodeOf(testCase.err)
+			if result != testCase.expected {
+				t.Errorf("expected %s, got %s", testCase.expected, result)
+			}
+		})
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{"unknown error", errors.New("something went wrong"), "Something went wrong"},
+		{"mismatched blocks", &imaging.ValidationError{Offset: 1536, MismatchedBlocks: 2, BlockSize: 4194304},
+			"Read/write mismatch! Validation of image failed. It is unsafe to boot this device. " +
+				"The first mismatch is at byte 1536, and 2 blocks of 4.0 MiB differ."},
+		{"truncated device", &imaging.ValidationError{Offset: 1024, BlockSize: 4194304, Truncated: true},
+			"Read/write mismatch! Validation of image failed. It is unsafe to boot this device. " +
+				"The device ran out of data at byte 1024, before the end of the image. " +
+				"Is the device too small, or was the write cut short?"},
+		{"targets failed", &flasher.TargetsError{Total: 3, Errors: []*flasher.TargetError{
+			{Target: "/dev/sdc", Err: imaging.ErrDeviceReadOnly},
+			{Target: "/dev/sdd", Err: &imaging.CancelledError{}},
+		}},
+			"2 of 3 targets failed!\n/dev/sdc: The selected device is read-only or write-protected! " +
+				"If it is an SD card, check the lock switch on its side.\n/dev/sdd: The operation was cancelled after 0 bytes"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			if result := app.ErrorMessage(testCase.err); result != testCase.expected {
+				t.Errorf("expected %q, got %q", testCase.expected, result)
+			}
+		})
+	}
+}
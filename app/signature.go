@@ -0,0 +1,42 @@
+package app
+
+import (
+	"errors"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+// VerifySignature verifies the OpenPGP signature of the checksum file against the keyring at
+// keyringPath, or of the disk image itself if checksumFile is empty. It returns the name of the
+// signer, along with the checksum of the disk image from the checksum file, if one was passed.
+func VerifySignature(image string, checksumFile string, keyringPath string) (*imaging.Checksum, string, error) {
+	keyring, err := imaging.ReadKeyring(keyringPath)
+	if err != nil {
+		return nil, "", err
+	} else if checksumFile != "" {
+		return imaging.ReadSignedChecksumFile(checksumFile, image, keyring)
+	}
+	signer, err := imaging.VerifySignature(image, keyring)
+	return nil, signer, err
+}
+
+// SignatureStatus is the result of [VerifySignature], shown as a badge in the GUI.
+type SignatureStatus struct {
+	// Status is one of verified, missing, invalid or error.
+	Status string `json:"status"`
+	// Message is the signer if the signature was verified, else a description of the error.
+	Message string `json:"message"`
+}
+
+// SignatureStatusOf returns the [SignatureStatus] corresponding to the result of [VerifySignature].
+func SignatureStatusOf(signer string, err error) SignatureStatus {
+	switch {
+	case err == nil:
+		return SignatureStatus{Status: "verified", Message: signer}
+	case errors.Is(err, imaging.ErrSignatureMissing):
+		return SignatureStatus{Status: "missing", Message: imaging.CapitalizeString(err.Error())}
+	case errors.Is(err, imaging.ErrSignatureInvalid):
+		return SignatureStatus{Status: "invalid", Message: imaging.CapitalizeString(err.Error())}
+	}
+	return SignatureStatus{Status: "error", Message: imaging.CapitalizeString(err.Error())}
+}
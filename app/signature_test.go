@@ -0,0 +1,37 @@
+package app_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/retrixe/imprint/app"
+	"github.com/retrixe/imprint/imaging"
+)
+
+func TestSignatureStatusOf(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		signer   string
+		err      error
+		expected string
+	}{
+		{"verified", "Imprint Test <test@example.com>", nil, "verified"},
+		{"missing", "", imaging.ErrSignatureMissing, "missing"},
+		{"invalid", "", &imaging.SignatureError{Name: "SHA256SUMS", Err: errors.New("bad signature")}, "invalid"},
+		{"unreadable keyring", "", os.ErrNotExist, "error"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			status := app.SignatureStatusOf(testCase.signer, testCase.err)
+			if status.Status != testCase.expected {
+				t.Errorf("expected status %s, got %s", testCase.expected, status.Status)
+			} else if testCase.err == nil && status.Message != testCase.signer {
+				t.Errorf("expected message %s, got %s", testCase.signer, status.Message)
+			}
+		})
+	}
+}
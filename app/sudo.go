@@ -2,8 +2,11 @@ package app
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
+	"strconv"
 	"strings"
 
 	"github.com/retrixe/imprint/imaging"
@@ -82,3 +85,58 @@ func elevatedMacCommand(platform imaging.Platform, name string, args ...string)
 	)
 	return cmd, nil
 }
+
+// RunElevated runs Imprint again with the given arguments and elevated privileges, attached to the
+// standard streams of this process, and returns its exit code once it exits.
+func RunElevated(platform imaging.Platform, arg ...string) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 1, err
+	}
+	cmd, err := ElevatedCommand(platform, executable, arg...)
+	if err != nil {
+		return 1, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+// ChownToInvokingUser gives a file created with elevated privileges to the user who elevated them
+// with `sudo` or `pkexec`, so they can move or delete it later. It does nothing if the application
+// isn't elevated, or the user is unknown.
+func ChownToInvokingUser(platform imaging.Platform, name string) error {
+	if platform.RuntimeGOOS() == "windows" || platform.OsGeteuid() != 0 {
+		return nil
+	}
+	uid, gid := os.Getenv("SUDO_UID"), os.Getenv("SUDO_GID")
+	if uid == "" {
+		uid = os.Getenv("PKEXEC_UID")
+	}
+	if uid == "" {
+		return nil
+	} else if gid == "" {
+		invoker, err := user.LookupId(uid)
+		if err != nil {
+			return err
+		}
+		gid = invoker.Gid
+	}
+	parsedUID, err := strconv.Atoi(uid)
+	if err != nil {
+		return err
+	}
+	parsedGID, err := strconv.Atoi(gid)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(name, parsedUID, parsedGID); err != nil {
+		return fmt.Errorf("failed to give %s to the user who ran Imprint! %w", name, err)
+	}
+	return nil
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"testing"
 
 	"github.com/retrixe/imprint/app"
@@ -205,3 +207,37 @@ func TestElevatedCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestChownToInvokingUser(t *testing.T) {
+	// The invoking user is read from the environment, so this test can't run in parallel.
+	file := filepath.Join(t.TempDir(), "backup.img")
+	os.WriteFile(file, []byte{}, 0644)
+	uid, gid := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	testCases := []struct {
+		name     string
+		elevated bool
+		uid      string
+		gid      string
+		fails    bool
+	}{
+		{"does nothing when not elevated", false, "invalid", "", false},
+		{"does nothing when the user is unknown", true, "", "", false},
+		{"chowns to the invoking user", true, uid, gid, false},
+		{"fails with an invalid user", true, "invalid", gid, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Setenv("SUDO_UID", testCase.uid)
+			t.Setenv("SUDO_GID", testCase.gid)
+			t.Setenv("PKEXEC_UID", "")
+			mockPlatform := mockSudoPlatform{T: t, os: "linux", elevated: testCase.elevated}
+			err := app.ChownToInvokingUser(mockPlatform, file)
+			if testCase.fails && err == nil {
+				t.Errorf("Expected ChownToInvokingUser to fail")
+			} else if !testCase.fails && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
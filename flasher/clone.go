@@ -0,0 +1,101 @@
+package flasher
+
+import (
+	"context"
+	"errors"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+// CloneOptions configures [Clone].
+type CloneOptions struct {
+	// Source is the path to the device to clone.
+	Source string
+	// Targets are the paths to the devices to clone the source device to.
+	Targets []string
+	// BlockSize is the size of each read and write, or [imaging.DefaultBlockSize] if zero.
+	BlockSize int
+	// Sync controls when writes are synced to the targets, see [imaging.SyncPolicy].
+	Sync imaging.SyncPolicy
+	// DirectIO writes to the targets bypassing the page cache, on Linux only. See
+	// [imaging.CopyOptions.DirectIO].
+	DirectIO bool
+	// Verify enables validating each target after writing it, against hashes of the blocks read
+	// from the source device, so it isn't read again.
+	Verify bool
+	// AllowRegularFile allows the targets to be regular files instead of block devices, in which
+	// case they aren't unmounted. This is mainly useful for testing.
+	AllowRegularFile bool
+	// OnEvent is called with events as cloning progresses, if not nil. Events about a single
+	// target have their Target set. It may be called from several goroutines, but never
+	// concurrently, and should return quickly.
+	OnEvent func(Event)
+}
+
+// ErrCloneToSource is returned for targets which are the source device itself, even through
+// another path to it (see [imaging.SameDevice]).
+var ErrCloneToSource = errors.New("the source device cannot be cloned to itself")
+
+// Clone clones the used region of the source device to every target, reading it once (see
+// [imaging.CloneDevice]). It goes through the same phases as a [Flasher], and a target which
+// fails does not abort the others: once every target is done, a [*TargetsError] listing the
+// targets which failed is returned, if any did. If the context is cancelled, an error matching
+// [imaging.ErrCancelled] is returned instead.
+func Clone(ctx context.Context, opts CloneOptions) error {
+	if opts.Source == "" || len(opts.Targets) == 0 {
+		return ErrMissingOptions
+	}
+	totalPhases := 2
+	if opts.Verify {
+		totalPhases = 3
+	}
+	run := newTargetRun(opts.Targets, totalPhases, opts.OnEvent)
+	run.emit(Event{Type: EventPhase, Phase: PhaseUnmount})
+	for i, target := range opts.Targets {
+		if imaging.SameDevice(target, opts.Source) {
+			run.fail(PhaseUnmount, i, ErrCloneToSource)
+		}
+	}
+	run.unmount(opts.AllowRegularFile)
+	if ctx.Err() != nil {
+		return &imaging.CancelledError{}
+	}
+
+	run.emit(Event{Type: EventPhase, Phase: PhaseWrite})
+	hashes := &imaging.BlockHashes{}
+	active := run.active()
+	copyOptions := imaging.CopyOptions{
+		BlockSize:      opts.BlockSize,
+		Sync:           opts.Sync,
+		DirectIO:       opts.DirectIO,
+		TargetProgress: run.progress(PhaseWrite, active),
+	}
+	if opts.Verify {
+		copyOptions.Hashes = hashes
+	}
+	if len(active) > 0 {
+		_, errs := imaging.CloneDevice(ctx, opts.Source, run.paths(active), copyOptions)
+		for i, err := range errs {
+			if err != nil {
+				run.fail(PhaseWrite, active[i], err)
+			}
+		}
+	}
+
+	if opts.Verify && ctx.Err() == nil {
+		run.emit(Event{Type: EventPhase, Phase: PhaseValidate})
+		run.validate(func(target string, progress imaging.ProgressFunc) error {
+			return imaging.ValidateDeviceHashes(ctx, target, hashes, imaging.CopyOptions{Progress: progress})
+		})
+	}
+	// The backup GPT is written for the size of each target once it's validated, since it changes
+	// the primary GPT which the hashes were recorded with.
+	if ctx.Err() == nil {
+		for _, target := range run.active() {
+			if err := imaging.RelocateBackupGPT(opts.Targets[target]); err != nil {
+				run.fail(PhaseWrite, target, err)
+			}
+		}
+	}
+	return run.result(ctx)
+}
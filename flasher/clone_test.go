@@ -0,0 +1,94 @@
+package flasher_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/retrixe/imprint/flasher"
+	"github.com/retrixe/imprint/imaging"
+)
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+	source, _, data := generateImageAndTarget(t)
+	dir := t.TempDir()
+	targets := []string{filepath.Join(dir, "first.iso"), filepath.Join(dir, "small.iso"), filepath.Join(dir, "second.iso")}
+	os.WriteFile(targets[0], make([]byte, len(data)), 0644)
+	os.WriteFile(targets[1], make([]byte, len(data)/2), 0644)
+	os.WriteFile(targets[2], make([]byte, len(data)), 0644)
+
+	// The source is also passed through another path to it, which should be detected.
+	link := filepath.Join(dir, "link.iso")
+	os.Symlink(source, link)
+
+	var mutex sync.Mutex
+	failed := make(map[string]error)
+	validated := make(map[string]imaging.Progress)
+	err := flasher.Clone(context.Background(), flasher.CloneOptions{
+		Source: source, Targets: append(targets, link), Verify: true, AllowRegularFile: true,
+		OnEvent: func(event flasher.Event) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if event.Type == flasher.EventTargetFailed {
+				failed[event.Target] = event.Err
+			} else if event.Type == flasher.EventProgress && event.Phase == flasher.PhaseValidate {
+				validated[event.Target] = event.Progress
+			}
+		},
+	})
+
+	var errTargets *flasher.TargetsError
+	if !errors.As(err, &errTargets) {
+		t.Fatalf("expected TargetsError, got %v", err)
+	} else if errTargets.Total != 4 || len(errTargets.Errors) != 2 {
+		t.Errorf("expected 2 of 4 targets to fail, got %v", err)
+	} else if !errors.Is(failed[targets[1]], imaging.ErrTargetTooSmall) || !errors.Is(failed[link], flasher.ErrCloneToSource) {
+		t.Errorf("expected the small target and the source to fail, got %v", failed)
+	}
+	for _, target := range []string{targets[0], targets[2]} {
+		if written, _ := os.ReadFile(target); !bytes.Equal(written, data) {
+			t.Errorf("expected %s to be a clone of the source", target)
+		} else if !validated[target].Done {
+			t.Errorf("expected %s to be validated, got %+v", target, validated[target])
+		}
+	}
+}
+
+func TestCloneToSource(t *testing.T) {
+	t.Parallel()
+	source, target, _ := generateImageAndTarget(t)
+	var failures, warnings []flasher.Event
+	err := flasher.Clone(context.Background(), flasher.CloneOptions{
+		Source: source, Targets: []string{target, source}, AllowRegularFile: true,
+		OnEvent: func(event flasher.Event) {
+			if event.Type == flasher.EventTargetFailed {
+				failures = append(failures, event)
+			} else if event.Type == flasher.EventWarning && event.Target == source {
+				warnings = append(warnings, event)
+			}
+		},
+	})
+	if !errors.Is(err, flasher.ErrCloneToSource) {
+		t.Errorf("expected ErrCloneToSource, got %v", err)
+	} else if len(failures) != 1 || failures[0].Target != source {
+		t.Errorf("expected a single failure for the source, got %v", failures)
+	} else if len(warnings) != 0 {
+		t.Errorf("expected the source not to be unmounted, got %v", warnings)
+	}
+}
+
+func TestCloneCancelled(t *testing.T) {
+	t.Parallel()
+	source, target, _ := generateImageAndTarget(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := flasher.Clone(ctx, flasher.CloneOptions{Source: source, Targets: []string{target}, AllowRegularFile: true})
+	if !errors.Is(err, imaging.ErrCancelled) {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+}
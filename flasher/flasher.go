@@ -0,0 +1,284 @@
+// Package flasher provides Imprint's engine for flashing disk images to devices, for embedding
+// in other Go programs.
+//
+// A [Flasher] unmounts the target device, writes the disk image to it, and optionally validates
+// the written image, reporting its progress through [Options.OnEvent]. It never writes to
+// stdout or stderr itself.
+package flasher
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+// Phase is a phase of flashing a disk image.
+type Phase int
+
+const (
+	// PhaseUnmount is the phase where the partitions of the target device are unmounted.
+	PhaseUnmount Phase = iota + 1
+	// PhaseWrite is the phase where the disk image is written to the target device.
+	PhaseWrite
+	// PhaseValidate is the phase where the written image is validated against the disk image.
+	PhaseValidate
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseUnmount:
+		return "Unmounting disk."
+	case PhaseWrite:
+		return "Writing ISO to disk."
+	case PhaseValidate:
+		return "Validating written image on disk."
+	}
+	return "Unknown phase."
+}
+
+// EventType is the type of an [Event].
+type EventType int
+
+const (
+	// EventPhase is sent when a new phase starts.
+	EventPhase EventType = iota
+	// EventProgress is sent periodically with the progress of the write and validate phases.
+	EventProgress
+	// EventWarning is sent when a non-fatal error occurs.
+	EventWarning
+	// EventTargetFailed is sent when one of several targets fails, while the others continue.
+	EventTargetFailed
+)
+
+// Event is sent to [Options.OnEvent] as flashing progresses.
+type Event struct {
+	Type EventType
+	// Phase is the current phase, and TotalPhases is the number of phases in this run.
+	Phase       Phase
+	TotalPhases int
+	// Progress is the progress of the current phase, for progress events.
+	Progress imaging.Progress
+	// Warning is the non-fatal error which occurred, for warning events.
+	Warning error
+	// Target is the device the event is about, when writing to several targets at once. It is
+	// empty for events about every target, e.g. phase events.
+	Target string
+	// Err is the error which made the target fail, for target failed events.
+	Err error
+}
+
+// ErrMissingOptions is returned by [New] when the source or target are not specified, or both
+// Target and Targets are.
+var ErrMissingOptions = errors.New("the source and target must be specified")
+
+// ErrBmapMultipleTargets is sent as a warning when flashing several targets with a bmap or a
+// sparse mode, which are ignored, so the whole disk image is written to each target.
+var ErrBmapMultipleTargets = errors.New("bmap files and sparse modes are not supported with several targets, the whole image will be written")
+
+// Options configures a [Flasher].
+type Options struct {
+	// Source is the path to the disk image to flash, which may be compressed or a zip archive.
+	Source string
+	// Entry is the disk image to flash from a zip archive, if it contains multiple.
+	Entry string
+	// Target is the path to the device to flash the disk image to.
+	Target string
+	// Targets are the paths to several devices to flash the disk image to at once, instead of
+	// Target. The disk image is read once, and each device is written to and validated
+	// independently, so a device which fails does not abort the others (see [TargetsError]).
+	Targets []string
+	// BlockSize is the size of each read and write, or [imaging.DefaultBlockSize] if zero.
+	BlockSize int
+	// Sync controls when writes are synced to the device, see [imaging.SyncPolicy].
+	Sync imaging.SyncPolicy
+	// DirectIO writes to the device bypassing the page cache, on Linux only. See
+	// [imaging.CopyOptions.DirectIO].
+	DirectIO bool
+	// Verify enables validating the written image against the disk image after writing it. By
+	// default, the device is validated against hashes of the blocks written to it, so the disk
+	// image isn't read again.
+	Verify bool
+	// CompareSource validates the device by reading the disk image again and comparing it with
+	// the device byte-by-byte, instead of comparing hashes of the written blocks. It is ignored
+	// when flashing with a bmap, since the unmapped blocks on the device are not written.
+	CompareSource bool
+	// Bmap is the block map of the disk image, if not nil. Only the blocks it maps are written
+	// and validated, and they are verified against the checksums in it. See [imaging.Bmap]. It
+	// is ignored with several Targets, with a warning.
+	Bmap *imaging.Bmap
+	// Sparse controls how the blocks which aren't mapped in the bmap are written and validated,
+	// see [imaging.SparseMode]. It is ignored without a bmap, or with several targets.
+	Sparse imaging.SparseMode
+	// Checksum is the expected checksum of the disk image file, if not nil. It is verified while
+	// the image is written, and flashing fails with an [imaging.ErrChecksumMismatch] if the image
+	// does not match it.
+	Checksum *imaging.Checksum
+	// AllowRegularFile allows the target to be a regular file instead of a block device, in
+	// which case it isn't unmounted. This is mainly useful for testing.
+	AllowRegularFile bool
+	// OnEvent is called with events as flashing progresses, if not nil. It is called from the
+	// goroutine calling [Flasher.Run], and should return quickly. With several Targets, events
+	// about a single target have their Target set, and it may be called from several
+	// goroutines, but never concurrently.
+	OnEvent func(Event)
+}
+
+// Flasher flashes a disk image to a device. Create one with [New].
+type Flasher struct {
+	opts Options
+}
+
+// New creates a [Flasher] with the given options.
+func New(opts Options) (*Flasher, error) {
+	if len(opts.Targets) == 1 && opts.Target == "" {
+		opts.Target, opts.Targets = opts.Targets[0], nil
+	}
+	if opts.Source == "" || (opts.Target == "" && len(opts.Targets) == 0) ||
+		(opts.Target != "" && len(opts.Targets) > 0) {
+		return nil, ErrMissingOptions
+	}
+	return &Flasher{opts: opts}, nil
+}
+
+// TotalPhases returns the number of phases the flasher goes through.
+func (f *Flasher) TotalPhases() int {
+	if f.opts.Verify {
+		return 3
+	}
+	return 2
+}
+
+// Run flashes the disk image to the device, stopping early if the context is cancelled, in
+// which case an error matching [imaging.ErrCancelled] is returned. With several targets, a
+// [*TargetsError] listing the targets which failed is returned once every target is done, if any
+// of them did.
+func (f *Flasher) Run(ctx context.Context) error {
+	if len(f.opts.Targets) > 0 {
+		return f.runTargets(ctx)
+	}
+	f.startPhase(PhaseUnmount)
+	if f.opts.AllowRegularFile && isRegularFile(f.opts.Target) {
+		f.emit(Event{Type: EventWarning, Phase: PhaseUnmount, Warning: imaging.ErrNotBlockDevice})
+	} else if err := imaging.CheckDeviceWritable(f.opts.Target); err != nil {
+		return err
+	} else if err := imaging.UnmountDevice(f.opts.Target); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return &imaging.CancelledError{}
+	}
+
+	f.startPhase(PhaseWrite)
+	var hashes *imaging.BlockHashes
+	if f.opts.Verify && !f.opts.CompareSource && f.opts.Bmap == nil {
+		hashes = &imaging.BlockHashes{}
+	}
+	writeOptions := f.copyOptions(PhaseWrite)
+	writeOptions.Hashes = hashes
+	writeOptions.DirectIO = f.opts.DirectIO
+	var err error
+	if f.opts.Bmap != nil {
+		err = imaging.WriteDiskImageBmap(ctx, f.opts.Source, f.opts.Entry, f.opts.Target, f.opts.Bmap, writeOptions)
+	} else {
+		err = imaging.WriteDiskImageEntry(ctx, f.opts.Source, f.opts.Entry, f.opts.Target, writeOptions)
+	}
+	if err != nil {
+		return err
+	}
+
+	if f.opts.Verify {
+		f.startPhase(PhaseValidate)
+		if f.opts.Bmap != nil {
+			err = imaging.ValidateDeviceBmap(ctx, f.opts.Target, f.opts.Bmap, f.copyOptions(PhaseValidate))
+		} else if hashes != nil {
+			err = imaging.ValidateDeviceHashes(ctx, f.opts.Target, hashes, f.copyOptions(PhaseValidate))
+		} else {
+			err = imaging.ValidateDiskImageEntry(ctx, f.opts.Source, f.opts.Entry, f.opts.Target, f.copyOptions(PhaseValidate))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTargets flashes the disk image to several targets at once, reading it once (see
+// [imaging.WriteDiskImageTargets]).
+func (f *Flasher) runTargets(ctx context.Context) error {
+	run := newTargetRun(f.opts.Targets, f.TotalPhases(), f.opts.OnEvent)
+	run.emit(Event{Type: EventPhase, Phase: PhaseUnmount})
+	run.unmount(f.opts.AllowRegularFile)
+	if ctx.Err() != nil {
+		return &imaging.CancelledError{}
+	}
+
+	run.emit(Event{Type: EventPhase, Phase: PhaseWrite})
+	if f.opts.Bmap != nil || f.opts.Sparse != imaging.SparseOff {
+		run.emit(Event{Type: EventWarning, Phase: PhaseWrite, Warning: ErrBmapMultipleTargets})
+	}
+	var hashes *imaging.BlockHashes
+	if f.opts.Verify && !f.opts.CompareSource {
+		hashes = &imaging.BlockHashes{}
+	}
+	active := run.active()
+	writeOptions := f.copyOptions(PhaseWrite)
+	writeOptions.Progress = nil
+	writeOptions.TargetProgress = run.progress(PhaseWrite, active)
+	writeOptions.Hashes = hashes
+	writeOptions.DirectIO = f.opts.DirectIO
+	if len(active) > 0 {
+		errs := imaging.WriteDiskImageTargets(ctx, f.opts.Source, f.opts.Entry, run.paths(active), writeOptions)
+		for i, err := range errs {
+			if err != nil {
+				run.fail(PhaseWrite, active[i], err)
+			}
+		}
+	}
+
+	if f.opts.Verify && ctx.Err() == nil {
+		run.emit(Event{Type: EventPhase, Phase: PhaseValidate})
+		run.validate(func(target string, progress imaging.ProgressFunc) error {
+			opts := imaging.CopyOptions{BlockSize: f.opts.BlockSize, Progress: progress}
+			if hashes != nil {
+				return imaging.ValidateDeviceHashes(ctx, target, hashes, opts)
+			}
+			return imaging.ValidateDiskImageEntry(ctx, f.opts.Source, f.opts.Entry, target, opts)
+		})
+	}
+	return run.result(ctx)
+}
+
+func isRegularFile(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.Mode().Type()&fs.ModeType == 0
+}
+
+func (f *Flasher) copyOptions(phase Phase) imaging.CopyOptions {
+	var checksum *imaging.Checksum
+	if phase == PhaseWrite {
+		checksum = f.opts.Checksum
+	}
+	return imaging.CopyOptions{
+		BlockSize: f.opts.BlockSize,
+		Checksum:  checksum,
+		Sync:      f.opts.Sync,
+		Sparse:    f.opts.Sparse,
+		Progress: func(progress imaging.Progress) {
+			f.emit(Event{Type: EventProgress, Phase: phase, Progress: progress})
+		},
+	}
+}
+
+func (f *Flasher) startPhase(phase Phase) {
+	f.emit(Event{Type: EventPhase, Phase: phase})
+}
+
+func (f *Flasher) emit(event Event) {
+	if f.opts.OnEvent != nil {
+		event.TotalPhases = f.TotalPhases()
+		f.opts.OnEvent(event)
+	}
+}
@@ -0,0 +1,316 @@
+package flasher_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/retrixe/imprint/flasher"
+	"github.com/retrixe/imprint/imaging"
+)
+
+func generateImageAndTarget(t *testing.T) (string, string, []byte) {
+	t.Helper()
+	data := make([]byte, 3*1024*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to generate random data: %v", err)
+	}
+	dir := t.TempDir()
+	image := filepath.Join(dir, "image.iso")
+	target := filepath.Join(dir, "target.iso")
+	if err := os.WriteFile(image, data, 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	} else if err := os.WriteFile(target, nil, 0644); err != nil {
+		t.Fatalf("Failed to create target: %v", err)
+	}
+	return image, target, data
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+	if _, err := flasher.New(flasher.Options{Source: "image.iso"}); !errors.Is(err, flasher.ErrMissingOptions) {
+		t.Errorf("expected ErrMissingOptions, got %v", err)
+	}
+	if _, err := flasher.New(flasher.Options{Target: "/dev/sda"}); !errors.Is(err, flasher.ErrMissingOptions) {
+		t.Errorf("expected ErrMissingOptions, got %v", err)
+	}
+	if _, err := flasher.New(flasher.Options{
+		Source: "image.iso", Target: "/dev/sda", Targets: []string{"/dev/sdb"},
+	}); !errors.Is(err, flasher.ErrMissingOptions) {
+		t.Errorf("expected ErrMissingOptions, got %v", err)
+	}
+	f, err := flasher.New(flasher.Options{Source: "image.iso", Target: "/dev/sda", Verify: true})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	} else if f.TotalPhases() != 3 {
+		t.Errorf("expected 3 phases, got %d", f.TotalPhases())
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+	image, target, data := generateImageAndTarget(t)
+	var events []flasher.Event
+	f, err := flasher.New(flasher.Options{
+		Source:           image,
+		Target:           target,
+		BlockSize:        1024 * 1024,
+		Verify:           true,
+		AllowRegularFile: true,
+		OnEvent:          func(event flasher.Event) { events = append(events, event) },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(context.Background()); err != nil {
+		t.Fatalf("Failed to flash image: %v", err)
+	}
+
+	written, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Failed to read target: %v", err)
+	} else if !bytes.Equal(written, data) {
+		t.Errorf("written image does not match source image")
+	}
+
+	var phases []flasher.Phase
+	var warnings, finalProgress int
+	for _, event := range events {
+		if event.TotalPhases != 3 {
+			t.Errorf("expected 3 total phases, got %d", event.TotalPhases)
+		}
+		switch event.Type {
+		case flasher.EventPhase:
+			phases = append(phases, event.Phase)
+		case flasher.EventWarning:
+			warnings++
+			if !errors.Is(event.Warning, imaging.ErrNotBlockDevice) {
+				t.Errorf("expected ErrNotBlockDevice warning, got %v", event.Warning)
+			}
+		case flasher.EventProgress:
+			if event.Progress.Done {
+				finalProgress++
+				if event.Progress.Bytes != len(data) {
+					t.Errorf("expected %d bytes in phase %d, got %d", len(data), event.Phase, event.Progress.Bytes)
+				}
+			}
+		}
+	}
+	expectedPhases := []flasher.Phase{flasher.PhaseUnmount, flasher.PhaseWrite, flasher.PhaseValidate}
+	if len(phases) != len(expectedPhases) {
+		t.Fatalf("expected phases %v, got %v", expectedPhases, phases)
+	}
+	for i := range phases {
+		if phases[i] != expectedPhases[i] {
+			t.Errorf("expected phases %v, got %v", expectedPhases, phases)
+		}
+	}
+	if warnings != 1 {
+		t.Errorf("expected 1 warning, got %d", warnings)
+	} else if finalProgress != 2 {
+		t.Errorf("expected 2 final progress events, got %d", finalProgress)
+	}
+}
+
+func TestRunCompareSource(t *testing.T) {
+	t.Parallel()
+	image, target, _ := generateImageAndTarget(t)
+	f, err := flasher.New(flasher.Options{
+		Source: image, Target: target, Verify: true, CompareSource: true, AllowRegularFile: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(context.Background()); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestRunTargets(t *testing.T) {
+	t.Parallel()
+	image, target, data := generateImageAndTarget(t)
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.iso")
+	os.WriteFile(small, make([]byte, len(data)/2), 0644)
+	targets := []string{target, small, filepath.Join(dir, "second.iso"), target}
+	os.WriteFile(targets[2], nil, 0644)
+
+	for _, compareSource := range []bool{false, true} {
+		var mutex sync.Mutex
+		failed := make(map[string]error)
+		validated := make(map[string]imaging.Progress)
+		f, err := flasher.New(flasher.Options{
+			Source: image, Targets: targets, Verify: true, CompareSource: compareSource, AllowRegularFile: true,
+			OnEvent: func(event flasher.Event) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				if event.Type == flasher.EventTargetFailed {
+					failed[event.Target] = event.Err
+				} else if event.Type == flasher.EventProgress && event.Phase == flasher.PhaseValidate {
+					validated[event.Target] = event.Progress
+				}
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create flasher: %v", err)
+		}
+
+		var errTargets *flasher.TargetsError
+		if err := f.Run(context.Background()); !errors.As(err, &errTargets) {
+			t.Fatalf("expected TargetsError, got %v", err)
+		} else if errTargets.Total != 4 || len(errTargets.Errors) != 2 {
+			t.Errorf("expected 2 of 4 targets to fail, got %v", err)
+		} else if !errors.Is(failed[small], imaging.ErrTargetTooSmall) {
+			t.Errorf("expected the small target to fail, got %v", failed)
+		}
+		for _, target := range targets[:3:3] {
+			if target == small {
+				continue
+			} else if written, _ := os.ReadFile(target); !bytes.Equal(written, data) {
+				t.Errorf("expected %s to contain the image", target)
+			} else if !validated[target].Done {
+				t.Errorf("expected %s to be validated, got %+v", target, validated[target])
+			}
+		}
+	}
+}
+
+func TestRunTargetsSparse(t *testing.T) {
+	t.Parallel()
+	image, target, data := generateImageAndTarget(t)
+	second := filepath.Join(t.TempDir(), "second.iso")
+	os.WriteFile(second, nil, 0644)
+	var mutex sync.Mutex
+	var warnings int
+	f, err := flasher.New(flasher.Options{
+		Source: image, Targets: []string{target, second}, Sparse: imaging.SparseSkip, AllowRegularFile: true,
+		OnEvent: func(event flasher.Event) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if event.Type == flasher.EventWarning && errors.Is(event.Warning, flasher.ErrBmapMultipleTargets) {
+				warnings++
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(context.Background()); err != nil {
+		t.Fatalf("Failed to flash image: %v", err)
+	} else if warnings != 1 {
+		t.Errorf("expected 1 ErrBmapMultipleTargets warning, got %d", warnings)
+	}
+	if written, _ := os.ReadFile(second); !bytes.Equal(written, data) {
+		t.Errorf("expected the whole image to be written")
+	}
+}
+
+func TestRunBmap(t *testing.T) {
+	t.Parallel()
+	image, target, data := generateImageAndTarget(t)
+	bmap := &imaging.Bmap{ImageSize: len(data), BlockSize: 4096, Ranges: []imaging.BmapRange{
+		{First: 0, Last: 9}, {First: 100, Last: 199},
+	}}
+	var last imaging.Progress
+	f, err := flasher.New(flasher.Options{
+		Source: image, Target: target, Verify: true, Bmap: bmap, AllowRegularFile: true,
+		OnEvent: func(event flasher.Event) {
+			if event.Type == flasher.EventProgress && event.Phase == flasher.PhaseWrite {
+				last = event.Progress
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(context.Background()); err != nil {
+		t.Fatalf("Failed to flash image: %v", err)
+	}
+
+	written, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Failed to read target: %v", err)
+	} else if !bytes.Equal(written[:10*4096], data[:10*4096]) || !bytes.Equal(written[100*4096:200*4096], data[100*4096:200*4096]) {
+		t.Errorf("mapped blocks do not match source image")
+	} else if !bytes.Equal(written[10*4096:100*4096], make([]byte, 90*4096)) {
+		t.Errorf("expected unmapped blocks to not be written")
+	} else if last.Total != 110*4096 || last.Bytes != 110*4096 {
+		t.Errorf("expected progress against %d mapped bytes, got %+v", 110*4096, last)
+	}
+}
+
+func TestRunSparse(t *testing.T) {
+	t.Parallel()
+	image, target, data := generateImageAndTarget(t)
+	if err := os.WriteFile(target, bytes.Repeat([]byte{0xff}, len(data)), 0644); err != nil {
+		t.Fatalf("Failed to write target: %v", err)
+	}
+	bmap := &imaging.Bmap{ImageSize: len(data), BlockSize: 4096, Ranges: []imaging.BmapRange{
+		{First: 0, Last: 9}, {First: 100, Last: 199},
+	}}
+	f, err := flasher.New(flasher.Options{
+		Source: image, Target: target, Verify: true, Bmap: bmap, Sparse: imaging.SparseZero, AllowRegularFile: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(context.Background()); err != nil {
+		t.Fatalf("Failed to flash image: %v", err)
+	}
+
+	written, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatalf("Failed to read target: %v", err)
+	} else if !bytes.Equal(written[:10*4096], data[:10*4096]) || !bytes.Equal(written[100*4096:200*4096], data[100*4096:200*4096]) {
+		t.Errorf("mapped blocks do not match source image")
+	} else if !bytes.Equal(written[10*4096:100*4096], make([]byte, 90*4096)) || !bytes.Equal(written[200*4096:], make([]byte, len(data)-200*4096)) {
+		t.Errorf("expected unmapped blocks to be zeroed")
+	}
+}
+
+func TestRunRejectsRegularFile(t *testing.T) {
+	t.Parallel()
+	image, target, _ := generateImageAndTarget(t)
+	f, err := flasher.New(flasher.Options{Source: image, Target: target})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(context.Background()); !errors.Is(err, imaging.ErrNotBlockDevice) {
+		t.Errorf("expected ErrNotBlockDevice, got %v", err)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	t.Parallel()
+	image, target, _ := generateImageAndTarget(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f, err := flasher.New(flasher.Options{Source: image, Target: target, AllowRegularFile: true})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(ctx); !errors.Is(err, imaging.ErrCancelled) {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+}
+
+func TestRunChecksum(t *testing.T) {
+	t.Parallel()
+	image, target, data := generateImageAndTarget(t)
+	sum := sha256.Sum256(data)
+	checksum := &imaging.Checksum{Algorithm: "sha256", Digest: sum[:]}
+	f, err := flasher.New(flasher.Options{Source: image, Target: target, Checksum: checksum, AllowRegularFile: true})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(context.Background()); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	sum[0]++
+	checksum = &imaging.Checksum{Algorithm: "sha256", Digest: sum[:]}
+	f, err = flasher.New(flasher.Options{Source: image, Target: target, Checksum: checksum, AllowRegularFile: true})
+	if err != nil {
+		t.Fatalf("Failed to create flasher: %v", err)
+	} else if err := f.Run(context.Background()); !errors.Is(err, imaging.ErrChecksumMismatch) {
+		t.Errorf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
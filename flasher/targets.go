@@ -0,0 +1,167 @@
+package flasher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+// TargetError is the error which made writing to one of several targets fail.
+type TargetError struct {
+	Target string
+	Err    error
+}
+
+func (e *TargetError) Error() string {
+	return e.Target + ": " + e.Err.Error()
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+// TargetsError is returned when writing to any of several targets fails, listing the targets
+// which failed. The targets which aren't listed were written successfully.
+type TargetsError struct {
+	// Total is the total number of targets, including those which succeeded.
+	Total  int
+	Errors []*TargetError
+}
+
+func (e *TargetsError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d of %d targets failed! %s", len(e.Errors), e.Total, strings.Join(messages, "; "))
+}
+
+func (e *TargetsError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// targetRun tracks the targets written to by a run, and the errors of those which failed. Events
+// may be emitted from several goroutines, but are never sent concurrently.
+type targetRun struct {
+	targets     []string
+	errs        []error
+	totalPhases int
+	onEvent     func(Event)
+	mutex       sync.Mutex
+}
+
+func newTargetRun(targets []string, totalPhases int, onEvent func(Event)) *targetRun {
+	return &targetRun{
+		targets:     targets,
+		errs:        make([]error, len(targets)),
+		totalPhases: totalPhases,
+		onEvent:     onEvent,
+	}
+}
+
+func (r *targetRun) emit(event Event) {
+	if r.onEvent != nil {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		event.TotalPhases = r.totalPhases
+		r.onEvent(event)
+	}
+}
+
+// fail records the error of a target, which isn't written to any further.
+func (r *targetRun) fail(phase Phase, target int, err error) {
+	r.errs[target] = err
+	r.emit(Event{Type: EventTargetFailed, Phase: phase, Target: r.targets[target], Err: err})
+}
+
+// active returns the indices of the targets which haven't failed.
+func (r *targetRun) active() []int {
+	var active []int
+	for i, err := range r.errs {
+		if err == nil {
+			active = append(active, i)
+		}
+	}
+	return active
+}
+
+// paths returns the paths of the targets with the given indices.
+func (r *targetRun) paths(targets []int) []string {
+	paths := make([]string, len(targets))
+	for i, target := range targets {
+		paths[i] = r.targets[target]
+	}
+	return paths
+}
+
+// unmount checks that every target is writable and unmounts it, failing those which aren't.
+// Duplicate targets fail as well, since they would be written to twice at once. Targets which
+// already failed are left alone.
+func (r *targetRun) unmount(allowRegularFile bool) {
+	seen := make(map[string]bool)
+	for i, target := range r.targets {
+		if r.errs[i] != nil {
+			continue
+		} else if seen[target] {
+			r.fail(PhaseUnmount, i, fmt.Errorf("the target %s was passed more than once", target))
+		} else if allowRegularFile && isRegularFile(target) {
+			r.emit(Event{Type: EventWarning, Phase: PhaseUnmount, Target: target, Warning: imaging.ErrNotBlockDevice})
+		} else if err := imaging.CheckDeviceWritable(target); err != nil {
+			r.fail(PhaseUnmount, i, err)
+		} else if err := imaging.UnmountDevice(target); err != nil {
+			r.fail(PhaseUnmount, i, err)
+		}
+		seen[target] = true
+	}
+}
+
+// progress returns an [imaging.TargetProgressFunc] emitting progress events for the targets with
+// the given indices, in the given phase.
+func (r *targetRun) progress(phase Phase, targets []int) imaging.TargetProgressFunc {
+	return func(target int, progress imaging.Progress) {
+		r.emit(Event{Type: EventProgress, Phase: phase, Target: r.targets[targets[target]], Progress: progress})
+	}
+}
+
+// validate validates every target which hasn't failed in parallel, with the given function.
+func (r *targetRun) validate(validate func(target string, progress imaging.ProgressFunc) error) {
+	var wg sync.WaitGroup
+	active := r.active()
+	progress := r.progress(PhaseValidate, active)
+	for i, target := range active {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := validate(r.targets[target], func(p imaging.Progress) { progress(i, p) })
+			if err != nil {
+				r.fail(PhaseValidate, target, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// result returns a [*TargetsError] listing the targets which failed, if any. If the context was
+// cancelled, the error matching [imaging.ErrCancelled] is returned instead.
+func (r *targetRun) result(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return &imaging.CancelledError{}
+	}
+	var errs []*TargetError
+	for i, err := range r.errs {
+		if err != nil {
+			errs = append(errs, &TargetError{Target: r.targets[i], Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return &TargetsError{Total: len(r.targets), Errors: errs}
+	}
+	return nil
+}
@@ -3,8 +3,16 @@ module github.com/retrixe/imprint
 go 1.22
 
 require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/klauspost/compress v1.17.11
 	github.com/sqweek/dialog v0.0.0-20240226140203-065105509627
+	github.com/ulikunitz/xz v0.5.12
 	github.com/webview/webview_go v0.0.0-20240831120633-6173450d4dd6
 )
 
-require github.com/TheTitanrain/w32 v0.0.0-20200114052255-2654d97dbd3d // indirect
+require (
+	github.com/TheTitanrain/w32 v0.0.0-20200114052255-2654d97dbd3d // indirect
+	github.com/cloudflare/circl v1.3.7 // indirect
+	golang.org/x/crypto v0.17.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+)
@@ -0,0 +1,164 @@
+package imaging
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// BackupCompression returns the compression format of a backup written to the given path, based
+// on its extension, e.g. [CompressionZstd] for backup.img.zst.
+func BackupCompression(path string) Compression {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz":
+		return CompressionGzip
+	case ".xz":
+		return CompressionXz
+	case ".zst":
+		return CompressionZstd
+	case ".bz2":
+		return CompressionBzip2
+	case ".zip":
+		return CompressionZip
+	}
+	return CompressionNone
+}
+
+// BackupDevice reads the first size bytes of the device (or the whole device, if size is zero)
+// into a new disk image file at output, compressed according to its extension (see
+// [BackupCompression]). The device isn't opened exclusively, so it can be backed up while it is
+// mounted, but it should not be written to meanwhile. The output file is removed if the backup
+// fails or is cancelled.
+//
+// It returns the SHA-256 checksum of the output file, see [BackupImage].
+func BackupDevice(ctx context.Context, of string, output string, size int, opts CopyOptions) (*Checksum, error) {
+	src, err := openFile(of, os.O_RDONLY, 0, "device")
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	if size <= 0 {
+		size = deviceSize(src)
+	}
+	dest, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("the output file %s already exists!", output)
+	} else if err != nil {
+		return nil, fmt.Errorf("an error occurred while opening output! %w", err)
+	}
+	checksum, err := BackupImage(ctx, src, dest, size, BackupCompression(output), opts)
+	if closeErr := dest.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("encountered error while writing to output! %w", closeErr)
+	}
+	if err != nil {
+		os.Remove(output)
+		return nil, err
+	}
+	return checksum, nil
+}
+
+// BackupImage copies size bytes from src (or until EOF, if size is negative) to dest, compressing
+// them with the given compression format, until done or the context is cancelled, in which case
+// a [*CancelledError] is returned. If src ends before size bytes are read, an error matching
+// [io.ErrUnexpectedEOF] is returned.
+//
+// It returns the SHA-256 checksum of the data written to dest, i.e. of the compressed image, so
+// it can be verified with tools like sha256sum later.
+func BackupImage(ctx context.Context, src io.Reader, dest io.Writer, size int, compression Compression, opts CopyOptions) (*Checksum, error) {
+	hash := sha256.New()
+	writer, err := compressWriter(io.MultiWriter(dest, hash), compression)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		src = io.LimitReader(src, int64(size))
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	startTime := time.Now()
+	progress := func(total int, done bool) Progress {
+		return Progress{Bytes: total, Total: size, Duration: time.Since(startTime), Done: done}
+	}
+	var total int
+	buf := make([]byte, opts.blockSize())
+	for {
+		if ctx.Err() != nil {
+			return nil, &CancelledError{Bytes: total}
+		}
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if _, err := writer.Write(buf[:n]); err != nil {
+				return nil, fmt.Errorf("encountered error while writing to output! %w", err)
+			}
+			total += n
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("encountered error while reading device! %w", err)
+		}
+		select {
+		case <-ticker.C:
+			if opts.Progress != nil {
+				opts.Progress(progress(total, false))
+			}
+		default:
+		}
+	}
+	if size >= 0 && total < size {
+		return nil, fmt.Errorf("the device ended after %d of %d bytes! %w", total, size, io.ErrUnexpectedEOF)
+	} else if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("encountered error while writing to output! %w", err)
+	} else if opts.Sync != SyncNone {
+		if err := syncWriter(dest); err != nil {
+			return nil, fmt.Errorf("failed to sync writes to disk! %w", err)
+		}
+	}
+	if opts.Progress != nil {
+		opts.Progress(progress(total, true))
+	}
+	return &Checksum{Algorithm: "sha256", Digest: hash.Sum(nil)}, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter returns a writer compressing data written to it with the given compression
+// format, which must be closed to flush it.
+func compressWriter(writer io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{writer}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(writer), nil
+	case CompressionXz:
+		return xz.NewWriter(writer)
+	case CompressionZstd:
+		return zstd.NewWriter(writer)
+	}
+	return nil, fmt.Errorf("%s compression is not supported for backups, use gz, xz or zst instead", compression)
+}
+
+// deviceSize returns the size of a device or file, or -1 if it can't be determined, e.g. for raw
+// disks on macOS and Windows, which can't be seeked to the end.
+func deviceSize(file *os.File) int {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil || size <= 0 {
+		return -1
+	} else if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return -1
+	}
+	return int(size)
+}
@@ -0,0 +1,132 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupCompression(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]Compression{
+		"backup.img":     CompressionNone,
+		"backup.img.gz":  CompressionGzip,
+		"backup.img.XZ":  CompressionXz,
+		"backup.img.zst": CompressionZstd,
+		"backup.iso.bz2": CompressionBzip2,
+	}
+	for path, expected := range testCases {
+		if compression := BackupCompression(path); compression != expected {
+			t.Errorf("expected %s to use %q compression, got %q", path, expected, compression)
+		}
+	}
+}
+
+func TestBackupDevice(t *testing.T) {
+	t.Parallel()
+	data := make([]byte, 3*1024*1024+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to read random data: %v", err)
+	}
+	device := filepath.Join(t.TempDir(), "device.img")
+	if err := os.WriteFile(device, data, 0644); err != nil {
+		t.Fatalf("Failed to write device: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		size int
+	}{
+		{"whole device", 0},
+		{"partitions only", len(data) / 2},
+	}
+	for _, extension := range []string{".img", ".img.gz", ".img.xz", ".img.zst"} {
+		for _, testCase := range testCases {
+			t.Run(testCase.name+" to "+extension, func(t *testing.T) {
+				t.Parallel()
+				output := filepath.Join(t.TempDir(), "backup"+extension)
+				var last Progress
+				opts := CopyOptions{Progress: func(p Progress) { last = p }}
+				checksum, err := BackupDevice(context.Background(), device, output, testCase.size, opts)
+				if err != nil {
+					t.Fatalf("BackupDevice failed: %v", err)
+				}
+				expected := data
+				if testCase.size > 0 {
+					expected = data[:testCase.size]
+				}
+				if !last.Done || last.Bytes != len(expected) || last.Total != len(expected) {
+					t.Errorf("expected final progress of %d bytes, got %+v", len(expected), last)
+				}
+
+				file, _ := os.ReadFile(output)
+				if sum := sha256.Sum256(file); !bytes.Equal(checksum.Digest, sum[:]) {
+					t.Errorf("expected checksum of the output file, got %s", checksum)
+				}
+				src, err := OpenSourceImage(output, "")
+				if err != nil {
+					t.Fatalf("Failed to open backup: %v", err)
+				}
+				defer src.Close()
+				if restored, err := io.ReadAll(src); err != nil || !bytes.Equal(restored, expected) {
+					t.Errorf("expected backup to contain the device, got error %v", err)
+				}
+			})
+		}
+	}
+
+	t.Run("existing output", func(t *testing.T) {
+		t.Parallel()
+		output := filepath.Join(t.TempDir(), "backup.img")
+		os.WriteFile(output, []byte("precious"), 0644)
+		if _, err := BackupDevice(context.Background(), device, output, 0, CopyOptions{}); err == nil {
+			t.Errorf("expected error for existing output file")
+		} else if file, _ := os.ReadFile(output); string(file) != "precious" {
+			t.Errorf("expected existing output file to be left as-is")
+		}
+	})
+
+	t.Run("unsupported compression", func(t *testing.T) {
+		t.Parallel()
+		output := filepath.Join(t.TempDir(), "backup.img.bz2")
+		if _, err := BackupDevice(context.Background(), device, output, 0, CopyOptions{}); err == nil {
+			t.Errorf("expected error for bzip2 compression")
+		} else if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Errorf("expected output file to be removed, got %v", err)
+		}
+	})
+}
+
+func TestBackupImage(t *testing.T) {
+	t.Parallel()
+	data := make([]byte, 1024*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to read random data: %v", err)
+	}
+
+	t.Run("device shorter than size", func(t *testing.T) {
+		t.Parallel()
+		var output bytes.Buffer
+		_, err := BackupImage(context.Background(), bytes.NewReader(data), &output, len(data)*2, CompressionNone, CopyOptions{})
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var output bytes.Buffer
+		_, err := BackupImage(ctx, bytes.NewReader(data), &output, -1, CompressionNone, CopyOptions{})
+		if !errors.Is(err, ErrCancelled) {
+			t.Errorf("expected ErrCancelled, got %v", err)
+		}
+	})
+}
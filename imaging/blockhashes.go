@@ -0,0 +1,116 @@
+package imaging
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultHashBlockSize is the size of the blocks hashed by [BlockHashes], unless set otherwise.
+// It is independent of the block size used to write the image, so small writes don't record a
+// digest for every few bytes, which would take gigabytes of memory for large images.
+const DefaultHashBlockSize = 4 * 1024 * 1024
+
+// BlockHashes are the SHA-256 digests of each block of a disk image, recorded by [WriteImage] as
+// it writes them. They allow validating the image on the device without reading the disk image
+// again, which is slow for images on network shares, and impossible for streamed images.
+type BlockHashes struct {
+	// BlockSize is the size of each hashed block, except for the last one which may be shorter. If
+	// zero, it is set to [DefaultHashBlockSize] when the hashes are recorded.
+	BlockSize int
+	// Size is the total size of the disk image in bytes.
+	Size    int
+	Digests [][sha256.Size]byte
+	block   hash.Hash // The hash of the last block, which may be incomplete.
+}
+
+// reset clears the hashes, before recording the blocks of a disk image.
+func (h *BlockHashes) reset() {
+	if h != nil {
+		*h = BlockHashes{BlockSize: cmp.Or(h.BlockSize, DefaultHashBlockSize)}
+	}
+}
+
+// add records the hash of the next data written from the disk image, which may span several
+// blocks or only part of one.
+func (h *BlockHashes) add(data []byte) {
+	for h != nil && len(data) > 0 {
+		if h.Size%h.BlockSize == 0 {
+			h.block = sha256.New()
+			h.Digests = append(h.Digests, [sha256.Size]byte{})
+		}
+		n := min(len(data), h.BlockSize-h.Size%h.BlockSize)
+		h.block.Write(data[:n])
+		h.block.Sum(h.Digests[len(h.Digests)-1][:0])
+		h.Size += n
+		data = data[n:]
+	}
+}
+
+// ValidateDeviceHashes checks if the contents of the block device match the hashes recorded while
+// writing the disk image to it. Progress is reported according to the given [CopyOptions], whose
+// other options are ignored, and validation stops when the context is cancelled.
+func ValidateDeviceHashes(ctx context.Context, of string, hashes *BlockHashes, opts CopyOptions) error {
+	dest, err := openFile(of, os.O_RDONLY|os.O_EXCL, os.ModePerm, "destination")
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return ValidateHashes(ctx, dest, hashes, opts)
+}
+
+// ValidateHashes checks if the contents read from dest match the hashes of a disk image, until the
+// whole image is read or the context is cancelled, in which case a [*CancelledError] is returned.
+// If they don't match, a [*ValidationError] is returned, whose Offset is that of the first block
+// which differs, since the exact byte isn't known.
+func ValidateHashes(ctx context.Context, dest io.Reader, hashes *BlockHashes, opts CopyOptions) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	startTime := time.Now()
+	progress := func(total int, done bool) Progress {
+		return Progress{Bytes: total, Total: hashes.Size, Duration: time.Since(startTime), Done: done}
+	}
+	var total int
+	var mismatch *ValidationError
+	buf := make([]byte, hashes.BlockSize)
+	for _, digest := range hashes.Digests {
+		if ctx.Err() != nil {
+			return &CancelledError{Bytes: total}
+		}
+		n, err := io.ReadFull(dest, buf[:min(hashes.BlockSize, hashes.Size-total)])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("encountered error while validating device! %w", err)
+		} else if err != nil { // The device ran out of data before the end of the image.
+			if mismatch == nil {
+				mismatch = &ValidationError{Offset: total + n, BlockSize: hashes.BlockSize}
+			}
+			mismatch.Truncated = true
+			return mismatch
+		}
+		if sha256.Sum256(buf[:n]) != digest {
+			if mismatch == nil {
+				mismatch = &ValidationError{Offset: total, BlockSize: hashes.BlockSize}
+			}
+			mismatch.MismatchedBlocks++
+		}
+		total += n
+		select {
+		case <-ticker.C:
+			if opts.Progress != nil {
+				opts.Progress(progress(total, false))
+			}
+		default:
+		}
+	}
+	if mismatch != nil {
+		return mismatch
+	} else if opts.Progress != nil {
+		opts.Progress(progress(total, true))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestValidateHashes(t *testing.T) {
+	t.Parallel()
+	data := make([]byte, 10*1024+512)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to read random data: %v", err)
+	}
+	// The hashed blocks are independent of the blocks written.
+	hashes := BlockHashes{BlockSize: 1024}
+	var dest bytes.Buffer
+	err := WriteImage(context.Background(), bytes.NewReader(data), &dest, CopyOptions{BlockSize: 1536, Hashes: &hashes})
+	if err != nil {
+		t.Fatalf("WriteImage failed: %v", err)
+	} else if hashes.Size != len(data) || len(hashes.Digests) != 11 || hashes.BlockSize != 1024 {
+		t.Fatalf("Expected 11 hashes of 1024 byte blocks, got %d of %d byte blocks", len(hashes.Digests), hashes.BlockSize)
+	}
+
+	corrupted := append(bytes.Clone(data), make([]byte, 512)...) // Devices are larger than the image.
+	corrupted[2100]++
+	corrupted[len(data)-1]++
+	testCases := []struct {
+		name     string
+		device   []byte
+		expected *ValidationError
+	}{
+		{"matching device", append(bytes.Clone(data), make([]byte, 512)...), nil},
+		{"corrupted device", corrupted, &ValidationError{Offset: 2048, MismatchedBlocks: 2, BlockSize: 1024}},
+		{"truncated device", data[:4000], &ValidationError{Offset: 4000, BlockSize: 1024, Truncated: true}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			var last Progress
+			err := ValidateHashes(context.Background(), bytes.NewReader(testCase.device), &hashes,
+				CopyOptions{Progress: func(p Progress) { last = p }})
+			var errValidation *ValidationError
+			if testCase.expected == nil && err != nil {
+				t.Errorf("Expected no error, got: %v", err)
+			} else if testCase.expected == nil && (!last.Done || last.Bytes != len(data)) {
+				t.Errorf("Expected final progress of %d bytes, got %+v", len(data), last)
+			} else if testCase.expected != nil && !errors.As(err, &errValidation) {
+				t.Errorf("Expected ValidationError, got: %v", err)
+			} else if testCase.expected != nil && *errValidation != *testCase.expected {
+				t.Errorf("Expected %+v, got %+v", testCase.expected, errValidation)
+			}
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := ValidateHashes(ctx, bytes.NewReader(data), &hashes, CopyOptions{}); !errors.Is(err, ErrCancelled) {
+			t.Errorf("Expected ErrCancelled, got: %v", err)
+		}
+	})
+}
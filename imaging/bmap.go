@@ -0,0 +1,544 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidBmap is returned when a bmap file can't be parsed, or is inconsistent.
+var ErrInvalidBmap = errors.New("invalid bmap file")
+
+// Bmap is a block map of a disk image, listing the ranges of blocks which contain data, as
+// generated by bmaptool for Yocto and Tizen images. Only these ranges need to be written to the
+// device, which is much faster than writing the entire image for sparse images.
+type Bmap struct {
+	// ImageSize is the size of the (decompressed) disk image in bytes.
+	ImageSize int
+	// BlockSize is the size of each block in bytes.
+	BlockSize int
+	// Ranges are the ranges of mapped blocks, in ascending order.
+	Ranges []BmapRange
+}
+
+// BmapRange is a range of mapped blocks in a [Bmap].
+type BmapRange struct {
+	// First and Last are the indices of the first and last block in the range, inclusive.
+	First int
+	Last  int
+	// Checksum is the checksum of the data in the range, if the bmap file has one.
+	Checksum *Checksum
+}
+
+// bounds returns the offsets of the start and end of a range in the disk image.
+func (b *Bmap) bounds(r BmapRange) (int, int) {
+	return r.First * b.BlockSize, min((r.Last+1)*b.BlockSize, b.ImageSize)
+}
+
+// bmapSegment is a part of a disk image, either a range mapped in a [Bmap] or a hole between them.
+type bmapSegment struct {
+	start int
+	end   int
+	// index is the index of the range in Bmap.Ranges, or -1 for holes.
+	index int
+}
+
+// segments splits the disk image into its mapped ranges and the holes between them, in order.
+func (b *Bmap) segments() []bmapSegment {
+	var segments []bmapSegment
+	position := 0
+	for i, r := range b.Ranges {
+		start, end := b.bounds(r)
+		if start > position {
+			segments = append(segments, bmapSegment{start: position, end: start, index: -1})
+		}
+		segments = append(segments, bmapSegment{start: start, end: end, index: i})
+		position = end
+	}
+	if position < b.ImageSize {
+		segments = append(segments, bmapSegment{start: position, end: b.ImageSize, index: -1})
+	}
+	return segments
+}
+
+// MappedBytes returns the number of bytes in the mapped ranges of the disk image.
+func (b *Bmap) MappedBytes() int {
+	total := 0
+	for _, r := range b.Ranges {
+		start, end := b.bounds(r)
+		total += end - start
+	}
+	return total
+}
+
+type bmapFile struct {
+	Version          string `xml:"version,attr"`
+	ImageSize        string `xml:"ImageSize"`
+	BlockSize        string `xml:"BlockSize"`
+	BlocksCount      string `xml:"BlocksCount"`
+	ChecksumType     string `xml:"ChecksumType"`
+	BmapFileChecksum string `xml:"BmapFileChecksum"`
+	BmapFileSHA1     string `xml:"BmapFileSHA1"`
+	Ranges           []struct {
+		Checksum string `xml:"chksum,attr"`
+		SHA1     string `xml:"sha1,attr"`
+		Blocks   string `xml:",chardata"`
+	} `xml:"BlockMap>Range"`
+}
+
+// ReadBmap reads a bmap file (versions 1 and 2 are supported), verifying its own checksum if it
+// has one, as well as the consistency of its ranges.
+func ReadBmap(path string) (*Bmap, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseBmap(data)
+}
+
+func parseBmap(data []byte) (*Bmap, error) {
+	var file bmapFile
+	if err := xml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%w! %w", ErrInvalidBmap, err)
+	}
+	algorithm := strings.ToLower(strings.TrimSpace(file.ChecksumType))
+	fileChecksum := strings.TrimSpace(file.BmapFileChecksum)
+	if strings.HasPrefix(strings.TrimSpace(file.Version), "1.") {
+		algorithm, fileChecksum = "sha1", strings.TrimSpace(file.BmapFileSHA1)
+	}
+	if _, ok := checksumAlgorithms[algorithm]; !ok && algorithm != "" {
+		return nil, fmt.Errorf("%w! unsupported checksum type %s", ErrInvalidBmap, algorithm)
+	} else if fileChecksum != "" {
+		// The checksum of the bmap file is calculated with the checksum itself zeroed out.
+		zeroed := bytes.Replace(data, []byte(fileChecksum), bytes.Repeat([]byte("0"), len(fileChecksum)), 1)
+		expected, err := ParseChecksum(algorithm + ":" + fileChecksum)
+		if err != nil {
+			return nil, fmt.Errorf("%w! %w", ErrInvalidBmap, err)
+		}
+		hash := expected.newHash()
+		hash.Write(zeroed)
+		if !bytes.Equal(hash.Sum(nil), expected.Digest) {
+			return nil, fmt.Errorf("%w! the checksum of the bmap file does not match, it may be corrupt", ErrInvalidBmap)
+		}
+	}
+
+	bmap := &Bmap{}
+	blocksCount, err := strconv.Atoi(strings.TrimSpace(file.BlocksCount))
+	if err == nil {
+		bmap.ImageSize, err = strconv.Atoi(strings.TrimSpace(file.ImageSize))
+	}
+	if err == nil {
+		bmap.BlockSize, err = strconv.Atoi(strings.TrimSpace(file.BlockSize))
+	}
+	if err != nil || bmap.ImageSize <= 0 || bmap.BlockSize <= 0 {
+		return nil, fmt.Errorf("%w! the image size, block size and blocks count must be positive", ErrInvalidBmap)
+	}
+	for _, entry := range file.Ranges {
+		first, last, ok := strings.Cut(strings.TrimSpace(entry.Blocks), "-")
+		if !ok {
+			last = first
+		}
+		r := BmapRange{}
+		r.First, err = strconv.Atoi(strings.TrimSpace(first))
+		if err == nil {
+			r.Last, err = strconv.Atoi(strings.TrimSpace(last))
+		}
+		if err != nil || r.First < 0 || r.Last < r.First || r.Last >= blocksCount ||
+			r.First*bmap.BlockSize >= bmap.ImageSize ||
+			(len(bmap.Ranges) > 0 && r.First <= bmap.Ranges[len(bmap.Ranges)-1].Last) {
+			return nil, fmt.Errorf("%w! invalid range of blocks %s", ErrInvalidBmap, strings.TrimSpace(entry.Blocks))
+		}
+		if checksum := strings.TrimSpace(entry.Checksum + entry.SHA1); checksum != "" {
+			digest, err := hex.DecodeString(checksum)
+			if err != nil || algorithm == "" || len(digest) != checksumAlgorithms[algorithm] {
+				return nil, fmt.Errorf("%w! invalid checksum of blocks %s", ErrInvalidBmap, strings.TrimSpace(entry.Blocks))
+			}
+			r.Checksum = &Checksum{Algorithm: algorithm, Digest: digest}
+		}
+		bmap.Ranges = append(bmap.Ranges, r)
+	}
+	return bmap, nil
+}
+
+// FindBmapFile looks for the bmap file of a disk image next to it, e.g. image.wic.bmap for
+// image.wic or image.wic.xz, and returns its path, or an empty string if there is none.
+func FindBmapFile(image string) string {
+	for candidate := image; ; {
+		if stat, err := os.Stat(candidate + ".bmap"); err == nil && stat.Mode().IsRegular() {
+			return candidate + ".bmap"
+		}
+		extension := filepath.Ext(candidate)
+		if extension == "" {
+			return ""
+		}
+		candidate = strings.TrimSuffix(candidate, extension)
+	}
+}
+
+// SparseMode controls how the holes in a disk image are handled when writing and validating it
+// with a [Bmap], i.e. the blocks which aren't mapped in it.
+type SparseMode int
+
+const (
+	// SparseOff skips holes when writing, and doesn't validate them. This is how bmap files are
+	// used by bmaptool, since unmapped blocks are of no interest to the image.
+	SparseOff SparseMode = iota
+	// SparseSkip skips holes when writing, and validates that they are zeroed on the device, e.g.
+	// for devices which are known to be zeroed already.
+	SparseSkip
+	// SparseZero zeroes holes on the device quickly, without writing zeros where the device (or
+	// filesystem) supports it, and validates that they are zeroed.
+	SparseZero
+	// SparseDiscard discards the whole device before writing (e.g. TRIM on SSDs and SD cards),
+	// skips holes when writing, and validates that they are zeroed. Devices which don't return
+	// zeros for discarded blocks will fail validation.
+	SparseDiscard
+)
+
+func (m SparseMode) String() string {
+	switch m {
+	case SparseSkip:
+		return "skip"
+	case SparseZero:
+		return "zero"
+	case SparseDiscard:
+		return "discard"
+	}
+	return "off"
+}
+
+// ParseSparseMode parses a [SparseMode] from its name, either off, skip, zero or discard.
+func ParseSparseMode(mode string) (SparseMode, error) {
+	for _, m := range []SparseMode{SparseOff, SparseSkip, SparseZero, SparseDiscard} {
+		if m.String() == mode {
+			return m, nil
+		}
+	}
+	return SparseOff, fmt.Errorf("invalid sparse mode %s, expected off, skip, zero or discard", mode)
+}
+
+// SparseBmap creates a [Bmap] mapping the blocks of a sparse disk image file which contain data,
+// found using SEEK_DATA and SEEK_HOLE, for images without a bmap file. On systems which don't
+// support finding holes, the whole image is mapped.
+func SparseBmap(path string) (*Bmap, error) {
+	file, err := openFile(path, os.O_RDONLY, 0, "file")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while opening file! %w", err)
+	}
+	var header [16]byte
+	n, err := file.ReadAt(header[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("encountered error while reading file! %w", err)
+	} else if DetectCompression(header[:n]) != CompressionNone {
+		return nil, errors.New("sparse writing requires an uncompressed disk image")
+	}
+	extents, err := dataExtents(file, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("failed to find holes in the disk image! %w", err)
+	}
+	bmap := &Bmap{ImageSize: int(stat.Size()), BlockSize: bufferAlignment}
+	for _, extent := range extents {
+		// Extents are rounded outwards to whole blocks, merging them with the previous range.
+		r := BmapRange{First: int(extent[0]) / bmap.BlockSize, Last: int(extent[1]-1) / bmap.BlockSize}
+		if last := len(bmap.Ranges) - 1; last >= 0 && r.First <= bmap.Ranges[last].Last+1 {
+			bmap.Ranges[last].Last = max(bmap.Ranges[last].Last, r.Last)
+		} else {
+			bmap.Ranges = append(bmap.Ranges, r)
+		}
+	}
+	return bmap, nil
+}
+
+// WriteDiskImageBmap is [WriteDiskImageEntry], writing only the ranges of the disk image mapped
+// in the bmap, see [WriteBmapImage]. With [SparseDiscard], the device is discarded first.
+func WriteDiskImageBmap(ctx context.Context, iff string, entry string, of string, bmap *Bmap, opts CopyOptions) error {
+	src, err := OpenSourceImage(iff, entry)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, file, err := openDestination(of, opts.DirectIO)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if opts.Sparse == SparseDiscard {
+		if err := discardFile(file); err != nil {
+			return fmt.Errorf("failed to discard the device! %w", err)
+		}
+	}
+	return WriteBmapImage(ctx, src, dest.(io.WriterAt), bmap, opts)
+}
+
+// WriteBmapImage copies the ranges of a disk image mapped in the bmap from src to dest, skipping
+// the rest of the image, until the last range is written or the context is cancelled, in which
+// case a [*CancelledError] is returned. Progress is reported against the mapped bytes. The holes
+// between the ranges are zeroed on the device with [SparseZero], see [CopyOptions.Sparse].
+//
+// Each range is verified against its checksum in the bmap, returning an error matching
+// [ErrChecksumMismatch] if it doesn't match. Ranges without a checksum have the checksum of the
+// data written to them filled in, so the device can be validated with [ValidateBmap] later.
+func WriteBmapImage(ctx context.Context, src io.Reader, dest io.WriterAt, bmap *Bmap, opts CopyOptions) error {
+	bs := opts.blockSize()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	startTime := time.Now()
+	mapped := bmap.MappedBytes()
+	progress := func(total int, done bool) Progress {
+		progress := sourceProgress(src)
+		progress.Bytes, progress.Total = total, mapped
+		progress.Duration, progress.Done = time.Since(startTime), done
+		return progress
+	}
+	syncDest := func() error {
+		if opts.Sync == SyncNone {
+			return nil
+		} else if err := syncWriter(dest); err != nil {
+			return fmt.Errorf("failed to sync writes to disk! %w", err)
+		}
+		return nil
+	}
+	var total int
+	buf := alignedBuffer(bs)
+	reader, verifyChecksum := startChecksum(src, opts.Checksum)
+	for _, segment := range bmap.segments() {
+		if segment.index == -1 && segment.end == bmap.ImageSize && opts.Checksum == nil && opts.Sparse != SparseZero {
+			break // The rest of the disk image doesn't need to be read.
+		} else if segment.index == -1 {
+			if err := discard(reader, segment.end-segment.start, buf); err != nil {
+				return fmt.Errorf("encountered error while reading file! %w", err)
+			} else if opts.Sparse != SparseZero {
+				continue
+			} else if err := zeroRange(dest, segment.start, segment.end-segment.start); err != nil {
+				return fmt.Errorf("encountered error while writing to dest! %w", err)
+			}
+			continue
+		}
+		r := bmap.Ranges[segment.index]
+		checksum := r.Checksum
+		if checksum == nil {
+			checksum = &Checksum{Algorithm: "sha256"}
+		}
+		hash := checksum.newHash()
+		for offset := segment.start; offset < segment.end; {
+			if ctx.Err() != nil {
+				if err := syncDest(); err != nil {
+					return err
+				}
+				return &CancelledError{Bytes: total}
+			}
+			n, err := io.ReadFull(reader, buf[:min(bs, segment.end-offset)])
+			if err != nil {
+				return fmt.Errorf("encountered error while reading file! %w", err)
+			} else if _, err := dest.WriteAt(buf[:n], int64(offset)); err != nil {
+				return fmt.Errorf("encountered error while writing to dest! %w", err)
+			}
+			hash.Write(buf[:n])
+			offset += n
+			total += n
+			select {
+			case <-ticker.C:
+				if opts.Sync == SyncPeriodic {
+					if err := syncDest(); err != nil {
+						return err
+					}
+				}
+				if opts.Progress != nil {
+					opts.Progress(progress(total, false))
+				}
+			default:
+			}
+		}
+		if sum := hash.Sum(nil); r.Checksum == nil {
+			bmap.Ranges[segment.index].Checksum = &Checksum{Algorithm: checksum.Algorithm, Digest: sum}
+		} else if !bytes.Equal(sum, r.Checksum.Digest) {
+			return fmt.Errorf("blocks %d-%d: %w", r.First, r.Last,
+				&ChecksumMismatchError{Expected: r.Checksum, Actual: &Checksum{Algorithm: r.Checksum.Algorithm, Digest: sum}})
+		}
+	}
+	if opts.Checksum != nil { // The whole image file must be read to verify its checksum.
+		if err := discard(reader, -1, buf); err != nil {
+			return fmt.Errorf("encountered error while reading file! %w", err)
+		}
+	}
+	if err := syncDest(); err != nil {
+		return err
+	} else if err := verifyChecksum(); err != nil {
+		return err
+	} else if opts.Progress != nil {
+		opts.Progress(progress(total, true))
+	}
+	return nil
+}
+
+// discard reads and discards n bytes from reader using buf, or until EOF if n is negative.
+func discard(reader io.Reader, n int, buf []byte) error {
+	for n != 0 {
+		size := len(buf)
+		if n > 0 {
+			size = min(size, n)
+		}
+		read, err := io.ReadFull(reader, buf[:size])
+		if n < 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			return nil
+		} else if err != nil {
+			return err
+		} else if n > 0 {
+			n -= read
+		}
+	}
+	return nil
+}
+
+// zeroRange zeroes a range of the device, without writing zeros if the device supports it.
+func zeroRange(dest io.WriterAt, offset int, length int) error {
+	var file *os.File
+	switch dest := dest.(type) {
+	case *os.File:
+		file = dest
+	case *directWriter:
+		file = dest.file
+	}
+	if file != nil && zeroFileRange(file, int64(offset), int64(length)) == nil {
+		return nil
+	}
+	zeros := alignedBuffer(min(length, DefaultBlockSize))
+	for length > 0 {
+		n, err := dest.WriteAt(zeros[:min(len(zeros), length)], int64(offset))
+		if err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// ValidateDeviceBmap checks if the ranges of the block device mapped in the bmap match their
+// checksums, see [ValidateBmap].
+func ValidateDeviceBmap(ctx context.Context, of string, bmap *Bmap, opts CopyOptions) error {
+	dest, err := openFile(of, os.O_RDONLY|os.O_EXCL, os.ModePerm, "destination")
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return ValidateBmap(ctx, dest, bmap, opts)
+}
+
+// ValidateBmap checks if the ranges read from dest mapped in the bmap match their checksums,
+// until every range is read or the context is cancelled, in which case a [*CancelledError] is
+// returned. Unless [CopyOptions.Sparse] is [SparseOff], the holes between the ranges are
+// validated to be zeroed as well, and progress is reported against the whole image.
+//
+// If anything doesn't match, a [*ValidationError] is returned, whose Offset is that of the first
+// range which differs (or the first byte, for holes), and MismatchedBlocks the number of blocks
+// in ranges which differ, along with the blocks in holes which aren't zeroed.
+func ValidateBmap(ctx context.Context, dest io.ReaderAt, bmap *Bmap, opts CopyOptions) error {
+	bs := opts.blockSize()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	startTime := time.Now()
+	size := bmap.MappedBytes()
+	if opts.Sparse != SparseOff {
+		size = bmap.ImageSize
+	}
+	progress := func(total int, done bool) Progress {
+		return Progress{Bytes: total, Total: size, Duration: time.Since(startTime), Done: done}
+	}
+	var total int
+	var mismatch *ValidationError
+	buf := make([]byte, bs)
+	for _, segment := range bmap.segments() {
+		if segment.index == -1 && opts.Sparse == SparseOff {
+			continue
+		}
+		var r BmapRange
+		var hash hash.Hash
+		if segment.index != -1 {
+			r = bmap.Ranges[segment.index]
+			if r.Checksum == nil {
+				return fmt.Errorf("%w! blocks %d-%d have no checksum to validate against", ErrInvalidBmap, r.First, r.Last)
+			}
+			hash = r.Checksum.newHash()
+		}
+		for offset := segment.start; offset < segment.end; {
+			if ctx.Err() != nil {
+				return &CancelledError{Bytes: total}
+			}
+			n, err := dest.ReadAt(buf[:min(bs, segment.end-offset)], int64(offset))
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("encountered error while validating device! %w", err)
+			} else if n < min(bs, segment.end-offset) { // The device ran out of data before the end of the image.
+				if mismatch == nil {
+					mismatch = &ValidationError{Offset: offset + n, BlockSize: bmap.BlockSize}
+				}
+				mismatch.Truncated = true
+				return mismatch
+			}
+			if hash != nil {
+				hash.Write(buf[:n])
+			} else if blocks, first := nonZeroBlocks(buf[:n], offset, bmap.BlockSize); blocks > 0 {
+				if mismatch == nil {
+					mismatch = &ValidationError{Offset: first, BlockSize: bmap.BlockSize}
+				}
+				mismatch.MismatchedBlocks += blocks
+			}
+			offset += n
+			total += n
+			select {
+			case <-ticker.C:
+				if opts.Progress != nil {
+					opts.Progress(progress(total, false))
+				}
+			default:
+			}
+		}
+		if hash != nil && !bytes.Equal(hash.Sum(nil), r.Checksum.Digest) {
+			if mismatch == nil {
+				mismatch = &ValidationError{Offset: segment.start, BlockSize: bmap.BlockSize}
+			}
+			mismatch.MismatchedBlocks += r.Last - r.First + 1
+		}
+	}
+	if mismatch != nil {
+		return mismatch
+	} else if opts.Progress != nil {
+		opts.Progress(progress(total, true))
+	}
+	return nil
+}
+
+// nonZeroBlocks returns the number of blocks in data read from the given offset which aren't
+// zeroed, along with the offset of the first byte which isn't zero.
+func nonZeroBlocks(data []byte, offset int, blockSize int) (int, int) {
+	blocks, first := 0, -1
+	for start := 0; start < len(data); {
+		end := min(len(data), start+blockSize-(offset+start)%blockSize)
+		for i, b := range data[start:end] {
+			if b != 0 {
+				if first == -1 {
+					first = offset + start + i
+				}
+				blocks++
+				break
+			}
+		}
+		start = end
+	}
+	return blocks, first
+}
@@ -0,0 +1,314 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// GenerateBmap generates a version 2.0 bmap file for a disk image, like bmaptool, mapping the
+// given ranges of 4 KiB blocks.
+func GenerateBmap(t *testing.T, image []byte, ranges [][2]int) []byte {
+	t.Helper()
+	var blockMap strings.Builder
+	mapped := 0
+	for _, r := range ranges {
+		sum := sha256.Sum256(image[r[0]*4096 : min((r[1]+1)*4096, len(image))])
+		fmt.Fprintf(&blockMap, "        <Range chksum=\"%x\"> %d-%d </Range>\n", sum, r[0], r[1])
+		mapped += r[1] - r[0] + 1
+	}
+	zeroes := strings.Repeat("0", 64)
+	bmap := "<?xml version=\"1.0\" ?>\n<bmap version=\"2.0\">\n" +
+		fmt.Sprintf("    <ImageSize> %d </ImageSize>\n", len(image)) +
+		"    <BlockSize> 4096 </BlockSize>\n" +
+		fmt.Sprintf("    <BlocksCount> %d </BlocksCount>\n", (len(image)+4095)/4096) +
+		fmt.Sprintf("    <MappedBlocksCount> %d </MappedBlocksCount>\n", mapped) +
+		"    <ChecksumType> sha256 </ChecksumType>\n" +
+		"    <BmapFileChecksum> " + zeroes + " </BmapFileChecksum>\n" +
+		"    <BlockMap>\n" + blockMap.String() + "    </BlockMap>\n</bmap>\n"
+	sum := sha256.Sum256([]byte(bmap))
+	return []byte(strings.Replace(bmap, zeroes, hex.EncodeToString(sum[:]), 1))
+}
+
+// generateSparseImage generates a disk image of 16 blocks, with data only in the given ranges.
+func generateSparseImage(t *testing.T, ranges [][2]int) []byte {
+	t.Helper()
+	image := make([]byte, 16*4096-100) // The last block is partial.
+	for _, r := range ranges {
+		if _, err := rand.Read(image[r[0]*4096 : min((r[1]+1)*4096, len(image))]); err != nil {
+			t.Fatalf("Failed to read random data: %v", err)
+		}
+	}
+	return image
+}
+
+func TestReadBmap(t *testing.T) {
+	t.Parallel()
+	ranges := [][2]int{{0, 1}, {4, 4}, {10, 15}}
+	image := generateSparseImage(t, ranges)
+	path := filepath.Join(t.TempDir(), "image.wic.bmap")
+	if err := os.WriteFile(path, GenerateBmap(t, image, ranges), 0644); err != nil {
+		t.Fatalf("Failed to write bmap: %v", err)
+	}
+	bmap, err := ReadBmap(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	} else if bmap.ImageSize != len(image) || bmap.BlockSize != 4096 || len(bmap.Ranges) != 3 {
+		t.Fatalf("Expected 3 ranges of 4096 byte blocks, got %+v", bmap)
+	} else if r := bmap.Ranges[1]; r.First != 4 || r.Last != 4 || r.Checksum.Algorithm != "sha256" {
+		t.Errorf("Expected range 4-4 with sha256 checksum, got %+v", r)
+	} else if mapped := bmap.MappedBytes(); mapped != 9*4096-100 {
+		t.Errorf("Expected %d mapped bytes, got %d", 9*4096-100, mapped)
+	}
+
+	sum := sha1.Sum(image[:4096])
+	testCases := []struct {
+		name          string
+		bmap          string
+		expectedError bool
+	}{
+		{"version 1 with sha1 checksums", `<bmap version="1.3"><ImageSize>8192</ImageSize>` +
+			`<BlockSize>4096</BlockSize><BlocksCount>2</BlocksCount><BlockMap>` +
+			`<Range sha1="` + hex.EncodeToString(sum[:]) + `">0</Range></BlockMap></bmap>`, false},
+		{"version 1 without checksums", `<bmap version="1.0"><ImageSize>8192</ImageSize>` +
+			`<BlockSize>4096</BlockSize><BlocksCount>2</BlocksCount><BlockMap>` +
+			`<Range>0-1</Range></BlockMap></bmap>`, false},
+		{"tampered bmap file", strings.Replace(string(GenerateBmap(t, image, ranges)), "4-4", "5-5", 1), true},
+		{"overlapping ranges", `<bmap version="1.0"><ImageSize>16384</ImageSize>` +
+			`<BlockSize>4096</BlockSize><BlocksCount>4</BlocksCount><BlockMap>` +
+			`<Range>0-2</Range><Range>2-3</Range></BlockMap></bmap>`, true},
+		{"range past the end of the image", `<bmap version="1.0"><ImageSize>8192</ImageSize>` +
+			`<BlockSize>4096</BlockSize><BlocksCount>2</BlocksCount><BlockMap>` +
+			`<Range>1-2</Range></BlockMap></bmap>`, true},
+		{"invalid XML", "<bmap", true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := parseBmap([]byte(testCase.bmap))
+			if testCase.expectedError && !errors.Is(err, ErrInvalidBmap) {
+				t.Errorf("Expected ErrInvalidBmap, got: %v", err)
+			} else if !testCase.expectedError && err != nil {
+				t.Errorf("Expected no error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestFindBmapFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	image := filepath.Join(dir, "core-image.wic.xz")
+	if path := FindBmapFile(image); path != "" {
+		t.Errorf("Expected no bmap file, got %s", path)
+	}
+	os.WriteFile(filepath.Join(dir, "core-image.wic.bmap"), nil, 0644)
+	if path := FindBmapFile(image); path != filepath.Join(dir, "core-image.wic.bmap") {
+		t.Errorf("Expected core-image.wic.bmap, got %s", path)
+	}
+	os.WriteFile(image+".bmap", nil, 0644)
+	if path := FindBmapFile(image); path != image+".bmap" {
+		t.Errorf("Expected core-image.wic.xz.bmap to be preferred, got %s", path)
+	}
+}
+
+func TestWriteAndValidateBmapImage(t *testing.T) {
+	t.Parallel()
+	ranges := [][2]int{{0, 1}, {4, 4}, {10, 15}}
+	image := generateSparseImage(t, ranges)
+	parse := func(t *testing.T) *Bmap {
+		bmap, err := parseBmap(GenerateBmap(t, image, ranges))
+		if err != nil {
+			t.Fatalf("Failed to parse bmap: %v", err)
+		}
+		return bmap
+	}
+	// The device contains garbage, which is left as-is outside the mapped ranges.
+	garbage := bytes.Repeat([]byte{0xff}, len(image))
+	expected := bytes.Clone(garbage)
+	for _, r := range ranges {
+		start, end := r[0]*4096, min((r[1]+1)*4096, len(image))
+		copy(expected[start:end], image[start:end])
+	}
+
+	t.Run("mapped ranges are written and validated", func(t *testing.T) {
+		t.Parallel()
+		bmap := parse(t)
+		dest, _ := GenerateTempFile(t, "dest", false)
+		dest.Write(garbage)
+		var last Progress
+		opts := CopyOptions{BlockSize: 4096, Progress: func(p Progress) { last = p }}
+		if err := WriteBmapImage(context.Background(), bytes.NewReader(image), dest, bmap, opts); err != nil {
+			t.Fatalf("WriteBmapImage failed: %v", err)
+		} else if written, _ := os.ReadFile(dest.Name()); !bytes.Equal(written, expected) {
+			t.Errorf("Expected only the mapped ranges to be written")
+		} else if !last.Done || last.Bytes != bmap.MappedBytes() || last.Total != bmap.MappedBytes() {
+			t.Errorf("Expected final progress of %d mapped bytes, got %+v", bmap.MappedBytes(), last)
+		}
+		if err := ValidateBmap(context.Background(), dest, bmap, opts); err != nil {
+			t.Errorf("ValidateBmap failed: %v", err)
+		}
+	})
+
+	t.Run("corrupt ranges on the device fail validation", func(t *testing.T) {
+		t.Parallel()
+		corrupted := bytes.Clone(expected)
+		corrupted[4*4096+10]++
+		corrupted[11*4096]++
+		var errValidation *ValidationError
+		err := ValidateBmap(context.Background(), bytes.NewReader(corrupted), parse(t), CopyOptions{})
+		if !errors.As(err, &errValidation) {
+			t.Errorf("Expected ValidationError, got: %v", err)
+		} else if errValidation.Offset != 4*4096 || errValidation.MismatchedBlocks != 7 {
+			t.Errorf("Expected mismatch at block 4 in 7 blocks, got %+v", errValidation)
+		}
+	})
+
+	t.Run("corrupt ranges in the image fail writing", func(t *testing.T) {
+		t.Parallel()
+		corrupted := bytes.Clone(image)
+		corrupted[4*4096+10]++
+		dest, _ := GenerateTempFile(t, "dest", false)
+		err := WriteBmapImage(context.Background(), bytes.NewReader(corrupted), dest, parse(t), CopyOptions{})
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
+		}
+	})
+
+	t.Run("ranges without checksums are filled in while writing", func(t *testing.T) {
+		t.Parallel()
+		bmap := parse(t)
+		for i := range bmap.Ranges {
+			bmap.Ranges[i].Checksum = nil
+		}
+		dest, _ := GenerateTempFile(t, "dest", false)
+		if err := WriteBmapImage(context.Background(), bytes.NewReader(image), dest, bmap, CopyOptions{}); err != nil {
+			t.Fatalf("WriteBmapImage failed: %v", err)
+		} else if err := ValidateBmap(context.Background(), dest, bmap, CopyOptions{}); err != nil {
+			t.Errorf("ValidateBmap failed: %v", err)
+		}
+	})
+
+	t.Run("the whole image is verified against its checksum", func(t *testing.T) {
+		t.Parallel()
+		sum := sha256.Sum256(image)
+		sum[0]++
+		dest, _ := GenerateTempFile(t, "dest", false)
+		err := WriteBmapImage(context.Background(), bytes.NewReader(image), dest, parse(t),
+			CopyOptions{Checksum: &Checksum{Algorithm: "sha256", Digest: sum[:]}})
+		if !errors.Is(err, ErrChecksumMismatch) {
+			t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
+		}
+	})
+}
+
+func TestParseSparseMode(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []SparseMode{SparseOff, SparseSkip, SparseZero, SparseDiscard} {
+		if parsed, err := ParseSparseMode(mode.String()); err != nil || parsed != mode {
+			t.Errorf("Expected %s to parse to itself, got %s and error %v", mode, parsed, err)
+		}
+	}
+	if _, err := ParseSparseMode("sometimes"); err == nil {
+		t.Errorf("Expected error for invalid sparse mode")
+	}
+}
+
+func TestSparseBmap(t *testing.T) {
+	t.Parallel()
+	ranges := [][2]int{{0, 1}, {4, 4}, {10, 15}}
+	image := generateSparseImage(t, ranges)
+	// Only the ranges with data are written, so the rest are holes where the filesystem supports it.
+	file, _ := GenerateTempFile(t, "image.img", false)
+	if err := file.Truncate(int64(len(image))); err != nil {
+		t.Fatalf("Failed to truncate image: %v", err)
+	}
+	for _, r := range ranges {
+		start, end := r[0]*4096, min((r[1]+1)*4096, len(image))
+		if _, err := file.WriteAt(image[start:end], int64(start)); err != nil {
+			t.Fatalf("Failed to write image: %v", err)
+		}
+	}
+	bmap, err := SparseBmap(file.Name())
+	if err != nil {
+		t.Fatalf("SparseBmap failed: %v", err)
+	} else if bmap.ImageSize != len(image) || bmap.MappedBytes() == 0 {
+		t.Fatalf("Expected bmap of the whole image with mapped blocks, got %+v", bmap)
+	}
+	// Filesystems may allocate more than was written, but the data must be mapped either way.
+	for _, r := range ranges {
+		covered := false
+		for _, mapped := range bmap.Ranges {
+			covered = covered || (mapped.First <= r[0] && mapped.Last >= r[1])
+		}
+		if !covered {
+			t.Errorf("Expected blocks %d-%d to be mapped, got %+v", r[0], r[1], bmap.Ranges)
+		}
+	}
+
+	compressed, _, _ := GenerateCompressedFile(t, CompressionXz)
+	if _, err := SparseBmap(compressed); err == nil {
+		t.Errorf("Expected error for compressed image")
+	}
+}
+
+func TestWriteAndValidateSparseImage(t *testing.T) {
+	t.Parallel()
+	ranges := [][2]int{{0, 1}, {4, 4}, {10, 15}}
+	image := generateSparseImage(t, ranges)
+	parse := func(t *testing.T) *Bmap {
+		bmap, err := parseBmap(GenerateBmap(t, image, ranges))
+		if err != nil {
+			t.Fatalf("Failed to parse bmap: %v", err)
+		}
+		return bmap
+	}
+	garbage := bytes.Repeat([]byte{0xff}, len(image))
+
+	t.Run("holes are zeroed", func(t *testing.T) {
+		t.Parallel()
+		bmap := parse(t)
+		dest, _ := GenerateTempFile(t, "dest", false)
+		dest.Write(garbage)
+		var last Progress
+		opts := CopyOptions{BlockSize: 4096, Sparse: SparseZero, Progress: func(p Progress) { last = p }}
+		if err := WriteBmapImage(context.Background(), bytes.NewReader(image), dest, bmap, opts); err != nil {
+			t.Fatalf("WriteBmapImage failed: %v", err)
+		} else if written, _ := os.ReadFile(dest.Name()); !bytes.Equal(written, image) {
+			t.Errorf("Expected the holes to be zeroed")
+		}
+		if err := ValidateBmap(context.Background(), dest, bmap, opts); err != nil {
+			t.Errorf("ValidateBmap failed: %v", err)
+		} else if !last.Done || last.Total != len(image) {
+			t.Errorf("Expected validation progress against the whole image, got %+v", last)
+		}
+	})
+
+	t.Run("holes which aren't zeroed fail validation", func(t *testing.T) {
+		t.Parallel()
+		written := bytes.Clone(image)
+		written[2*4096+100] = 1
+		written[3*4096] = 1
+		written[8*4096+5] = 1
+		var errValidation *ValidationError
+		err := ValidateBmap(context.Background(), bytes.NewReader(written), parse(t), CopyOptions{Sparse: SparseSkip})
+		if !errors.As(err, &errValidation) {
+			t.Errorf("Expected ValidationError, got: %v", err)
+		} else if errValidation.Offset != 2*4096+100 || errValidation.MismatchedBlocks != 3 {
+			t.Errorf("Expected mismatch at byte %d in 3 blocks, got %+v", 2*4096+100, errValidation)
+		}
+		if err := ValidateBmap(context.Background(), bytes.NewReader(written), parse(t), CopyOptions{}); err != nil {
+			t.Errorf("Expected holes to be ignored without sparse mode, got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,239 @@
+package imaging
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidChecksum is returned when a checksum can't be parsed.
+var ErrInvalidChecksum = errors.New("invalid checksum")
+
+// ErrChecksumMismatch is returned (as a [*ChecksumMismatchError]) when the disk image does not
+// match the expected checksum.
+var ErrChecksumMismatch = errors.New("the disk image does not match the expected checksum")
+
+// ChecksumMismatchError is returned when the disk image does not match the expected checksum. It
+// matches [ErrChecksumMismatch] with [errors.Is].
+type ChecksumMismatchError struct {
+	Expected *Checksum
+	Actual   *Checksum
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("the disk image does not match the expected checksum! expected %s, got %s",
+		e.Expected, e.Actual)
+}
+
+func (e *ChecksumMismatchError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// ChecksumNotFoundError is returned when a checksum file doesn't list the disk image.
+type ChecksumNotFoundError struct{ Name string }
+
+func (e *ChecksumNotFoundError) Error() string {
+	return fmt.Sprintf("the checksum file does not contain a checksum for %s!", e.Name)
+}
+
+// checksumAlgorithms maps the supported checksum algorithms to their digest sizes in bytes.
+var checksumAlgorithms = map[string]int{"md5": md5.Size, "sha1": sha1.Size, "sha256": sha256.Size, "sha512": sha512.Size}
+
+// Checksum is the expected digest of a disk image file, e.g. from a SHA256SUMS file.
+type Checksum struct {
+	// Algorithm is one of md5, sha1, sha256 or sha512.
+	Algorithm string
+	Digest    []byte
+}
+
+// String formats the checksum as <algorithm>:<hex>, as accepted by [ParseChecksum].
+func (c *Checksum) String() string {
+	return c.Algorithm + ":" + hex.EncodeToString(c.Digest)
+}
+
+func (c *Checksum) newHash() hash.Hash {
+	switch c.Algorithm {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// ParseChecksum parses a checksum in the form <algorithm>:<hex>, e.g. sha256:e3b0c442... If the
+// algorithm is omitted, it is inferred from the length of the digest.
+func ParseChecksum(checksum string) (*Checksum, error) {
+	algorithm, digest, ok := strings.Cut(strings.TrimSpace(checksum), ":")
+	if !ok {
+		algorithm, digest = "", algorithm
+	}
+	algorithm = strings.ToLower(strings.ReplaceAll(algorithm, "-", ""))
+	decoded, err := hex.DecodeString(digest)
+	if err != nil || len(decoded) == 0 {
+		return nil, fmt.Errorf("%w %s, expected <algorithm>:<hex digest>", ErrInvalidChecksum, checksum)
+	} else if algorithm == "" {
+		for name, size := range checksumAlgorithms {
+			if size == len(decoded) {
+				algorithm = name
+			}
+		}
+	}
+	if size, ok := checksumAlgorithms[algorithm]; !ok {
+		return nil, fmt.Errorf("%w %s, supported algorithms are md5, sha1, sha256 and sha512",
+			ErrInvalidChecksum, checksum)
+	} else if size != len(decoded) {
+		return nil, fmt.Errorf("%w %s, %s digests are %d bytes long", ErrInvalidChecksum, checksum, algorithm, size)
+	}
+	return &Checksum{Algorithm: algorithm, Digest: decoded}, nil
+}
+
+// ReadChecksumFile reads the checksum of a disk image from a checksum file, like SHA256SUMS.
+// Both the GNU format (<hex>  <name>) and the BSD format (SHA256 (<name>) = <hex>) are supported,
+// including PGP clearsigned files. Files with a lone digest (e.g. <image>.sha256) are accepted too.
+func ReadChecksumFile(checksumFile string, image string) (*Checksum, error) {
+	file, err := os.ReadFile(checksumFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseChecksumFile(file, filepath.Base(image))
+}
+
+func parseChecksumFile(file []byte, name string) (*Checksum, error) {
+	var lone *Checksum
+	entries := 0
+	inSignature := false
+	for _, line := range strings.Split(string(bytes.ReplaceAll(file, []byte("\r\n"), []byte("\n"))), "\n") {
+		line = strings.TrimSpace(strings.TrimPrefix(line, "- ")) // Dash-escaping in clearsigned files.
+		if line == "-----BEGIN PGP SIGNATURE-----" {
+			inSignature = true
+		} else if line == "-----END PGP SIGNATURE-----" {
+			inSignature = false
+		}
+		if inSignature || line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-----") {
+			continue
+		}
+		var algorithm, entry, digest string
+		if before, after, ok := strings.Cut(line, " ("); ok && strings.Contains(after, ") = ") {
+			// BSD format: SHA256 (Fedora-Workstation-Live-42-1.1.x86_64.iso) = <hex>
+			separator := strings.LastIndex(after, ") = ")
+			algorithm, entry, digest = before, after[:separator], after[separator+4:]
+		} else if fields := strings.SplitN(line, " ", 2); len(fields) == 2 {
+			// GNU format: <hex>  ubuntu-24.04.3-desktop-amd64.iso, or <hex> *<name> in binary mode.
+			digest, entry = fields[0], strings.TrimPrefix(strings.TrimLeft(fields[1], " "), "*")
+		} else {
+			digest = line
+		}
+		if algorithm != "" {
+			digest = algorithm + ":" + digest
+		}
+		checksum, err := ParseChecksum(digest)
+		if err != nil {
+			continue // e.g. "Hash: SHA256" in the header of clearsigned files.
+		}
+		entries++
+		if entry == "" {
+			lone = checksum
+		} else if entry == name || path.Base(filepath.ToSlash(entry)) == name {
+			return checksum, nil
+		}
+	}
+	if lone != nil && entries == 1 {
+		return lone, nil
+	}
+	return nil, &ChecksumNotFoundError{Name: name}
+}
+
+// FindChecksumFile looks for a checksum file listing the disk image next to it, e.g.
+// <image>.sha256 or SHA256SUMS, and returns its path along with the checksum of the image. If
+// there is none, the returned path is empty.
+func FindChecksumFile(image string) (string, *Checksum) {
+	candidates := []string{}
+	for _, algorithm := range []string{"sha256", "sha512", "sha1", "md5"} {
+		candidates = append(candidates, image+"."+algorithm, image+"."+algorithm+"sum")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(image))
+	for _, entry := range entries {
+		name := strings.ToUpper(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+		if !entry.IsDir() && (strings.HasSuffix(name, "SUMS") || strings.HasSuffix(name, "CHECKSUM")) {
+			candidates = append(candidates, filepath.Join(filepath.Dir(image), entry.Name()))
+		}
+	}
+	for _, candidate := range candidates {
+		if checksum, err := ReadChecksumFile(candidate, image); err == nil {
+			return candidate, checksum
+		}
+	}
+	return "", nil
+}
+
+// startChecksum starts hashing the disk image read from src, returning the reader to read it from
+// instead, and a function to compare the hash against the checksum once src is exhausted. If src
+// is a [*SourceImage], the image file is hashed as-is, i.e. before decompression.
+func startChecksum(src io.Reader, checksum *Checksum) (io.Reader, func() error) {
+	if checksum == nil {
+		return src, func() error { return nil }
+	}
+	hash := checksum.newHash()
+	compare := func(sum []byte, err error) error {
+		if err != nil {
+			return fmt.Errorf("encountered error while reading file! %w", err)
+		} else if !bytes.Equal(sum, checksum.Digest) {
+			return &ChecksumMismatchError{Expected: checksum, Actual: &Checksum{Algorithm: checksum.Algorithm, Digest: sum}}
+		}
+		return nil
+	}
+	if image, ok := src.(*SourceImage); ok {
+		image.startHashing(hash)
+		return src, func() error { return compare(image.sum()) }
+	}
+	return io.TeeReader(src, hash), func() error { return compare(hash.Sum(nil), nil) }
+}
+
+// fileHasher hashes a file in order as it is read, reading any parts which were skipped (or read
+// before hashing started) directly from the file. Parts which are read again are ignored.
+type fileHasher struct {
+	file   io.ReaderAt
+	hash   hash.Hash
+	offset int64
+	err    error
+}
+
+// update hashes data which was read from the file at the given offset.
+func (h *fileHasher) update(p []byte, off int64) {
+	if h == nil {
+		return
+	} else if off > h.offset {
+		h.fill(off)
+	}
+	if end := off + int64(len(p)); h.err == nil && end > h.offset {
+		h.hash.Write(p[h.offset-off:])
+		h.offset = end
+	}
+}
+
+// fill hashes the file up to the given offset, reading it from the file.
+func (h *fileHasher) fill(end int64) {
+	if h.err != nil || end <= h.offset {
+		return
+	}
+	n, err := io.Copy(h.hash, io.NewSectionReader(h.file, h.offset, end-h.offset))
+	h.offset += n
+	if err == nil && h.offset != end {
+		err = io.ErrUnexpectedEOF
+	}
+	h.err = err
+}
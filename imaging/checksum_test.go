@@ -0,0 +1,244 @@
+package imaging
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	t.Parallel()
+	sha256Hex := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	testCases := []struct {
+		name              string
+		checksum          string
+		expectedAlgorithm string
+		expectedError     error
+	}{
+		{"with algorithm", "sha256:" + sha256Hex, "sha256", nil},
+		{"uppercase algorithm", "SHA-256:" + sha256Hex, "sha256", nil},
+		{"inferred algorithm", sha256Hex, "sha256", nil},
+		{"inferred md5", "d41d8cd98f00b204e9800998ecf8427e", "md5", nil},
+		{"invalid hex", "sha256:xyz", "", ErrInvalidChecksum},
+		{"empty digest", "sha256:", "", ErrInvalidChecksum},
+		{"unsupported algorithm", "crc32:00000000", "", ErrInvalidChecksum},
+		{"wrong length", "sha512:" + sha256Hex, "", ErrInvalidChecksum},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			checksum, err := ParseChecksum(testCase.checksum)
+			if !errors.Is(err, testCase.expectedError) {
+				t.Fatalf("expected error %v, got %v", testCase.expectedError, err)
+			} else if err == nil && checksum.Algorithm != testCase.expectedAlgorithm {
+				t.Errorf("expected algorithm %s, got %s", testCase.expectedAlgorithm, checksum.Algorithm)
+			} else if err == nil && !strings.HasSuffix(testCase.checksum, hex.EncodeToString(checksum.Digest)) {
+				t.Errorf("expected digest from %s, got %x", testCase.checksum, checksum.Digest)
+			}
+		})
+	}
+}
+
+func TestReadChecksumFile(t *testing.T) {
+	t.Parallel()
+	ubuntu := "c74833a55e525b1e99e1541509c566bb3e32bdb53bf27ea3347174364a57f47c"
+	fedora := "2ad67c8e3ae6bb6b2ee6fca2e2a35a3ee5bc3e5a3c5e3aa5ba6ed8e3b0c44298"
+	testCases := []struct {
+		name          string
+		file          string
+		image         string
+		expected      string
+		expectedError bool
+	}{
+		{"GNU format", "" +
+			"a435f6f393dda581172490eda9f683c32e495158a780b5a1de422ee77d98e909 *ubuntu-24.04.3-live-server-amd64.iso\n" +
+			ubuntu + " *ubuntu-24.04.3-desktop-amd64.iso\n",
+			"/home/user/Downloads/ubuntu-24.04.3-desktop-amd64.iso", "sha256:" + ubuntu, false},
+		{"BSD format with clearsigned PGP", "" +
+			"-----BEGIN PGP SIGNED MESSAGE-----\n" +
+			"Hash: SHA256\n" +
+			"\n" +
+			"# Fedora-Workstation-Live-42-1.1.x86_64.iso: 2398625792 bytes\n" +
+			"SHA256 (Fedora-Workstation-Live-42-1.1.x86_64.iso) = " + fedora + "\n" +
+			"-----BEGIN PGP SIGNATURE-----\n" +
+			"\n" +
+			"iQIzBAEBCAAdFiEE\n" +
+			"-----END PGP SIGNATURE-----\n",
+			"Fedora-Workstation-Live-42-1.1.x86_64.iso", "sha256:" + fedora, false},
+		{"lone digest", ubuntu + "\n", "image.iso", "sha256:" + ubuntu, false},
+		{"CRLF line endings", ubuntu + "  ./image.iso\r\n", "image.iso", "sha256:" + ubuntu, false},
+		{"missing entry", ubuntu + "  other.iso\n", "image.iso", "", true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "SHA256SUMS")
+			if err := os.WriteFile(path, []byte(testCase.file), 0644); err != nil {
+				t.Fatalf("Failed to write checksum file: %v", err)
+			}
+			checksum, err := ReadChecksumFile(path, testCase.image)
+			var errNotFound *ChecksumNotFoundError
+			if testCase.expectedError && !errors.As(err, &errNotFound) {
+				t.Errorf("expected ChecksumNotFoundError, got %v", err)
+			} else if !testCase.expectedError && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if !testCase.expectedError && checksum.String() != testCase.expected {
+				t.Errorf("expected %s, got %s", testCase.expected, checksum)
+			}
+		})
+	}
+}
+
+func TestFindChecksumFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	image := filepath.Join(dir, "image.iso")
+	digest := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if path, checksum := FindChecksumFile(image); path != "" || checksum != nil {
+		t.Errorf("expected no checksum file, got %s", path)
+	}
+	os.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(digest+"  other.iso\n"), 0644)
+	if path, _ := FindChecksumFile(image); path != "" {
+		t.Errorf("expected SHA256SUMS without the image to be ignored, got %s", path)
+	}
+	os.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(digest+"  image.iso\n"), 0644)
+	if path, checksum := FindChecksumFile(image); path != filepath.Join(dir, "SHA256SUMS") {
+		t.Errorf("expected SHA256SUMS, got %s", path)
+	} else if checksum.String() != "sha256:"+digest {
+		t.Errorf("expected sha256:%s, got %s", digest, checksum)
+	}
+	os.WriteFile(image+".sha256", []byte(digest+"\n"), 0644)
+	if path, _ := FindChecksumFile(image); path != image+".sha256" {
+		t.Errorf("expected image.iso.sha256 to be preferred, got %s", path)
+	}
+}
+
+func TestWriteAndValidateImageWithChecksum(t *testing.T) {
+	t.Parallel()
+	checksumOf := func(t *testing.T, path string) *Checksum {
+		t.Helper()
+		file, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read image: %v", err)
+		}
+		sum := sha256.Sum256(file)
+		return &Checksum{Algorithm: "sha256", Digest: sum[:]}
+	}
+	compressed, data, _ := GenerateCompressedFile(t, CompressionXz)
+	uncompressed := filepath.Join(t.TempDir(), "image.iso")
+	if err := os.WriteFile(uncompressed, data, 0644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+	testCases := []struct {
+		name  string
+		path  string
+		entry string
+	}{
+		{"uncompressed image", uncompressed, ""},
+		{"xz compressed image", compressed, ""},
+		{"image in zip archive", GenerateZipFile(t, map[string][]byte{
+			"readme.txt": []byte("Flash the image with Imprint."), "image.img": data,
+		}, zip.Deflate), "image.img"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			checksum := checksumOf(t, testCase.path)
+			for _, corrupt := range []bool{false, true} {
+				expected := checksum
+				if corrupt {
+					expected = &Checksum{Algorithm: "sha256", Digest: bytes.Clone(checksum.Digest)}
+					expected.Digest[0]++
+				}
+				src, err := OpenSourceImage(testCase.path, testCase.entry)
+				if err != nil {
+					t.Fatalf("Failed to open image: %v", err)
+				}
+				var dest bytes.Buffer
+				err = WriteImage(context.Background(), src, &dest, CopyOptions{Checksum: expected})
+				src.Close()
+				var errMismatch *ChecksumMismatchError
+				if corrupt && (!errors.As(err, &errMismatch) || errMismatch.Actual.String() != checksum.String()) {
+					t.Errorf("expected ChecksumMismatchError with actual %s, got %v", checksum, err)
+				} else if !corrupt && err != nil {
+					t.Errorf("expected no error, got %v", err)
+				} else if !bytes.Equal(dest.Bytes(), data) {
+					t.Errorf("written data does not match image")
+				}
+
+				src, err = OpenSourceImage(testCase.path, testCase.entry)
+				if err != nil {
+					t.Fatalf("Failed to open image: %v", err)
+				}
+				err = ValidateImage(context.Background(), src, bytes.NewReader(data), CopyOptions{Checksum: expected})
+				src.Close()
+				if corrupt != errors.Is(err, ErrChecksumMismatch) {
+					t.Errorf("expected checksum mismatch to be %v, got %v", corrupt, err)
+				}
+			}
+		})
+	}
+
+	t.Run("plain readers are hashed as read", func(t *testing.T) {
+		t.Parallel()
+		sum := sha256.Sum256(data)
+		err := WriteImage(context.Background(), bytes.NewReader(data), &bytes.Buffer{},
+			CopyOptions{Checksum: &Checksum{Algorithm: "sha256", Digest: sum[:]}})
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+}
+
+func TestValidateChecksum(t *testing.T) {
+	t.Parallel()
+	image := []byte("disk image contents")
+	device := append(bytes.Clone(image), make([]byte, 64)...) // Devices are larger than the image.
+	sum := sha256.Sum256(image)
+	checksum := &Checksum{Algorithm: "sha256", Digest: sum[:]}
+	testCases := []struct {
+		name          string
+		device        []byte
+		size          int
+		expectedError error
+	}{
+		{"matching device", device, len(image), nil},
+		{"corrupt device", append([]byte("D"), device[1:]...), len(image), ErrDeviceValidationFailed},
+		{"wrong size", device, len(image) + 1, ErrDeviceValidationFailed},
+		{"device smaller than size", image[:4], len(image), ErrDeviceValidationFailed},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			var last Progress
+			err := ValidateChecksum(context.Background(), bytes.NewReader(testCase.device), testCase.size,
+				checksum, CopyOptions{BlockSize: 4, Progress: func(p Progress) { last = p }})
+			if !errors.Is(err, testCase.expectedError) {
+				t.Errorf("expected error %v, got %v", testCase.expectedError, err)
+			} else if err == nil && (!last.Done || last.Bytes != len(image) || last.Total != len(image)) {
+				t.Errorf("expected final progress of %d bytes, got %+v", len(image), last)
+			}
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := ValidateChecksum(ctx, bytes.NewReader(device), len(image), checksum, CopyOptions{})
+		if !errors.Is(err, ErrCancelled) {
+			t.Errorf("expected ErrCancelled, got %v", err)
+		}
+	})
+}
@@ -4,3 +4,63 @@ import "errors"
 
 // ErrNotBlockDevice is returned when the specified device is not a block device.
 var ErrNotBlockDevice = errors.New("specified device is not a block device")
+
+// ErrDeviceReadOnly is returned when the specified device is read-only or write-protected, e.g.
+// an SD card with its lock switch on.
+var ErrDeviceReadOnly = errors.New("specified device is read-only or write-protected")
+
+// Reasons a device may be excluded from the list of devices available to flash to.
+const (
+	ExcludedNotDisk      = "not a disk"
+	ExcludedSystemDevice = "contains system partitions"
+	ExcludedNotRemovable = "not removable"
+	ExcludedInternal     = "internal device"
+	ExcludedVirtual      = "virtual device"
+)
+
+// Device is a struct representing a block device.
+type Device struct {
+	Name      string `json:"name"`
+	Model     string `json:"model"`
+	Size      string `json:"size"`
+	Bytes     int    `json:"bytes"`
+	Removable bool   `json:"removable"`
+	ReadOnly  bool   `json:"readOnly"`
+	Vendor    string `json:"vendor,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	// Transport is the bus the device is connected through, e.g. usb, mmc, nvme or sata.
+	Transport string `json:"transport,omitempty"`
+	// LogicalSectorSize and PhysicalSectorSize are in bytes, or 0 if unknown.
+	LogicalSectorSize  int `json:"logicalSectorSize,omitempty"`
+	PhysicalSectorSize int `json:"physicalSectorSize,omitempty"`
+	// ByIDPath is a path to the device which stays the same across reboots, e.g. under
+	// /dev/disk/by-id on Linux, if there is one.
+	ByIDPath   string      `json:"byIdPath,omitempty"`
+	Partitions []Partition `json:"partitions,omitempty"`
+	// ExcludedReason is why the device can't be flashed to, or empty if it is eligible.
+	ExcludedReason string `json:"excludedReason,omitempty"`
+}
+
+// Partition is a partition on a [Device].
+type Partition struct {
+	Name        string   `json:"name"`
+	Label       string   `json:"label,omitempty"`
+	FSType      string   `json:"fsType,omitempty"`
+	Bytes       int      `json:"bytes"`
+	Mountpoints []string `json:"mountpoints,omitempty"`
+}
+
+// GetDevices returns the list of USB devices available to read/write from.
+func GetDevices(platform Platform) ([]Device, error) {
+	devices, err := GetAllDevices(platform)
+	if err != nil {
+		return nil, err
+	}
+	eligible := []Device{}
+	for _, device := range devices {
+		if device.ExcludedReason == "" {
+			eligible = append(eligible, device)
+		}
+	}
+	return eligible, nil
+}
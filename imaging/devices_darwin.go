@@ -2,20 +2,14 @@ package imaging
 
 import (
 	"io/fs"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
-// Device is a struct representing a block device.
-type Device struct {
-	Name  string
-	Model string
-	Size  string
-	Bytes int
-}
-
-// GetDevices returns the list of USB devices available to read/write from.
-func GetDevices(platform Platform) ([]Device, error) {
+// GetAllDevices returns the list of all disks, including those excluded from [GetDevices], along
+// with the reason they were excluded.
+func GetAllDevices(platform Platform) ([]Device, error) {
 	res, err := platform.ExecCommandOutput(platform.ExecCommand("diskutil", "info", "-all"))
 	if err != nil {
 		return nil, err
@@ -24,33 +18,53 @@ func GetDevices(platform Platform) ([]Device, error) {
 	availableDisks := strings.Split(string(res), "\n**********\n")
 	availableDisks = availableDisks[:len(availableDisks)-1]
 
-	disks := []Device{}
-
+	parsedDisks := []map[string]string{}
 	for _, availableDisk := range availableDisks {
-		disk := make(map[string]string)
-		lines := strings.Split(availableDisk, "\n")
-		for _, rawLine := range lines {
-			line := strings.SplitN(strings.TrimSpace(rawLine), ":", 2)
-			if len(line) == 2 {
-				disk[strings.TrimSpace(line[0])] = strings.TrimSpace(line[1])
-			} else {
-				disk[strings.TrimSpace(line[0])] = ""
-			}
-		}
-		if disk["Virtual"] != "No" {
-			continue
-		} else if disk["Whole"] != "Yes" {
+		parsedDisks = append(parsedDisks, parseDiskutilInfo(availableDisk))
+	}
+
+	// Partitions are listed separately, and refer to their disk through "Part of Whole".
+	partitions := map[string][]Partition{}
+	for _, disk := range parsedDisks {
+		if disk["Whole"] == "Yes" {
 			continue
-		} else if disk["Device Location"] == "Internal" {
+		}
+		partition := Partition{
+			Name:   disk["Device Node"],
+			FSType: disk["Type (Bundle)"],
+			Bytes:  diskutilBytes(disk["Disk Size"]),
+		}
+		if !strings.HasPrefix(disk["Volume Name"], "Not applicable") {
+			partition.Label = disk["Volume Name"]
+		}
+		if disk["Mount Point"] != "" {
+			partition.Mountpoints = []string{disk["Mount Point"]}
+		}
+		partitions[disk["Part of Whole"]] = append(partitions[disk["Part of Whole"]], partition)
+	}
+
+	disks := []Device{}
+	for _, disk := range parsedDisks {
+		if disk["Whole"] != "Yes" {
 			continue
 		}
 		splitDiskSize := strings.Split(disk["Disk Size"], " ")
-		bytes, _ := strconv.Atoi(splitDiskSize[2][1:])
+		sectorSize, _ := strconv.Atoi(strings.TrimSuffix(disk["Device Block Size"], " Bytes"))
 		device := Device{
-			Name:  disk["Device Node"],
-			Size:  splitDiskSize[0] + " " + splitDiskSize[1],
-			Bytes: bytes,
-			Model: disk["Device / Media Name"],
+			Name:              disk["Device Node"],
+			Size:              splitDiskSize[0] + " " + splitDiskSize[1],
+			Bytes:             diskutilBytes(disk["Disk Size"]),
+			Model:             disk["Device / Media Name"],
+			Removable:         disk["Removable Media"] == "Removable",
+			ReadOnly:          disk["Media Read-Only"] == "Yes",
+			Transport:         diskutilTransport(disk["Protocol"]),
+			LogicalSectorSize: sectorSize,
+			Partitions:        partitions[disk["Device Identifier"]],
+		}
+		if disk["Virtual"] != "No" {
+			device.ExcludedReason = ExcludedVirtual
+		} else if disk["Device Location"] == "Internal" {
+			device.ExcludedReason = ExcludedInternal
 		}
 		disks = append(disks, device)
 	}
@@ -58,6 +72,71 @@ func GetDevices(platform Platform) ([]Device, error) {
 	return disks, nil
 }
 
+// parseDiskutilInfo parses the output of `diskutil info` for a single disk into a map.
+func parseDiskutilInfo(info string) map[string]string {
+	disk := make(map[string]string)
+	lines := strings.Split(info, "\n")
+	for _, rawLine := range lines {
+		line := strings.SplitN(strings.TrimSpace(rawLine), ":", 2)
+		if len(line) == 2 {
+			disk[strings.TrimSpace(line[0])] = strings.TrimSpace(line[1])
+		} else {
+			disk[strings.TrimSpace(line[0])] = ""
+		}
+	}
+	return disk
+}
+
+// diskutilBytes parses the number of bytes from a size printed by diskutil, like
+// "30.9 GB (30943995904 Bytes) (exactly 60437492 512-Byte-Units)".
+func diskutilBytes(size string) int {
+	splitSize := strings.Split(size, " ")
+	if len(splitSize) < 3 {
+		return 0
+	}
+	bytes, _ := strconv.Atoi(strings.TrimPrefix(splitSize[2], "("))
+	return bytes
+}
+
+// diskutilTransport returns the transport of a disk, like on Linux, from its diskutil protocol.
+func diskutilTransport(protocol string) string {
+	switch protocol {
+	case "USB":
+		return "usb"
+	case "SATA":
+		return "sata"
+	case "Secure Digital":
+		return "mmc"
+	case "PCI-Express":
+		return "nvme"
+	}
+	return strings.ToLower(protocol)
+}
+
+// CheckDeviceWritable returns [ErrDeviceReadOnly] if a block device is read-only, before flashing
+// to it (and unmounting its partitions).
+func CheckDeviceWritable(device string) error {
+	return CheckDeviceWritableWithPlatform(SystemPlatform, device)
+}
+
+// CheckDeviceWritableWithPlatform returns [ErrDeviceReadOnly] if a block device is read-only.
+// It accepts a [Platform] to allow for testing with a mock platform.
+func CheckDeviceWritableWithPlatform(platform Platform, device string) error {
+	stat, err := platform.OsStat(device)
+	if err != nil {
+		return err
+	} else if stat.Mode().Type()&fs.ModeDevice == 0 {
+		return ErrNotBlockDevice
+	}
+	res, err := platform.ExecCommandOutput(platform.ExecCommand("diskutil", "info", device))
+	if err != nil {
+		return err
+	} else if parseDiskutilInfo(string(res))["Media Read-Only"] == "Yes" {
+		return ErrDeviceReadOnly
+	}
+	return nil
+}
+
 // UnmountDevice unmounts a block device's partitions before flashing to it.
 func UnmountDevice(device string) error {
 	return UnmountDeviceWithPlatform(SystemPlatform, device)
@@ -81,3 +160,12 @@ func UnmountDeviceWithPlatform(platform Platform, device string) error {
 	}
 	return nil
 }
+
+// wholeDisks returns the name of the disk which a device is on, e.g. disk2 for /dev/rdisk2s1.
+func wholeDisks(platform Platform, device string) []string {
+	name := strings.TrimPrefix(filepath.Base(device), "r")
+	if partition := strings.IndexByte(strings.TrimPrefix(name, "disk"), 's'); strings.HasPrefix(name, "disk") && partition != -1 {
+		name = name[:len("disk")+partition]
+	}
+	return []string{name}
+}
@@ -9,6 +9,7 @@ import (
 	"io/fs"
 	"os"
 	"os/exec"
+	"reflect"
 	"slices"
 	"testing"
 	"time"
@@ -125,7 +126,9 @@ func TestGetDevices(t *testing.T) {
 				},
 			},
 			[]imaging.Device{
-				{Name: "/dev/disk8", Model: "DataTraveler 3.0", Size: imaging.BytesToString(30943995904, false), Bytes: 30943995904},
+				{Name: "/dev/disk8", Model: "DataTraveler 3.0", Size: imaging.BytesToString(30943995904, false), Bytes: 30943995904, Removable: true,
+					Transport: "usb", LogicalSectorSize: 512, Partitions: []imaging.Partition{{Name: "/dev/disk8s1", Label: "OPENSUSE-TU",
+						FSType: "msdos", Bytes: 30942920704, Mountpoints: []string{"/Volumes/OPENSUSE-TU"}}}},
 			},
 			nil,
 		},
@@ -140,12 +143,12 @@ func TestGetDevices(t *testing.T) {
 			})
 			if !errors.Is(err, testCase.expectedError) {
 				t.Errorf("expected error %v, got %v", testCase.expectedError, err)
-			} else if !slices.Equal(devices, testCase.expectedDevices) {
+			} else if !reflect.DeepEqual(devices, testCase.expectedDevices) {
 				if len(devices) != len(testCase.expectedDevices) {
 					t.Errorf("expected %d devices, got %d", len(testCase.expectedDevices), len(devices))
 				} else {
 					for i := range devices {
-						if devices[i] != testCase.expectedDevices[i] {
+						if !reflect.DeepEqual(devices[i], testCase.expectedDevices[i]) {
 							t.Errorf("expected device %+v, got %+v", testCase.expectedDevices[i], devices[i])
 						}
 					}
@@ -234,3 +237,40 @@ func TestUnmountDeviceWithPlatform(t *testing.T) {
 		}
 	})
 }
+
+func TestCheckDeviceWritableWithPlatform(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name          string
+		files         map[string]fakeFileInfo
+		output        string
+		expectedError error
+	}{
+		{name: "stat error bubbles up", expectedError: os.ErrNotExist},
+		{name: "not a block device", files: map[string]fakeFileInfo{"/dev/diskX": {mode: 0}},
+			expectedError: imaging.ErrNotBlockDevice},
+		{name: "writable device", files: map[string]fakeFileInfo{"/dev/diskX": {mode: os.ModeDevice}},
+			output: "   Device Identifier:         diskX\n   Media Read-Only:           No\n"},
+		{name: "read-only device", files: map[string]fakeFileInfo{"/dev/diskX": {mode: os.ModeDevice}},
+			output:        "   Device Identifier:         diskX\n   Media Read-Only:           Yes\n",
+			expectedError: imaging.ErrDeviceReadOnly},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			err := imaging.CheckDeviceWritableWithPlatform(mockDevicesPlatform{
+				T:            t,
+				allowedFiles: testCase.files,
+				allowedCmds: map[string]mockDevicesPlatformCommand{
+					"diskutil": {args: []string{"info", "/dev/diskX"}, output: []byte(testCase.output)},
+				},
+			}, "/dev/diskX")
+			if testCase.expectedError == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if !errors.Is(err, testCase.expectedError) {
+				t.Errorf("expected error %v, got %v", testCase.expectedError, err)
+			}
+		})
+	}
+}
@@ -3,73 +3,322 @@
 package imaging
 
 import (
+	"encoding/json"
 	"io/fs"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
-// Device is a struct representing a block device.
-type Device struct {
-	Name  string
-	Model string
-	Size  string
-	Bytes int
+// blockDevice is a whole disk as reported by lsblk or sysfs, before system devices are excluded.
+type blockDevice struct {
+	Device
+	Type string
 }
 
-// GetDevices returns the list of USB devices available to read/write from.
-func GetDevices(platform Platform) ([]Device, error) {
-	// TODO: -J = --json (available since Ubuntu 16.04)
-	// -d = --nodeps
+// GetAllDevices returns the list of all disks, including those excluded from [GetDevices], along
+// with the reason they were excluded.
+func GetAllDevices(platform Platform) ([]Device, error) {
+	blockDevices, err := getLsblkDevices(platform)
+	if err != nil {
+		// lsblk may be missing or too old to support JSON output, so fallback to sysfs.
+		var sysfsErr error
+		blockDevices, sysfsErr = getSysfsDevices(platform)
+		if sysfsErr != nil {
+			return nil, err
+		}
+	}
+
+	mounts, err := readMounts(platform)
+	if err != nil {
+		return nil, err
+	}
+	systemDisks := getSystemDisks(platform, mounts)
+	mountpoints := map[string][]string{}
+	for _, mount := range mounts {
+		if name := resolveBlockDevice(platform, mount.source); name != "" {
+			mountpoints[name] = append(mountpoints[name], mount.mountpoint)
+		}
+	}
+	byIDPaths := readByIDPaths(platform)
+
+	devices := []Device{}
+	for _, blockDevice := range blockDevices {
+		device := blockDevice.Device
+		device.ByIDPath = byIDPaths[strings.TrimPrefix(device.Name, "/dev/")]
+		for idx, partition := range device.Partitions {
+			device.Partitions[idx].Mountpoints = mountpoints[strings.TrimPrefix(partition.Name, "/dev/")]
+		}
+
+		if reason, ok := systemDisks[device.Name]; ok {
+			device.ExcludedReason = reason
+		} else if blockDevice.Type != "disk" {
+			device.ExcludedReason = ExcludedNotDisk
+		} else if !device.Removable {
+			device.ExcludedReason = ExcludedNotRemovable
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// lsblkColumns are the columns requested from lsblk.
+const lsblkColumns = "KNAME,TYPE,RM,RO,SIZE,MODEL,VENDOR,TRAN,SERIAL,LOG-SEC,PHY-SEC,LABEL,FSTYPE"
+
+// lsblkValue is a value in the JSON output of lsblk. Before util-linux v2.33, all values were
+// strings, but newer versions use booleans and numbers where appropriate.
+type lsblkValue string
+
+func (v *lsblkValue) UnmarshalJSON(data []byte) error {
+	var str string
+	if string(data) == "null" {
+		*v = ""
+	} else if err := json.Unmarshal(data, &str); err == nil {
+		*v = lsblkValue(strings.TrimSpace(str))
+	} else {
+		*v = lsblkValue(data)
+	}
+	return nil
+}
+
+func (v lsblkValue) Bool() bool {
+	return v == "1" || v == "true"
+}
+
+func (v lsblkValue) Int() int {
+	value, _ := strconv.Atoi(string(v))
+	return value
+}
+
+type lsblkDevice struct {
+	KName    lsblkValue    `json:"kname"`
+	Type     lsblkValue    `json:"type"`
+	RM       lsblkValue    `json:"rm"`
+	RO       lsblkValue    `json:"ro"`
+	Size     lsblkValue    `json:"size"`
+	Model    lsblkValue    `json:"model"`
+	Vendor   lsblkValue    `json:"vendor"`
+	Tran     lsblkValue    `json:"tran"`
+	Serial   lsblkValue    `json:"serial"`
+	LogSec   lsblkValue    `json:"log-sec"`
+	PhySec   lsblkValue    `json:"phy-sec"`
+	Label    lsblkValue    `json:"label"`
+	FSType   lsblkValue    `json:"fstype"`
+	Children []lsblkDevice `json:"children"`
+}
+
+type lsblkOutput struct {
+	BlockDevices []lsblkDevice `json:"blockdevices"`
+}
+
+// getLsblkDevices returns the list of whole disks reported by lsblk, along with their partitions.
+func getLsblkDevices(platform Platform) ([]blockDevice, error) {
+	// -J = --json (available since Ubuntu 16.04)
 	// -b = --bytes
 	// -o = --output
 	res, err := platform.ExecCommandOutput(platform.ExecCommand(
-		"lsblk", "-d", "-b", "-o", "KNAME,TYPE,RM,SIZE,MODEL"))
+		"lsblk", "-J", "-b", "-o", lsblkColumns))
 	if err != nil {
 		return nil, err
 	}
-	deviceStrings := strings.Split(string(res), "\n")
-	deviceStrings = deviceStrings[:len(deviceStrings)-1]
-
-	// FIXME: Iterate through /etc/fstab for all system mounts (skip noauto,nofail)
-	res, err = platform.ExecCommandOutput(platform.ExecCommand("df", "/", "/home"))
-	if err != nil {
+	var output lsblkOutput
+	if err := json.Unmarshal(res, &output); err != nil {
 		return nil, err
 	}
 
-	systemDevices := strings.Split(strings.TrimSpace(string(res)), "\n")
-	for idx, device := range systemDevices {
-		systemDevices[idx] = strings.Fields(device)[0]
-		// FIXME: Get the parent device of each of those devices (PKNAME in lsblk)
+	devices := []blockDevice{}
+	for _, device := range output.BlockDevices {
+		bytes := device.Size.Int()
+		var partitions []Partition
+		for _, child := range device.Children {
+			if child.Type == "part" {
+				partitions = append(partitions, Partition{
+					Name:   "/dev/" + string(child.KName),
+					Label:  string(child.Label),
+					FSType: string(child.FSType),
+					Bytes:  child.Size.Int(),
+				})
+			}
+		}
+		devices = append(devices, blockDevice{Type: string(device.Type), Device: Device{
+			Name:               "/dev/" + string(device.KName),
+			Model:              string(device.Model),
+			Size:               BytesToString(bytes, false),
+			Bytes:              bytes,
+			Removable:          device.RM.Bool(),
+			ReadOnly:           device.RO.Bool(),
+			Vendor:             string(device.Vendor),
+			Serial:             string(device.Serial),
+			Transport:          string(device.Tran),
+			LogicalSectorSize:  device.LogSec.Int(),
+			PhysicalSectorSize: device.PhySec.Int(),
+			Partitions:         partitions,
+		}})
 	}
+	return devices, nil
+}
 
-	devices := []Device{}
+// getSysfsDevices returns the list of whole disks in /sys/block, along with their partitions.
+func getSysfsDevices(platform Platform) ([]blockDevice, error) {
+	entries, err := platform.OsReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+	labels := readDevLinks(platform, "/dev/disk/by-label")
+
+	devices := []blockDevice{}
+	for _, entry := range entries {
+		name := entry.Name()
+		path := "/sys/block/" + name
+		readAttribute := func(attribute string) string {
+			value, _ := platform.OsReadFile(path + "/" + attribute)
+			return strings.TrimSpace(string(value))
+		}
+		// The size in sysfs is always in 512-byte sectors, regardless of the device's sector size.
+		sectors, _ := strconv.Atoi(readAttribute("size"))
+		bytes := sectors * 512
+		logicalSectorSize, _ := strconv.Atoi(readAttribute("queue/logical_block_size"))
+		physicalSectorSize, _ := strconv.Atoi(readAttribute("queue/physical_block_size"))
 
-nextDevice:
-	for _, deviceString := range deviceStrings {
-		deviceFields := strings.Fields(deviceString)
-		if deviceFields[1] == "disk" && deviceFields[2] == "1" {
-			// Exclude any "system" devices (as defined by /etc/fstab) from being enumerated
-			for _, systemDevice := range systemDevices {
-				if strings.HasPrefix(systemDevice, "/dev/"+deviceFields[0]) {
-					continue nextDevice
-				}
+		var partitions []Partition
+		children, _ := platform.OsReadDir(path)
+		for _, child := range children {
+			if !strings.HasPrefix(child.Name(), name) {
+				continue
+			} else if _, err := platform.OsReadFile(path + "/" + child.Name() + "/partition"); err != nil {
+				continue
 			}
-			bytes, _ := strconv.Atoi(deviceFields[3])
-			device := Device{
-				Name:  "/dev/" + deviceFields[0],
-				Size:  BytesToString(bytes, false),
-				Bytes: bytes,
+			sectors, _ := strconv.Atoi(readAttribute(child.Name() + "/size"))
+			partition := Partition{Name: "/dev/" + child.Name(), Bytes: sectors * 512}
+			if len(labels[child.Name()]) > 0 {
+				partition.Label = decodeUdevString(labels[child.Name()][0])
 			}
+			partitions = append(partitions, partition)
+		}
 
-			if len(deviceFields) >= 4 {
-				device.Model = strings.TrimSpace(strings.Join(deviceFields[4:], " "))
-			}
+		devices = append(devices, blockDevice{Type: sysfsDeviceType(name), Device: Device{
+			Name:               "/dev/" + name,
+			Model:              readAttribute("device/model"),
+			Size:               BytesToString(bytes, false),
+			Bytes:              bytes,
+			Removable:          readAttribute("removable") == "1",
+			ReadOnly:           readAttribute("ro") == "1",
+			Vendor:             readAttribute("device/vendor"),
+			Serial:             readAttribute("device/serial"),
+			Transport:          sysfsTransport(platform, name),
+			LogicalSectorSize:  logicalSectorSize,
+			PhysicalSectorSize: physicalSectorSize,
+			Partitions:         partitions,
+		}})
+	}
+	return devices, nil
+}
 
-			devices = append(devices, device)
+// readDevLinks returns the names of the symlinks in a directory like /dev/disk/by-id, mapped by
+// the kernel name of the block device they link to.
+func readDevLinks(platform Platform, dir string) map[string][]string {
+	links := map[string][]string{}
+	entries, err := platform.OsReadDir(dir)
+	if err != nil {
+		return links
+	}
+	for _, entry := range entries {
+		if link, err := platform.OsReadlink(dir + "/" + entry.Name()); err == nil {
+			name := filepath.Base(link)
+			links[name] = append(links[name], entry.Name())
 		}
 	}
+	return links
+}
 
-	return devices, nil
+// readByIDPaths returns the paths to block devices in /dev/disk/by-id, mapped by their kernel
+// name. IDs derived from the model and serial number are preferred over WWNs and EUIs.
+func readByIDPaths(platform Platform) map[string]string {
+	paths := map[string]string{}
+	for name, ids := range readDevLinks(platform, "/dev/disk/by-id") {
+		paths[name] = "/dev/disk/by-id/" + ids[0]
+		for _, id := range ids {
+			if !strings.HasPrefix(id, "wwn-") && !strings.HasPrefix(id, "nvme-eui.") {
+				paths[name] = "/dev/disk/by-id/" + id
+				break
+			}
+		}
+	}
+	return paths
+}
+
+// sysfsDeviceType returns the device type lsblk would report for a disk in /sys/block.
+func sysfsDeviceType(name string) string {
+	switch {
+	case strings.HasPrefix(name, "loop"):
+		return "loop"
+	case strings.HasPrefix(name, "sr"):
+		return "rom"
+	case strings.HasPrefix(name, "dm-"):
+		return "dm"
+	case strings.HasPrefix(name, "md"):
+		return "raid"
+	}
+	return "disk"
+}
+
+// sysfsTransport returns the transport lsblk would report for a disk in /sys/block, based on the
+// path of the device in /sys/devices which /sys/block/<name> links to.
+func sysfsTransport(platform Platform, name string) string {
+	link, err := platform.OsReadlink("/sys/block/" + name)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case strings.Contains(link, "/usb"):
+		return "usb"
+	case strings.HasPrefix(name, "nvme"):
+		return "nvme"
+	case strings.HasPrefix(name, "mmcblk"):
+		return "mmc"
+	case strings.Contains(link, "/ata"):
+		return "sata"
+	case strings.Contains(link, "/virtio"):
+		return "virtio"
+	}
+	return ""
+}
+
+// blkroget is the BLKROGET ioctl, which gets whether a block device is read-only.
+const blkroget = 0x125e
+
+// CheckDeviceWritable returns [ErrDeviceReadOnly] if a block device is read-only, before flashing
+// to it (and unmounting its partitions).
+func CheckDeviceWritable(device string) error {
+	return CheckDeviceWritableWithPlatform(UnixSystemPlatform, device)
+}
+
+// CheckDeviceWritableWithPlatform returns [ErrDeviceReadOnly] if a block device is read-only.
+// It accepts a [UnixPlatform] to allow for testing with a mock platform.
+func CheckDeviceWritableWithPlatform(platform UnixPlatform, device string) error {
+	stat, err := platform.OsStat(device)
+	if err != nil {
+		return err
+	} else if stat.Mode().Type()&fs.ModeDevice == 0 {
+		return ErrNotBlockDevice
+	}
+
+	ro, err := platform.OsReadFile("/sys/class/block/" + resolveBlockDevice(platform, device) + "/ro")
+	if err == nil && strings.TrimSpace(string(ro)) == "1" {
+		return ErrDeviceReadOnly
+	}
+
+	// sysfs may not be mounted, so ask the kernel directly as well.
+	file, err := platform.OsOpen(device)
+	if err != nil {
+		return nil // Writing will fail with a more appropriate error, if it does.
+	}
+	defer file.Close()
+	if readOnly, err := platform.SyscallIoctlGetInt(file.Fd(), blkroget); err == nil && readOnly != 0 {
+		return ErrDeviceReadOnly
+	}
+	return nil
 }
 
 // UnmountDevice unmounts a block device's partitions before flashing to it.
@@ -5,9 +5,16 @@ package imaging_test
 import (
 	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
+	"os"
 	"os/exec"
+	"reflect"
 	"slices"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/retrixe/imprint/imaging"
 )
@@ -16,6 +23,10 @@ type mockDevicesPlatform struct {
 	imaging.Platform
 	*testing.T
 	allowedCmds map[string]mockDevicesPlatformCommand
+	// files is the mock filesystem, with paths relative to the root directory.
+	files fstest.MapFS
+	// links maps the paths of symlinks to their targets.
+	links map[string]string
 }
 
 type mockDevicesPlatformCommand struct {
@@ -47,124 +58,396 @@ func (p mockDevicesPlatform) ExecCommandOutput(cmd *exec.Cmd) ([]byte, error) {
 	return p.allowedCmds[cmd.Path].output, nil
 }
 
+func (p mockDevicesPlatform) OsReadFile(name string) ([]byte, error) {
+	return p.files.ReadFile(strings.TrimPrefix(name, "/"))
+}
+
+func (p mockDevicesPlatform) OsReadDir(name string) ([]os.DirEntry, error) {
+	return p.files.ReadDir(strings.TrimPrefix(name, "/"))
+}
+
+func (p mockDevicesPlatform) OsReadlink(name string) (string, error) {
+	if link, ok := p.links[name]; ok {
+		return link, nil
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+}
+
+var lsblkArgs = []string{"-J", "-b", "-o", "KNAME,TYPE,RM,RO,SIZE,MODEL,VENDOR,TRAN,SERIAL,LOG-SEC,PHY-SEC,LABEL,FSTYPE"}
+
+// fedoraSystemFiles contains the mounts of Fedora 42 installed with btrfs on LUKS on an NVMe SSD.
+var fedoraSystemFiles = fstest.MapFS{
+	"proc/self/mountinfo": {Data: []byte("" +
+		"65 1 0:33 /root / rw,relatime shared:1 - btrfs /dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7 rw,seclabel,compress=zstd:1,ssd,space_cache=v2,subvolid=257,subvol=/root\n" +
+		"24 65 0:22 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw\n" +
+		"95 65 0:33 /home /home rw,relatime shared:52 - btrfs /dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7 rw,seclabel,compress=zstd:1,ssd,space_cache=v2,subvolid=256,subvol=/home\n" +
+		"98 65 259:2 / /boot rw,relatime shared:54 - ext4 /dev/nvme0n1p2 rw,seclabel\n" +
+		"101 98 259:1 / /boot/efi rw,relatime shared:56 - vfat /dev/nvme0n1p1 rw,fmask=0077,dmask=0077\n" +
+		"50 65 0:43 / /tmp rw,nosuid,nodev shared:30 - tmpfs tmpfs rw,seclabel,nr_inodes=1048576\n" +
+		"412 65 8:1 / /run/media/user/Fedora-WS-Live-42-1-1 ro,nosuid,nodev,relatime shared:232 - iso9660 /dev/sda1 ro,nojoliet,check=s,map=n,blocksize=2048\n")},
+	"proc/swaps": {Data: []byte("" +
+		"Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n" +
+		"/dev/zram0                              partition\t8388604\t\t0\t\t100\n")},
+	"etc/fstab": {Data: []byte("" +
+		"#\n# /etc/fstab\n# Created by anaconda on Sat Apr 19 10:19:44 2025\n#\n" +
+		"UUID=8ba1e1cf-2a45-4e1e-a5a0-2d8e5ba9c3b4 /                       btrfs   subvol=root,compress=zstd:1,x-systemd.device-timeout=0 0 0\n" +
+		"UUID=0e7e5b6a-6c54-4b41-8b1d-6b0d2f5d2a3c /boot                   ext4    defaults        1 2\n" +
+		"UUID=A1B2-C3D4          /boot/efi               vfat    umask=0077,shortname=winnt 0 2\n" +
+		"UUID=8ba1e1cf-2a45-4e1e-a5a0-2d8e5ba9c3b4 /home                   btrfs   subvol=home,compress=zstd:1,x-systemd.device-timeout=0 0 0\n")},
+	"sys/class/block/dm-0/slaves/nvme0n1p3": {},
+	"sys/class/block/nvme0n1p1/partition":   {Data: []byte("1\n")},
+	"sys/class/block/nvme0n1p2/partition":   {Data: []byte("2\n")},
+	"sys/class/block/nvme0n1p3/partition":   {Data: []byte("3\n")},
+}
+
+var fedoraSystemLinks = map[string]string{
+	"/dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7":  "../dm-0",
+	"/dev/disk/by-uuid/8ba1e1cf-2a45-4e1e-a5a0-2d8e5ba9c3b4": "../../dm-0",
+	"/dev/disk/by-uuid/0e7e5b6a-6c54-4b41-8b1d-6b0d2f5d2a3c": "../../nvme0n1p2",
+	"/dev/disk/by-uuid/A1B2-C3D4":                            "../../nvme0n1p1",
+	"/sys/class/block/nvme0n1p1":                             "../../devices/pci0000:00/0000:00:06.0/0000:01:00.0/nvme/nvme0/nvme0n1/nvme0n1p1",
+	"/sys/class/block/nvme0n1p2":                             "../../devices/pci0000:00/0000:00:06.0/0000:01:00.0/nvme/nvme0/nvme0n1/nvme0n1p2",
+	"/sys/class/block/nvme0n1p3":                             "../../devices/pci0000:00/0000:00:06.0/0000:01:00.0/nvme/nvme0/nvme0n1/nvme0n1p3",
+}
+
+// fedoraByIDFiles contains /dev/disk/by-id on Fedora 42 with a USB flash drive attached.
+var fedoraByIDFiles = fstest.MapFS{
+	"dev/disk/by-id/nvme-WD_PC_SN560_SDDPNQE-1T00-1102_23195H800123":   {},
+	"dev/disk/by-id/nvme-eui.e8238fa6bf530001001b448b4a1c2f3e":         {},
+	"dev/disk/by-id/usb-SanDisk_Cruzer_4C530001230615117452-0:0":       {},
+	"dev/disk/by-id/usb-SanDisk_Cruzer_4C530001230615117452-0:0-part1": {},
+	"dev/disk/by-id/wwn-0x5001b448b4a1c2f3":                            {},
+}
+
+var fedoraByIDLinks = map[string]string{
+	"/dev/disk/by-id/nvme-WD_PC_SN560_SDDPNQE-1T00-1102_23195H800123":   "../../nvme0n1",
+	"/dev/disk/by-id/nvme-eui.e8238fa6bf530001001b448b4a1c2f3e":         "../../nvme0n1",
+	"/dev/disk/by-id/usb-SanDisk_Cruzer_4C530001230615117452-0:0":       "../../sda",
+	"/dev/disk/by-id/usb-SanDisk_Cruzer_4C530001230615117452-0:0-part1": "../../sda1",
+	"/dev/disk/by-id/wwn-0x5001b448b4a1c2f3":                            "../../nvme0n1",
+}
+
+func mergeFiles(files ...fstest.MapFS) fstest.MapFS {
+	merged := fstest.MapFS{}
+	for _, file := range files {
+		maps.Copy(merged, file)
+	}
+	return merged
+}
+
+func mergeLinks(links ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, link := range links {
+		maps.Copy(merged, link)
+	}
+	return merged
+}
+
+// sysfsFiles contains /sys/block on a laptop with an NVMe SSD, a USB flash drive, an SD card
+// and a loop device attached.
+var sysfsFiles = fstest.MapFS{
+	"dev/disk/by-label/Fedora-WS-Live-42-1-1":     {},
+	"sys/block/loop0/removable":                   {Data: []byte("0\n")},
+	"sys/block/loop0/ro":                          {Data: []byte("1\n")},
+	"sys/block/loop0/size":                        {Data: []byte("8192\n")},
+	"sys/block/mmcblk0/device/vendor":             {Data: []byte{}},
+	"sys/block/mmcblk0/removable":                 {Data: []byte("0\n")},
+	"sys/block/mmcblk0/ro":                        {Data: []byte("1\n")},
+	"sys/block/mmcblk0/size":                      {Data: []byte("62333952\n")},
+	"sys/block/nvme0n1/device/model":              {Data: []byte("WD PC SN560 SDDPNQE-1T00-1102          \n")},
+	"sys/block/nvme0n1/device/serial":             {Data: []byte("23195H800123        \n")},
+	"sys/block/nvme0n1/queue/logical_block_size":  {Data: []byte("512\n")},
+	"sys/block/nvme0n1/queue/physical_block_size": {Data: []byte("512\n")},
+	"sys/block/nvme0n1/removable":                 {Data: []byte("0\n")},
+	"sys/block/nvme0n1/ro":                        {Data: []byte("0\n")},
+	"sys/block/nvme0n1/size":                      {Data: []byte("2000409264\n")},
+	"sys/block/sda/device/model":                  {Data: []byte("Cruzer Blade    \n")},
+	"sys/block/sda/device/vendor":                 {Data: []byte("SanDisk \n")},
+	"sys/block/sda/queue/logical_block_size":      {Data: []byte("512\n")},
+	"sys/block/sda/queue/physical_block_size":     {Data: []byte("512\n")},
+	"sys/block/sda/removable":                     {Data: []byte("1\n")},
+	"sys/block/sda/ro":                            {Data: []byte("0\n")},
+	"sys/block/sda/sda1/partition":                {Data: []byte("1\n")},
+	"sys/block/sda/sda1/size":                     {Data: []byte("3905536\n")},
+	"sys/block/sda/size":                          {Data: []byte("3907711\n")},
+	"sys/block/zram0/removable":                   {Data: []byte("0\n")},
+	"sys/block/zram0/ro":                          {Data: []byte("0\n")},
+	"sys/block/zram0/size":                        {Data: []byte("16777216\n")},
+}
+
+var sysfsLinks = map[string]string{
+	"/dev/disk/by-label/Fedora-WS-Live-42-1-1": "../../sda1",
+	"/sys/block/loop0":                         "../devices/virtual/block/loop0",
+	"/sys/block/mmcblk0":                       "../devices/pci0000:00/0000:00:14.5/mmc_host/mmc0/mmc0:aaaa/block/mmcblk0",
+	"/sys/block/nvme0n1":                       "../devices/pci0000:00/0000:00:06.0/0000:01:00.0/nvme/nvme0/nvme0n1",
+	"/sys/block/sda":                           "../devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host0/target0:0:0/0:0:0:0/block/sda",
+	"/sys/block/zram0":                         "../devices/virtual/block/zram0",
+}
+
+// sysfsCruzer is the USB flash drive in sysfsFiles.
+var sysfsCruzer = imaging.Device{Name: "/dev/sda", Model: "Cruzer Blade", Size: imaging.BytesToString(3907711*512, false), Bytes: 3907711 * 512,
+	Removable: true, Vendor: "SanDisk", Transport: "usb", LogicalSectorSize: 512, PhysicalSectorSize: 512,
+	Partitions: []imaging.Partition{{Name: "/dev/sda1", Label: "Fedora-WS-Live-42-1-1", Bytes: 3905536 * 512,
+		Mountpoints: []string{"/run/media/user/Fedora-WS-Live-42-1-1"}}}}
+
 func TestGetDevices(t *testing.T) {
 	t.Parallel()
 
 	var lsblkExitError = errors.New("lsblk mock error")
 
-	var dfExitError = errors.New("df mock error")
-
 	testCases := []struct {
 		name            string
 		cmds            map[string]mockDevicesPlatformCommand
+		files           fstest.MapFS
+		links           map[string]string
 		expectedDevices []imaging.Device
 		expectedError   error
 	}{
 		{
-			"fails upon missing lsblk",
+			"fails upon missing lsblk and sysfs",
 			map[string]mockDevicesPlatformCommand{},
+			nil,
+			nil,
 			[]imaging.Device{},
 			exec.ErrNotFound,
 		},
 		{
-			"fails upon lsblk error",
+			"fails upon lsblk error and missing sysfs",
 			map[string]mockDevicesPlatformCommand{
 				"lsblk": {
-					args: []string{"-d", "-b", "-o", "KNAME,TYPE,RM,SIZE,MODEL"},
+					args: lsblkArgs,
 					err:  lsblkExitError,
 				},
 			},
+			nil,
+			nil,
 			[]imaging.Device{},
 			lsblkExitError,
 		},
 		{
-			"fails upon missing df",
+			"fails upon missing mountinfo",
 			map[string]mockDevicesPlatformCommand{
 				"lsblk": {
-					args:   []string{"-d", "-b", "-o", "KNAME,TYPE,RM,SIZE,MODEL"},
-					output: []byte("KNAME   TYPE RM          SIZE MODEL\nzram0   disk  0    8589934592 \n"),
+					args:   lsblkArgs,
+					output: []byte(`{"blockdevices": [{"kname":"zram0", "type":"disk", "rm":false, "ro":false, "size":8589934592, "model":null, "vendor":null, "tran":null}]}`),
 				},
 			},
+			nil,
+			nil,
 			[]imaging.Device{},
-			exec.ErrNotFound,
+			fs.ErrNotExist,
 		},
 		{
-			"fails upon df error",
+			"works on Fedora 42 on ASUS Zenbook S 14 w/ dual boot, btrfs, LUKS with 0 devices attached",
 			map[string]mockDevicesPlatformCommand{
 				"lsblk": {
-					args:   []string{"-d", "-b", "-o", "KNAME,TYPE,RM,SIZE,MODEL"},
-					output: []byte("KNAME   TYPE RM          SIZE MODEL\nzram0   disk  0    8589934592 \n"),
-				},
-				"df": {
-					args: []string{"/", "/home"},
-					err:  dfExitError,
+					args: lsblkArgs,
+					output: []byte(`{
+   "blockdevices": [
+      {
+         "kname": "zram0",
+         "type": "disk",
+         "rm": false,
+         "ro": false,
+         "size": 8589934592,
+         "model": null,
+         "vendor": null,
+         "tran": null
+      },{
+         "kname": "nvme0n1",
+         "type": "disk",
+         "rm": false,
+         "ro": false,
+         "size": 1024209543168,
+         "model": "WD PC SN560 SDDPNQE-1T00-1102",
+         "vendor": null,
+         "tran": "nvme"
+      }
+   ]
+}`),
 				},
 			},
+			fedoraSystemFiles,
+			fedoraSystemLinks,
 			[]imaging.Device{},
-			dfExitError,
+			nil,
 		},
 		{
-			"works on Fedora 42 on ASUS Zenbook S 14 w/ dual boot, btrfs, LUKS with 0 devices attached",
+			"works on Fedora 42 on ASUS Zenbook S 14 w/ dual boot, btrfs, LUKS with 1 device attached",
 			map[string]mockDevicesPlatformCommand{
 				"lsblk": {
-					args: []string{"-d", "-b", "-o", "KNAME,TYPE,RM,SIZE,MODEL"},
-					output: []byte("KNAME   TYPE RM          SIZE MODEL\n" +
-						"zram0   disk  0    8589934592 \n" +
-						"nvme0n1 disk  0 1024209543168 WD PC SN560 SDDPNQE-1T00-1102\n"),
-				},
-				"df": {
-					args: []string{"/", "/home"},
-					output: []byte("Filesystem                                            1K-blocks      Used Available Use% Mounted on\n" +
-						"/dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7 535805952 503377676  28342100  95% /\n" +
-						"/dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7 535805952 503377676  28342100  95% /home\n"),
+					args: lsblkArgs,
+					output: []byte(`{
+   "blockdevices": [
+      {
+         "kname": "sda",
+         "type": "disk",
+         "rm": true,
+         "ro": false,
+         "size": 2000748032,
+         "model": "Cruzer",
+         "vendor": "SanDisk ",
+         "tran": "usb",
+         "serial": "4C530001230615117452",
+         "log-sec": 512,
+         "phy-sec": 512,
+         "label": null,
+         "fstype": null,
+         "children": [
+            {
+               "kname": "sda1",
+               "type": "part",
+               "rm": true,
+               "ro": false,
+               "size": 1999699456,
+               "model": null,
+               "vendor": null,
+               "tran": null,
+               "serial": null,
+               "log-sec": 512,
+               "phy-sec": 512,
+               "label": "Fedora-WS-Live-42-1-1",
+               "fstype": "iso9660"
+            }
+         ]
+      },{
+         "kname": "zram0",
+         "type": "disk",
+         "rm": false,
+         "ro": false,
+         "size": 8589934592,
+         "model": null,
+         "vendor": null,
+         "tran": null
+      },{
+         "kname": "nvme0n1",
+         "type": "disk",
+         "rm": false,
+         "ro": false,
+         "size": 1024209543168,
+         "model": "WD PC SN560 SDDPNQE-1T00-1102",
+         "vendor": null,
+         "tran": "nvme"
+      }
+   ]
+}`),
 				},
 			},
-			[]imaging.Device{},
+			mergeFiles(fedoraSystemFiles, fedoraByIDFiles),
+			mergeLinks(fedoraSystemLinks, fedoraByIDLinks),
+			[]imaging.Device{
+				{Name: "/dev/sda", Model: "Cruzer", Size: imaging.BytesToString(2000748032, false), Bytes: 2000748032, Removable: true,
+					Vendor: "SanDisk", Serial: "4C530001230615117452", Transport: "usb", LogicalSectorSize: 512, PhysicalSectorSize: 512,
+					ByIDPath: "/dev/disk/by-id/usb-SanDisk_Cruzer_4C530001230615117452-0:0",
+					Partitions: []imaging.Partition{{Name: "/dev/sda1", Label: "Fedora-WS-Live-42-1-1", FSType: "iso9660", Bytes: 1999699456,
+						Mountpoints: []string{"/run/media/user/Fedora-WS-Live-42-1-1"}}}},
+			},
 			nil,
 		},
 		{
-			"works on Fedora 42 on ASUS Zenbook S 14 w/ dual boot, btrfs, LUKS with 1 device attached",
+			"works on Fedora 42 on ASUS Zenbook S 14 w/ dual boot, btrfs, LUKS with 2 devices attached",
 			map[string]mockDevicesPlatformCommand{
 				"lsblk": {
-					args: []string{"-d", "-b", "-o", "KNAME,TYPE,RM,SIZE,MODEL"},
-					output: []byte("KNAME   TYPE RM          SIZE MODEL\n" +
-						"sda     disk  1    2000748032 Cruzer\n" +
-						"zram0   disk  0    8589934592 \n" +
-						"nvme0n1 disk  0 1024209543168 WD PC SN560 SDDPNQE-1T00-1102\n"),
-				},
-				"df": {
-					args: []string{"/", "/home"},
-					output: []byte("Filesystem                                            1K-blocks      Used Available Use% Mounted on\n" +
-						"/dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7 535805952 503377676  28342100  95% /\n" +
-						"/dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7 535805952 503377676  28342100  95% /home\n"),
+					args: lsblkArgs,
+					output: []byte(`{
+   "blockdevices": [
+      {
+         "kname": "sda",
+         "type": "disk",
+         "rm": true,
+         "ro": false,
+         "size": 2000748032,
+         "model": "Cruzer",
+         "vendor": "SanDisk ",
+         "tran": "usb"
+      },{
+         "kname": "sdb",
+         "type": "disk",
+         "rm": true,
+         "ro": false,
+         "size": 61530439680,
+         "model": "SanDisk 3.2Gen1",
+         "vendor": " USB    ",
+         "tran": "usb"
+      },{
+         "kname": "zram0",
+         "type": "disk",
+         "rm": false,
+         "ro": false,
+         "size": 8589934592,
+         "model": null,
+         "vendor": null,
+         "tran": null
+      },{
+         "kname": "nvme0n1",
+         "type": "disk",
+         "rm": false,
+         "ro": false,
+         "size": 1024209543168,
+         "model": "WD PC SN560 SDDPNQE-1T00-1102",
+         "vendor": null,
+         "tran": "nvme"
+      }
+   ]
+}`),
 				},
 			},
+			fedoraSystemFiles,
+			fedoraSystemLinks,
 			[]imaging.Device{
-				{Name: "/dev/sda", Model: "Cruzer", Size: imaging.BytesToString(2000748032, false), Bytes: 2000748032},
+				{Name: "/dev/sda", Model: "Cruzer", Size: imaging.BytesToString(2000748032, false), Bytes: 2000748032, Removable: true,
+					Vendor: "SanDisk", Transport: "usb"},
+				{Name: "/dev/sdb", Model: "SanDisk 3.2Gen1", Size: imaging.BytesToString(61530439680, false), Bytes: 61530439680, Removable: true,
+					Vendor: "USB", Transport: "usb"},
 			},
 			nil,
 		},
 		{
-			"works on Fedora 42 on ASUS Zenbook S 14 w/ dual boot, btrfs, LUKS with 2 devices attached",
+			"works with lsblk from util-linux before v2.33 and missing columns",
 			map[string]mockDevicesPlatformCommand{
 				"lsblk": {
-					args: []string{"-d", "-b", "-o", "KNAME,TYPE,RM,SIZE,MODEL"},
-					output: []byte("KNAME   TYPE RM          SIZE MODEL\n" +
-						"sda     disk  1    2000748032 Cruzer\n" +
-						"sdb     disk  1   61530439680 SanDisk 3.2Gen1\n" +
-						"zram0   disk  0    8589934592 \n" +
-						"nvme0n1 disk  0 1024209543168 WD PC SN560 SDDPNQE-1T00-1102\n"),
+					args: lsblkArgs,
+					output: []byte(`{
+   "blockdevices": [
+      {"kname": "sda", "type": "disk", "rm": "1", "ro": "0", "size": "2000748032", "model": "Cruzer Blade    ", "vendor": "SanDisk ", "tran": "usb"},
+      {"kname": "sdb", "type": "disk", "rm": "1", "ro": "1", "size": "31914983424", "model": null, "tran": "usb"},
+      {"kname": "sda1", "type": "part", "rm": "1", "ro": "0", "size": "2000748032", "model": null, "vendor": null, "tran": null}
+   ]
+}`),
 				},
-				"df": {
-					args: []string{"/", "/home"},
-					output: []byte("Filesystem                                            1K-blocks      Used Available Use% Mounted on\n" +
-						"/dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7 535805952 503377676  28342100  95% /\n" +
-						"/dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7 535805952 503377676  28342100  95% /home\n"),
+			},
+			fedoraSystemFiles,
+			fedoraSystemLinks,
+			[]imaging.Device{
+				{Name: "/dev/sda", Model: "Cruzer Blade", Size: imaging.BytesToString(2000748032, false), Bytes: 2000748032, Removable: true,
+					Vendor: "SanDisk", Transport: "usb"},
+				{Name: "/dev/sdb", Size: imaging.BytesToString(31914983424, false), Bytes: 31914983424, Removable: true,
+					ReadOnly: true, Transport: "usb"},
+			},
+			nil,
+		},
+		{
+			"falls back to sysfs upon missing lsblk",
+			map[string]mockDevicesPlatformCommand{},
+			mergeFiles(fedoraSystemFiles, sysfsFiles),
+			mergeLinks(fedoraSystemLinks, sysfsLinks),
+			[]imaging.Device{
+				sysfsCruzer,
+			},
+			nil,
+		},
+		{
+			"falls back to sysfs upon lsblk without JSON support",
+			map[string]mockDevicesPlatformCommand{
+				"lsblk": {
+					args: lsblkArgs,
+					err:  lsblkExitError,
 				},
 			},
+			mergeFiles(fedoraSystemFiles, sysfsFiles),
+			mergeLinks(fedoraSystemLinks, sysfsLinks),
 			[]imaging.Device{
-				{Name: "/dev/sda", Model: "Cruzer", Size: imaging.BytesToString(2000748032, false), Bytes: 2000748032},
-				{Name: "/dev/sdb", Model: "SanDisk 3.2Gen1", Size: imaging.BytesToString(61530439680, false), Bytes: 61530439680},
+				sysfsCruzer,
 			},
 			nil,
 		},
@@ -173,19 +456,22 @@ func TestGetDevices(t *testing.T) {
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
 			t.Parallel()
-			devices, err := imaging.GetDevices(mockDevicesPlatform{
+			platform := mockDevicesPlatform{
 				Platform:    imaging.SystemPlatform,
 				T:           t,
 				allowedCmds: testCase.cmds,
-			})
+				files:       testCase.files,
+				links:       testCase.links,
+			}
+			devices, err := imaging.GetDevices(platform)
 			if !errors.Is(err, testCase.expectedError) {
 				t.Errorf("expected error %v, got %v", testCase.expectedError, err)
-			} else if !slices.Equal(devices, testCase.expectedDevices) {
+			} else if !reflect.DeepEqual(devices, testCase.expectedDevices) {
 				if len(devices) != len(testCase.expectedDevices) {
 					t.Errorf("expected %d devices, got %d", len(testCase.expectedDevices), len(devices))
 				} else {
 					for i := range devices {
-						if devices[i] != testCase.expectedDevices[i] {
+						if !reflect.DeepEqual(devices[i], testCase.expectedDevices[i]) {
 							t.Errorf("expected device %+v, got %+v", testCase.expectedDevices[i], devices[i])
 						}
 					}
@@ -194,3 +480,318 @@ func TestGetDevices(t *testing.T) {
 		})
 	}
 }
+
+// systemDisksFiles contains the mounts of a system with LUKS on an NVMe SSD, mdraid, LVM on LUKS,
+// swap and fstab entries on various external drives, which should all be protected except sdb,
+// sde and sdf.
+var systemDisksFiles = fstest.MapFS{
+	"proc/self/mountinfo": {Data: []byte("" +
+		"22 1 0:30 /root / rw,relatime shared:1 - btrfs /dev/mapper/luks-root rw,seclabel,compress=zstd:1\n" +
+		"60 22 9:0 / /var rw,relatime shared:30 - ext4 /dev/md0 rw\n" +
+		"61 60 0:40 / /var/tmp rw,relatime shared:31 - tmpfs tmpfs rw\n" +
+		"70 22 8:17 / /run/media/user/STICK rw,nosuid,nodev shared:40 - vfat /dev/sdb1 rw\n" +
+		"80 22 253:2 / /srv/data rw,relatime shared:50 - xfs /dev/mapper/vg-data rw\n")},
+	"proc/swaps": {Data: []byte("" +
+		"Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n" +
+		"/dev/sdc2                               partition\t8388604\t\t0\t\t-2\n" +
+		"/swapfile                               file\t\t1048572\t\t0\t\t-3\n")},
+	"etc/fstab": {Data: []byte("" +
+		"# <file system> <mount point> <type> <options> <dump> <pass>\n" +
+		"/dev/mapper/luks-root / btrfs subvol=root 0 0\n" +
+		"UUID=1111 /boot ext4 defaults 1 2\n" +
+		"UUID=2222 /mnt/backup ext4 defaults,nofail 0 2\n" +
+		"LABEL=Stick /mnt/stick vfat noauto,user 0 0\n" +
+		"LABEL=Data\\040Disk /mnt/data ext4 defaults 0 2\n" +
+		"tmpfs /tmp tmpfs defaults 0 0\n")},
+	"sys/class/block/dm-0/slaves/nvme0n1p3": {},
+	"sys/class/block/md0/slaves/sda1":       {},
+	"sys/class/block/dm-2/slaves/dm-1":      {},
+	"sys/class/block/dm-1/slaves/sdg1":      {},
+	"sys/class/block/nvme0n1p3/partition":   {Data: []byte("3\n")},
+	"sys/class/block/sda1/partition":        {Data: []byte("1\n")},
+	"sys/class/block/sdb1/partition":        {Data: []byte("1\n")},
+	"sys/class/block/sdc2/partition":        {Data: []byte("2\n")},
+	"sys/class/block/sdd1/partition":        {Data: []byte("1\n")},
+	"sys/class/block/sdg1/partition":        {Data: []byte("1\n")},
+	"sys/class/block/sdh1/partition":        {Data: []byte("1\n")},
+}
+
+var systemDisksLinks = map[string]string{
+	"/dev/mapper/luks-root":            "../dm-0",
+	"/dev/mapper/vg-data":              "../dm-2",
+	"/dev/disk/by-uuid/1111":           "../../sdd1",
+	"/dev/disk/by-uuid/2222":           "../../sde1",
+	"/dev/disk/by-label/Stick":         "../../sdf1",
+	"/dev/disk/by-label/Data\\x20Disk": "../../sdh1",
+	"/sys/class/block/nvme0n1p3":       "../../devices/pci0000:00/0000:00:06.0/0000:01:00.0/nvme/nvme0/nvme0n1/nvme0n1p3",
+	"/sys/class/block/sda1":            "../../devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host0/target0:0:0/0:0:0:0/block/sda/sda1",
+	"/sys/class/block/sdb1":            "../../devices/pci0000:00/0000:00:14.0/usb2/2-2/2-2:1.0/host1/target1:0:0/1:0:0:0/block/sdb/sdb1",
+	"/sys/class/block/sdc2":            "../../devices/pci0000:00/0000:00:14.0/usb2/2-3/2-3:1.0/host2/target2:0:0/2:0:0:0/block/sdc/sdc2",
+	"/sys/class/block/sdd1":            "../../devices/pci0000:00/0000:00:14.0/usb2/2-4/2-4:1.0/host3/target3:0:0/3:0:0:0/block/sdd/sdd1",
+	"/sys/class/block/sdg1":            "../../devices/pci0000:00/0000:00:14.0/usb3/3-1/3-1:1.0/host6/target6:0:0/6:0:0:0/block/sdg/sdg1",
+	"/sys/class/block/sdh1":            "../../devices/pci0000:00/0000:00:14.0/usb3/3-2/3-2:1.0/host7/target7:0:0/7:0:0:0/block/sdh/sdh1",
+}
+
+// btrfsRaidFiles contains the mounts of a system with a btrfs RAID1 root across sda2 and sdb2, of
+// which mountinfo only lists sda2, and an mdraid RAID1 /boot/efi (with metadata at the end, so the
+// filesystem is visible on its members) across sdc1 and sdd1, which fstab refers to through sdc1.
+// Only sde should be flashable.
+var btrfsRaidFiles = fstest.MapFS{
+	"proc/self/mountinfo": {Data: []byte("" +
+		"22 1 0:30 /@ / rw,relatime shared:1 - btrfs /dev/sda2 rw,space_cache=v2,subvolid=256,subvol=/@\n" +
+		"23 22 0:30 /@home /home rw,relatime shared:2 - btrfs /dev/sda2 rw,space_cache=v2,subvolid=257,subvol=/@home\n")},
+	"etc/fstab": {Data: []byte("" +
+		"UUID=5c2e0f7a-8d8e-4c1b-9f3e-2b1d7c6a9e10 / btrfs subvol=@ 0 0\n" +
+		"UUID=5c2e0f7a-8d8e-4c1b-9f3e-2b1d7c6a9e10 /home btrfs subvol=@home 0 0\n" +
+		"UUID=3333-4444 /boot/efi vfat umask=0077 0 1\n")},
+	"sys/fs/btrfs/features/raid1c34":                                 {Data: []byte("0\n")},
+	"sys/fs/btrfs/5c2e0f7a-8d8e-4c1b-9f3e-2b1d7c6a9e10/devices/sda2": {},
+	"sys/fs/btrfs/5c2e0f7a-8d8e-4c1b-9f3e-2b1d7c6a9e10/devices/sdb2": {},
+	"sys/class/block/sdc1/holders/md127":                             {},
+	"sys/class/block/sdd1/holders/md127":                             {},
+	"sys/class/block/md127/slaves/sdc1":                              {},
+	"sys/class/block/md127/slaves/sdd1":                              {},
+	"sys/class/block/sda2/partition":                                 {Data: []byte("2\n")},
+	"sys/class/block/sdb2/partition":                                 {Data: []byte("2\n")},
+	"sys/class/block/sdc1/partition":                                 {Data: []byte("1\n")},
+	"sys/class/block/sdd1/partition":                                 {Data: []byte("1\n")},
+}
+
+var btrfsRaidLinks = map[string]string{
+	"/dev/disk/by-uuid/5c2e0f7a-8d8e-4c1b-9f3e-2b1d7c6a9e10": "../../sda2",
+	"/dev/disk/by-uuid/3333-4444":                            "../../sdc1",
+	"/sys/class/block/sda2":                                  "../../devices/pci0000:00/0000:00:17.0/ata1/host0/target0:0:0/0:0:0:0/block/sda/sda2",
+	"/sys/class/block/sdb2":                                  "../../devices/pci0000:00/0000:00:17.0/ata2/host1/target1:0:0/1:0:0:0/block/sdb/sdb2",
+	"/sys/class/block/sdc1":                                  "../../devices/pci0000:00/0000:00:17.0/ata3/host2/target2:0:0/2:0:0:0/block/sdc/sdc1",
+	"/sys/class/block/sdd1":                                  "../../devices/pci0000:00/0000:00:17.0/ata4/host3/target3:0:0/3:0:0:0/block/sdd/sdd1",
+}
+
+func TestGetAllDevices(t *testing.T) {
+	t.Parallel()
+
+	usbDisk := func(name string, reason string) imaging.Device {
+		return imaging.Device{Name: "/dev/" + name, Model: "Flash Disk", Size: imaging.BytesToString(2000748032, false),
+			Bytes: 2000748032, Removable: true, Transport: "usb", ExcludedReason: reason}
+	}
+	lsblkOutput := `{"blockdevices": [
+		{"kname": "nvme0n1", "type": "disk", "rm": false, "ro": false, "size": 1024209543168, "model": "WD PC SN560 SDDPNQE-1T00-1102", "vendor": null, "tran": "nvme"},
+		{"kname": "sr0", "type": "rom", "rm": true, "ro": false, "size": 1073741312, "model": "DVD-RW", "vendor": null, "tran": "sata"}`
+	for _, name := range []string{"sda", "sdb", "sdc", "sdd", "sde", "sdf", "sdg", "sdh"} {
+		lsblkOutput += `,
+		{"kname": "` + name + `", "type": "disk", "rm": true, "ro": false, "size": 2000748032, "model": "Flash Disk", "vendor": null, "tran": "usb"}`
+	}
+	lsblkOutput += "]}"
+
+	t.Run("lsblk", func(t *testing.T) {
+		t.Parallel()
+		devices, err := imaging.GetAllDevices(mockDevicesPlatform{
+			Platform: imaging.SystemPlatform,
+			T:        t,
+			allowedCmds: map[string]mockDevicesPlatformCommand{
+				"lsblk": {args: lsblkArgs, output: []byte(lsblkOutput)},
+			},
+			files: systemDisksFiles,
+			links: systemDisksLinks,
+		})
+		expectedDevices := []imaging.Device{
+			{Name: "/dev/nvme0n1", Model: "WD PC SN560 SDDPNQE-1T00-1102", Size: imaging.BytesToString(1024209543168, false), Bytes: 1024209543168,
+				Transport: "nvme", ExcludedReason: imaging.ExcludedSystemDevice + " (mounted at /)"},
+			{Name: "/dev/sr0", Model: "DVD-RW", Size: imaging.BytesToString(1073741312, false), Bytes: 1073741312, Removable: true,
+				Transport: "sata", ExcludedReason: imaging.ExcludedNotDisk},
+			usbDisk("sda", imaging.ExcludedSystemDevice+" (mounted at /var)"),
+			usbDisk("sdb", ""),
+			usbDisk("sdc", imaging.ExcludedSystemDevice+" (used as swap)"),
+			usbDisk("sdd", imaging.ExcludedSystemDevice+" (in /etc/fstab at /boot)"),
+			usbDisk("sde", ""),
+			usbDisk("sdf", ""),
+			usbDisk("sdg", imaging.ExcludedSystemDevice+" (mounted at /srv/data)"),
+			usbDisk("sdh", imaging.ExcludedSystemDevice+" (in /etc/fstab at /mnt/data)"),
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		} else if len(devices) != len(expectedDevices) {
+			t.Fatalf("expected %d devices, got %d", len(expectedDevices), len(devices))
+		}
+		for i := range devices {
+			if !reflect.DeepEqual(devices[i], expectedDevices[i]) {
+				t.Errorf("expected device %+v, got %+v", expectedDevices[i], devices[i])
+			}
+		}
+	})
+
+	t.Run("btrfs RAID1", func(t *testing.T) {
+		t.Parallel()
+		devices, err := imaging.GetAllDevices(mockDevicesPlatform{
+			Platform: imaging.SystemPlatform,
+			T:        t,
+			allowedCmds: map[string]mockDevicesPlatformCommand{
+				"lsblk": {args: lsblkArgs, output: []byte(lsblkOutput)},
+			},
+			files: btrfsRaidFiles,
+			links: btrfsRaidLinks,
+		})
+		expectedReasons := map[string]string{
+			"/dev/sda": imaging.ExcludedSystemDevice + " (mounted at /)",
+			"/dev/sdb": imaging.ExcludedSystemDevice + " (mounted at /)",
+			"/dev/sdc": imaging.ExcludedSystemDevice + " (in /etc/fstab at /boot/efi)",
+			"/dev/sdd": imaging.ExcludedSystemDevice + " (in /etc/fstab at /boot/efi)",
+			"/dev/sde": "",
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		for _, device := range devices {
+			if reason, ok := expectedReasons[device.Name]; ok && device.ExcludedReason != reason {
+				t.Errorf("expected %s to be excluded with %q, got %q", device.Name, reason, device.ExcludedReason)
+			}
+		}
+	})
+
+	t.Run("sysfs", func(t *testing.T) {
+		t.Parallel()
+		devices, err := imaging.GetAllDevices(mockDevicesPlatform{
+			Platform: imaging.SystemPlatform,
+			T:        t,
+			files:    mergeFiles(fedoraSystemFiles, sysfsFiles),
+			links:    mergeLinks(fedoraSystemLinks, sysfsLinks),
+		})
+		expectedDevices := []imaging.Device{
+			{Name: "/dev/loop0", Size: imaging.BytesToString(8192*512, false), Bytes: 8192 * 512, ReadOnly: true,
+				ExcludedReason: imaging.ExcludedNotDisk},
+			{Name: "/dev/mmcblk0", Size: imaging.BytesToString(62333952*512, false), Bytes: 62333952 * 512, ReadOnly: true,
+				Transport: "mmc", ExcludedReason: imaging.ExcludedNotRemovable},
+			{Name: "/dev/nvme0n1", Model: "WD PC SN560 SDDPNQE-1T00-1102", Size: imaging.BytesToString(2000409264*512, false),
+				Bytes: 2000409264 * 512, Serial: "23195H800123", Transport: "nvme", LogicalSectorSize: 512, PhysicalSectorSize: 512,
+				ExcludedReason: imaging.ExcludedSystemDevice + " (mounted at /)"},
+			sysfsCruzer,
+			{Name: "/dev/zram0", Size: imaging.BytesToString(16777216*512, false), Bytes: 16777216 * 512,
+				ExcludedReason: imaging.ExcludedSystemDevice + " (used as swap)"},
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		} else if len(devices) != len(expectedDevices) {
+			t.Fatalf("expected %d devices, got %d", len(expectedDevices), len(devices))
+		}
+		for i := range devices {
+			if !reflect.DeepEqual(devices[i], expectedDevices[i]) {
+				t.Errorf("expected device %+v, got %+v", expectedDevices[i], devices[i])
+			}
+		}
+	})
+}
+
+type mockWritablePlatform struct {
+	mockDevicesPlatform
+	mode fs.FileMode
+	// ioctlReadOnly is the value returned by the BLKROGET ioctl.
+	ioctlReadOnly int
+}
+
+func (p mockWritablePlatform) OsStat(name string) (fs.FileInfo, error) {
+	if name != "/dev/sda" {
+		return nil, os.ErrNotExist
+	}
+	return fakeFileInfo{mode: p.mode}, nil
+}
+
+func (p mockWritablePlatform) OsOpen(name string) (*os.File, error) {
+	return os.Open(os.DevNull)
+}
+
+func (p mockWritablePlatform) SyscallIoctlGetInt(fd uintptr, req uint) (int, error) {
+	return p.ioctlReadOnly, nil
+}
+
+func (p mockWritablePlatform) SyscallUnmount(target string, flags int) error {
+	p.T.Errorf("SyscallUnmount called unexpectedly for %s", target)
+	return nil
+}
+
+type fakeFileInfo struct {
+	mode fs.FileMode
+}
+
+func (f fakeFileInfo) Name() string       { return "" }
+func (f fakeFileInfo) Size() int64        { return 0 }
+func (f fakeFileInfo) Mode() fs.FileMode  { return f.mode }
+func (f fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (f fakeFileInfo) IsDir() bool        { return false }
+func (f fakeFileInfo) Sys() any           { return nil }
+
+func TestCheckDeviceWritableWithPlatform(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name          string
+		device        string
+		mode          fs.FileMode
+		files         fstest.MapFS
+		ioctlReadOnly int
+		expectedError error
+	}{
+		{name: "stat error bubbles up", device: "/dev/sdz", mode: fs.ModeDevice, expectedError: os.ErrNotExist},
+		{name: "not a block device", device: "/dev/sda", expectedError: imaging.ErrNotBlockDevice},
+		{name: "writable device", device: "/dev/sda", mode: fs.ModeDevice,
+			files: fstest.MapFS{"sys/class/block/sda/ro": {Data: []byte("0\n")}}},
+		{name: "read-only in sysfs", device: "/dev/sda", mode: fs.ModeDevice,
+			files:         fstest.MapFS{"sys/class/block/sda/ro": {Data: []byte("1\n")}},
+			expectedError: imaging.ErrDeviceReadOnly},
+		{name: "read-only through ioctl", device: "/dev/sda", mode: fs.ModeDevice, ioctlReadOnly: 1,
+			expectedError: imaging.ErrDeviceReadOnly},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			err := imaging.CheckDeviceWritableWithPlatform(mockWritablePlatform{
+				mockDevicesPlatform: mockDevicesPlatform{T: t, files: testCase.files},
+				mode:                testCase.mode,
+				ioctlReadOnly:       testCase.ioctlReadOnly,
+			}, testCase.device)
+			if testCase.expectedError == nil && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if !errors.Is(err, testCase.expectedError) {
+				t.Errorf("expected error %v, got %v", testCase.expectedError, err)
+			}
+		})
+	}
+}
+
+type mockSameDevicePlatform struct {
+	mockDevicesPlatform
+}
+
+func (p mockSameDevicePlatform) OsStat(name string) (fs.FileInfo, error) {
+	return fakeFileInfo{mode: fs.ModeDevice}, nil
+}
+
+func TestSameDeviceWithPlatform(t *testing.T) {
+	t.Parallel()
+	platform := mockSameDevicePlatform{mockDevicesPlatform{
+		T:     t,
+		files: mergeFiles(fedoraSystemFiles, sysfsFiles),
+		links: mergeLinks(fedoraSystemLinks, fedoraByIDLinks, map[string]string{
+			"/sys/class/block/sda1": "../../devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host0/target0:0:0/0:0:0:0/block/sda/sda1",
+		}),
+	}}
+	platform.files["sys/class/block/sda1/partition"] = &fstest.MapFile{Data: []byte("1\n")}
+	testCases := []struct {
+		name     string
+		a        string
+		b        string
+		expected bool
+	}{
+		{"same disk", "/dev/sda", "/dev/disk/by-id/usb-SanDisk_Cruzer_4C530001230615117452-0:0", true},
+		{"partition of the disk", "/dev/sda", "/dev/disk/by-id/usb-SanDisk_Cruzer_4C530001230615117452-0:0-part1", true},
+		{"disk of the partition", "/dev/nvme0n1p2", "/dev/nvme0n1", true},
+		{"device mapper on the disk", "/dev/mapper/luks-283e2319-0541-4588-93ef-a2687dd09fc7", "/dev/nvme0n1", true},
+		{"different disks", "/dev/sda1", "/dev/nvme0n1", false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			if imaging.SameDeviceWithPlatform(platform, testCase.a, testCase.b) != testCase.expected {
+				t.Errorf("expected SameDevice(%s, %s) to be %v", testCase.a, testCase.b, testCase.expected)
+			}
+		})
+	}
+}
@@ -1,64 +1,97 @@
 package imaging
 
 import (
+	"errors"
 	"io/fs"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
-// Device is a struct representing a block device.
-type Device struct {
-	Name  string
-	Model string
-	Size  string
-	Bytes int
-}
-
-const wmicArgs = "diskdrive get deviceid, mediatype, model, caption, size"
+const wmicArgs = "diskdrive get BytesPerSector,Caption,DeviceID,InterfaceType,MediaType,Model,SerialNumber,Size /format:list"
 
-// GetDevices returns the list of USB devices available to read/write from.
-func GetDevices(platform Platform) ([]Device, error) {
+// GetAllDevices returns the list of all disks, including those excluded from [GetDevices], along
+// with the reason they were excluded.
+func GetAllDevices(platform Platform) ([]Device, error) {
 	// FIXME: Write unit tests
 	res, err := platform.ExecCommandOutput(platform.ExecCommand("wmic", strings.Split(wmicArgs, " ")...))
 	if err != nil {
 		return nil, err
 	}
 
-	availableDisks := strings.Split(strings.TrimSpace(string(res)), "\n")
+	// With /format:list, each disk is printed as Key=Value lines, separated by blank lines.
+	availableDisks := []map[string]string{}
+	disk := map[string]string{}
+	for _, line := range strings.Split(string(res), "\n") {
+		line = strings.TrimSpace(line)
+		if key, value, ok := strings.Cut(line, "="); ok {
+			disk[key] = strings.TrimSpace(value)
+		} else if line == "" && len(disk) > 0 {
+			availableDisks = append(availableDisks, disk)
+			disk = map[string]string{}
+		}
+	}
+	if len(disk) > 0 {
+		availableDisks = append(availableDisks, disk)
+	}
 
 	disks := []Device{}
 
-	for _, availableDisk := range availableDisks {
-		split := strings.Split(availableDisk, "  ")
-		disk := []string{}
-		for _, element := range split {
-			trimmed := strings.TrimSpace(element)
-			if trimmed != "" {
-				disk = append(disk, trimmed)
-			}
+	for _, disk := range availableDisks {
+		bytes, _ := strconv.Atoi(disk["Size"])
+		sectorSize, _ := strconv.Atoi(disk["BytesPerSector"])
+		device := Device{
+			Name:              disk["DeviceID"],
+			Model:             disk["Model"],
+			Size:              BytesToString(bytes, false),
+			Bytes:             bytes,
+			Removable:         disk["MediaType"] == "Removable Media",
+			Serial:            disk["SerialNumber"],
+			Transport:         strings.ToLower(disk["InterfaceType"]),
+			LogicalSectorSize: sectorSize,
 		}
-		indexOffset := 0
-		if len(disk) == 5 {
-			indexOffset = 1
+		if device.Model == "" {
+			device.Model = disk["Caption"]
 		}
-		if disk[1+indexOffset] == "Removable Media" {
-			bytes, _ := strconv.Atoi(disk[3+indexOffset])
-			device := Device{
-				Name:  disk[0+indexOffset],
-				Size:  BytesToString(bytes, false),
-				Bytes: bytes,
-			}
-			if indexOffset == 1 {
-				device.Model = disk[0]
-			}
-			disks = append(disks, device)
+		if !device.Removable {
+			device.ExcludedReason = ExcludedNotRemovable
 		}
+		disks = append(disks, device)
 	}
 
 	return disks, nil
 }
 
+// ioctlDiskIsWritable is IOCTL_DISK_IS_WRITABLE, which fails with ERROR_WRITE_PROTECT if a disk is
+// write-protected.
+const ioctlDiskIsWritable = 0x00070024
+
+// errorWriteProtect is ERROR_WRITE_PROTECT.
+const errorWriteProtect = syscall.Errno(19)
+
+// CheckDeviceWritable returns [ErrDeviceReadOnly] if a disk is write-protected, before flashing
+// to it (and unmounting its partitions).
+func CheckDeviceWritable(device string) error {
+	// FIXME: Write unit tests
+	path, err := syscall.UTF16PtrFromString(device)
+	if err != nil {
+		return err
+	}
+	handle, err := syscall.CreateFile(path, syscall.GENERIC_READ,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil, syscall.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+	var bytesReturned uint32
+	err = syscall.DeviceIoControl(handle, ioctlDiskIsWritable, nil, 0, nil, 0, &bytesReturned, nil)
+	if errors.Is(err, errorWriteProtect) {
+		return ErrDeviceReadOnly
+	}
+	return nil // Writing will fail with a more appropriate error, if it does.
+}
+
 // UnmountDevice unmounts a block device's partitons before flashing to it.
 func UnmountDevice(device string) error {
 	// FIXME: Write unit tests
@@ -0,0 +1,25 @@
+//go:build linux
+
+package imaging
+
+import (
+	"os"
+	"syscall"
+)
+
+// directIOFlag is the flag to open devices with to bypass the page cache, if supported.
+const directIOFlag = syscall.O_DIRECT
+
+// disableDirectIO stops bypassing the page cache for a file opened with [directIOFlag], which
+// is needed to write blocks which aren't aligned to the logical sector size of the device.
+func disableDirectIO(file *os.File) error {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return errno
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_SETFL, flags&^syscall.O_DIRECT)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package imaging
+
+import "os"
+
+// directIOFlag is the flag to open devices with to bypass the page cache, if supported.
+const directIOFlag = 0
+
+// disableDirectIO stops bypassing the page cache for a file opened with [directIOFlag], which
+// is needed to write blocks which aren't aligned to the logical sector size of the device.
+func disableDirectIO(file *os.File) error {
+	return nil
+}
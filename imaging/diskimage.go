@@ -3,6 +3,7 @@ package imaging
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +14,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,10 +23,135 @@ import (
 var ErrDeviceValidationFailed = errors.New(
 	"read/write mismatch, validation of image on device failed")
 
+// ValidationError is returned when the image on the device does not match the disk image. It
+// matches [ErrDeviceValidationFailed] with [errors.Is].
+type ValidationError struct {
+	// Offset is the offset of the first byte on the device which differs from the disk image (or
+	// the first block or range, when validating against [BlockHashes] or a [Bmap]), or where the
+	// device ran out of data if Truncated is true.
+	Offset int
+	// MismatchedBlocks is the number of blocks on the device which differ from the disk image.
+	MismatchedBlocks int
+	// BlockSize is the size of the blocks which were compared.
+	BlockSize int
+	// Truncated is true if the device ran out of data before the end of the disk image, e.g.
+	// because the device is smaller than the image, or the write was cut short.
+	Truncated bool
+}
+
+func (e *ValidationError) Error() string {
+	if e.Truncated && e.MismatchedBlocks == 0 {
+		return fmt.Sprintf("%v! the device ended at byte %d, before the end of the image",
+			ErrDeviceValidationFailed, e.Offset)
+	}
+	message := fmt.Sprintf("%v! first mismatch at byte %d, %d blocks of %s differ",
+		ErrDeviceValidationFailed, e.Offset, e.MismatchedBlocks, BytesToString(e.BlockSize, true))
+	if e.Truncated {
+		message += ", and the device ended before the end of the image"
+	}
+	return message
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrDeviceValidationFailed
+}
+
 // ErrReadWriteMismatch is returned if written bytes are not the same as bytes as read.
 // Typically caused by target device being too small.
 var ErrReadWriteMismatch = errors.New("mismatch between bytes read and written")
 
+// ErrCancelled is returned (as a [*CancelledError]) when an operation is cancelled.
+var ErrCancelled = errors.New("the operation was cancelled")
+
+// CancelledError is returned when an operation is cancelled through its context. It matches
+// [ErrCancelled] with [errors.Is].
+type CancelledError struct {
+	// Bytes is the number of bytes written (or validated) before the operation was cancelled.
+	Bytes int
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("the operation was cancelled after %d bytes", e.Bytes)
+}
+
+func (e *CancelledError) Is(target error) bool {
+	return target == ErrCancelled
+}
+
+// DefaultBlockSize is the default size of each read and write when writing or validating images.
+const DefaultBlockSize = 4 * 1024 * 1024
+
+// MaxBlockSize is the largest block size accepted by [ParseBlockSize]. Several blocks are buffered
+// at once while writing, so larger blocks would use a lot of memory without being any faster.
+const MaxBlockSize = 64 * 1024 * 1024
+
+// SyncPolicy controls when writes are synced to the device by [WriteImage].
+type SyncPolicy int
+
+const (
+	// SyncEnd syncs writes once the whole image is written (or writing is cancelled).
+	SyncEnd SyncPolicy = iota
+	// SyncPeriodic syncs writes every second as well, before reporting progress, so progress
+	// reflects the throughput of the device rather than the page cache.
+	SyncPeriodic
+	// SyncNone never syncs writes, leaving it up to the OS.
+	SyncNone
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncPeriodic:
+		return "periodic"
+	case SyncNone:
+		return "none"
+	}
+	return "end"
+}
+
+// ParseSyncPolicy parses a [SyncPolicy] from its name, either end, periodic or none.
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	for _, p := range []SyncPolicy{SyncEnd, SyncPeriodic, SyncNone} {
+		if p.String() == policy {
+			return p, nil
+		}
+	}
+	return SyncEnd, fmt.Errorf("invalid sync policy %s, expected end, periodic or none", policy)
+}
+
+// CopyOptions configures how disk images are written and validated.
+type CopyOptions struct {
+	// BlockSize is the size of each read and write, or [DefaultBlockSize] if zero.
+	BlockSize int
+	// Progress is called periodically with the progress of the operation, if not nil.
+	Progress ProgressFunc
+	// TargetProgress is called periodically with the progress of writing to each target by
+	// [WriteImageTargets] and [CloneDevice] instead of Progress, if not nil. It is called from a
+	// separate goroutine for each target.
+	TargetProgress TargetProgressFunc
+	// Checksum is the expected checksum of the disk image, if not nil. The image is hashed as it
+	// is read, and a [*ChecksumMismatchError] is returned once it is exhausted if it doesn't match.
+	// For a [*SourceImage], the image file is hashed as-is, i.e. before decompression.
+	Checksum *Checksum
+	// Hashes records the hashes of the image written by [WriteImage], if not nil, in blocks of
+	// its own BlockSize, to validate the image on the device against with [ValidateHashes] later.
+	Hashes *BlockHashes
+	// Sync controls when writes are synced to the device by [WriteImage], see [SyncPolicy].
+	Sync SyncPolicy
+	// DirectIO writes to the device bypassing the page cache (with O_DIRECT), on Linux only. This
+	// makes progress reflect the data actually written to the device, instead of the page cache.
+	DirectIO bool
+	// Sparse controls how the holes in a disk image are written and validated with a [Bmap], see
+	// [SparseMode]. It is ignored without a bmap.
+	Sparse SparseMode
+}
+
+func (o CopyOptions) blockSize() int {
+	if o.BlockSize <= 0 {
+		return DefaultBlockSize
+	}
+	return o.BlockSize
+}
+
 // IsDirectoryError is returned if a path that was passed is a directory, but a file was expected.
 type IsDirectoryError struct{ Name string }
 
@@ -41,8 +169,20 @@ func (e *NotExistsError) Error() string {
 // FormatProgress formats the progress of a dd-like operation.
 // There's some minor differences in output with dd, mainly decimal places and kB vs KB.
 func FormatProgress(total int, delta int64, action string, floatPrec bool) string {
+	return formatProgress(total, delta, action, "", floatPrec)
+}
+
+// FormatCompressedProgress formats the progress of a dd-like operation on a compressed image.
+// Alongside the decompressed bytes processed, it reports how much of the compressed image has
+// been read, in the form of `<read>/<size> compressed bytes read`.
+func FormatCompressedProgress(total int, read int, size int, delta int64, action string, floatPrec bool) string {
+	return formatProgress(total, delta, action,
+		strconv.Itoa(read)+"/"+strconv.Itoa(size)+" compressed bytes read, ", floatPrec)
+}
+
+func formatProgress(total int, delta int64, action string, extra string, floatPrec bool) string {
 	str := strconv.Itoa(total) + " bytes " +
-		"(" + BytesToString(total, false) + ", " + BytesToString(total, true) + ") " + action + ", "
+		"(" + BytesToString(total, false) + ", " + BytesToString(total, true) + ") " + action + ", " + extra
 	if floatPrec {
 		timeDifference := float64(delta) / 1000
 		speed := 0
@@ -61,95 +201,222 @@ func FormatProgress(total int, delta int64, action string, floatPrec bool) strin
 	return str
 }
 
+// DdError is returned by [RunDd] if dd fails, with the exit code of dd.
+type DdError struct {
+	ExitCode int
+}
+
+func (e *DdError) Error() string {
+	return fmt.Sprintf("dd failed with exit code %d", e.ExitCode)
+}
+
 // RunDd is a wrapper around the `dd` command. This wrapper behaves
-// identically to dd, but accepts stdin input "stop\n".
-func RunDd(iff string, of string) error {
+// identically to dd, but is killed when the context is cancelled.
+// If dd fails, a [*DdError] is returned with its exit code.
+func RunDd(ctx context.Context, iff string, of string) error {
 	conv := "conv=sync"
 	if runtime.GOOS == "linux" {
 		conv = "conv=fdatasync"
 	}
-	cmd := exec.Command("dd", "if="+iff, "of="+of, "status=progress", "bs=1M", conv)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-	go io.Copy(os.Stdout, stdout)
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
-	}
-	go io.Copy(os.Stderr, stderr)
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
-	quit := handleStopInput(os.Stdin, func() { cmd.Process.Kill() })
-	err = cmd.Wait()
-	quit <- true
-	if err != nil && cmd.ProcessState.ExitCode() != 0 {
-		os.Exit(cmd.ProcessState.ExitCode())
+	cmd := exec.CommandContext(ctx, "dd", "if="+iff, "of="+of, "status=progress", "bs=1M", conv)
+	progress := &ddProgressWriter{dest: os.Stderr}
+	cmd.Stdout, cmd.Stderr = os.Stdout, progress
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if ctx.Err() != nil {
+		return &CancelledError{Bytes: progress.bytes}
+	} else if errors.As(err, &exitErr) {
+		return &DdError{ExitCode: exitErr.ExitCode()}
 	}
 	return err
 }
 
+// ddProgressWriter passes the output of dd through to dest, keeping track of the bytes copied
+// according to the last progress line, e.g. "1048576 bytes (1.0 MB, 1.0 MiB) copied, ...".
+type ddProgressWriter struct {
+	dest  io.Writer
+	line  []byte
+	bytes int
+}
+
+func (w *ddProgressWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c != '\r' && c != '\n' {
+			w.line = append(w.line, c)
+			continue
+		}
+		if fields := strings.Fields(string(w.line)); len(fields) >= 2 && fields[1] == "bytes" {
+			if bytes, err := strconv.Atoi(fields[0]); err == nil {
+				w.bytes = bytes
+			}
+		}
+		w.line = w.line[:0]
+	}
+	return w.dest.Write(p)
+}
+
 // WriteDiskImage is a re-implementation of dd to work cross-platform on Windows as well.
+// Compressed images are transparently decompressed while being written to the device.
 func WriteDiskImage(iff string, of string) error {
+	return WriteDiskImageEntry(context.Background(), iff, "", of, CopyOptions{Progress: PrintProgress("copied")})
+}
+
+// WriteDiskImageEntry is [WriteDiskImage] for a specific entry in a zip archive. If entry is
+// empty, the only disk image in the archive is written. Progress is reported according to the
+// given [CopyOptions] instead of being printed, and writing stops when the context is cancelled.
+func WriteDiskImageEntry(ctx context.Context, iff string, entry string, of string, opts CopyOptions) error {
 	// References to use:
 	// https://stackoverflow.com/questions/21032426/low-level-disk-i-o-in-golang
 	// https://stackoverflow.com/questions/56512227/how-to-read-and-write-low-level-raw-disk-in-windows-and-go
-	quit := handleStopInput(os.Stdin, func() { os.Exit(0) })
-	src, err := openFile(iff, os.O_RDONLY, 0, "file")
+	src, err := OpenSourceImage(iff, entry)
 	if err != nil {
 		return err
 	}
 	defer src.Close()
-	dest, err := openFile(of, os.O_WRONLY|os.O_EXCL, os.ModePerm, "destination")
+	dest, file, err := openDestination(of, opts.DirectIO)
 	if err != nil {
 		return err
 	}
-	defer dest.Close()
-	bs := 4 * 1024 * 1024 // TODO: Allow configurability?
+	defer file.Close()
+	return WriteImage(ctx, src, dest, opts)
+}
+
+// openDestination opens the device to write a disk image to, returning the writer to write to
+// and the file to close afterwards. If directIO is true, direct I/O is used where supported.
+func openDestination(of string, directIO bool) (io.Writer, *os.File, error) {
+	if directIO && directIOFlag != 0 {
+		file, err := openFile(of, os.O_WRONLY|os.O_EXCL|directIOFlag, os.ModePerm, "destination")
+		if err == nil {
+			return &directWriter{file: file}, file, nil
+		} else if !errors.Is(err, syscall.EINVAL) { // Some filesystems don't support direct I/O.
+			return nil, nil, err
+		}
+	}
+	file, err := openFile(of, os.O_WRONLY|os.O_EXCL, os.ModePerm, "destination")
+	return file, file, err
+}
+
+// directWriter writes to a file opened with [directIOFlag], which requires writes to be aligned
+// to the logical sector size of the device. Direct I/O is disabled for unaligned writes, which
+// happen at most once, for the last block of a disk image.
+type directWriter struct {
+	file *os.File
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	if len(p)%bufferAlignment != 0 {
+		if err := disableDirectIO(w.file); err != nil {
+			return 0, err
+		}
+	}
+	return w.file.Write(p)
+}
+
+func (w *directWriter) WriteAt(p []byte, off int64) (int, error) {
+	if len(p)%bufferAlignment != 0 || off%bufferAlignment != 0 {
+		if err := disableDirectIO(w.file); err != nil {
+			return 0, err
+		}
+	}
+	return w.file.WriteAt(p, off)
+}
+
+func (w *directWriter) Sync() error {
+	return w.file.Sync()
+}
+
+// WriteImage copies a disk image from src to dest, until src is exhausted or the context is
+// cancelled, in which case a [*CancelledError] is returned. If dest has a Sync method (e.g. it
+// is an [*os.File]), writes are synced to disk before returning, even when cancelled, unless
+// [CopyOptions.Sync] is [SyncNone].
+//
+// The next blocks of the disk image are read from src in a separate goroutine while the current
+// block is written to dest, and progress reports the bytes written to dest so far.
+func WriteImage(ctx context.Context, src io.Reader, dest io.Writer, opts CopyOptions) error {
+	return writeImage(ctx, src, dest, opts, pipelineBuffers)
+}
+
+func writeImage(ctx context.Context, src io.Reader, dest io.Writer, opts CopyOptions, buffers int) error {
+	bs := opts.blockSize()
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
-	startTime := time.Now().UnixMilli()
+	startTime := time.Now()
 	var total int
-	buf := make([]byte, bs)
+	reader, verifyChecksum := startChecksum(src, opts.Checksum)
+	opts.Hashes.reset()
+	pipeline := startPipeline(reader, src, bs, buffers)
+	defer pipeline.stop()
+	progress := func(block pipelineBlock, done bool) Progress {
+		progress := block.progress
+		progress.Bytes, progress.Duration, progress.Done = total, time.Since(startTime), done
+		return progress
+	}
+	syncDest := func() error {
+		if opts.Sync == SyncNone {
+			return nil
+		}
+		return syncWriter(dest)
+	}
+	var block pipelineBlock
 	for {
-		n1, errRead := src.Read(buf)
-		if errRead != nil && errRead != io.EOF {
-			return fmt.Errorf("encountered error while reading file! %w", errRead)
+		if ctx.Err() != nil {
+			if err := syncDest(); err != nil {
+				return fmt.Errorf("failed to sync writes to disk! %w", err)
+			}
+			return &CancelledError{Bytes: total}
 		}
-		n2, err := dest.Write(buf[:n1])
+		block = <-pipeline.blocks
+		if block.err != nil && block.err != io.EOF {
+			return fmt.Errorf("encountered error while reading file! %w", block.err)
+		}
+		n, err := dest.Write(block.data)
 		if err != nil {
 			return fmt.Errorf("encountered error while writing to dest! %w", err)
-		} else if n2 != n1 {
+		} else if n != len(block.data) {
 			return ErrReadWriteMismatch
 		}
-		total += n1
-		if errRead == io.EOF {
+		opts.Hashes.add(block.data)
+		total += n
+		if block.err == io.EOF {
 			break
 		}
+		pipeline.release(block)
 		select {
 		case <-ticker.C:
-			print(FormatProgress(total, time.Now().UnixMilli()-startTime, "copied", false) + "\r")
+			if opts.Sync == SyncPeriodic {
+				if err := syncWriter(dest); err != nil {
+					return fmt.Errorf("failed to sync writes to disk! %w", err)
+				}
+			}
+			if opts.Progress != nil {
+				opts.Progress(progress(block, false))
+			}
 		default:
 		}
 	}
-	// t, _ := io.CopyBuffer(dest, file, buf); total = int(t)
-	err = dest.Sync()
+	err := syncDest()
 	if err != nil {
 		return fmt.Errorf("failed to sync writes to disk! %w", err)
-	} else {
-		println(FormatProgress(total, time.Now().UnixMilli()-startTime, "copied", true))
+	} else if err := verifyChecksum(); err != nil {
+		return err
+	} else if opts.Progress != nil {
+		opts.Progress(progress(block, true))
 	}
-	quit <- true
 	return nil
 }
 
 // ValidateDiskImage checks if the block device contents match the given disk image.
+// Compressed images are transparently decompressed while being compared.
 func ValidateDiskImage(iff string, of string) error {
-	quit := handleStopInput(os.Stdin, func() { os.Exit(0) })
-	src, err := openFile(iff, os.O_RDONLY, 0, "file")
+	return ValidateDiskImageEntry(context.Background(), iff, "", of, CopyOptions{Progress: PrintProgress("validated")})
+}
+
+// ValidateDiskImageEntry is [ValidateDiskImage] for a specific entry in a zip archive. If entry
+// is empty, the only disk image in the archive is validated against. Progress is reported
+// according to the given [CopyOptions] instead of being printed, and validation stops when the
+// context is cancelled.
+func ValidateDiskImageEntry(ctx context.Context, iff string, entry string, of string, opts CopyOptions) error {
+	src, err := OpenSourceImage(iff, entry)
 	if err != nil {
 		return err
 	}
@@ -159,26 +426,49 @@ func ValidateDiskImage(iff string, of string) error {
 		return err
 	}
 	defer dest.Close()
-	bs := 4 * 1024 * 1024 // TODO: Allow configurability?
+	return ValidateImage(ctx, src, dest, opts)
+}
+
+// ValidateImage checks if the contents read from dest match the disk image read from src, until
+// src is exhausted or the context is cancelled, in which case a [*CancelledError] is returned.
+// Mismatches don't stop validation, so the returned [*ValidationError] covers the whole image,
+// unless dest runs out of data first.
+func ValidateImage(ctx context.Context, src io.Reader, dest io.Reader, opts CopyOptions) error {
+	bs := opts.blockSize()
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
-	startTime := time.Now().UnixMilli()
+	startTime := time.Now()
 	var total int
 	buf1 := make([]byte, bs)
 	buf2 := make([]byte, bs)
+	reader, verifyChecksum := startChecksum(src, opts.Checksum)
+	var mismatch *ValidationError
 	for {
-		n1, err1 := src.Read(buf1)
-		if err1 != nil && err1 != io.EOF {
+		if ctx.Err() != nil {
+			return &CancelledError{Bytes: total}
+		}
+		n1, err1 := io.ReadFull(reader, buf1)
+		if err1 == io.ErrUnexpectedEOF {
+			err1 = io.EOF
+		} else if err1 != nil && err1 != io.EOF {
 			return fmt.Errorf("encountered error while validating device! %w", err1)
 		}
 		n2, err2 := io.ReadFull(dest, buf2[:n1])
 		if err2 != nil && err2 != io.EOF && err2 != io.ErrUnexpectedEOF {
 			return fmt.Errorf("encountered error while validating device! %w", err2)
-		} else if err2 != nil {
-			return ErrDeviceValidationFailed
 		}
-		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
-			return ErrDeviceValidationFailed
+		if !bytes.Equal(buf1[:n2], buf2[:n2]) {
+			if mismatch == nil {
+				mismatch = &ValidationError{Offset: total + firstMismatch(buf1[:n2], buf2[:n2]), BlockSize: bs}
+			}
+			mismatch.MismatchedBlocks++
+		}
+		if err2 != nil { // The device ran out of data before the end of the image.
+			if mismatch == nil {
+				mismatch = &ValidationError{Offset: total + n2, BlockSize: bs}
+			}
+			mismatch.Truncated = true
+			return mismatch
 		}
 		total += n1
 		if err1 == io.EOF {
@@ -186,12 +476,104 @@ func ValidateDiskImage(iff string, of string) error {
 		}
 		select {
 		case <-ticker.C:
-			print(FormatProgress(total, time.Now().UnixMilli()-startTime, "validated", false) + "\r")
+			if opts.Progress != nil {
+				opts.Progress(readerProgress(src, total, startTime, false))
+			}
 		default:
 		}
 	}
-	println(FormatProgress(total, time.Now().UnixMilli()-startTime, "validated", true))
-	quit <- true
+	if mismatch != nil {
+		return mismatch
+	} else if err := verifyChecksum(); err != nil {
+		return err
+	} else if opts.Progress != nil {
+		opts.Progress(readerProgress(src, total, startTime, true))
+	}
+	return nil
+}
+
+// firstMismatch returns the index of the first byte which differs between a and b.
+func firstMismatch(a []byte, b []byte) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+// ValidateDeviceChecksum checks if the first size bytes of the block device match the checksum of
+// the disk image flashed to it, for when the disk image itself is no longer available. Progress
+// is reported according to the given [CopyOptions], whose Checksum is ignored.
+func ValidateDeviceChecksum(ctx context.Context, of string, size int, checksum *Checksum, opts CopyOptions) error {
+	dest, err := openFile(of, os.O_RDONLY|os.O_EXCL, os.ModePerm, "destination")
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return ValidateChecksum(ctx, dest, size, checksum, opts)
+}
+
+// ValidateChecksum checks if the first size bytes read from dest match the checksum, stopping
+// early if the context is cancelled, in which case a [*CancelledError] is returned. If they don't
+// match (or dest is smaller than size), an error matching [ErrDeviceValidationFailed] is returned.
+func ValidateChecksum(ctx context.Context, dest io.Reader, size int, checksum *Checksum, opts CopyOptions) error {
+	bs := opts.blockSize()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	startTime := time.Now()
+	progress := func(total int, done bool) Progress {
+		return Progress{Bytes: total, Total: size, Duration: time.Since(startTime), Done: done}
+	}
+	var total int
+	buf := make([]byte, bs)
+	hash := checksum.newHash()
+	for total < size {
+		if ctx.Err() != nil {
+			return &CancelledError{Bytes: total}
+		}
+		n, err := io.ReadFull(dest, buf[:min(bs, size-total)])
+		hash.Write(buf[:n])
+		total += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &ValidationError{Offset: total, BlockSize: bs, Truncated: true}
+		} else if err != nil {
+			return fmt.Errorf("encountered error while validating device! %w", err)
+		}
+		select {
+		case <-ticker.C:
+			if opts.Progress != nil {
+				opts.Progress(progress(total, false))
+			}
+		default:
+		}
+	}
+	if sum := hash.Sum(nil); !bytes.Equal(sum, checksum.Digest) {
+		return fmt.Errorf("%w! expected %s, got %s", ErrDeviceValidationFailed,
+			checksum, &Checksum{Algorithm: checksum.Algorithm, Digest: sum})
+	} else if opts.Progress != nil {
+		opts.Progress(progress(total, true))
+	}
+	return nil
+}
+
+// WithStopInput returns a copy of the parent context which is cancelled when "stop\n" is read
+// from the given input (typically stdin), or when the returned cancel function is called.
+func WithStopInput(parent context.Context, input io.Reader) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	quit := handleStopInput(input, cancel)
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() { quit <- true })
+		cancel()
+	}
+}
+
+// syncWriter commits writes to disk if the writer supports it.
+func syncWriter(writer any) error {
+	if syncer, ok := writer.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
 	return nil
 }
 
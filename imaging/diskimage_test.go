@@ -2,6 +2,7 @@ package imaging
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"errors"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -16,7 +18,7 @@ import (
 
 func GenerateTempFile(t *testing.T, suffix string, prefill bool) (*os.File, []byte) {
 	t.Helper()
-	sample, err := os.CreateTemp(t.TempDir(), t.Name()+"_"+suffix)
+	sample, err := os.CreateTemp(t.TempDir(), strings.ReplaceAll(t.Name(), "/", "_")+"_"+suffix)
 	if err != nil {
 		t.Fatalf("Failed to create temp file: %v", err)
 	}
@@ -60,6 +62,20 @@ func ChecksumFile(t *testing.T, file string) ([]byte, error) {
 	return fileHash.Sum(nil), nil
 }
 
+func TestDdProgressWriter(t *testing.T) {
+	t.Parallel()
+	var output bytes.Buffer
+	writer := &ddProgressWriter{dest: &output}
+	progress := "1048576 bytes (1.0 MB, 1.0 MiB) copied, 1 s, 1.0 MB/s\r20971"
+	writer.Write([]byte(progress))
+	writer.Write([]byte("52 bytes (2.1 MB, 2.0 MiB) copied, 2 s, 1.0 MB/s\r2+0 records in\n"))
+	if writer.bytes != 2097152 {
+		t.Errorf("Expected 2097152 bytes, got %d", writer.bytes)
+	} else if !strings.HasPrefix(output.String(), progress) {
+		t.Errorf("Expected output to be passed through, got %q", output.String())
+	}
+}
+
 func TestFlashAndValidationWithDd(t *testing.T) {
 	t.Parallel()
 	if _, err := exec.LookPath("dd"); err != nil {
@@ -72,11 +88,11 @@ func TestFlashAndValidationWithDd(t *testing.T) {
 		t.SkipNow() // We don't want to test RunDd failures since it doesn't have proper error handling,
 		// and this isn't a supported configuration either.
 		var errIsDir *IsDirectoryError
-		err := RunDd(sampleDir, dest.Name())
+		err := RunDd(context.Background(), sampleDir, dest.Name())
 		if !errors.As(err, &errIsDir) {
 			t.Errorf("Expected IsDirectoryError, got: %v", err)
 		}
-		err = RunDd(sample.Name(), sampleDir)
+		err = RunDd(context.Background(), sample.Name(), sampleDir)
 		if !errors.As(err, &errIsDir) {
 			t.Errorf("Expected IsDirectoryError, got: %v", err)
 		}
@@ -85,17 +101,24 @@ func TestFlashAndValidationWithDd(t *testing.T) {
 		t.SkipNow() // We don't want to test RunDd failures since it doesn't have proper error handling,
 		// and this isn't a supported configuration either.
 		var errNotExists *NotExistsError
-		err := RunDd(sample.Name(), filepath.Join(sampleDir, "nonexistent"))
+		err := RunDd(context.Background(), sample.Name(), filepath.Join(sampleDir, "nonexistent"))
 		if !errors.As(err, &errNotExists) {
 			t.Errorf("Expected NotExistsError, got: %v", err)
 		}
-		err = RunDd(filepath.Join(sampleDir, "nonexistent"), dest.Name())
+		err = RunDd(context.Background(), filepath.Join(sampleDir, "nonexistent"), dest.Name())
 		if !errors.As(err, &errNotExists) {
 			t.Errorf("Expected NotExistsError, got: %v", err)
 		}
 	})
+	t.Run("RunDd returns the exit code of dd", func(t *testing.T) {
+		var errDd *DdError
+		err := RunDd(context.Background(), filepath.Join(sampleDir, "nonexistent"), dest.Name())
+		if !errors.As(err, &errDd) || errDd.ExitCode == 0 {
+			t.Errorf("Expected DdError with a non-zero exit code, got: %v", err)
+		}
+	})
 	t.Run("RunDd executes correctly", func(t *testing.T) {
-		err := RunDd(sample.Name(), dest.Name())
+		err := RunDd(context.Background(), sample.Name(), dest.Name())
 		if err != nil {
 			t.Errorf("RunDd failed: %v", err)
 		} else if checksum, err := ChecksumFile(t, dest.Name()); err != nil {
@@ -185,6 +208,176 @@ func TestFlashAndValidation(t *testing.T) {
 	})
 }
 
+// cancellingReader cancels a context after a certain number of bytes are read from it.
+type cancellingReader struct {
+	reader io.Reader
+	after  int
+	cancel context.CancelFunc
+	read   int
+}
+
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += n
+	if r.read >= r.after {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestWriteAndValidateImage(t *testing.T) {
+	t.Parallel()
+	data := make([]byte, 10*1024*1024+512)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to read random data: %v", err)
+	}
+	t.Run("WriteImage and ValidateImage work with readers and writers", func(t *testing.T) {
+		t.Parallel()
+		var dest bytes.Buffer
+		if err := WriteImage(context.Background(), bytes.NewReader(data), &dest, CopyOptions{}); err != nil {
+			t.Errorf("WriteImage failed: %v", err)
+		} else if !bytes.Equal(dest.Bytes(), data) {
+			t.Errorf("Written data does not match original data")
+		}
+		if err := ValidateImage(context.Background(), bytes.NewReader(data), &dest, CopyOptions{}); err != nil {
+			t.Errorf("ValidateImage failed: %v", err)
+		}
+	})
+	t.Run("ValidateImage fails if data corrupted", func(t *testing.T) {
+		t.Parallel()
+		corrupted := bytes.Clone(data)
+		corrupted[1000]++
+		corrupted[len(corrupted)-1]++
+		err := ValidateImage(context.Background(), bytes.NewReader(data), bytes.NewReader(corrupted), CopyOptions{})
+		var errValidation *ValidationError
+		if !errors.Is(err, ErrDeviceValidationFailed) || !errors.As(err, &errValidation) {
+			t.Errorf("Expected ValidationError, got: %v", err)
+		} else if errValidation.Offset != 1000 || errValidation.MismatchedBlocks != 2 || errValidation.Truncated {
+			t.Errorf("Expected first mismatch at byte 1000 in 2 blocks, got: %+v", errValidation)
+		}
+	})
+	t.Run("ValidateImage reports where the device ran out of data", func(t *testing.T) {
+		t.Parallel()
+		truncated := data[:DefaultBlockSize+100]
+		err := ValidateImage(context.Background(), bytes.NewReader(data), bytes.NewReader(truncated), CopyOptions{})
+		var errValidation *ValidationError
+		if !errors.As(err, &errValidation) {
+			t.Errorf("Expected ValidationError, got: %v", err)
+		} else if !errValidation.Truncated || errValidation.Offset != len(truncated) || errValidation.MismatchedBlocks != 0 {
+			t.Errorf("Expected device to end at byte %d, got: %+v", len(truncated), errValidation)
+		}
+	})
+	t.Run("WriteImage and ValidateImage return immediately if already cancelled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var errCancelled *CancelledError
+		var dest bytes.Buffer
+		err := WriteImage(ctx, bytes.NewReader(data), &dest, CopyOptions{})
+		if !errors.Is(err, ErrCancelled) || !errors.As(err, &errCancelled) || errCancelled.Bytes != 0 {
+			t.Errorf("Expected CancelledError after 0 bytes, got: %v", err)
+		} else if dest.Len() != 0 {
+			t.Errorf("Expected no data to be written, got %d bytes", dest.Len())
+		}
+		err = ValidateImage(ctx, bytes.NewReader(data), bytes.NewReader(data), CopyOptions{})
+		if !errors.Is(err, ErrCancelled) || !errors.As(err, &errCancelled) || errCancelled.Bytes != 0 {
+			t.Errorf("Expected CancelledError after 0 bytes, got: %v", err)
+		}
+	})
+	t.Run("WriteImage stops cleanly when cancelled midway", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dest, _ := GenerateTempFile(t, "dest", false)
+		src := &cancellingReader{reader: bytes.NewReader(data), after: 1, cancel: cancel}
+		var errCancelled *CancelledError
+		err := WriteImage(ctx, src, dest, CopyOptions{})
+		if !errors.As(err, &errCancelled) {
+			t.Fatalf("Expected CancelledError, got: %v", err)
+		} else if errCancelled.Bytes > src.read { // Blocks are read ahead of the ones written.
+			t.Errorf("Expected CancelledError after at most %d bytes, got %d", src.read, errCancelled.Bytes)
+		}
+		if written, err := os.ReadFile(dest.Name()); err != nil {
+			t.Errorf("Failed to read dest file: %v", err)
+		} else if !bytes.Equal(written, data[:errCancelled.Bytes]) {
+			t.Errorf("Expected %d bytes to be written, got %d", errCancelled.Bytes, len(written))
+		}
+	})
+}
+
+type syncCountingWriter struct {
+	bytes.Buffer
+	syncs int
+}
+
+func (w *syncCountingWriter) Sync() error {
+	w.syncs++
+	return nil
+}
+
+func TestWriteImageSyncPolicy(t *testing.T) {
+	t.Parallel()
+	data := make([]byte, 1024*1024)
+	testCases := []struct {
+		policy        string
+		expectedSyncs int
+	}{
+		{"end", 1},
+		{"none", 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.policy, func(t *testing.T) {
+			t.Parallel()
+			policy, err := ParseSyncPolicy(testCase.policy)
+			if err != nil {
+				t.Fatalf("Failed to parse sync policy: %v", err)
+			} else if policy.String() != testCase.policy {
+				t.Errorf("Expected sync policy %s, got %s", testCase.policy, policy)
+			}
+			var dest syncCountingWriter
+			err = WriteImage(context.Background(), bytes.NewReader(data), &dest, CopyOptions{BlockSize: 64 * 1024, Sync: policy})
+			if err != nil {
+				t.Errorf("WriteImage failed: %v", err)
+			} else if dest.syncs != testCase.expectedSyncs {
+				t.Errorf("Expected %d syncs, got %d", testCase.expectedSyncs, dest.syncs)
+			}
+		})
+	}
+
+	if _, err := ParseSyncPolicy("always"); err == nil {
+		t.Errorf("Expected error for invalid sync policy")
+	}
+}
+
+func TestWithStopInput(t *testing.T) {
+	t.Parallel()
+	t.Run("context is cancelled upon stop input", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := WithStopInput(context.Background(), bytes.NewBufferString("stop\n"))
+		defer cancel()
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Errorf("Context should have been cancelled")
+		}
+	})
+	t.Run("context is not cancelled without stop input", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := WithStopInput(context.Background(), bytes.NewBufferString("\n"))
+		select {
+		case <-ctx.Done():
+			t.Errorf("Context should not have been cancelled")
+		case <-time.After(time.Second):
+		}
+		cancel()
+		cancel() // Cancelling twice should not block.
+		if ctx.Err() == nil {
+			t.Errorf("Context should have been cancelled")
+		}
+	})
+}
+
 func TestHandleStopInput(t *testing.T) {
 	t.Parallel()
 	t.Run("quit handling stop input with channel message", func(t *testing.T) {
@@ -332,3 +525,95 @@ func TestFormatProgress(t *testing.T) {
 		})
 	}
 }
+
+func TestFormatCompressedProgress(t *testing.T) {
+	testCases := []struct {
+		name       string
+		totalBytes int
+		readBytes  int
+		size       int
+		delta      int64
+		floatPrec  bool
+		expected   string
+	}{
+		{
+			name:       "zero bytes, zero delta, float",
+			totalBytes: 0,
+			readBytes:  0,
+			size:       1000,
+			delta:      0,
+			floatPrec:  true,
+			expected:   "0 bytes (0 B, 0 B) copied, 0/1000 compressed bytes read, 0.000 s, 0 B/s",
+		},
+		{
+			name:       "MiB size, longer delta, int",
+			totalBytes: 2 * 1024 * 1024,
+			readBytes:  524288,
+			size:       1048576,
+			delta:      4876,
+			floatPrec:  false,
+			expected:   "2097152 bytes (2.1 MB, 2.0 MiB) copied, 524288/1048576 compressed bytes read, 4 s, 524.3 KB/s",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			result := FormatCompressedProgress(testCase.totalBytes, testCase.readBytes, testCase.size,
+				testCase.delta, "copied", testCase.floatPrec)
+			if result != testCase.expected {
+				t.Errorf("expected %s, got %s", testCase.expected, result)
+			}
+		})
+	}
+}
+
+// BenchmarkWriteImage compares writing a disk image in lock-step (with a single buffer) against
+// the pipeline used by [WriteImage], with and without direct I/O. The image is written to a loop
+// file in a temporary directory, or the device in IMPRINT_BENCHMARK_DEVICE, e.g. /dev/loop0.
+func BenchmarkWriteImage(b *testing.B) {
+	data := make([]byte, 64*1024*1024)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatalf("Failed to read random data: %v", err)
+	}
+	dir := b.TempDir()
+	image := filepath.Join(dir, "image.iso")
+	target := filepath.Join(dir, "loop.img")
+	if err := os.WriteFile(image, data, 0644); err != nil {
+		b.Fatalf("Failed to write image: %v", err)
+	} else if device := os.Getenv("IMPRINT_BENCHMARK_DEVICE"); device != "" {
+		target = device
+	} else if err := os.WriteFile(target, nil, 0644); err != nil {
+		b.Fatalf("Failed to create loop file: %v", err)
+	}
+	benchmarks := []struct {
+		name     string
+		buffers  int
+		directIO bool
+	}{
+		{"lock-step", 1, false},
+		{"pipelined", pipelineBuffers, false},
+		{"pipelined with direct I/O", pipelineBuffers, true},
+	}
+
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for range b.N {
+				src, err := OpenSourceImage(image, "")
+				if err != nil {
+					b.Fatalf("Failed to open image: %v", err)
+				}
+				dest, file, err := openDestination(target, benchmark.directIO)
+				if err != nil {
+					b.Fatalf("Failed to open target: %v", err)
+				}
+				err = writeImage(context.Background(), src, dest, CopyOptions{}, benchmark.buffers)
+				file.Close()
+				src.Close()
+				if err != nil {
+					b.Fatalf("Failed to write image: %v", err)
+				}
+			}
+		})
+	}
+}
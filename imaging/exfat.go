@@ -0,0 +1,202 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"unicode"
+	"unicode/utf16"
+)
+
+const (
+	exfatBootRegionSectors = 12
+	exfatMinVolumeSize     = 1024 * 1024
+	exfatFirstCluster      = 2
+	exfatEndOfChain        = 0xffffffff
+)
+
+// exfatClusterSize returns the cluster size used by Windows for exFAT volumes of the given size.
+func exfatClusterSize(size int) int {
+	switch {
+	case size <= 256*1024*1024:
+		return 4096
+	case size <= 32*1024*1024*1024:
+		return 32768
+	}
+	return 128 * 1024
+}
+
+// exfatChecksum adds data to an exFAT checksum, as used for the boot region and up-case table.
+func exfatChecksum(checksum uint32, data []byte) uint32 {
+	for _, b := range data {
+		checksum = bits.RotateLeft32(checksum, -1) + uint32(b)
+	}
+	return checksum
+}
+
+// exfatUpcaseTable returns the up-case table of an exFAT volume, mapping each character of the
+// Basic Multilingual Plane to its uppercase form, compressed by replacing runs of characters which
+// map to themselves with 0xFFFF followed by the length of the run.
+func exfatUpcaseTable() []byte {
+	var table []uint16
+	run := 0
+	flush := func(c int, force bool) {
+		if run > 2 || (force && run > 0) {
+			table = append(table, 0xffff, uint16(run))
+		} else {
+			for i := c - run; i < c; i++ {
+				table = append(table, uint16(i))
+			}
+		}
+		run = 0
+	}
+	for c := 0; c <= 0xffff; c++ {
+		upper := unicode.ToUpper(rune(c))
+		if upper == rune(c) || upper > 0xffff || utf16.IsSurrogate(rune(c)) {
+			run++
+			continue
+		}
+		flush(c, false)
+		table = append(table, uint16(upper))
+	}
+	// 0xFFFF maps to itself, and must be in a compressed run, since it would start one otherwise.
+	flush(0x10000, true)
+	data := make([]byte, len(table)*2)
+	for i, c := range table {
+		binary.LittleEndian.PutUint16(data[i*2:], c)
+	}
+	return data
+}
+
+// formatExFAT creates an exFAT filesystem on a partition with the given number of sectors, which
+// starts hidden sectors into the device.
+func formatExFAT(dest io.WriterAt, hidden int, sectors int, sectorSize int, label string) error {
+	if sectors*sectorSize < exfatMinVolumeSize {
+		return errors.New("the device is too small for exFAT")
+	}
+	serial, err := volumeSerial()
+	if err != nil {
+		return err
+	}
+	clusterSize := exfatClusterSize(sectors * sectorSize)
+	spc := clusterSize / sectorSize
+	// The FAT and cluster heap are aligned to the cluster size, the FAT being sized for the most
+	// clusters which could fit on the volume.
+	fatOffset := roundUp(2*exfatBootRegionSectors, spc)
+	fatSectors := roundUp((sectors/spc+exfatFirstCluster)*4, sectorSize) / sectorSize
+	heapOffset := roundUp(fatOffset+fatSectors, spc)
+	if heapOffset >= sectors {
+		return errors.New("the device is too small for exFAT")
+	}
+	clusters := (sectors - heapOffset) / spc
+
+	// The cluster heap starts with the allocation bitmap, followed by the up-case table and the
+	// root directory, each in their own contiguous clusters.
+	upcase := exfatUpcaseTable()
+	bitmapClusters := roundUp((clusters+7)/8, clusterSize) / clusterSize
+	upcaseClusters := roundUp(len(upcase), clusterSize) / clusterSize
+	allocations := []int{bitmapClusters, upcaseClusters, 1}
+	used := bitmapClusters + upcaseClusters + 1
+	if used > clusters {
+		return errors.New("the device is too small for exFAT")
+	}
+
+	bitmap := make([]byte, bitmapClusters*clusterSize)
+	for i := 0; i < used; i++ {
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+	fat := make([]byte, (exfatFirstCluster+used)*4)
+	binary.LittleEndian.PutUint32(fat[0:4], 0xffffff00|fatMediaFixed)
+	binary.LittleEndian.PutUint32(fat[4:8], exfatEndOfChain)
+	cluster := exfatFirstCluster
+	for _, count := range allocations {
+		for i := 1; i <= count; i++ {
+			next := uint32(cluster + 1)
+			if i == count {
+				next = exfatEndOfChain
+			}
+			binary.LittleEndian.PutUint32(fat[cluster*4:], next)
+			cluster++
+		}
+	}
+
+	root := make([]byte, clusterSize)
+	entries := root
+	if label != "" {
+		name := utf16.Encode([]rune(label))
+		entries[0] = 0x83 // Volume label
+		entries[1] = byte(len(name))
+		for i, c := range name {
+			binary.LittleEndian.PutUint16(entries[2+i*2:], c)
+		}
+		entries = entries[32:]
+	}
+	entries[0] = 0x81 // Allocation bitmap
+	binary.LittleEndian.PutUint32(entries[20:24], exfatFirstCluster)
+	binary.LittleEndian.PutUint64(entries[24:32], uint64((clusters+7)/8))
+	entries[32] = 0x82 // Up-case table
+	binary.LittleEndian.PutUint32(entries[36:40], exfatChecksum(0, upcase))
+	binary.LittleEndian.PutUint32(entries[52:56], uint32(exfatFirstCluster+bitmapClusters))
+	binary.LittleEndian.PutUint64(entries[56:64], uint64(len(upcase)))
+
+	boot := make([]byte, exfatBootRegionSectors*sectorSize)
+	copy(boot[0:3], []byte{0xeb, 0x76, 0x90})
+	copy(boot[3:11], "EXFAT   ")
+	binary.LittleEndian.PutUint64(boot[64:72], uint64(hidden))
+	binary.LittleEndian.PutUint64(boot[72:80], uint64(sectors))
+	binary.LittleEndian.PutUint32(boot[80:84], uint32(fatOffset))
+	binary.LittleEndian.PutUint32(boot[84:88], uint32(fatSectors))
+	binary.LittleEndian.PutUint32(boot[88:92], uint32(heapOffset))
+	binary.LittleEndian.PutUint32(boot[92:96], uint32(clusters))
+	binary.LittleEndian.PutUint32(boot[96:100], uint32(exfatFirstCluster+bitmapClusters+upcaseClusters))
+	binary.LittleEndian.PutUint32(boot[100:104], serial)
+	binary.LittleEndian.PutUint16(boot[104:106], 0x0100) // Revision 1.0
+	boot[108] = byte(bits.TrailingZeros(uint(sectorSize)))
+	boot[109] = byte(bits.TrailingZeros(uint(spc)))
+	boot[110] = 1    // Number of FATs
+	boot[111] = 0x80 // Drive select
+	boot[112] = byte(used * 100 / clusters)
+	for i := 120; i < 510; i++ { // Boot code, which just halts, as the specification recommends.
+		boot[i] = 0xf4
+	}
+	boot[510], boot[511] = 0x55, 0xaa
+	for i := 1; i <= 8; i++ { // Extended boot sectors
+		binary.LittleEndian.PutUint32(boot[(i+1)*sectorSize-4:], 0xaa550000)
+	}
+	// The checksum skips VolumeFlags and PercentInUse, which change as the volume is used.
+	checksum := exfatChecksum(0, boot[:106])
+	checksum = exfatChecksum(checksum, boot[108:112])
+	checksum = exfatChecksum(checksum, boot[113:11*sectorSize])
+	for i := 11 * sectorSize; i < len(boot); i += 4 {
+		binary.LittleEndian.PutUint32(boot[i:], checksum)
+	}
+
+	heapStart := heapOffset * sectorSize
+	if err := zeroRange(dest, 0, heapStart); err != nil {
+		return fmt.Errorf("failed to write exFAT filesystem! %w", err)
+	}
+	writes := []struct {
+		data   []byte
+		offset int
+	}{
+		{boot, 0},
+		{boot, exfatBootRegionSectors * sectorSize}, // Backup boot region
+		{fat, fatOffset * sectorSize},
+		{bitmap, heapStart},
+		{upcase, heapStart + bitmapClusters*clusterSize},
+		{root, heapStart + (bitmapClusters+upcaseClusters)*clusterSize},
+	}
+	for _, write := range writes {
+		if _, err := dest.WriteAt(write.data, int64(write.offset)); err != nil {
+			return fmt.Errorf("failed to write exFAT filesystem! %w", err)
+		}
+	}
+	return nil
+}
+
+// roundUp rounds n up to a multiple of m.
+func roundUp(n int, m int) int {
+	return (n + m - 1) / m * m
+}
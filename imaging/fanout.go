@@ -0,0 +1,273 @@
+package imaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTargetTooSmall is returned by [CloneDevice] and [WriteDiskImageTargets] for targets smaller
+// than the used region of the source device, or the disk image.
+var ErrTargetTooSmall = errors.New("the target device is smaller than the source")
+
+// fanOutBuffers is the number of buffers used when writing to several targets, so that faster
+// targets can get ahead of slower ones by a few blocks.
+const fanOutBuffers = 8
+
+// TargetProgressFunc is called periodically with the progress of writing to the target with the
+// given index, when writing to several targets at once. It may be nil.
+type TargetProgressFunc func(target int, progress Progress)
+
+// sharedBlock is a block read by a [pipeline] being written to several targets, which is released
+// once every target is done with it.
+type sharedBlock struct {
+	pipelineBlock
+	refs atomic.Int32
+}
+
+// fanOutTarget writes the blocks sent to it to a single target, in its own goroutine.
+type fanOutTarget struct {
+	index   int
+	dest    io.Writer
+	blocks  chan *sharedBlock
+	written int
+	err     error
+	// failed counts the targets which failed, so that reading stops once every target failed.
+	failed *atomic.Int32
+}
+
+// WriteImageTargets is [WriteImage] for several targets, reading src once and writing each block
+// to every target independently, so a slow target only holds the others back once the blocks
+// read ahead for it run out. Progress is reported for each target with opts.TargetProgress, and
+// the hashes of the image are recorded once in opts.Hashes.
+//
+// It returns the error encountered writing to each target, or nil for targets which were
+// written successfully. Writing to the other targets continues when one of them fails, but
+// errors reading src, checksum mismatches and cancellation fail every target.
+func WriteImageTargets(ctx context.Context, src io.Reader, dests []io.Writer, opts CopyOptions) []error {
+	bs := opts.blockSize()
+	startTime := time.Now()
+	reader, verifyChecksum := startChecksum(src, opts.Checksum)
+	opts.Hashes.reset()
+	pipeline := startPipeline(reader, src, bs, fanOutBuffers)
+	defer pipeline.stop()
+	release := func(block *sharedBlock) {
+		if block.refs.Add(-1) == 0 {
+			pipeline.release(block.pipelineBlock)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	targets := make([]*fanOutTarget, len(dests))
+	for i, dest := range dests {
+		targets[i] = &fanOutTarget{index: i, dest: dest, blocks: make(chan *sharedBlock, fanOutBuffers), failed: &failed}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			targets[i].run(opts, startTime, release)
+		}()
+	}
+
+	var last pipelineBlock
+	var err error
+	for err == nil && int(failed.Load()) < len(targets) {
+		var block pipelineBlock
+		select {
+		case block = <-pipeline.blocks:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			err = &CancelledError{}
+			break
+		} else if block.err != nil && block.err != io.EOF {
+			err = fmt.Errorf("encountered error while reading file! %w", block.err)
+			break
+		}
+		opts.Hashes.add(block.data)
+		last = block
+		shared := &sharedBlock{pipelineBlock: block}
+		shared.refs.Store(int32(len(targets)))
+		for _, target := range targets {
+			select {
+			case target.blocks <- shared:
+			case <-ctx.Done():
+				release(shared)
+			}
+		}
+		if block.err == io.EOF {
+			err = verifyChecksum()
+			break
+		}
+	}
+	for _, target := range targets {
+		close(target.blocks)
+	}
+	wg.Wait()
+
+	errs := make([]error, len(targets))
+	for i, target := range targets {
+		var errCancelled *CancelledError
+		if target.err != nil {
+			errs[i] = target.err
+		} else if errors.As(err, &errCancelled) {
+			errs[i] = &CancelledError{Bytes: target.written}
+		} else if err != nil {
+			errs[i] = err
+		} else if opts.TargetProgress != nil {
+			progress := last.progress
+			progress.Bytes, progress.Duration, progress.Done = target.written, time.Since(startTime), true
+			opts.TargetProgress(i, progress)
+		}
+	}
+	return errs
+}
+
+// run writes the blocks sent to the target until its channel is closed. Once writing fails, the
+// remaining blocks are released without being written.
+func (t *fanOutTarget) run(opts CopyOptions, startTime time.Time, release func(*sharedBlock)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last pipelineBlock
+	for block := range t.blocks {
+		if t.err == nil {
+			t.write(block.data)
+			last = block.pipelineBlock
+		}
+		release(block)
+		if t.err != nil {
+			continue
+		}
+		select {
+		case <-ticker.C:
+			if opts.Sync == SyncPeriodic {
+				if err := syncWriter(t.dest); err != nil {
+					t.fail(fmt.Errorf("failed to sync writes to disk! %w", err))
+				}
+			}
+			if opts.TargetProgress != nil {
+				progress := last.progress
+				progress.Bytes, progress.Duration = t.written, time.Since(startTime)
+				opts.TargetProgress(t.index, progress)
+			}
+		default:
+		}
+	}
+	if t.err == nil && opts.Sync != SyncNone {
+		if err := syncWriter(t.dest); err != nil {
+			t.fail(fmt.Errorf("failed to sync writes to disk! %w", err))
+		}
+	}
+}
+
+func (t *fanOutTarget) fail(err error) {
+	t.err = err
+	t.failed.Add(1)
+}
+
+func (t *fanOutTarget) write(data []byte) {
+	n, err := t.dest.Write(data)
+	t.written += n
+	if err != nil {
+		t.fail(fmt.Errorf("encountered error while writing to dest! %w", err))
+	} else if n != len(data) {
+		t.fail(ErrReadWriteMismatch)
+	}
+}
+
+// CloneDevice copies the used region of the source device to every target device, reading it
+// once (see [WriteImageTargets]). The used region ends with the last partition on the source
+// device, or is the whole device if it has no partition table (see [PartitionTableEnd]). Targets
+// which are known to be smaller than it fail with [ErrTargetTooSmall] before anything is written.
+// With GPT, the backup partition table isn't copied, and should be written to the end of each
+// target with [RelocateBackupGPT] afterwards.
+//
+// It returns the size of the used region, along with the error for each target.
+func CloneDevice(ctx context.Context, source string, targets []string, opts CopyOptions) (int, []error) {
+	src, err := openFile(source, os.O_RDONLY, 0, "source")
+	if err != nil {
+		return 0, repeatError(err, len(targets))
+	}
+	defer src.Close()
+	size, err := PartitionTableEnd(src)
+	if errors.Is(err, ErrNoPartitionTable) {
+		size = deviceSize(src)
+	} else if err != nil {
+		return 0, repeatError(err, len(targets))
+	}
+
+	var reader io.Reader = src
+	if size > 0 {
+		reader = io.LimitReader(src, int64(size))
+	}
+	if targetProgress := opts.TargetProgress; targetProgress != nil {
+		opts.TargetProgress = func(target int, progress Progress) {
+			progress.Total = size
+			targetProgress(target, progress)
+		}
+	}
+	return size, writeDestinations(ctx, reader, targets, size, opts)
+}
+
+// WriteDiskImageTargets is [WriteDiskImageEntry] for several targets, reading and decompressing
+// the disk image once and writing it to every target (see [WriteImageTargets]). Targets which
+// are known to be smaller than the disk image fail with [ErrTargetTooSmall] before anything is
+// written. It returns the error for each target, or nil for those written successfully.
+func WriteDiskImageTargets(ctx context.Context, iff string, entry string, targets []string, opts CopyOptions) []error {
+	src, err := OpenSourceImage(iff, entry)
+	if err != nil {
+		return repeatError(err, len(targets))
+	}
+	defer src.Close()
+	return writeDestinations(ctx, src, targets, src.UncompressedSize, opts)
+}
+
+// writeDestinations opens every target and writes src to those which could be opened and aren't
+// smaller than size (if known), with [WriteImageTargets]. The target indices passed to
+// opts.TargetProgress are those in targets, not just in the targets which were written to.
+func writeDestinations(ctx context.Context, src io.Reader, targets []string, size int, opts CopyOptions) []error {
+	errs := make([]error, len(targets))
+	var dests []io.Writer
+	var indices []int
+	for i, target := range targets {
+		dest, file, err := openDestination(target, opts.DirectIO)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		defer file.Close()
+		if targetSize := deviceSize(file); size > 0 && targetSize > 0 && targetSize < size {
+			errs[i] = fmt.Errorf("%w! %s is needed, but the target is %s", ErrTargetTooSmall,
+				BytesToString(size, true), BytesToString(targetSize, true))
+			continue
+		}
+		dests, indices = append(dests, dest), append(indices, i)
+	}
+	if len(dests) == 0 {
+		return errs
+	}
+
+	if targetProgress := opts.TargetProgress; targetProgress != nil {
+		opts.TargetProgress = func(target int, progress Progress) {
+			targetProgress(indices[target], progress)
+		}
+	}
+	for i, err := range WriteImageTargets(ctx, src, dests, opts) {
+		errs[indices[i]] = err
+	}
+	return errs
+}
+
+// repeatError returns the same error for each of n targets, for errors which fail all of them.
+func repeatError(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
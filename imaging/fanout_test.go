@@ -0,0 +1,166 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// limitedWriter fails once more than limit bytes are written to it.
+type limitedWriter struct {
+	bytes.Buffer
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.limit {
+		return 0, io.ErrShortWrite
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestWriteImageTargets(t *testing.T) {
+	t.Parallel()
+	data := make([]byte, 10*1024*1024+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Failed to read random data: %v", err)
+	}
+
+	t.Run("a failing target does not abort the others", func(t *testing.T) {
+		t.Parallel()
+		var first, second bytes.Buffer
+		failing := &limitedWriter{limit: 3 * 1024 * 1024}
+		var mutex sync.Mutex
+		final := make(map[int]Progress)
+		hashes := &BlockHashes{}
+		opts := CopyOptions{BlockSize: 1024 * 1024, Hashes: hashes, TargetProgress: func(target int, p Progress) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			final[target] = p
+		}}
+		errs := WriteImageTargets(context.Background(), bytes.NewReader(data), []io.Writer{&first, failing, &second}, opts)
+		if errs[0] != nil || errs[2] != nil {
+			t.Fatalf("Expected other targets to succeed, got %v", errs)
+		} else if !errors.Is(errs[1], io.ErrShortWrite) {
+			t.Errorf("Expected failing target to fail with io.ErrShortWrite, got %v", errs[1])
+		}
+		if !bytes.Equal(first.Bytes(), data) || !bytes.Equal(second.Bytes(), data) {
+			t.Errorf("Expected targets to contain the image")
+		} else if hashes.Size != len(data) || len(hashes.Digests) != 3 {
+			t.Errorf("Expected hashes of the whole image to be recorded once, got %d bytes in %d blocks", hashes.Size, len(hashes.Digests))
+		} else if p := final[0]; !p.Done || p.Bytes != len(data) {
+			t.Errorf("Expected final progress of %d bytes, got %+v", len(data), p)
+		} else if final[1].Done {
+			t.Errorf("Expected no final progress for the failing target")
+		}
+	})
+
+	t.Run("a checksum mismatch fails every target", func(t *testing.T) {
+		t.Parallel()
+		sum := sha256.Sum256(data)
+		sum[0]++
+		opts := CopyOptions{Checksum: &Checksum{Algorithm: "sha256", Digest: sum[:]}}
+		errs := WriteImageTargets(context.Background(), bytes.NewReader(data), []io.Writer{io.Discard, io.Discard}, opts)
+		for i, err := range errs {
+			if !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("Expected target %d to fail with ErrChecksumMismatch, got %v", i, err)
+			}
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		errs := WriteImageTargets(ctx, bytes.NewReader(data), []io.Writer{io.Discard, io.Discard}, CopyOptions{})
+		for i, err := range errs {
+			if !errors.Is(err, ErrCancelled) {
+				t.Errorf("Expected target %d to fail with ErrCancelled, got %v", i, err)
+			}
+		}
+	})
+}
+
+func TestCloneDevice(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	// The source has a partition ending at 1 MiB, followed by data which isn't cloned.
+	source := make([]byte, 2*1024*1024)
+	if _, err := rand.Read(source); err != nil {
+		t.Fatalf("Failed to read random data: %v", err)
+	}
+	copy(source, generateMBR([3]int{0x83, 2048, 0}, [3]int{0x0c, 1, 2047}))
+	sourcePath := filepath.Join(dir, "source.img")
+	os.WriteFile(sourcePath, source, 0644)
+	target := filepath.Join(dir, "target.img")
+	os.WriteFile(target, make([]byte, 2*1024*1024), 0644)
+	small := filepath.Join(dir, "small.img")
+	os.WriteFile(small, make([]byte, 512*1024), 0644)
+
+	var mutex sync.Mutex
+	final := make(map[int]Progress)
+	opts := CopyOptions{TargetProgress: func(target int, p Progress) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		final[target] = p
+	}}
+	size, errs := CloneDevice(context.Background(), sourcePath, []string{small, target, filepath.Join(dir, "missing")}, opts)
+	var errNotExists *NotExistsError
+	if size != 1024*1024 {
+		t.Errorf("Expected used region of 1 MiB, got %d bytes", size)
+	} else if !errors.Is(errs[0], ErrTargetTooSmall) || errs[1] != nil || !errors.As(errs[2], &errNotExists) {
+		t.Fatalf("Expected only the second target to succeed, got %v", errs)
+	} else if p := final[1]; !p.Done || p.Bytes != size || p.Total != size {
+		t.Errorf("Expected final progress of %d bytes for the second target, got %+v", size, p)
+	}
+	written, _ := os.ReadFile(target)
+	if !bytes.Equal(written[:size], source[:size]) || !bytes.Equal(written[size:], make([]byte, len(written)-size)) {
+		t.Errorf("Expected only the used region of the source to be cloned")
+	} else if small, _ := os.ReadFile(small); !bytes.Equal(small, make([]byte, 512*1024)) {
+		t.Errorf("Expected the target which is too small to be left as-is")
+	}
+}
+
+func TestWriteDiskImageTargets(t *testing.T) {
+	t.Parallel()
+	image, data, _ := GenerateCompressedFile(t, CompressionNone)
+	dir := t.TempDir()
+	targets := []string{filepath.Join(dir, "first.img"), filepath.Join(dir, "small.img"), filepath.Join(dir, "second.img")}
+	os.WriteFile(targets[0], nil, 0644)
+	os.WriteFile(targets[1], make([]byte, 1024*1024), 0644)
+	os.WriteFile(targets[2], nil, 0644)
+
+	var mutex sync.Mutex
+	final := make(map[int]Progress)
+	opts := CopyOptions{TargetProgress: func(target int, p Progress) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		final[target] = p
+	}}
+	errs := WriteDiskImageTargets(context.Background(), image, "", targets, opts)
+	if errs[0] != nil || !errors.Is(errs[1], ErrTargetTooSmall) || errs[2] != nil {
+		t.Fatalf("Expected only the small target to fail, got %v", errs)
+	}
+	for _, i := range []int{0, 2} {
+		if written, _ := os.ReadFile(targets[i]); !bytes.Equal(written, data) {
+			t.Errorf("Expected target %d to contain the disk image", i)
+		} else if p := final[i]; !p.Done || p.Bytes != len(data) {
+			t.Errorf("Expected final progress of %d bytes for target %d, got %+v", len(data), i, p)
+		}
+	}
+
+	errs = WriteDiskImageTargets(context.Background(), filepath.Join(dir, "missing.img"), "", targets, opts)
+	var errNotExists *NotExistsError
+	for i, err := range errs {
+		if !errors.As(err, &errNotExists) {
+			t.Errorf("Expected target %d to fail with the missing image, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	fat32ReservedSectors = 32
+	fat32NumFATs         = 2
+	fat32MinClusters     = 65525
+	fat32MaxClusters     = 0x0ffffff5
+	fat32RootCluster     = 2
+	fat32EndOfChain      = 0x0fffffff
+	fatMediaFixed        = 0xf8
+)
+
+// ErrFAT32TooSmall is returned by [RestoreDevice] if the device is too small for FAT32, which needs
+// at least 65525 clusters.
+var ErrFAT32TooSmall = errors.New("the device is too small for FAT32, use exFAT instead")
+
+// ErrFAT32TooLarge is returned by [RestoreDevice] if the device is too large for FAT32, which can
+// have at most 268435445 clusters, and 4294967295 sectors.
+var ErrFAT32TooLarge = errors.New("the device is too large for FAT32, use exFAT instead")
+
+// fat32ClusterSize returns the cluster size used by Windows for FAT32 volumes of the given size.
+func fat32ClusterSize(size int) int {
+	switch {
+	case size <= 8*1024*1024*1024:
+		return 4096
+	case size <= 16*1024*1024*1024:
+		return 8192
+	case size <= 32*1024*1024*1024:
+		return 16384
+	}
+	return 32768
+}
+
+// fat32Layout returns the sectors per cluster, reserved sectors, sectors per FAT and cluster count
+// of a FAT32 volume with the given number of sectors. The data region is aligned to the cluster
+// size, by adding reserved sectors.
+func fat32Layout(sectors int, sectorSize int) (spc int, reserved int, fatSectors int, clusters int) {
+	// Smaller clusters are used on small volumes, which wouldn't have enough clusters otherwise.
+	for spc = max(fat32ClusterSize(sectors*sectorSize)/sectorSize, 1); ; spc /= 2 {
+		reserved = fat32ReservedSectors
+		entriesPerSector := sectorSize / 4
+		fatSectors = (sectors - reserved + 2*spc + entriesPerSector*spc + fat32NumFATs - 1) /
+			(entriesPerSector*spc + fat32NumFATs)
+		reserved += (spc - (reserved+fat32NumFATs*fatSectors)%spc) % spc
+		clusters = (sectors - reserved - fat32NumFATs*fatSectors) / spc
+		if clusters >= fat32MinClusters || spc == 1 {
+			return
+		}
+	}
+}
+
+// formatFAT32 creates a FAT32 filesystem on a partition with the given number of sectors, which
+// starts hidden sectors into the device.
+func formatFAT32(dest io.WriterAt, hidden int, sectors int, sectorSize int, label string) error {
+	if sectors > 0xffffffff { // The sector count is 32-bit.
+		return ErrFAT32TooLarge
+	}
+	spc, reserved, fatSectors, clusters := fat32Layout(sectors, sectorSize)
+	if clusters < fat32MinClusters {
+		return ErrFAT32TooSmall
+	} else if clusters > fat32MaxClusters {
+		return ErrFAT32TooLarge
+	}
+	serial, err := volumeSerial()
+	if err != nil {
+		return err
+	}
+	label = strings.ToUpper(label)
+	volumeLabel := "NO NAME"
+	if label != "" {
+		volumeLabel = label
+	}
+
+	boot := make([]byte, sectorSize)
+	copy(boot[0:3], []byte{0xeb, 0x58, 0x90})
+	copy(boot[3:11], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(boot[11:13], uint16(sectorSize))
+	boot[13] = byte(spc)
+	binary.LittleEndian.PutUint16(boot[14:16], uint16(reserved))
+	boot[16] = fat32NumFATs
+	boot[21] = fatMediaFixed
+	binary.LittleEndian.PutUint16(boot[24:26], 63)  // Sectors per track
+	binary.LittleEndian.PutUint16(boot[26:28], 255) // Heads
+	binary.LittleEndian.PutUint32(boot[28:32], uint32(hidden))
+	binary.LittleEndian.PutUint32(boot[32:36], uint32(sectors))
+	binary.LittleEndian.PutUint32(boot[36:40], uint32(fatSectors))
+	binary.LittleEndian.PutUint32(boot[44:48], fat32RootCluster)
+	binary.LittleEndian.PutUint16(boot[48:50], 1) // FSInfo sector
+	binary.LittleEndian.PutUint16(boot[50:52], 6) // Backup boot sector
+	boot[64] = 0x80                               // Drive number
+	boot[66] = 0x29                               // Extended boot signature
+	binary.LittleEndian.PutUint32(boot[67:71], serial)
+	copy(boot[71:82], fmt.Sprintf("%-11s", volumeLabel))
+	copy(boot[82:90], "FAT32   ")
+	copy(boot[90:92], []byte{0xcd, 0x18}) // int 18h, so the BIOS tries the next boot device.
+	boot[510], boot[511] = 0x55, 0xaa
+
+	fsInfo := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(fsInfo[0:4], 0x41615252)
+	binary.LittleEndian.PutUint32(fsInfo[484:488], 0x61417272)
+	binary.LittleEndian.PutUint32(fsInfo[488:492], uint32(clusters-1)) // The root directory is used.
+	binary.LittleEndian.PutUint32(fsInfo[492:496], fat32RootCluster+1)
+	binary.LittleEndian.PutUint32(fsInfo[508:512], 0xaa550000)
+
+	fat := make([]byte, 12)
+	binary.LittleEndian.PutUint32(fat[0:4], 0x0fffff00|fatMediaFixed)
+	binary.LittleEndian.PutUint32(fat[4:8], fat32EndOfChain)
+	binary.LittleEndian.PutUint32(fat[8:12], fat32EndOfChain) // The root directory.
+
+	root := make([]byte, spc*sectorSize)
+	if label != "" {
+		copy(root[0:11], fmt.Sprintf("%-11s", label))
+		root[11] = 0x08 // Volume label attribute
+	}
+
+	dataStart := (reserved + fat32NumFATs*fatSectors) * sectorSize
+	if err := zeroRange(dest, 0, dataStart); err != nil {
+		return fmt.Errorf("failed to write FAT32 filesystem! %w", err)
+	}
+	writes := []struct {
+		data   []byte
+		offset int
+	}{
+		{boot, 0},
+		{fsInfo, sectorSize},
+		{boot, 6 * sectorSize},
+		{fsInfo, 7 * sectorSize},
+		{fat, reserved * sectorSize},
+		{fat, (reserved + fatSectors) * sectorSize},
+		{root, dataStart},
+	}
+	for _, write := range writes {
+		if _, err := dest.WriteAt(write.data, int64(write.offset)); err != nil {
+			return fmt.Errorf("failed to write FAT32 filesystem! %w", err)
+		}
+	}
+	return nil
+}
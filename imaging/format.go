@@ -0,0 +1,300 @@
+package imaging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// Filesystem is a filesystem which [RestoreDevice] can create on a device.
+type Filesystem int
+
+const (
+	// FilesystemExFAT is exFAT, which is supported by Windows, macOS and most Linux distributions,
+	// and allows files larger than 4 GiB.
+	FilesystemExFAT Filesystem = iota
+	// FilesystemFAT32 is FAT32, which is supported almost everywhere, e.g. by TVs and car stereos.
+	FilesystemFAT32
+)
+
+func (f Filesystem) String() string {
+	if f == FilesystemFAT32 {
+		return "fat32"
+	}
+	return "exfat"
+}
+
+// ParseFilesystem parses a [Filesystem] from its name, either exfat or fat32.
+func ParseFilesystem(filesystem string) (Filesystem, error) {
+	for _, f := range []Filesystem{FilesystemExFAT, FilesystemFAT32} {
+		if f.String() == filesystem {
+			return f, nil
+		}
+	}
+	return FilesystemExFAT, fmt.Errorf("invalid filesystem %s, expected exfat or fat32", filesystem)
+}
+
+// PartitionTable is a partition table which [RestoreDevice] can write to a device.
+type PartitionTable int
+
+const (
+	// PartitionTableMBR is an MBR partition table, supported by every OS and most firmware.
+	PartitionTableMBR PartitionTable = iota
+	// PartitionTableGPT is a GPT partition table, required for devices larger than 2 TiB.
+	PartitionTableGPT
+)
+
+func (t PartitionTable) String() string {
+	if t == PartitionTableGPT {
+		return "gpt"
+	}
+	return "mbr"
+}
+
+// ParsePartitionTable parses a [PartitionTable] from its name, either mbr or gpt.
+func ParsePartitionTable(table string) (PartitionTable, error) {
+	for _, t := range []PartitionTable{PartitionTableMBR, PartitionTableGPT} {
+		if t.String() == table {
+			return t, nil
+		}
+	}
+	return PartitionTableMBR, fmt.Errorf("invalid partition table %s, expected mbr or gpt", table)
+}
+
+// ErrInvalidLabel is returned by [RestoreDevice] if the label is too long, or contains characters
+// which the filesystem does not allow.
+var ErrInvalidLabel = errors.New("the label is invalid")
+
+// RestoreOptions configures [RestoreDevice].
+type RestoreOptions struct {
+	Filesystem Filesystem
+	Table      PartitionTable
+	// Label is the label of the filesystem, up to 11 characters long. For FAT32, it is converted
+	// to uppercase, and may only contain ASCII characters.
+	Label string
+	// SectorSize is the logical sector size of the device, or 512 bytes if zero.
+	SectorSize int
+}
+
+// partitionAlignment is the offset of the partition created by [RestoreDevice], and the
+// alignment of its end, which suits the erase blocks of flash memory.
+const partitionAlignment = 1024 * 1024
+
+// RestoreDevice turns a device back into a normal drive with a single partition spanning it,
+// after flashing a disk image to it. The old partition tables and filesystem signatures are
+// wiped first (see [WipeQuick]), then a new partition table is written, and the partition is
+// formatted with the given filesystem.
+func RestoreDevice(ctx context.Context, of string, opts RestoreOptions) error {
+	if err := validateLabel(opts.Label, opts.Filesystem); err != nil {
+		return err
+	}
+	sectorSize := opts.SectorSize
+	if sectorSize == 0 {
+		sectorSize = mbrSectorSize
+	}
+	file, err := openFile(of, os.O_RDWR|os.O_EXCL, os.ModePerm, "destination")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size := deviceSize(file)
+	if size <= 0 {
+		size = listedDeviceSize(of)
+	}
+	if size <= 0 {
+		return ErrUnknownDeviceSize
+	}
+
+	// The GPT backup partition table is in the last 33 sectors, so leave space for it.
+	start := partitionAlignment
+	end := size - size%partitionAlignment
+	if end > size-33*sectorSize {
+		end -= partitionAlignment
+	}
+	if end <= start {
+		return fmt.Errorf("the device is too small to be formatted! it is only %s", BytesToString(size, true))
+	} else if opts.Table == PartitionTableMBR && end/sectorSize > 0xffffffff {
+		return errors.New("devices larger than 2 TiB need a GPT partition table")
+	}
+
+	for _, r := range quickWipeRanges(file, size) {
+		if ctx.Err() != nil {
+			return &CancelledError{}
+		} else if err := zeroRange(file, r[0], r[1]-r[0]); err != nil {
+			return fmt.Errorf("failed to wipe the device! %w", err)
+		}
+	}
+	if ctx.Err() != nil {
+		return &CancelledError{}
+	}
+	partition := io.NewOffsetWriter(file, int64(start))
+	if opts.Filesystem == FilesystemFAT32 {
+		err = formatFAT32(partition, start/sectorSize, (end-start)/sectorSize, sectorSize, opts.Label)
+	} else {
+		err = formatExFAT(partition, start/sectorSize, (end-start)/sectorSize, sectorSize, opts.Label)
+	}
+	if err != nil {
+		return err
+	}
+	// The partition table is written last, so the partition is never detected half-formatted.
+	if opts.Table == PartitionTableGPT {
+		err = writeGPT(file, size/sectorSize, sectorSize, start/sectorSize, end/sectorSize-1, opts.Label)
+	} else {
+		err = writeMBR(file, start/sectorSize, (end-start)/sectorSize, opts.Filesystem)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write partition table! %w", err)
+	} else if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync writes to disk! %w", err)
+	}
+	rereadPartitionTable(file)
+	return nil
+}
+
+// validateLabel checks that a label is valid for the given filesystem.
+func validateLabel(label string, filesystem Filesystem) error {
+	invalid := "\"*/:<>?\\|"
+	if filesystem == FilesystemFAT32 {
+		invalid += "+,.;=[]"
+	}
+	length := len(utf16.Encode([]rune(label)))
+	if length > 11 {
+		return fmt.Errorf("%w! it is %d characters long, but at most 11 are allowed", ErrInvalidLabel, length)
+	}
+	for _, c := range label {
+		if c < 0x20 || c == 0x7f || (filesystem == FilesystemFAT32 && c > 0x7f) || strings.ContainsRune(invalid, c) {
+			return fmt.Errorf("%w! %q is not allowed", ErrInvalidLabel, c)
+		}
+	}
+	return nil
+}
+
+// writeMBR writes an MBR partition table with a single partition to the first sector of a device.
+func writeMBR(dest io.WriterAt, start int, count int, filesystem Filesystem) error {
+	mbr := make([]byte, mbrSectorSize)
+	if _, err := rand.Read(mbr[440:444]); err != nil { // Disk signature
+		return err
+	}
+	writeMBREntry(mbr[mbrPartitions:], start, count, mbrPartitionType(filesystem))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	_, err := dest.WriteAt(mbr, 0)
+	return err
+}
+
+// writeMBREntry writes an MBR partition entry. The partition is only addressed by its LBA, with
+// its CHS addresses set to the maximum, as done by modern partitioning tools.
+func writeMBREntry(entry []byte, start int, count int, partitionType byte) {
+	copy(entry[1:4], []byte{0xfe, 0xff, 0xff})
+	entry[4] = partitionType
+	copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:12], uint32(start))
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(count))
+}
+
+func mbrPartitionType(filesystem Filesystem) byte {
+	if filesystem == FilesystemFAT32 {
+		return 0x0c // FAT32 with LBA
+	}
+	return 0x07 // exFAT (and NTFS)
+}
+
+const (
+	gptEntryCount = 128
+	gptEntrySize  = 128
+)
+
+// gptBasicDataType is the type GUID of Microsoft basic data partitions, used for FAT and exFAT.
+var gptBasicDataType = guidBytes([16]byte{
+	0xeb, 0xd0, 0xa0, 0xa2, 0xb9, 0xe5, 0x44, 0x33, 0x87, 0xc0, 0x68, 0xb6, 0xb7, 0x26, 0x99, 0xc7,
+})
+
+// writeGPT writes a protective MBR and a GPT partition table with a single partition spanning the
+// given sectors to a device with the given number of sectors, along with the backup partition
+// table at the end of the device.
+func writeGPT(dest io.WriterAt, sectors int, sectorSize int, first int, last int, label string) error {
+	var diskGUID, partitionGUID [16]byte
+	if err := randomGUID(&diskGUID); err != nil {
+		return err
+	} else if err := randomGUID(&partitionGUID); err != nil {
+		return err
+	}
+	entries := make([]byte, gptEntryCount*gptEntrySize)
+	copy(entries[0:16], gptBasicDataType[:])
+	copy(entries[16:32], partitionGUID[:])
+	binary.LittleEndian.PutUint64(entries[32:40], uint64(first))
+	binary.LittleEndian.PutUint64(entries[40:48], uint64(last))
+	for i, c := range utf16.Encode([]rune(label)) {
+		binary.LittleEndian.PutUint16(entries[56+i*2:], c)
+	}
+	entriesSectors := len(entries) / sectorSize
+	header := func(current int, backup int, entriesLBA int) []byte {
+		header := make([]byte, sectorSize)
+		copy(header, gptSignature)
+		binary.LittleEndian.PutUint32(header[8:12], 0x00010000) // Revision 1.0
+		binary.LittleEndian.PutUint32(header[12:16], gptHeaderSize)
+		binary.LittleEndian.PutUint64(header[24:32], uint64(current))
+		binary.LittleEndian.PutUint64(header[32:40], uint64(backup))
+		binary.LittleEndian.PutUint64(header[40:48], uint64(2+entriesSectors))
+		binary.LittleEndian.PutUint64(header[48:56], uint64(sectors-2-entriesSectors))
+		copy(header[56:72], diskGUID[:])
+		binary.LittleEndian.PutUint64(header[72:80], uint64(entriesLBA))
+		binary.LittleEndian.PutUint32(header[80:84], gptEntryCount)
+		binary.LittleEndian.PutUint32(header[84:88], gptEntrySize)
+		binary.LittleEndian.PutUint32(header[88:92], crc32.ChecksumIEEE(entries))
+		binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:gptHeaderSize]))
+		return header
+	}
+
+	mbr := make([]byte, sectorSize)
+	writeMBREntry(mbr[mbrPartitions:], 1, min(sectors-1, 0xffffffff), mbrTypeGPT)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	writes := []struct {
+		data []byte
+		lba  int
+	}{
+		{entries, sectors - 1 - entriesSectors},
+		{header(sectors-1, 1, sectors-1-entriesSectors), sectors - 1},
+		{entries, 2},
+		{header(1, sectors-1, 2), 1},
+		{mbr, 0},
+	}
+	for _, write := range writes {
+		if _, err := dest.WriteAt(write.data, int64(write.lba*sectorSize)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// randomGUID generates a random (version 4) GUID, in the mixed-endian form stored in GPTs.
+func randomGUID(guid *[16]byte) error {
+	if _, err := rand.Read(guid[:]); err != nil {
+		return err
+	}
+	guid[7] = guid[7]&0x0f | 0x40 // The version is in the third group, which is little-endian.
+	guid[8] = guid[8]&0x3f | 0x80
+	return nil
+}
+
+// guidBytes converts a GUID from the order it is written in to the mixed-endian form stored in
+// GPTs, where the first three groups are little-endian.
+func guidBytes(guid [16]byte) [16]byte {
+	guid[0], guid[1], guid[2], guid[3] = guid[3], guid[2], guid[1], guid[0]
+	guid[4], guid[5] = guid[5], guid[4]
+	guid[6], guid[7] = guid[7], guid[6]
+	return guid
+}
+
+// volumeSerial generates a random volume serial number for FAT32 and exFAT.
+func volumeSerial() (uint32, error) {
+	var serial [4]byte
+	_, err := rand.Read(serial[:])
+	return binary.LittleEndian.Uint32(serial[:]), err
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package imaging
+
+import (
+	"os"
+	"syscall"
+)
+
+const ioctlBlkRrpart = 0x125f // BLKRRPART
+
+// rereadPartitionTable asks the kernel to read the new partition table of a block device, so its
+// partition appears without replugging it. Failures are ignored, since udev usually does the same
+// once the device is closed.
+func rereadPartitionTable(file *os.File) {
+	if isBlockDevice(file) {
+		syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), ioctlBlkRrpart, 0)
+	}
+}
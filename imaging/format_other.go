@@ -0,0 +1,9 @@
+//go:build !linux
+
+package imaging
+
+import "os"
+
+// rereadPartitionTable asks the OS to read the new partition table of a block device. macOS and
+// Windows do so on their own once the device is closed.
+func rereadPartitionTable(file *os.File) {}
@@ -0,0 +1,242 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseFilesystem(t *testing.T) {
+	t.Parallel()
+	for _, filesystem := range []Filesystem{FilesystemExFAT, FilesystemFAT32} {
+		if parsed, err := ParseFilesystem(filesystem.String()); err != nil || parsed != filesystem {
+			t.Errorf("expected %s to parse, got %v and error %v", filesystem, parsed, err)
+		}
+	}
+	if _, err := ParseFilesystem("ntfs"); err == nil {
+		t.Errorf("expected error for invalid filesystem")
+	}
+	for _, table := range []PartitionTable{PartitionTableMBR, PartitionTableGPT} {
+		if parsed, err := ParsePartitionTable(table.String()); err != nil || parsed != table {
+			t.Errorf("expected %s to parse, got %v and error %v", table, parsed, err)
+		}
+	}
+	if _, err := ParsePartitionTable("apm"); err == nil {
+		t.Errorf("expected error for invalid partition table")
+	}
+}
+
+func TestValidateLabel(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		label      string
+		filesystem Filesystem
+		valid      bool
+	}{
+		{"", FilesystemFAT32, true},
+		{"USB DRIVE", FilesystemFAT32, true},
+		{"Backups 2024", FilesystemExFAT, false},
+		{"Sauvegardé", FilesystemExFAT, true},
+		{"Sauvegardé", FilesystemFAT32, false},
+		{"A.B", FilesystemExFAT, true},
+		{"A.B", FilesystemFAT32, false},
+		{"A/B", FilesystemExFAT, false},
+	}
+	for _, testCase := range testCases {
+		err := validateLabel(testCase.label, testCase.filesystem)
+		if testCase.valid && err != nil {
+			t.Errorf("expected %q to be a valid %s label, got %v", testCase.label, testCase.filesystem, err)
+		} else if !testCase.valid && !errors.Is(err, ErrInvalidLabel) {
+			t.Errorf("expected %q to be an invalid %s label, got %v", testCase.label, testCase.filesystem, err)
+		}
+	}
+}
+
+func TestRestoreDevice(t *testing.T) {
+	t.Parallel()
+	const size = 81 * 1024 * 1024
+	testCases := []struct {
+		filesystem Filesystem
+		table      PartitionTable
+		label      string
+	}{
+		{FilesystemExFAT, PartitionTableMBR, "Imprint"},
+		{FilesystemExFAT, PartitionTableGPT, ""},
+		{FilesystemFAT32, PartitionTableMBR, ""},
+		{FilesystemFAT32, PartitionTableGPT, "imprint"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.filesystem.String()+"-"+testCase.table.String(), func(t *testing.T) {
+			t.Parallel()
+			// The device has a flashed disk image on it, whose partition table should be replaced.
+			original := make([]byte, size)
+			if _, err := rand.Read(original); err != nil {
+				t.Fatalf("Failed to read random data: %v", err)
+			}
+			copy(original, generateGPT(512, [2]int{34, 1000}))
+			device := filepath.Join(t.TempDir(), "device.img")
+			os.WriteFile(device, original, 0644)
+
+			err := RestoreDevice(context.Background(), device, RestoreOptions{
+				Filesystem: testCase.filesystem,
+				Table:      testCase.table,
+				Label:      testCase.label,
+			})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			restored, _ := os.ReadFile(device)
+			partitions, err := partitionRanges(bytes.NewReader(restored))
+			if err != nil {
+				t.Fatalf("expected partition table, got %v", err)
+			} else if len(partitions) != 1 || partitions[0] != [2]int{1024 * 1024, 80 * 1024 * 1024} {
+				t.Fatalf("expected a single partition spanning the device, got %v", partitions)
+			} else if !bytes.Equal(restored[size-1024*1024:size-33*512], make([]byte, 1024*1024-33*512)) {
+				t.Errorf("expected the end of the device to be wiped")
+			}
+			if testCase.table == PartitionTableMBR && restored[mbrPartitions+4] != mbrPartitionType(testCase.filesystem) {
+				t.Errorf("expected partition type %x, got %x", mbrPartitionType(testCase.filesystem), restored[mbrPartitions+4])
+			} else if testCase.table == PartitionTableGPT {
+				checkGPT(t, restored, size/512)
+			}
+
+			partition := restored[1024*1024 : 80*1024*1024]
+			if testCase.filesystem == FilesystemFAT32 {
+				checkFAT32(t, partition)
+			} else {
+				checkExFAT(t, partition)
+			}
+			checkBlkid(t, device, testCase.filesystem, testCase.label)
+		})
+	}
+}
+
+func TestRestoreDeviceErrors(t *testing.T) {
+	t.Parallel()
+	device := filepath.Join(t.TempDir(), "device.img")
+	os.WriteFile(device, make([]byte, 16*1024*1024), 0644)
+	err := RestoreDevice(context.Background(), device, RestoreOptions{Filesystem: FilesystemFAT32})
+	if !errors.Is(err, ErrFAT32TooSmall) {
+		t.Errorf("expected ErrFAT32TooSmall, got %v", err)
+	}
+	err = RestoreDevice(context.Background(), device, RestoreOptions{Label: "a label that is too long"})
+	if !errors.Is(err, ErrInvalidLabel) {
+		t.Errorf("expected ErrInvalidLabel, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := RestoreDevice(ctx, device, RestoreOptions{}); !errors.Is(err, ErrCancelled) {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+	// Partitions over 2 TiB don't fit in the 32-bit sector count of FAT32, which is checked before
+	// anything is written.
+	if err := formatFAT32(nil, 2048, 0x100000000, 512, ""); !errors.Is(err, ErrFAT32TooLarge) {
+		t.Errorf("expected ErrFAT32TooLarge, got %v", err)
+	}
+}
+
+func checkGPT(t *testing.T, device []byte, sectors int) {
+	for _, lba := range []int{1, sectors - 1} {
+		header := bytes.Clone(device[lba*512 : lba*512+gptHeaderSize])
+		checksum := binary.LittleEndian.Uint32(header[16:20])
+		clear(header[16:20])
+		entriesLBA := int(binary.LittleEndian.Uint64(header[72:80]))
+		entries := device[entriesLBA*512 : entriesLBA*512+gptEntryCount*gptEntrySize]
+		if crc32.ChecksumIEEE(header) != checksum {
+			t.Errorf("expected valid GPT header checksum at LBA %d", lba)
+		} else if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(header[88:92]) {
+			t.Errorf("expected valid GPT entries checksum at LBA %d", lba)
+		} else if !bytes.Equal(entries[0:16], gptBasicDataType[:]) {
+			t.Errorf("expected basic data partition at LBA %d", lba)
+		}
+	}
+}
+
+func checkFAT32(t *testing.T, partition []byte) {
+	sectorSize := int(binary.LittleEndian.Uint16(partition[11:13]))
+	spc := int(partition[13])
+	reserved := int(binary.LittleEndian.Uint16(partition[14:16]))
+	fatSectors := int(binary.LittleEndian.Uint32(partition[36:40]))
+	sectors := int(binary.LittleEndian.Uint32(partition[32:36]))
+	clusters := (sectors - reserved - 2*fatSectors) / spc
+	if string(partition[82:90]) != "FAT32   " || partition[510] != 0x55 || partition[511] != 0xaa {
+		t.Errorf("expected FAT32 boot sector")
+	} else if sectors != len(partition)/512 {
+		t.Errorf("expected %d sectors, got %d", len(partition)/512, sectors)
+	} else if clusters < fat32MinClusters || fatSectors*sectorSize/4 < clusters+2 {
+		t.Errorf("expected enough clusters and a large enough FAT, got %d clusters and %d FAT sectors", clusters, fatSectors)
+	} else if (reserved+2*fatSectors)%spc != 0 {
+		t.Errorf("expected the data region to be aligned to clusters")
+	} else if !bytes.Equal(partition[:512], partition[6*512:7*512]) {
+		t.Errorf("expected backup boot sector")
+	}
+	for _, fat := range []int{reserved, reserved + fatSectors} {
+		if binary.LittleEndian.Uint32(partition[fat*512+8:]) != fat32EndOfChain {
+			t.Errorf("expected root directory cluster to be allocated")
+		} else if binary.LittleEndian.Uint32(partition[fat*512+12:]) != 0 {
+			t.Errorf("expected FAT to be cleared")
+		}
+	}
+}
+
+func checkExFAT(t *testing.T, partition []byte) {
+	if string(partition[3:11]) != "EXFAT   " || partition[510] != 0x55 || partition[511] != 0xaa {
+		t.Fatalf("expected exFAT boot sector")
+	}
+	checksum := exfatChecksum(0, partition[:106])
+	checksum = exfatChecksum(checksum, partition[108:112])
+	checksum = exfatChecksum(checksum, partition[113:11*512])
+	if binary.LittleEndian.Uint32(partition[11*512:]) != checksum {
+		t.Errorf("expected valid boot region checksum")
+	} else if !bytes.Equal(partition[:12*512], partition[12*512:24*512]) {
+		t.Errorf("expected backup boot region")
+	} else if int(binary.LittleEndian.Uint64(partition[72:80])) != len(partition)/512 {
+		t.Errorf("expected volume length to match partition")
+	}
+
+	// Every character round-trips through the decompressed up-case table.
+	upcase := exfatUpcaseTable()
+	var decompressed []uint16
+	for i := 0; i < len(upcase); i += 2 {
+		c := binary.LittleEndian.Uint16(upcase[i:])
+		if c == 0xffff {
+			i += 2
+			for range binary.LittleEndian.Uint16(upcase[i:]) {
+				decompressed = append(decompressed, uint16(len(decompressed)))
+			}
+		} else {
+			decompressed = append(decompressed, c)
+		}
+	}
+	if len(decompressed) != 0x10000 || decompressed['a'] != 'A' || decompressed['A'] != 'A' || decompressed[0xe9] != 0xc9 {
+		t.Errorf("expected valid up-case table, got %d entries", len(decompressed))
+	}
+}
+
+// checkBlkid checks that blkid detects the filesystem on the partition, if it is installed.
+func checkBlkid(t *testing.T, device string, filesystem Filesystem, label string) {
+	if _, err := exec.LookPath("blkid"); err != nil {
+		return
+	}
+	output, err := exec.Command("blkid", "-p", "-O", strconv.Itoa(1024*1024), device).Output()
+	if err != nil {
+		t.Errorf("expected blkid to detect the filesystem, got %v", err)
+	} else if expected := map[Filesystem]string{FilesystemExFAT: "exfat", FilesystemFAT32: "vfat"}[filesystem]; !strings.Contains(string(output), `TYPE="`+expected+`"`) {
+		t.Errorf("expected blkid to detect %s, got %s", expected, output)
+	} else if filesystem == FilesystemFAT32 {
+		label = strings.ToUpper(label)
+	}
+	if label != "" && !strings.Contains(string(output), `LABEL="`+label+`"`) {
+		t.Errorf("expected blkid to detect label %s, got %s", label, output)
+	}
+}
@@ -0,0 +1,228 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// ErrNoPartitionTable is returned by [PartitionTableEnd] if a device has no MBR or GPT partition
+// table, or no partitions in it.
+var ErrNoPartitionTable = errors.New("no partitions were found on the device")
+
+const (
+	mbrSectorSize    = 512
+	mbrPartitions    = 446
+	mbrTypeGPT       = 0xee
+	gptSignature     = "EFI PART"
+	gptHeaderSize    = 92
+	gptMaxEntrySize  = 4096
+	gptMaxEntryCount = 1024
+)
+
+// PartitionTableEnd returns the offset of the end of the last partition on a device, read from
+// its GPT partition table, or MBR partition table if it has no GPT. Logical partitions in an MBR
+// are within their extended partition, so they don't have to be read.
+//
+// With GPT, the backup partition table at the end of the device is not included, but it can be
+// recreated from the primary one with [RelocateBackupGPT].
+func PartitionTableEnd(device io.ReaderAt) (int, error) {
+	partitions, err := partitionRanges(device)
+	if err != nil {
+		return 0, err
+	}
+	end := 0
+	for _, partition := range partitions {
+		end = max(end, partition[1])
+	}
+	return end, nil
+}
+
+// HasGPT returns whether a device has a GPT partition table, with 512 or 4096 byte sectors.
+func HasGPT(device io.ReaderAt) bool {
+	signature := make([]byte, len(gptSignature))
+	for _, sectorSize := range []int{512, 4096} {
+		if _, err := device.ReadAt(signature, int64(sectorSize)); err == nil && string(signature) == gptSignature {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionRanges returns the offsets of the start and end of each partition on a device, read
+// from its GPT partition table, or MBR partition table if it has no GPT. For an MBR, extended
+// partitions are returned as-is, without the logical partitions in them.
+func partitionRanges(device io.ReaderAt) ([][2]int, error) {
+	mbr := make([]byte, mbrSectorSize)
+	if _, err := device.ReadAt(mbr, 0); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrNoPartitionTable
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read partition table! %w", err)
+	} else if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, ErrNoPartitionTable
+	}
+	var partitions [][2]int
+	for i := 0; i < 4; i++ {
+		entry := mbr[mbrPartitions+i*16 : mbrPartitions+(i+1)*16]
+		if entry[0] != 0x00 && entry[0] != 0x80 {
+			// Boot sectors of unpartitioned (superfloppy) devices have the same signature as an MBR,
+			// but their boot code doesn't have valid boot indicators where the partitions would be.
+			return nil, ErrNoPartitionTable
+		} else if entry[4] == mbrTypeGPT {
+			return gptPartitions(device)
+		} else if entry[4] != 0 {
+			start := int(binary.LittleEndian.Uint32(entry[8:12]))
+			count := int(binary.LittleEndian.Uint32(entry[12:16]))
+			if count > 0 {
+				partitions = append(partitions, [2]int{start * mbrSectorSize, (start + count) * mbrSectorSize})
+			}
+		}
+	}
+	if len(partitions) == 0 {
+		return nil, ErrNoPartitionTable
+	}
+	return partitions, nil
+}
+
+// gptPartitions returns the offsets of the start and end of each partition in a GPT partition
+// table, trying both 512 and 4096 byte logical sectors.
+func gptPartitions(device io.ReaderAt) ([][2]int, error) {
+	header := make([]byte, 92)
+	for _, sectorSize := range []int{512, 4096} {
+		if _, err := device.ReadAt(header, int64(sectorSize)); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read partition table! %w", err)
+		} else if !bytes.Equal(header[:8], []byte(gptSignature)) {
+			continue
+		}
+		entriesLBA := int(binary.LittleEndian.Uint64(header[72:80]))
+		count := int(binary.LittleEndian.Uint32(header[80:84]))
+		entrySize := int(binary.LittleEndian.Uint32(header[84:88]))
+		if entrySize < 128 || entrySize > gptMaxEntrySize || count > gptMaxEntryCount {
+			return nil, fmt.Errorf("the GPT partition table is invalid! %d entries of %d bytes", count, entrySize)
+		}
+		entries := make([]byte, count*entrySize)
+		if _, err := device.ReadAt(entries, int64(entriesLBA*sectorSize)); err != nil {
+			return nil, fmt.Errorf("failed to read partition table! %w", err)
+		}
+		var partitions [][2]int
+		for i := 0; i < count; i++ {
+			entry := entries[i*entrySize : (i+1)*entrySize]
+			if bytes.Equal(entry[:16], make([]byte, 16)) { // Unused entries have a zero type GUID.
+				continue
+			}
+			first := int(binary.LittleEndian.Uint64(entry[32:40]))
+			last := int(binary.LittleEndian.Uint64(entry[40:48]))
+			partitions = append(partitions, [2]int{first * sectorSize, (last + 1) * sectorSize})
+		}
+		if len(partitions) == 0 {
+			return nil, ErrNoPartitionTable
+		}
+		return partitions, nil
+	}
+	return nil, ErrNoPartitionTable
+}
+
+// RelocateBackupGPT writes the backup GPT partition table to the end of a device, and updates the
+// primary one to point to it. It is needed after copying the partitions of a device with a GPT
+// to a device of another size (see [CloneDevice]), which has no backup partition table at its
+// end otherwise, while the primary one refers to the end of the original device. Devices without
+// a GPT are left as-is.
+func RelocateBackupGPT(device string) error {
+	file, err := openFile(device, os.O_RDWR|os.O_EXCL, os.ModePerm, "destination")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size := deviceSize(file)
+	if size <= 0 {
+		size = listedDeviceSize(device)
+	}
+	if size <= 0 {
+		return ErrUnknownDeviceSize
+	}
+	if err := relocateBackupGPT(file, size); err != nil {
+		return fmt.Errorf("failed to write backup partition table! %w", err)
+	} else if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync writes to disk! %w", err)
+	}
+	return nil
+}
+
+// relocateBackupGPT writes the backup GPT partition table to the end of a device of the given
+// size, trying both 512 and 4096 byte logical sectors like [gptPartitions].
+func relocateBackupGPT(device interface {
+	io.ReaderAt
+	io.WriterAt
+}, size int) error {
+	for _, sectorSize := range []int{512, 4096} {
+		header := make([]byte, sectorSize)
+		if _, err := device.ReadAt(header, int64(sectorSize)); err != nil && err != io.EOF {
+			return err
+		} else if !bytes.Equal(header[:8], []byte(gptSignature)) {
+			continue
+		}
+		headerSize := int(binary.LittleEndian.Uint32(header[12:16]))
+		entriesLBA := int(binary.LittleEndian.Uint64(header[72:80]))
+		count := int(binary.LittleEndian.Uint32(header[80:84]))
+		entrySize := int(binary.LittleEndian.Uint32(header[84:88]))
+		if headerSize < gptHeaderSize || headerSize > sectorSize ||
+			entrySize < 128 || entrySize > gptMaxEntrySize || count > gptMaxEntryCount {
+			return errors.New("the GPT partition table is invalid")
+		}
+		entries := make([]byte, (count*entrySize+sectorSize-1)/sectorSize*sectorSize)
+		if _, err := device.ReadAt(entries, int64(entriesLBA*sectorSize)); err != nil {
+			return err
+		}
+
+		sectors := size / sectorSize
+		backupLBA := sectors - 1
+		backupEntriesLBA := backupLBA - len(entries)/sectorSize
+		lastUsable := backupEntriesLBA - 1
+		for i := 0; i < count; i++ {
+			if int(binary.LittleEndian.Uint64(entries[i*entrySize+40:])) > lastUsable {
+				return errors.New("there is no space for it after the last partition")
+			}
+		}
+		binary.LittleEndian.PutUint64(header[32:40], uint64(backupLBA))
+		binary.LittleEndian.PutUint64(header[48:56], uint64(lastUsable))
+		backup := bytes.Clone(header)
+		binary.LittleEndian.PutUint64(backup[24:32], uint64(backupLBA))
+		binary.LittleEndian.PutUint64(backup[32:40], 1)
+		binary.LittleEndian.PutUint64(backup[72:80], uint64(backupEntriesLBA))
+		for _, header := range [][]byte{header, backup} {
+			clear(header[16:20])
+			binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:headerSize]))
+		}
+
+		// The protective MBR partition spans the whole device, unless it's a hybrid MBR which has
+		// other partitions too.
+		mbr := make([]byte, mbrSectorSize)
+		if _, err := device.ReadAt(mbr, 0); err != nil {
+			return err
+		}
+		protective := mbr[mbrPartitions : mbrPartitions+16]
+		if protective[4] == mbrTypeGPT && bytes.Equal(mbr[mbrPartitions+16:mbrPartitions+64], make([]byte, 48)) {
+			binary.LittleEndian.PutUint32(protective[12:16], uint32(min(sectors-1, 0xffffffff)))
+		}
+		writes := []struct {
+			data []byte
+			lba  int
+		}{
+			{entries, backupEntriesLBA},
+			{backup, backupLBA},
+			{header, 1},
+			{mbr, 0},
+		}
+		for _, write := range writes {
+			if _, err := device.WriteAt(write.data, int64(write.lba*sectorSize)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// generateMBR generates the first sector of a device with an MBR partition table, with partitions
+// of the given types and start and sector counts.
+func generateMBR(partitions ...[3]int) []byte {
+	mbr := make([]byte, 512)
+	for i, p := range partitions {
+		entry := mbr[446+i*16:]
+		entry[4] = byte(p[0])
+		binary.LittleEndian.PutUint32(entry[8:], uint32(p[1]))
+		binary.LittleEndian.PutUint32(entry[12:], uint32(p[2]))
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
+
+// generateGPT generates the start of a device with a GPT partition table and logical sectors of
+// the given size, with partitions spanning the given first and last sectors.
+func generateGPT(sectorSize int, partitions ...[2]int) []byte {
+	device := make([]byte, 6*sectorSize)
+	copy(device, generateMBR([3]int{0xee, 1, 100}))
+	header := device[sectorSize:]
+	copy(header, "EFI PART")
+	binary.LittleEndian.PutUint32(header[12:], 92)
+	binary.LittleEndian.PutUint64(header[72:], 2)
+	binary.LittleEndian.PutUint32(header[80:], 8)
+	binary.LittleEndian.PutUint32(header[84:], 128)
+	for i, p := range partitions {
+		entry := device[2*sectorSize+i*128:]
+		entry[0] = 0xaf // Type GUIDs just have to be non-zero.
+		binary.LittleEndian.PutUint64(entry[32:], uint64(p[0]))
+		binary.LittleEndian.PutUint64(entry[40:], uint64(p[1]))
+	}
+	return device
+}
+
+func TestPartitionTableEnd(t *testing.T) {
+	t.Parallel()
+	superfloppy := generateMBR()
+	superfloppy[446] = 0xeb
+
+	testCases := []struct {
+		name          string
+		device        []byte
+		expectedEnd   int
+		expectedError error
+	}{
+		{"MBR", generateMBR([3]int{0x0c, 2048, 1000}, [3]int{0x83, 4096, 8192}), (4096 + 8192) * 512, nil},
+		{"MBR with extended partition", generateMBR([3]int{0x83, 2048, 1000}, [3]int{0x05, 4096, 100000}), (4096 + 100000) * 512, nil},
+		{"GPT with 512 byte sectors", generateGPT(512, [2]int{34, 2047}, [2]int{2048, 99999}), 100000 * 512, nil},
+		{"GPT with 4096 byte sectors", generateGPT(4096, [2]int{256, 1023}), 1024 * 4096, nil},
+		{"empty MBR", generateMBR(), 0, ErrNoPartitionTable},
+		{"empty GPT", generateGPT(512), 0, ErrNoPartitionTable},
+		{"superfloppy", superfloppy, 0, ErrNoPartitionTable},
+		{"no partition table", make([]byte, 4096), 0, ErrNoPartitionTable},
+		{"empty device", nil, 0, ErrNoPartitionTable},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			end, err := PartitionTableEnd(bytes.NewReader(testCase.device))
+			if !errors.Is(err, testCase.expectedError) {
+				t.Errorf("expected error %v, got %v", testCase.expectedError, err)
+			} else if end != testCase.expectedEnd {
+				t.Errorf("expected end %d, got %d", testCase.expectedEnd, end)
+			}
+		})
+	}
+}
+
+func TestHasGPT(t *testing.T) {
+	t.Parallel()
+	if !HasGPT(bytes.NewReader(generateGPT(512))) || !HasGPT(bytes.NewReader(generateGPT(4096))) {
+		t.Errorf("expected GPT to be detected")
+	} else if HasGPT(bytes.NewReader(generateMBR([3]int{0x83, 2048, 1000}))) || HasGPT(bytes.NewReader(nil)) {
+		t.Errorf("expected no GPT to be detected")
+	}
+}
+
+func TestRelocateBackupGPT(t *testing.T) {
+	t.Parallel()
+	// The source has a partition ending at 1 MiB, which is all that's cloned to the targets.
+	used := generateGPT(512, [2]int{34, 2047})
+	used = append(used, make([]byte, 2048*512-len(used))...)
+
+	testCases := []struct {
+		name  string
+		size  int
+		fails bool
+	}{
+		{"smaller target", 2 * 1024 * 1024, false},
+		{"larger target", 8 * 1024 * 1024, false},
+		{"no space after the last partition", 2050 * 512, true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			target := filepath.Join(t.TempDir(), "target.img")
+			os.WriteFile(target, append(bytes.Clone(used), make([]byte, testCase.size-len(used))...), 0644)
+			err := RelocateBackupGPT(target)
+			if testCase.fails {
+				if err == nil {
+					t.Errorf("expected error when there is no space for the backup partition table")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			device, _ := os.ReadFile(target)
+			sectors := testCase.size / 512
+			header, backup := device[512:1024], device[(sectors-1)*512:]
+			if alternate := binary.LittleEndian.Uint64(header[32:]); alternate != uint64(sectors-1) {
+				t.Errorf("expected primary header to point to LBA %d, got %d", sectors-1, alternate)
+			} else if string(backup[:8]) != gptSignature || binary.LittleEndian.Uint64(backup[72:]) != uint64(sectors-3) {
+				t.Errorf("expected backup header in the last sector, with the entries before it")
+			} else if !bytes.Equal(device[(sectors-3)*512:(sectors-1)*512], used[1024:2048]) {
+				t.Errorf("expected backup entries to match the primary ones")
+			} else if count := binary.LittleEndian.Uint32(device[mbrPartitions+12:]); count != uint32(sectors-1) {
+				t.Errorf("expected protective MBR to span %d sectors, got %d", sectors-1, count)
+			}
+			for _, header := range [][]byte{header, backup} {
+				crc := binary.LittleEndian.Uint32(header[16:20])
+				clear(header[16:20])
+				if expected := crc32.ChecksumIEEE(header[:gptHeaderSize]); crc != expected {
+					t.Errorf("expected header CRC %x, got %x", expected, crc)
+				}
+			}
+		})
+	}
+
+	t.Run("MBR", func(t *testing.T) {
+		t.Parallel()
+		target := filepath.Join(t.TempDir(), "target.img")
+		mbr := append(generateMBR([3]int{0x0c, 2048, 2048}), make([]byte, 2*1024*1024)...)
+		os.WriteFile(target, mbr, 0644)
+		if err := RelocateBackupGPT(target); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		} else if device, _ := os.ReadFile(target); !bytes.Equal(device, mbr) {
+			t.Errorf("expected device without a GPT to be left as-is")
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package imaging
+
+import (
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// pipelineBuffers is the number of buffers used when writing disk images, so that up to two
+// blocks are read ahead while another block is being written to the device.
+const pipelineBuffers = 3
+
+// bufferAlignment is the alignment of buffers used when writing disk images, as required for
+// direct I/O. This is the page size on most systems, and a multiple of the logical sector size.
+const bufferAlignment = 4096
+
+// alignedBuffer allocates a buffer of the given size aligned to [bufferAlignment].
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+bufferAlignment)
+	offset := 0
+	if remainder := int(uintptr(unsafe.Pointer(&buf[0])) % bufferAlignment); remainder != 0 {
+		offset = bufferAlignment - remainder
+	}
+	return buf[offset : offset+size : offset+size]
+}
+
+// pipelineBlock is a block of a disk image read ahead by a [pipeline].
+type pipelineBlock struct {
+	data []byte
+	// err is io.EOF for the last block (which may be empty), or the error encountered reading it.
+	err error
+	// progress is a snapshot of the progress of reading the source once this block was read.
+	progress Progress
+}
+
+// pipeline reads blocks from a reader in a separate goroutine, so that the next blocks are read
+// while the previous ones are being written. Blocks must be released once they are written.
+type pipeline struct {
+	blocks chan pipelineBlock
+	free   chan []byte
+	done   chan struct{}
+	exited chan struct{}
+	once   sync.Once
+}
+
+// startPipeline starts reading blocks of the given size from reader, using the given number of
+// buffers. Progress snapshots are taken from src, which reader reads from.
+func startPipeline(reader io.Reader, src io.Reader, blockSize int, buffers int) *pipeline {
+	p := &pipeline{
+		blocks: make(chan pipelineBlock, buffers),
+		free:   make(chan []byte, buffers),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	for range buffers {
+		p.free <- alignedBuffer(blockSize)
+	}
+	go p.read(reader, src)
+	return p
+}
+
+func (p *pipeline) read(reader io.Reader, src io.Reader) {
+	defer close(p.exited)
+	for {
+		var buf []byte
+		select {
+		case buf = <-p.free:
+		case <-p.done:
+			return
+		}
+		// Decompressors return short reads, so fill the buffer to write whole blocks.
+		n, err := io.ReadFull(reader, buf[:cap(buf)])
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		select {
+		case p.blocks <- pipelineBlock{data: buf[:n], err: err, progress: sourceProgress(src)}:
+		case <-p.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// release returns the buffer of a block once it has been written, so it can be read into again.
+func (p *pipeline) release(block pipelineBlock) {
+	p.free <- block.data
+}
+
+// stop stops reading blocks, and waits for the current read (if any) to complete.
+func (p *pipeline) stop() {
+	p.once.Do(func() { close(p.done) })
+	<-p.exited
+}
@@ -10,6 +10,8 @@ type Platform interface {
 	OsOpen(name string) (*os.File, error)
 	OsGeteuid() int
 	OsReadFile(name string) ([]byte, error)
+	OsReadDir(name string) ([]os.DirEntry, error)
+	OsReadlink(name string) (string, error)
 	OsStat(name string) (os.FileInfo, error)
 	RuntimeGOOS() string
 	ExecCommand(name string, arg ...string) *exec.Cmd
@@ -33,6 +35,14 @@ func (p systemPlatform) OsReadFile(name string) ([]byte, error) {
 	return os.ReadFile(name)
 }
 
+func (p systemPlatform) OsReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (p systemPlatform) OsReadlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
 func (p systemPlatform) OsStat(name string) (os.FileInfo, error) {
 	return os.Stat(name)
 }
@@ -2,11 +2,16 @@
 
 package imaging
 
-import "syscall"
+import (
+	"syscall"
+	"unsafe"
+)
 
 type UnixPlatform interface {
 	Platform
 	SyscallUnmount(target string, flags int) error
+	// SyscallIoctlGetInt performs an ioctl which stores a C int, and returns the int.
+	SyscallIoctlGetInt(fd uintptr, req uint) (int, error)
 }
 
 var UnixSystemPlatform UnixPlatform = systemPlatform{}
@@ -14,3 +19,12 @@ var UnixSystemPlatform UnixPlatform = systemPlatform{}
 func (p systemPlatform) SyscallUnmount(target string, flags int) error {
 	return syscall.Unmount(target, flags)
 }
+
+func (p systemPlatform) SyscallIoctlGetInt(fd uintptr, req uint) (int, error) {
+	var value int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(req), uintptr(unsafe.Pointer(&value)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(value), nil
+}
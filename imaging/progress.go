@@ -0,0 +1,78 @@
+package imaging
+
+import (
+	"io"
+	"time"
+)
+
+// Progress is a snapshot of the progress of writing or validating a disk image.
+type Progress struct {
+	// Bytes is the number of (decompressed) bytes written or validated so far.
+	Bytes int
+	// Total is the total number of bytes to be written or validated, or -1 if unknown.
+	Total int
+	// SourceBytes is the number of bytes read from the image file, if it is compressed.
+	SourceBytes int
+	// SourceTotal is the size of the image file, if it is compressed, or 0 otherwise.
+	SourceTotal int
+	// Duration is the time elapsed since the operation started.
+	Duration time.Duration
+	// Done is true for the final progress report, once the operation completes successfully.
+	Done bool
+}
+
+// Rate returns the average throughput of the operation in bytes per second.
+func (p Progress) Rate() int {
+	if p.Duration <= 0 {
+		return 0
+	}
+	return int(float64(p.Bytes) / p.Duration.Seconds())
+}
+
+// ProgressFunc is called periodically with the progress of an operation. It may be nil.
+type ProgressFunc func(Progress)
+
+// Format formats the progress as a line of dd-like output, see [FormatProgress] and
+// [FormatCompressedProgress]. The final progress report is formatted with more precision.
+func (p Progress) Format(action string) string {
+	delta := p.Duration.Milliseconds()
+	if p.SourceTotal > 0 {
+		return FormatCompressedProgress(p.Bytes, p.SourceBytes, p.SourceTotal, delta, action, p.Done)
+	}
+	return FormatProgress(p.Bytes, delta, action, p.Done)
+}
+
+// PrintProgress returns a [ProgressFunc] which prints dd-like progress to stderr.
+func PrintProgress(action string) ProgressFunc {
+	return func(p Progress) {
+		if p.Done {
+			println(p.Format(action))
+		} else {
+			print(p.Format(action) + "\r")
+		}
+	}
+}
+
+// readerProgress creates a snapshot of the progress of an operation reading from src. If src is
+// a [*SourceImage], the total size and compressed bytes read are included as well.
+func readerProgress(src io.Reader, total int, startTime time.Time, done bool) Progress {
+	progress := sourceProgress(src)
+	progress.Bytes = total
+	progress.Duration = time.Since(startTime)
+	progress.Done = done
+	return progress
+}
+
+// sourceProgress creates a snapshot of how much of src has been read. Only the total size and
+// compressed bytes read are included, if src is a [*SourceImage].
+func sourceProgress(src io.Reader) Progress {
+	progress := Progress{Total: -1}
+	if src, ok := src.(*SourceImage); ok {
+		progress.Total = src.UncompressedSize
+		if src.Compression != CompressionNone {
+			progress.SourceBytes = src.BytesRead()
+			progress.SourceTotal = src.Size
+		}
+	}
+	return progress
+}
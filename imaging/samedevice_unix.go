@@ -0,0 +1,40 @@
+//go:build !windows
+
+package imaging
+
+import (
+	"os"
+	"slices"
+	"syscall"
+)
+
+// SameDevice returns whether two paths refer to the same device, or to devices on the same disk,
+// e.g. /dev/sda and /dev/disk/by-id/usb-...-part1, or /dev/disk2 and /dev/rdisk2s1. Other files
+// are the same if they are the same file (see [os.SameFile]).
+func SameDevice(a string, b string) bool {
+	return SameDeviceWithPlatform(SystemPlatform, a, b)
+}
+
+// SameDeviceWithPlatform is [SameDevice] with a custom [Platform].
+func SameDeviceWithPlatform(platform Platform, a string, b string) bool {
+	statA, err := platform.OsStat(a)
+	if err != nil {
+		return false
+	}
+	statB, err := platform.OsStat(b)
+	if err != nil {
+		return false
+	} else if statA.Mode()&os.ModeDevice == 0 || statB.Mode()&os.ModeDevice == 0 {
+		return os.SameFile(statA, statB)
+	}
+	sysA, okA := statA.Sys().(*syscall.Stat_t)
+	sysB, okB := statB.Sys().(*syscall.Stat_t)
+	if okA && okB && sysA.Rdev == sysB.Rdev {
+		return true
+	}
+	// Partitions (and devices stacked on them) are compared by the disks they reside on.
+	disksA := wholeDisks(platform, a)
+	return slices.ContainsFunc(wholeDisks(platform, b), func(disk string) bool {
+		return slices.Contains(disksA, disk)
+	})
+}
@@ -0,0 +1,21 @@
+package imaging
+
+import (
+	"os"
+	"strings"
+)
+
+// SameDevice returns whether two paths refer to the same device. Physical drives are compared by
+// path, since they don't have device numbers, and other files are the same if they are the same
+// file (see [os.SameFile]).
+func SameDevice(a string, b string) bool {
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	statA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	statB, err := os.Stat(b)
+	return err == nil && os.SameFile(statA, statB)
+}
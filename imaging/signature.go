@@ -0,0 +1,153 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// ErrSignatureMissing is returned when a file has no OpenPGP signature to verify.
+var ErrSignatureMissing = errors.New("no OpenPGP signature was found")
+
+// ErrSignatureInvalid is returned (as a [*SignatureError]) when an OpenPGP signature is invalid,
+// or was not made by any key in the keyring.
+var ErrSignatureInvalid = errors.New("the OpenPGP signature is invalid")
+
+// SignatureError is returned when the OpenPGP signature of a file is invalid, or was not made by
+// any key in the keyring. It matches [ErrSignatureInvalid] with [errors.Is].
+type SignatureError struct {
+	Name string
+	Err  error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("the OpenPGP signature of %s is invalid! %v", e.Name, e.Err)
+}
+
+func (e *SignatureError) Is(target error) bool {
+	return target == ErrSignatureInvalid
+}
+
+func (e *SignatureError) Unwrap() error {
+	return e.Err
+}
+
+// SignatureExtensions are the extensions of detached signatures looked for next to a file, e.g.
+// SHA256SUMS.gpg for SHA256SUMS.
+var SignatureExtensions = []string{".gpg", ".sig", ".asc"}
+
+// ReadKeyring reads the OpenPGP public keys trusted to sign disk images or checksum files, from
+// either an ASCII armored (.asc) or binary (.gpg) keyring.
+func ReadKeyring(path string) (openpgp.EntityList, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keyring openpgp.EntityList
+	if isArmored(file) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(file))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(file))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring! %w", err)
+	} else if len(keyring) == 0 {
+		return nil, errors.New("the keyring does not contain any keys")
+	}
+	return keyring, nil
+}
+
+// FindSignatureFile returns the path to the detached signature of a file next to it (see
+// [SignatureExtensions]), or an empty string if there is none.
+func FindSignatureFile(file string) string {
+	for _, extension := range SignatureExtensions {
+		if stat, err := os.Stat(file + extension); err == nil && stat.Mode().IsRegular() {
+			return file + extension
+		}
+	}
+	return ""
+}
+
+// VerifySignature verifies the detached signature next to a file (see [FindSignatureFile]),
+// returning the name of the signer. It returns [ErrSignatureMissing] if there is no signature.
+func VerifySignature(file string, keyring openpgp.EntityList) (string, error) {
+	signatureFile := FindSignatureFile(file)
+	if signatureFile == "" {
+		return "", ErrSignatureMissing
+	}
+	signature, err := os.ReadFile(signatureFile)
+	if err != nil {
+		return "", err
+	}
+	signed, err := openFile(file, os.O_RDONLY, 0, "file")
+	if err != nil {
+		return "", err
+	}
+	defer signed.Close()
+	return verifyDetachedSignature(signed, signature, file, keyring)
+}
+
+// ReadSignedChecksumFile is [ReadChecksumFile] for checksum files signed with either a detached
+// signature next to them, or an inline clearsigned signature, returning the name of the signer as
+// well. Only the signed contents of the checksum file are trusted.
+func ReadSignedChecksumFile(checksumFile string, image string, keyring openpgp.EntityList) (*Checksum, string, error) {
+	file, err := os.ReadFile(checksumFile)
+	if err != nil {
+		return nil, "", err
+	}
+	var signer string
+	if signatureFile := FindSignatureFile(checksumFile); signatureFile != "" {
+		var signature []byte
+		if signature, err = os.ReadFile(signatureFile); err == nil {
+			signer, err = verifyDetachedSignature(bytes.NewReader(file), signature, checksumFile, keyring)
+		}
+	} else if block, _ := clearsign.Decode(file); block != nil {
+		var entity *openpgp.Entity
+		entity, err = block.VerifySignature(keyring, nil)
+		if err != nil {
+			err = &SignatureError{Name: checksumFile, Err: err}
+		} else {
+			signer, file = signerName(entity), block.Plaintext
+		}
+	} else {
+		err = ErrSignatureMissing
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	checksum, err := parseChecksumFile(file, filepath.Base(image))
+	return checksum, signer, err
+}
+
+func verifyDetachedSignature(signed io.Reader, signature []byte, name string, keyring openpgp.EntityList) (string, error) {
+	var entity *openpgp.Entity
+	var err error
+	if isArmored(signature) {
+		entity, err = openpgp.CheckArmoredDetachedSignature(keyring, signed, bytes.NewReader(signature), nil)
+	} else {
+		entity, err = openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(signature), nil)
+	}
+	if err != nil {
+		return "", &SignatureError{Name: name, Err: err}
+	}
+	return signerName(entity), nil
+}
+
+// signerName returns the name of the primary identity of a key, e.g. "Ubuntu CD Image Automatic
+// Signing Key (2012) <cdimage@ubuntu.com>", or its key ID if it has none.
+func signerName(entity *openpgp.Entity) string {
+	if identity := entity.PrimaryIdentity(); identity != nil {
+		return identity.Name
+	}
+	return entity.PrimaryKey.KeyIdString()
+}
+
+func isArmored(file []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(file), []byte("-----BEGIN PGP"))
+}
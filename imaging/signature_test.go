@@ -0,0 +1,199 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+func GenerateSigningKey(t *testing.T, name string) *openpgp.Entity {
+	t.Helper()
+	entity, err := openpgp.NewEntity(name, "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return entity
+}
+
+// WriteKeyring writes the public keys of the given entities to an armored keyring file.
+func WriteKeyring(t *testing.T, entities ...*openpgp.Entity) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keyring.asc")
+	var buf bytes.Buffer
+	writer, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("Failed to create armor encoder: %v", err)
+	}
+	for _, entity := range entities {
+		if err := entity.Serialize(writer); err != nil {
+			t.Fatalf("Failed to serialize key: %v", err)
+		}
+	}
+	writer.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write keyring: %v", err)
+	}
+	return path
+}
+
+func TestReadKeyring(t *testing.T) {
+	t.Parallel()
+	signer := GenerateSigningKey(t, "Imprint Test")
+	keyring, err := ReadKeyring(WriteKeyring(t, signer))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	} else if len(keyring) != 1 || keyring[0].PrimaryKey.KeyId != signer.PrimaryKey.KeyId {
+		t.Errorf("expected keyring with the signing key, got %d keys", len(keyring))
+	}
+
+	binary := filepath.Join(t.TempDir(), "keyring.gpg")
+	var buf bytes.Buffer
+	signer.Serialize(&buf)
+	os.WriteFile(binary, buf.Bytes(), 0644)
+	if keyring, err := ReadKeyring(binary); err != nil || len(keyring) != 1 {
+		t.Errorf("expected binary keyring with 1 key, got %d keys and error %v", len(keyring), err)
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.asc")
+	os.WriteFile(invalid, []byte("not a keyring"), 0644)
+	if _, err := ReadKeyring(invalid); err == nil {
+		t.Errorf("expected error for invalid keyring")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	t.Parallel()
+	signer := GenerateSigningKey(t, "Imprint Test")
+	impostor := GenerateSigningKey(t, "Impostor")
+	keyring, err := ReadKeyring(WriteKeyring(t, signer))
+	if err != nil {
+		t.Fatalf("Failed to read keyring: %v", err)
+	}
+	image := []byte("disk image contents")
+
+	testCases := []struct {
+		name          string
+		extension     string
+		sign          func(*bytes.Buffer, []byte) error
+		expectedError error
+	}{
+		{"armored signature", ".asc", func(buf *bytes.Buffer, data []byte) error {
+			return openpgp.ArmoredDetachSign(buf, signer, bytes.NewReader(data), nil)
+		}, nil},
+		{"binary signature", ".sig", func(buf *bytes.Buffer, data []byte) error {
+			return openpgp.DetachSign(buf, signer, bytes.NewReader(data), nil)
+		}, nil},
+		{"signature by unknown key", ".gpg", func(buf *bytes.Buffer, data []byte) error {
+			return openpgp.DetachSign(buf, impostor, bytes.NewReader(data), nil)
+		}, ErrSignatureInvalid},
+		{"tampered file", ".sig", func(buf *bytes.Buffer, data []byte) error {
+			return openpgp.DetachSign(buf, signer, bytes.NewReader(append(data, '!')), nil)
+		}, ErrSignatureInvalid},
+		{"missing signature", "", nil, ErrSignatureMissing},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "image.iso")
+			os.WriteFile(path, image, 0644)
+			if testCase.sign != nil {
+				var signature bytes.Buffer
+				if err := testCase.sign(&signature, image); err != nil {
+					t.Fatalf("Failed to sign image: %v", err)
+				}
+				os.WriteFile(path+testCase.extension, signature.Bytes(), 0644)
+			}
+			name, err := VerifySignature(path, keyring)
+			if !errors.Is(err, testCase.expectedError) {
+				t.Errorf("expected error %v, got %v", testCase.expectedError, err)
+			} else if err == nil && name != "Imprint Test <test@example.com>" {
+				t.Errorf("expected signer Imprint Test, got %s", name)
+			}
+		})
+	}
+}
+
+func TestReadSignedChecksumFile(t *testing.T) {
+	t.Parallel()
+	signer := GenerateSigningKey(t, "Imprint Test")
+	keyring, err := ReadKeyring(WriteKeyring(t, signer))
+	if err != nil {
+		t.Fatalf("Failed to read keyring: %v", err)
+	}
+	digest := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	forged := "0000000000000000000000000000000000000000000000000000000000000000"
+	sums := []byte(digest + "  image.iso\n")
+	clearsigned := func(t *testing.T, data []byte) []byte {
+		var buf bytes.Buffer
+		writer, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+		if err != nil {
+			t.Fatalf("Failed to clearsign: %v", err)
+		}
+		writer.Write(data)
+		writer.Close()
+		return buf.Bytes()
+	}
+
+	t.Run("detached signature", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "SHA256SUMS")
+		os.WriteFile(path, sums, 0644)
+		var signature bytes.Buffer
+		openpgp.ArmoredDetachSign(&signature, signer, bytes.NewReader(sums), nil)
+		os.WriteFile(path+".gpg", signature.Bytes(), 0644)
+		checksum, _, err := ReadSignedChecksumFile(path, "image.iso", keyring)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		} else if checksum.String() != "sha256:"+digest {
+			t.Errorf("expected sha256:%s, got %s", digest, checksum)
+		}
+	})
+
+	t.Run("clearsigned", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "CHECKSUM")
+		os.WriteFile(path, clearsigned(t, sums), 0644)
+		checksum, signerName, err := ReadSignedChecksumFile(path, "image.iso", keyring)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		} else if checksum.String() != "sha256:"+digest || signerName == "" {
+			t.Errorf("expected sha256:%s signed by Imprint Test, got %s signed by %s", digest, checksum, signerName)
+		}
+	})
+
+	t.Run("unsigned entries after clearsigned block are ignored", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "CHECKSUM")
+		file := append(clearsigned(t, []byte(digest+"  other.iso\n")), []byte(forged+"  image.iso\n")...)
+		os.WriteFile(path, file, 0644)
+		var errNotFound *ChecksumNotFoundError
+		if _, _, err := ReadSignedChecksumFile(path, "image.iso", keyring); !errors.As(err, &errNotFound) {
+			t.Errorf("expected ChecksumNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("tampered clearsigned file", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "CHECKSUM")
+		os.WriteFile(path, bytes.Replace(clearsigned(t, sums), []byte(digest), []byte(forged), 1), 0644)
+		if _, _, err := ReadSignedChecksumFile(path, "image.iso", keyring); !errors.Is(err, ErrSignatureInvalid) {
+			t.Errorf("expected ErrSignatureInvalid, got %v", err)
+		}
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		t.Parallel()
+		path := filepath.Join(t.TempDir(), "SHA256SUMS")
+		os.WriteFile(path, sums, 0644)
+		if _, _, err := ReadSignedChecksumFile(path, "image.iso", keyring); !errors.Is(err, ErrSignatureMissing) {
+			t.Errorf("expected ErrSignatureMissing, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,385 @@
+package imaging
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the compression format of a disk image.
+type Compression string
+
+const (
+	CompressionNone  Compression = ""
+	CompressionGzip  Compression = "gzip"
+	CompressionXz    Compression = "xz"
+	CompressionBzip2 Compression = "bzip2"
+	CompressionZstd  Compression = "zstd"
+	CompressionZip   Compression = "zip"
+)
+
+// ImageExtensions is the list of file extensions of disk images Imprint can flash.
+var ImageExtensions = []string{"raw", "iso", "img", "dmg", "xz", "gz", "bz2", "zst", "zip"}
+
+// ErrNoImageInArchive is returned when a zip archive doesn't contain any disk images.
+var ErrNoImageInArchive = errors.New("the zip archive does not contain any disk images")
+
+// MultipleImagesError is returned when a zip archive contains multiple disk images, and the entry
+// to flash was not specified.
+type MultipleImagesError struct{ Entries []string }
+
+func (e *MultipleImagesError) Error() string {
+	return "the zip archive contains multiple disk images, specify one of: " + strings.Join(e.Entries, ", ")
+}
+
+// EntryNotFoundError is returned when the specified entry does not exist in a zip archive.
+type EntryNotFoundError struct{ Name string }
+
+func (e *EntryNotFoundError) Error() string {
+	return fmt.Sprintf("the specified entry %s does not exist in the zip archive!", e.Name)
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	bzip2Magic = []byte{'B', 'Z', 'h'}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic   = []byte{'P', 'K', 0x03, 0x04}
+)
+
+// DetectCompression sniffs the magic bytes at the start of a disk image to determine how it
+// is compressed. Uncompressed images (and unknown formats) return [CompressionNone].
+func DetectCompression(header []byte) Compression {
+	if bytes.HasPrefix(header, xzMagic) {
+		return CompressionXz
+	} else if bytes.HasPrefix(header, zstdMagic) {
+		return CompressionZstd
+	} else if bytes.HasPrefix(header, gzipMagic) {
+		return CompressionGzip
+	} else if bytes.HasPrefix(header, bzip2Magic) && len(header) >= 4 &&
+		header[3] >= '1' && header[3] <= '9' {
+		return CompressionBzip2
+	} else if bytes.HasPrefix(header, zipMagic) {
+		return CompressionZip
+	}
+	return CompressionNone
+}
+
+// SourceImage is a disk image opened for reading. Compressed images are decompressed on the fly,
+// so reading from a SourceImage always yields the raw contents to be written to the device.
+//
+// Disk images inside zip archives are read directly from the archive, and may themselves be
+// compressed as well.
+type SourceImage struct {
+	// Compression is the compression format of the image file. For images in a zip archive, this
+	// is [CompressionZip], unless the archived image is compressed itself.
+	Compression Compression
+	// Entry is the name of the disk image inside the zip archive, if the image file is one.
+	Entry string
+	// Size is the size of the image file on disk, i.e. the compressed size of the image.
+	// For images in a zip archive, this is the compressed size of the entry.
+	Size int
+	// UncompressedSize is the size of the image after decompression, or -1 if it cannot be
+	// determined without decompressing the entire image.
+	UncompressedSize int
+
+	file    *os.File
+	counter *countingReader
+	reader  io.Reader
+	closer  io.Closer
+}
+
+// OpenSourceImage opens a disk image for reading, detecting its compression format.
+//
+// If the disk image is a zip archive, the specified entry is opened, or if entry is empty, the
+// only disk image in the archive is opened.
+func OpenSourceImage(filePath string, entry string) (*SourceImage, error) {
+	file, err := openFile(filePath, os.O_RDONLY, 0, "file")
+	if err != nil {
+		return nil, err
+	}
+	image, err := newSourceImage(file, entry)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return image, nil
+}
+
+func newSourceImage(file *os.File, entry string) (*SourceImage, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("an error occurred while opening file! %w", err)
+	}
+	image := &SourceImage{
+		Size:             int(stat.Size()),
+		UncompressedSize: int(stat.Size()),
+		file:             file,
+		counter:          &countingReader{reader: file},
+	}
+	var header [16]byte
+	n, err := file.ReadAt(header[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("encountered error while reading file! %w", err)
+	} else if DetectCompression(header[:n]) == CompressionZip {
+		err = image.openZipEntry(stat.Size(), entry)
+	} else {
+		err = image.decompress(image.counter, file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// openZipEntry opens a disk image inside a zip archive, falling through to decompress it.
+func (s *SourceImage) openZipEntry(size int64, entry string) error {
+	archive, err := zip.NewReader(&countingReaderAt{reader: s.file, counter: s.counter}, size)
+	if err != nil {
+		return fmt.Errorf("failed to read zip archive! %w", err)
+	}
+	var candidates []*zip.File
+	for _, file := range archive.File {
+		if entry != "" && (file.Name == entry || path.Base(file.Name) == entry) {
+			candidates = []*zip.File{file}
+			break
+		} else if entry == "" && isArchivedImage(file) {
+			candidates = append(candidates, file)
+		}
+	}
+	if len(candidates) == 0 && entry != "" {
+		return &EntryNotFoundError{Name: entry}
+	} else if len(candidates) == 0 {
+		return ErrNoImageInArchive
+	} else if len(candidates) > 1 {
+		names := make([]string, len(candidates))
+		for i, candidate := range candidates {
+			names[i] = candidate.Name
+		}
+		return &MultipleImagesError{Entries: names}
+	}
+	reader, err := candidates[0].Open()
+	if err != nil {
+		return fmt.Errorf("failed to read zip archive! %w", err)
+	}
+	// The archive's central directory and the entry's local header have been read by now.
+	s.counter.total = 0
+	s.Entry = candidates[0].Name
+	s.Size = int(candidates[0].CompressedSize64)
+	s.UncompressedSize = int(candidates[0].UncompressedSize64)
+	s.closer = reader
+	if err := s.decompress(reader, nil); err != nil {
+		return err
+	} else if s.Compression == CompressionNone {
+		s.Compression = CompressionZip
+	}
+	return nil
+}
+
+// decompress sniffs the compression format of the image and sets up a decompressor for it. If
+// the image is a file, its metadata is used to determine the uncompressed size if possible.
+func (s *SourceImage) decompress(reader io.Reader, file io.ReaderAt) error {
+	buffered := bufio.NewReader(reader)
+	header, err := buffered.Peek(16)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("encountered error while reading file! %w", err)
+	}
+	s.Compression = DetectCompression(header)
+	switch s.Compression {
+	case CompressionNone, CompressionZip: // Nested zip archives aren't supported.
+		s.Compression = CompressionNone
+		s.reader = buffered
+	case CompressionGzip:
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip image! %w", err)
+		}
+		s.reader, s.closer = reader, multiCloser{reader, s.closer}
+	case CompressionBzip2:
+		s.reader = bzip2.NewReader(buffered)
+	case CompressionXz:
+		reader, err := xz.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("failed to read xz image! %w", err)
+		}
+		s.reader = reader
+	case CompressionZstd:
+		reader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("failed to read zstd image! %w", err)
+		}
+		s.reader, s.closer = reader, multiCloser{reader.IOReadCloser(), s.closer}
+	}
+	if s.Compression != CompressionNone && file != nil {
+		s.UncompressedSize = uncompressedSize(file, s.Compression, header, s.Size)
+	} else if s.Compression != CompressionNone {
+		s.UncompressedSize = -1
+	}
+	return nil
+}
+
+// Read reads decompressed data from the disk image.
+func (s *SourceImage) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+// BytesRead returns the number of bytes read from the image file on disk so far. For compressed
+// images, this is the amount of compressed data consumed by the decompressor.
+func (s *SourceImage) BytesRead() int {
+	// Zip archives may store a data descriptor after the entry, which is read as well.
+	return min(s.counter.total, s.Size)
+}
+
+// Close closes the decompressor and the underlying image file.
+func (s *SourceImage) Close() error {
+	if s.closer != nil {
+		s.closer.Close()
+	}
+	return s.file.Close()
+}
+
+// startHashing starts hashing the image file as it is read, before decompression.
+func (s *SourceImage) startHashing(hash hash.Hash) {
+	s.counter.hasher = &fileHasher{file: s.file, hash: hash}
+}
+
+// sum hashes the remainder of the image file which wasn't read, e.g. the central directory of zip
+// archives, and returns the hash of the entire image file.
+func (s *SourceImage) sum() ([]byte, error) {
+	hasher := s.counter.hasher
+	stat, err := s.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	hasher.fill(stat.Size())
+	return hasher.hash.Sum(nil), hasher.err
+}
+
+// isArchivedImage returns if a file in a zip archive looks like a disk image.
+func isArchivedImage(file *zip.File) bool {
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(file.Name), "."))
+	return !file.FileInfo().IsDir() && extension != "zip" && slices.Contains(ImageExtensions, extension)
+}
+
+type countingReader struct {
+	reader io.Reader
+	total  int
+	// offset is the position of reader in the image file, for hashing.
+	offset int64
+	hasher *fileHasher
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hasher.update(p[:n], r.offset)
+	r.offset += int64(n)
+	r.total += n
+	return n, err
+}
+
+// countingReaderAt counts bytes read from a zip archive in the same counter as [countingReader].
+type countingReaderAt struct {
+	reader  io.ReaderAt
+	counter *countingReader
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.reader.ReadAt(p, off)
+	r.counter.hasher.update(p[:n], off)
+	r.counter.total += n
+	return n, err
+}
+
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	var errs []error
+	for _, closer := range c {
+		if closer != nil {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// uncompressedSize determines the decompressed size of an image from its metadata where the
+// format stores it reliably, returning -1 otherwise. gzip only stores the size modulo 4 GiB,
+// and bzip2 doesn't store it at all.
+func uncompressedSize(file io.ReaderAt, compression Compression, header []byte, size int) int {
+	switch compression {
+	case CompressionZstd:
+		var frame zstd.Header
+		if err := frame.Decode(header); err == nil && frame.HasFCS {
+			return int(frame.FrameContentSize)
+		}
+	case CompressionXz:
+		if n, err := xzUncompressedSize(file, size); err == nil {
+			return n
+		}
+	}
+	return -1
+}
+
+var errXzIndex = errors.New("unable to parse xz index")
+
+// xzUncompressedSize reads the index at the end of a single-stream xz file to sum up the
+// uncompressed sizes of all of its blocks.
+func xzUncompressedSize(file io.ReaderAt, size int) (int, error) {
+	const headerSize, footerSize = 12, 12
+	if size < headerSize+footerSize {
+		return 0, errXzIndex
+	}
+	footer := make([]byte, footerSize)
+	if _, err := file.ReadAt(footer, int64(size-footerSize)); err != nil {
+		return 0, err
+	} else if footer[10] != 'Y' || footer[11] != 'Z' {
+		return 0, errXzIndex
+	}
+	indexSize := (int(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if indexSize > size-headerSize-footerSize {
+		return 0, errXzIndex
+	}
+	index := make([]byte, indexSize)
+	if _, err := file.ReadAt(index, int64(size-footerSize-indexSize)); err != nil {
+		return 0, err
+	} else if index[0] != 0x00 {
+		return 0, errXzIndex
+	}
+	reader := bytes.NewReader(index[1:])
+	records, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, errXzIndex
+	}
+	blocksSize, total := 0, 0
+	for i := uint64(0); i < records; i++ {
+		unpadded, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0, errXzIndex
+		}
+		uncompressed, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0, errXzIndex
+		}
+		blocksSize += (int(unpadded) + 3) &^ 3
+		total += int(uncompressed)
+	}
+	// If the blocks don't account for the whole file, it has multiple streams or padding.
+	if headerSize+blocksSize+indexSize+footerSize != size {
+		return 0, errXzIndex
+	}
+	return total, nil
+}
@@ -0,0 +1,335 @@
+package imaging
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// GenerateCompressedFile writes random data (with a partial trailing block) to a file compressed
+// in the given format, and returns the file path along with the data and its checksum.
+func GenerateCompressedFile(t *testing.T, compression Compression) (string, []byte, []byte) {
+	t.Helper()
+	data := make([]byte, 9*1024*1024+123)
+	if _, err := rand.Read(data[:len(data)/2]); err != nil { // Leave half compressible
+		t.Fatalf("Failed to read random data: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	path := filepath.Join(t.TempDir(), "sample.img")
+	var buf bytes.Buffer
+	switch compression {
+	case CompressionNone:
+		buf.Write(data)
+	case CompressionGzip:
+		writer := gzip.NewWriter(&buf)
+		writer.Write(data)
+		writer.Close()
+	case CompressionXz:
+		writer, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("Failed to create xz writer: %v", err)
+		}
+		writer.Write(data)
+		writer.Close()
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			t.Fatalf("Failed to create zstd encoder: %v", err)
+		}
+		buf.Write(encoder.EncodeAll(data, nil))
+	case CompressionBzip2: // The standard library can only decompress bzip2
+		if _, err := exec.LookPath("bzip2"); err != nil {
+			t.Skip("bzip2 not found")
+		}
+		cmd := exec.Command("bzip2", "-c")
+		cmd.Stdin = bytes.NewReader(data)
+		cmd.Stdout = &buf
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Failed to run bzip2: %v", err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write compressed file: %v", err)
+	}
+	return path, data, sum[:]
+}
+
+// GenerateZipFile writes a zip archive with the given entries to a temporary file.
+func GenerateZipFile(t *testing.T, entries map[string][]byte, method uint16) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sample.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create zip file: %v", err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for name, data := range entries {
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		} else if _, err := writer.Write(data); err != nil {
+			t.Fatalf("Failed to write zip entry: %v", err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("Failed to write zip file: %v", err)
+	}
+	return path
+}
+
+func TestDetectCompression(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		header   []byte
+		expected Compression
+	}{
+		{"empty header", []byte{}, CompressionNone},
+		{"ISO header", []byte("CD001\x01\x00\x00"), CompressionNone},
+		{"MBR header", make([]byte, 16), CompressionNone},
+		{"gzip header", []byte{0x1f, 0x8b, 0x08, 0x00}, CompressionGzip},
+		{"xz header", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x04}, CompressionXz},
+		{"truncated xz header", []byte{0xfd, '7', 'z', 'X'}, CompressionNone},
+		{"bzip2 header", []byte("BZh91AY&SY"), CompressionBzip2},
+		{"bzip2 header with invalid block size", []byte("BZh0"), CompressionNone},
+		{"zstd header", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x04}, CompressionZstd},
+		{"zip header", []byte{'P', 'K', 0x03, 0x04, 0x14, 0x00}, CompressionZip},
+		{"empty zip header", []byte{'P', 'K', 0x05, 0x06}, CompressionNone},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			result := DetectCompression(testCase.header)
+			if result != testCase.expected {
+				t.Errorf("expected %q, got %q", testCase.expected, result)
+			}
+		})
+	}
+}
+
+func TestOpenSourceImage(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		compression   Compression
+		knownSize     bool
+		expectedLabel string
+	}{
+		{CompressionNone, true, "uncompressed"},
+		{CompressionGzip, false, "gzip"},
+		{CompressionXz, true, "xz"},
+		{CompressionZstd, true, "zstd"},
+		{CompressionBzip2, false, "bzip2"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.expectedLabel+" image is decompressed correctly", func(t *testing.T) {
+			t.Parallel()
+			path, data, _ := GenerateCompressedFile(t, testCase.compression)
+			image, err := OpenSourceImage(path, "")
+			if err != nil {
+				t.Fatalf("OpenSourceImage failed: %v", err)
+			}
+			defer image.Close()
+			if image.Compression != testCase.compression {
+				t.Errorf("expected compression %q, got %q", testCase.compression, image.Compression)
+			}
+			if stat, err := os.Stat(path); err != nil {
+				t.Errorf("Failed to stat image: %v", err)
+			} else if image.Size != int(stat.Size()) {
+				t.Errorf("expected size %d, got %d", stat.Size(), image.Size)
+			}
+			if testCase.knownSize && image.UncompressedSize != len(data) {
+				t.Errorf("expected uncompressed size %d, got %d", len(data), image.UncompressedSize)
+			} else if !testCase.knownSize && image.UncompressedSize != -1 {
+				t.Errorf("expected unknown uncompressed size, got %d", image.UncompressedSize)
+			}
+			result, err := io.ReadAll(image)
+			if err != nil {
+				t.Errorf("Failed to read image: %v", err)
+			} else if !bytes.Equal(result, data) {
+				t.Errorf("Decompressed data does not match original data")
+			}
+			if image.BytesRead() != image.Size {
+				t.Errorf("expected %d bytes read, got %d", image.Size, image.BytesRead())
+			}
+		})
+	}
+
+	t.Run("fails when file does not exist", func(t *testing.T) {
+		t.Parallel()
+		var errNotExists *NotExistsError
+		_, err := OpenSourceImage(filepath.Join(t.TempDir(), "nonexistent"), "")
+		if !errors.As(err, &errNotExists) {
+			t.Errorf("Expected NotExistsError, got: %v", err)
+		}
+	})
+}
+
+func TestFlashAndValidationOfCompressedImages(t *testing.T) {
+	t.Parallel()
+	for _, compression := range []Compression{CompressionGzip, CompressionXz, CompressionZstd, CompressionBzip2} {
+		t.Run(string(compression)+" image is flashed and validated correctly", func(t *testing.T) {
+			t.Parallel()
+			sample, _, sampleSum := GenerateCompressedFile(t, compression)
+			dest := filepath.Join(t.TempDir(), "dest")
+			if err := os.WriteFile(dest, nil, 0644); err != nil {
+				t.Fatalf("Failed to create dest file: %v", err)
+			}
+			err := WriteDiskImage(sample, dest)
+			if err != nil {
+				t.Errorf("WriteDiskImage failed: %v", err)
+			} else if checksum, err := ChecksumFile(t, dest); err != nil {
+				t.Errorf("Failed to generate checksum for dest: %v", err)
+			} else if !bytes.Equal(sampleSum, checksum) {
+				t.Errorf("Checksum mismatch: expected %x, got %x", sampleSum, checksum)
+			}
+			err = ValidateDiskImage(sample, dest)
+			if err != nil {
+				t.Errorf("Validation failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenSourceImageFromZip(t *testing.T) {
+	t.Parallel()
+	sample, data, _ := GenerateCompressedFile(t, CompressionNone)
+	sampleData, err := os.ReadFile(sample)
+	if err != nil {
+		t.Fatalf("Failed to read sample: %v", err)
+	}
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("Failed to create zstd encoder: %v", err)
+	}
+	compressedData := encoder.EncodeAll(sampleData, nil)
+	testCases := []struct {
+		name                string
+		entries             map[string][]byte
+		method              uint16
+		entry               string
+		expectedEntry       string
+		expectedCompression Compression
+		expectedData        []byte
+		expectedError       error
+	}{
+		{
+			"opens the only image in a stored archive",
+			map[string][]byte{"README.txt": []byte("readme"), "dir/sample.img": sampleData},
+			zip.Store, "", "dir/sample.img", CompressionZip, data, nil,
+		},
+		{
+			"opens the only image in a deflated archive",
+			map[string][]byte{"sample.iso": sampleData},
+			zip.Deflate, "", "sample.iso", CompressionZip, data, nil,
+		},
+		{
+			"opens a compressed image in an archive",
+			map[string][]byte{"sample.img.zst": compressedData},
+			zip.Store, "", "sample.img.zst", CompressionZstd, data, nil,
+		},
+		{
+			"opens the specified entry in an archive with multiple images",
+			map[string][]byte{"a.img": sampleData, "dir/b.img": []byte("b")},
+			zip.Deflate, "a.img", "a.img", CompressionZip, data, nil,
+		},
+		{
+			"opens the specified entry by base name",
+			map[string][]byte{"a.img": []byte("a"), "dir/b.img": sampleData},
+			zip.Deflate, "b.img", "dir/b.img", CompressionZip, data, nil,
+		},
+		{
+			"fails when the archive has no images",
+			map[string][]byte{"README.txt": []byte("readme")},
+			zip.Deflate, "", "", CompressionZip, nil, ErrNoImageInArchive,
+		},
+		{
+			"fails when the archive has multiple images",
+			map[string][]byte{"a.img": []byte("a"), "b.iso": []byte("b")},
+			zip.Deflate, "", "", CompressionZip, nil, &MultipleImagesError{},
+		},
+		{
+			"fails when the specified entry does not exist",
+			map[string][]byte{"a.img": []byte("a")},
+			zip.Deflate, "b.img", "", CompressionZip, nil, &EntryNotFoundError{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			path := GenerateZipFile(t, testCase.entries, testCase.method)
+			image, err := OpenSourceImage(path, testCase.entry)
+			var errMultiple *MultipleImagesError
+			var errNotFound *EntryNotFoundError
+			switch testCase.expectedError.(type) {
+			case nil:
+				if err != nil {
+					t.Fatalf("OpenSourceImage failed: %v", err)
+				}
+			case *MultipleImagesError:
+				if !errors.As(err, &errMultiple) || len(errMultiple.Entries) != len(testCase.entries) {
+					t.Errorf("Expected MultipleImagesError with all entries, got: %v", err)
+				}
+				return
+			case *EntryNotFoundError:
+				if !errors.As(err, &errNotFound) || errNotFound.Name != testCase.entry {
+					t.Errorf("Expected EntryNotFoundError, got: %v", err)
+				}
+				return
+			default:
+				if !errors.Is(err, testCase.expectedError) {
+					t.Errorf("expected error %v, got %v", testCase.expectedError, err)
+				}
+				return
+			}
+			defer image.Close()
+			if image.Entry != testCase.expectedEntry {
+				t.Errorf("expected entry %s, got %s", testCase.expectedEntry, image.Entry)
+			} else if image.Compression != testCase.expectedCompression {
+				t.Errorf("expected compression %q, got %q", testCase.expectedCompression, image.Compression)
+			}
+			result, err := io.ReadAll(image)
+			if err != nil {
+				t.Errorf("Failed to read image: %v", err)
+			} else if !bytes.Equal(result, testCase.expectedData) {
+				t.Errorf("Decompressed data does not match original data")
+			} else if image.BytesRead() != image.Size {
+				t.Errorf("expected %d bytes read, got %d", image.Size, image.BytesRead())
+			}
+		})
+	}
+
+	t.Run("image in archive is flashed and validated correctly", func(t *testing.T) {
+		t.Parallel()
+		path := GenerateZipFile(t, map[string][]byte{"a.img": sampleData, "b.img": nil}, zip.Deflate)
+		dest := filepath.Join(t.TempDir(), "dest")
+		if err := os.WriteFile(dest, nil, 0644); err != nil {
+			t.Fatalf("Failed to create dest file: %v", err)
+		}
+		if err := WriteDiskImageEntry(context.Background(), path, "a.img", dest, CopyOptions{}); err != nil {
+			t.Errorf("WriteDiskImageEntry failed: %v", err)
+		} else if result, err := os.ReadFile(dest); err != nil {
+			t.Errorf("Failed to read dest: %v", err)
+		} else if !bytes.Equal(result, data) {
+			t.Errorf("Written data does not match original data")
+		}
+		if err := ValidateDiskImageEntry(context.Background(), path, "a.img", dest, CopyOptions{}); err != nil {
+			t.Errorf("Validation failed: %v", err)
+		}
+	})
+}
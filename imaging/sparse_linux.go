@@ -0,0 +1,93 @@
+//go:build linux
+
+package imaging
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+
+	ioctlBlkDiscard    = 0x1277 // BLKDISCARD
+	ioctlBlkSecDiscard = 0x127d // BLKSECDISCARD
+	ioctlBlkZeroout    = 0x127f // BLKZEROOUT
+
+	fallocPunchHole = 0x02 | 0x01 // FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE
+	fallocZeroRange = 0x10        // FALLOC_FL_ZERO_RANGE
+)
+
+// dataExtents returns the ranges of a file which contain data, i.e. aren't holes. If the
+// filesystem doesn't support finding holes, the whole file is returned as a single range.
+func dataExtents(file *os.File, size int64) ([][2]int64, error) {
+	var extents [][2]int64
+	for offset := int64(0); offset < size; {
+		start, err := file.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) { // There is no more data after offset.
+			break
+		} else if errors.Is(err, syscall.EINVAL) && offset == 0 {
+			return [][2]int64{{0, size}}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		end, err := file.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, [2]int64{start, end})
+		offset = end
+	}
+	return extents, nil
+}
+
+// zeroFileRange zeroes a range of a block device or file, without writing zeros.
+func zeroFileRange(file *os.File, offset int64, length int64) error {
+	if isBlockDevice(file) {
+		return blockDeviceRangeIoctl(file, ioctlBlkZeroout, offset, length)
+	}
+	return syscall.Fallocate(int(file.Fd()), fallocZeroRange, offset, length)
+}
+
+// discardFile discards the whole block device (or punches a hole over the whole file), so that
+// its blocks can be skipped when writing a sparse disk image.
+func discardFile(file *os.File) error {
+	return discardFileWith(file, ioctlBlkDiscard)
+}
+
+// secureDiscardFile is [discardFile] with a secure discard, which erases any copies of the blocks
+// the device keeps internally as well. It fails if the device doesn't support secure discards.
+func secureDiscardFile(file *os.File) error {
+	return discardFileWith(file, ioctlBlkSecDiscard)
+}
+
+func discardFileWith(file *os.File, req uintptr) error {
+	size, err := file.Seek(0, 2)
+	if err != nil {
+		return err
+	} else if _, err := file.Seek(0, 0); err != nil {
+		return err
+	} else if isBlockDevice(file) {
+		return blockDeviceRangeIoctl(file, req, 0, size)
+	} else if size == 0 {
+		return nil
+	}
+	return syscall.Fallocate(int(file.Fd()), fallocPunchHole, 0, size)
+}
+
+func isBlockDevice(file *os.File) bool {
+	stat, err := file.Stat()
+	return err == nil && stat.Mode()&os.ModeDevice != 0 && stat.Mode()&os.ModeCharDevice == 0
+}
+
+func blockDeviceRangeIoctl(file *os.File, req uintptr, offset int64, length int64) error {
+	args := [2]uint64{uint64(offset), uint64(length)}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), req, uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package imaging
+
+import (
+	"errors"
+	"os"
+)
+
+// dataExtents returns the ranges of a file which contain data, i.e. aren't holes. Finding holes
+// is only supported on Linux, so the whole file is returned as a single range.
+func dataExtents(file *os.File, size int64) ([][2]int64, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return [][2]int64{{0, size}}, nil
+}
+
+// zeroFileRange zeroes a range of a block device or file, without writing zeros.
+func zeroFileRange(file *os.File, offset int64, length int64) error {
+	return errors.ErrUnsupported
+}
+
+// discardFile discards the whole block device (or punches a hole over the whole file), so that
+// its blocks can be skipped when writing a sparse disk image.
+func discardFile(file *os.File) error {
+	return errors.New("discarding devices is only supported on Linux")
+}
+
+// secureDiscardFile is [discardFile] with a secure discard, which erases any copies of the blocks
+// the device keeps internally as well. It fails if the device doesn't support secure discards.
+func secureDiscardFile(file *os.File) error {
+	return discardFile(file)
+}
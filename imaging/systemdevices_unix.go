@@ -0,0 +1,280 @@
+//go:build !darwin && !windows
+
+package imaging
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// systemMountpoints are the mountpoints which the OS needs to function. Disks backing them (or
+// any mountpoint nested inside them, except for under /) are never listed as flashable.
+var systemMountpoints = []string{"/", "/boot", "/efi", "/home", "/opt", "/srv", "/usr", "/var"}
+
+func isSystemMountpoint(mountpoint string) bool {
+	for _, systemMountpoint := range systemMountpoints {
+		if mountpoint == systemMountpoint ||
+			(systemMountpoint != "/" && strings.HasPrefix(mountpoint, systemMountpoint+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// mount is a filesystem mounted at a mountpoint, as listed in /proc/self/mountinfo.
+type mount struct {
+	source     string
+	mountpoint string
+}
+
+// readMounts returns the filesystems which are currently mounted.
+func readMounts(platform Platform) ([]mount, error) {
+	mountinfo, err := platform.OsReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	mounts := []mount{}
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(line)
+		separator := slices.Index(fields, "-")
+		if len(fields) < 5 || separator < 0 || len(fields) < separator+3 {
+			continue
+		}
+		mounts = append(mounts, mount{
+			source:     unescapeMountField(fields[separator+2]),
+			mountpoint: unescapeMountField(fields[4]),
+		})
+	}
+	return mounts, nil
+}
+
+// getSystemDisks returns the physical disks backing system mounts, swap and filesystems mounted at
+// boot through /etc/fstab, mapped to the reason they are protected. Device mapper (LVM, LUKS) and
+// mdraid devices are resolved to the disks underneath them through /sys/class/block, and btrfs
+// filesystems to every device in them through /sys/fs/btrfs.
+func getSystemDisks(platform Platform, mounts []mount) map[string]string {
+	systemDisks := map[string]string{}
+	btrfsDevices := readBtrfsDevices(platform)
+	protect := func(source string, reason string) {
+		name := resolveBlockDevice(platform, source)
+		members := []string{name}
+		if devices, ok := btrfsDevices[name]; ok {
+			members = devices
+		}
+		for _, member := range members {
+			for _, disk := range resolveDisks(platform, member) {
+				if _, ok := systemDisks["/dev/"+disk]; !ok {
+					systemDisks["/dev/"+disk] = ExcludedSystemDevice + " (" + reason + ")"
+				}
+			}
+		}
+	}
+
+	for _, mount := range mounts {
+		if isSystemMountpoint(mount.mountpoint) {
+			protect(mount.source, "mounted at "+mount.mountpoint)
+		}
+	}
+
+	// Active swap devices. Swap files reside on a filesystem which is already accounted for.
+	if swaps, err := platform.OsReadFile("/proc/swaps"); err == nil {
+		for _, line := range strings.Split(string(swaps), "\n")[1:] {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[1] == "partition" {
+				protect(unescapeMountField(fields[0]), "used as swap")
+			}
+		}
+	}
+
+	// Filesystems mounted at boot, which may not be mounted right now, e.g. when using automount.
+	if fstab, err := platform.OsReadFile("/etc/fstab"); err == nil {
+		for _, line := range strings.Split(string(fstab), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			options := strings.Split(fields[3], ",")
+			if slices.Contains(options, "noauto") || slices.Contains(options, "nofail") {
+				continue
+			} else if fields[2] == "swap" {
+				protect(unescapeMountField(fields[0]), "swap in /etc/fstab")
+			} else {
+				protect(unescapeMountField(fields[0]), "in /etc/fstab at "+unescapeMountField(fields[1]))
+			}
+		}
+	}
+
+	return systemDisks
+}
+
+// resolveBlockDevice returns the kernel name of the block device referred to by a device path in
+// mountinfo, swaps or fstab (which may also use UUID=, LABEL=, etc.), or "" if there is none.
+func resolveBlockDevice(platform Platform, source string) string {
+	for tag, dir := range map[string]string{
+		"UUID=":      "/dev/disk/by-uuid/",
+		"LABEL=":     "/dev/disk/by-label/",
+		"PARTUUID=":  "/dev/disk/by-partuuid/",
+		"PARTLABEL=": "/dev/disk/by-partlabel/",
+	} {
+		if strings.HasPrefix(source, tag) {
+			source = dir + encodeUdevString(strings.Trim(strings.TrimPrefix(source, tag), `"`))
+		}
+	}
+	if !strings.HasPrefix(source, "/dev/") {
+		return ""
+	}
+	// Follow symlinks such as /dev/mapper/* and /dev/disk/by-*/* to the actual device node.
+	for range 8 {
+		link, err := platform.OsReadlink(source)
+		if err != nil {
+			break
+		} else if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(source), link)
+		}
+		source = link
+	}
+	return filepath.Base(source)
+}
+
+// readBtrfsDevices maps each device of a mounted btrfs filesystem to every device in it, since
+// mountinfo only lists one of the devices of a filesystem spanning several, e.g. with RAID1.
+func readBtrfsDevices(platform Platform) map[string][]string {
+	btrfsDevices := map[string][]string{}
+	filesystems, err := platform.OsReadDir("/sys/fs/btrfs")
+	if err != nil {
+		return btrfsDevices
+	}
+	for _, filesystem := range filesystems {
+		// Besides a directory for each filesystem UUID, there are others like features.
+		entries, err := platform.OsReadDir("/sys/fs/btrfs/" + filesystem.Name() + "/devices")
+		if err != nil {
+			continue
+		}
+		devices := []string{}
+		for _, entry := range entries {
+			devices = append(devices, entry.Name())
+		}
+		for _, device := range devices {
+			btrfsDevices[device] = devices
+		}
+	}
+	return btrfsDevices
+}
+
+// resolveDisks returns the disks which a block device resides on. The holders of the device are
+// walked up first, so that every disk of a RAID array or LVM volume group it is a member of is
+// included, then the slaves of device mapper and mdraid devices are walked down, and partitions
+// are mapped to their parent disks.
+func resolveDisks(platform Platform, name string) []string {
+	disks := []string{}
+	for _, top := range resolveHolders(platform, name, 0) {
+		for _, disk := range resolveSlaves(platform, top, 0) {
+			if !slices.Contains(disks, disk) {
+				disks = append(disks, disk)
+			}
+		}
+	}
+	return disks
+}
+
+// resolveHolders returns the devices stacked on top of a block device which nothing else is
+// stacked on, by walking its holders, or the device itself if nothing is stacked on it.
+func resolveHolders(platform Platform, name string, depth int) []string {
+	if name == "" {
+		return nil
+	}
+	holders, err := platform.OsReadDir("/sys/class/block/" + name + "/holders")
+	if err != nil || len(holders) == 0 || depth > 8 {
+		return []string{name}
+	}
+	tops := []string{}
+	for _, holder := range holders {
+		tops = append(tops, resolveHolders(platform, holder.Name(), depth+1)...)
+	}
+	return tops
+}
+
+// resolveSlaves returns the disks which a block device resides on, by walking the slaves of
+// device mapper and mdraid devices, and mapping partitions to their parent disks.
+func resolveSlaves(platform Platform, name string, depth int) []string {
+	if name == "" || depth > 8 {
+		return nil
+	}
+	path := "/sys/class/block/" + name
+	if slaves, err := platform.OsReadDir(path + "/slaves"); err == nil && len(slaves) > 0 {
+		disks := []string{}
+		for _, slave := range slaves {
+			disks = append(disks, resolveSlaves(platform, slave.Name(), depth+1)...)
+		}
+		return disks
+	}
+	if _, err := platform.OsReadFile(path + "/partition"); err == nil {
+		// /sys/class/block/sda1 links to /sys/devices/.../block/sda/sda1
+		if link, err := platform.OsReadlink(path); err == nil {
+			return resolveSlaves(platform, filepath.Base(filepath.Dir(link)), depth+1)
+		}
+	}
+	return []string{name}
+}
+
+// unescapeMountField unescapes the octal escapes (e.g. \040 for space) used in mountinfo, swaps
+// and fstab.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var builder strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if value, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				builder.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		builder.WriteByte(field[i])
+	}
+	return builder.String()
+}
+
+// encodeUdevString encodes a filesystem label or UUID the way udev does for the symlinks in
+// /dev/disk/by-*, escaping characters like spaces and slashes as \xNN.
+func encodeUdevString(str string) string {
+	var builder strings.Builder
+	for i := 0; i < len(str); i++ {
+		char := str[i]
+		if char >= 0x80 || ('a' <= char && char <= 'z') || ('A' <= char && char <= 'Z') ||
+			('0' <= char && char <= '9') || strings.IndexByte("#+-.:=@_", char) >= 0 {
+			builder.WriteByte(char)
+		} else {
+			builder.WriteString(fmt.Sprintf("\\x%02x", char))
+		}
+	}
+	return builder.String()
+}
+
+// decodeUdevString decodes a string encoded by [encodeUdevString].
+func decodeUdevString(str string) string {
+	var builder strings.Builder
+	for i := 0; i < len(str); i++ {
+		if str[i] == '\\' && i+4 <= len(str) && str[i+1] == 'x' {
+			if value, err := strconv.ParseUint(str[i+2:i+4], 16, 8); err == nil {
+				builder.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		builder.WriteByte(str[i])
+	}
+	return builder.String()
+}
+
+// wholeDisks returns the names of the disks which a device resides on, e.g. sda for /dev/sda1,
+// or the disks under a device mapper or mdraid device.
+func wholeDisks(platform Platform, device string) []string {
+	return resolveDisks(platform, resolveBlockDevice(platform, device))
+}
@@ -1,6 +1,8 @@
 package imaging
 
 import (
+	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -35,3 +37,44 @@ func CapitalizeString(str string) string {
 	}
 	return strings.ToUpper(str[0:1]) + str[1:]
 }
+
+// ParseBytes parses a size in bytes, with an optional suffix like dd: K, M, G or T (or KiB, MiB,
+// GiB and TiB) for binary powers, and KB, MB, GB or TB for decimal powers, e.g. 4M or 4MiB for
+// 4194304 bytes, and 4MB for 4000000 bytes.
+func ParseBytes(size string) (int, error) {
+	invalid := fmt.Errorf("invalid size %s, expected a number of bytes, optionally with a K, M, G or T suffix", size)
+	number := strings.ToUpper(strings.TrimSpace(size))
+	base := 1024
+	if trimmed, ok := strings.CutSuffix(number, "IB"); ok {
+		number = trimmed
+	} else if trimmed, ok := strings.CutSuffix(number, "B"); ok {
+		number = trimmed
+		if strings.HasSuffix(number, "K") || strings.HasSuffix(number, "M") ||
+			strings.HasSuffix(number, "G") || strings.HasSuffix(number, "T") {
+			base = 1000
+		}
+	}
+	multiplier := 1
+	if suffix := strings.IndexAny(number, "KMGT"); suffix != -1 && suffix == len(number)-1 {
+		for range strings.IndexByte("KMGT", number[suffix]) + 1 {
+			multiplier *= base
+		}
+		number = number[:suffix]
+	}
+	bytes, err := strconv.Atoi(number)
+	if err != nil || bytes <= 0 {
+		return 0, invalid
+	} else if bytes > math.MaxInt/multiplier {
+		return 0, fmt.Errorf("invalid size %s, it is too large", size)
+	}
+	return bytes * multiplier, nil
+}
+
+// ParseBlockSize parses a block size with [ParseBytes], which may be at most [MaxBlockSize].
+func ParseBlockSize(size string) (int, error) {
+	bytes, err := ParseBytes(size)
+	if err == nil && bytes > MaxBlockSize {
+		return 0, fmt.Errorf("invalid block size %s, it may be at most %s", size, BytesToString(MaxBlockSize, true))
+	}
+	return bytes, err
+}
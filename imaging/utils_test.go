@@ -66,3 +66,55 @@ func TestCapitalizeString(t *testing.T) {
 		})
 	}
 }
+
+func TestParseBytes(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name          string
+		input         string
+		expected      int
+		expectedError bool
+	}{
+		{"plain bytes", "4096", 4096, false},
+		{"kibibytes", "512K", 524288, false},
+		{"mebibytes", "4M", 4194304, false},
+		{"lowercase suffix", "16m", 16777216, false},
+		{"binary suffix", "1MiB", 1048576, false},
+		{"gibibytes", "1G", 1073741824, false},
+		{"empty string", "", 0, true},
+		{"zero", "0", 0, true},
+		{"negative", "-1M", 0, true},
+		{"unknown suffix", "4X", 0, true},
+		{"suffix only", "M", 0, true},
+		{"tebibytes", "2T", 2199023255552, false},
+		{"decimal suffix", "4MB", 4000000, false},
+		{"decimal kilobytes", "512kB", 512000, false},
+		{"bytes suffix", "512B", 512, false},
+		{"overflow", "9999999999T", 0, true},
+		{"overflow without suffix", "99999999999999999999", 0, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			result, err := imaging.ParseBytes(testCase.input)
+			if testCase.expectedError && err == nil {
+				t.Errorf("expected error, got %d", result)
+			} else if !testCase.expectedError && err != nil {
+				t.Errorf("expected %d, got error %v", testCase.expected, err)
+			} else if result != testCase.expected {
+				t.Errorf("expected %d, got %d", testCase.expected, result)
+			}
+		})
+	}
+}
+
+func TestParseBlockSize(t *testing.T) {
+	t.Parallel()
+	if result, err := imaging.ParseBlockSize("64M"); err != nil || result != imaging.MaxBlockSize {
+		t.Errorf("expected %d, got %d and error %v", imaging.MaxBlockSize, result, err)
+	}
+	if result, err := imaging.ParseBlockSize("1G"); err == nil {
+		t.Errorf("expected error for block size above the maximum, got %d", result)
+	}
+}
@@ -0,0 +1,123 @@
+package imaging
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// DeviceEventType is the type of change to a device reported by [WatchDevices].
+type DeviceEventType string
+
+const (
+	DeviceAdded   DeviceEventType = "add"
+	DeviceRemoved DeviceEventType = "remove"
+	// DeviceChanged is reported when any property of a device changes, e.g. when media is
+	// inserted into a card reader, or a partition is mounted.
+	DeviceChanged DeviceEventType = "change"
+)
+
+// DeviceEvent is a device being added, removed or changed. For removals, Device is the device as
+// it was last seen.
+type DeviceEvent struct {
+	Type   DeviceEventType `json:"type"`
+	Device Device          `json:"device"`
+}
+
+// DevicePollInterval is how often devices are re-enumerated when the OS cannot notify of hotplug
+// events.
+const DevicePollInterval = 2 * time.Second
+
+// WatchDevices reports devices being added, removed or changed (including excluded devices, see
+// [GetAllDevices]) until the context is cancelled, after which the channel is closed. On Linux,
+// devices are re-enumerated upon kernel uevents, else they are polled every [DevicePollInterval].
+func WatchDevices(ctx context.Context) (<-chan DeviceEvent, error) {
+	notifications, err := hotplugNotifications(ctx)
+	if err != nil {
+		return pollDevices(ctx, SystemPlatform, DevicePollInterval)
+	}
+	return watchDevices(ctx, SystemPlatform, notifications)
+}
+
+// pollDevices reports devices being added, removed or changed by re-enumerating them every
+// interval until the context is cancelled, after which the channel is closed.
+func pollDevices(ctx context.Context, platform Platform, interval time.Duration) (<-chan DeviceEvent, error) {
+	return watchDevices(ctx, platform, pollNotifications(ctx, interval))
+}
+
+// watchDevices re-enumerates devices whenever a notification is received, and reports the
+// differences until the notifications channel is closed.
+func watchDevices(ctx context.Context, platform Platform, notifications <-chan struct{}) (<-chan DeviceEvent, error) {
+	devices, err := GetAllDevices(platform)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan DeviceEvent)
+	go func() {
+		defer close(events)
+		for range notifications {
+			updated, err := GetAllDevices(platform)
+			if err != nil {
+				continue // Enumeration can fail while a device is being removed, retry next time.
+			}
+			for _, event := range DiffDevices(devices, updated) {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			devices = updated
+		}
+	}()
+	return events, nil
+}
+
+// pollNotifications sends a notification every interval until the context is cancelled.
+func pollNotifications(ctx context.Context, interval time.Duration) <-chan struct{} {
+	notifications := make(chan struct{})
+	go func() {
+		defer close(notifications)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case notifications <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return notifications
+}
+
+// DiffDevices returns the events needed to go from one list of devices to another, with devices
+// matched by name. Removals are reported first, followed by additions and changes in the order
+// of the new list.
+func DiffDevices(old []Device, new []Device) []DeviceEvent {
+	events := []DeviceEvent{}
+	newDevices := make(map[string]Device, len(new))
+	for _, device := range new {
+		newDevices[device.Name] = device
+	}
+	oldDevices := make(map[string]Device, len(old))
+	for _, device := range old {
+		oldDevices[device.Name] = device
+		if _, ok := newDevices[device.Name]; !ok {
+			events = append(events, DeviceEvent{Type: DeviceRemoved, Device: device})
+		}
+	}
+	for _, device := range new {
+		if oldDevice, ok := oldDevices[device.Name]; !ok {
+			events = append(events, DeviceEvent{Type: DeviceAdded, Device: device})
+		} else if !reflect.DeepEqual(oldDevice, device) {
+			events = append(events, DeviceEvent{Type: DeviceChanged, Device: device})
+		}
+	}
+	return events
+}
@@ -0,0 +1,76 @@
+//go:build linux
+
+package imaging
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ueventSettleDelay is how long to wait after a block device uevent before re-enumerating, so
+// that bursts of uevents (e.g. a disk and its partitions) are coalesced, and udev has time to
+// process them.
+const ueventSettleDelay = 500 * time.Millisecond
+
+// ueventReadTimeout bounds how long reads from the uevent socket block, so that context
+// cancellation is noticed.
+const ueventReadTimeout = 250 * time.Millisecond
+
+// hotplugNotifications sends a notification whenever block devices are added, removed or changed,
+// by listening to kernel uevents over netlink, until the context is cancelled.
+func hotplugNotifications(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	// Group 1 receives uevents from the kernel, as opposed to group 2 which udev re-broadcasts to.
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1})
+	if err == nil {
+		timeout := syscall.NsecToTimeval(ueventReadTimeout.Nanoseconds())
+		err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	notifications := make(chan struct{})
+	go func() {
+		defer close(notifications)
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*1024)
+		var settled time.Time // Zero if no block uevent is pending.
+		for ctx.Err() == nil {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == nil && isBlockUevent(buf[:n]) && settled.IsZero() {
+				settled = time.Now().Add(ueventSettleDelay)
+			} else if errors.Is(err, syscall.ENOBUFS) && settled.IsZero() {
+				settled = time.Now().Add(ueventSettleDelay) // Uevents were dropped, so re-enumerate.
+			}
+			if settled.IsZero() || time.Now().Before(settled) {
+				continue
+			}
+			settled = time.Time{}
+			select {
+			case notifications <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return notifications, nil
+}
+
+// isBlockUevent returns whether a uevent is for a block device. Uevents consist of a header like
+// "add@/devices/..." followed by KEY=value pairs, all NUL-terminated.
+func isBlockUevent(uevent []byte) bool {
+	for _, field := range strings.Split(string(uevent), "\x00") {
+		if field == "SUBSYSTEM=block" {
+			return true
+		}
+	}
+	return false
+}
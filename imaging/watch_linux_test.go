@@ -0,0 +1,39 @@
+//go:build linux
+
+package imaging
+
+import "testing"
+
+func TestIsBlockUevent(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name     string
+		uevent   string
+		expected bool
+	}{
+		{"block device added",
+			"add@/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdb\x00" +
+				"ACTION=add\x00DEVPATH=/devices/pci0000:00/0000:00:14.0/usb2/2-1/2-1:1.0/host6/target6:0:0/6:0:0:0/block/sdb\x00" +
+				"SUBSYSTEM=block\x00MAJOR=8\x00MINOR=16\x00DEVNAME=sdb\x00DEVTYPE=disk\x00SEQNUM=4321\x00", true},
+		{"partition removed",
+			"remove@/devices/virtual/block/loop0/loop0p1\x00ACTION=remove\x00DEVPATH=/devices/virtual/block/loop0/loop0p1\x00" +
+				"SUBSYSTEM=block\x00DEVNAME=loop0p1\x00DEVTYPE=partition\x00", true},
+		{"usb device added",
+			"add@/devices/pci0000:00/0000:00:14.0/usb2/2-1\x00ACTION=add\x00DEVPATH=/devices/pci0000:00/0000:00:14.0/usb2/2-1\x00" +
+				"SUBSYSTEM=usb\x00DEVTYPE=usb_device\x00", false},
+		{"block in another field",
+			"change@/devices/virtual/bdi/8:16\x00ACTION=change\x00DEVPATH=/devices/virtual/bdi/8:16\x00" +
+				"SUBSYSTEM=bdi\x00NAME=SUBSYSTEM=block\x00", false},
+		{"header only", "add@/devices/virtual/block/loop0", false},
+		{"empty", "", false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			if result := isBlockUevent([]byte(testCase.uevent)); result != testCase.expected {
+				t.Errorf("expected %v, got %v", testCase.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package imaging
+
+import (
+	"context"
+	"errors"
+)
+
+// hotplugNotifications is unsupported on this OS, so [WatchDevices] falls back to polling.
+func hotplugNotifications(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,48 @@
+package imaging_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/retrixe/imprint/imaging"
+)
+
+func TestDiffDevices(t *testing.T) {
+	t.Parallel()
+	sda := imaging.Device{Name: "/dev/sda", Model: "Cruzer Blade", Bytes: 16008609792, Removable: true}
+	sdb := imaging.Device{Name: "/dev/sdb", Model: "Card Reader", Removable: true}
+	sdbInserted := imaging.Device{Name: "/dev/sdb", Model: "Card Reader", Bytes: 31914983424, Removable: true}
+	sdc := imaging.Device{Name: "/dev/sdc", Model: "DataTraveler", Bytes: 31025332224, Removable: true}
+	testCases := []struct {
+		name     string
+		old      []imaging.Device
+		new      []imaging.Device
+		expected []imaging.DeviceEvent
+	}{
+		{"no changes", []imaging.Device{sda, sdb}, []imaging.Device{sda, sdb}, []imaging.DeviceEvent{}},
+		{"device added", []imaging.Device{sda}, []imaging.Device{sda, sdc},
+			[]imaging.DeviceEvent{{Type: imaging.DeviceAdded, Device: sdc}}},
+		{"device removed", []imaging.Device{sda, sdc}, []imaging.Device{sdc},
+			[]imaging.DeviceEvent{{Type: imaging.DeviceRemoved, Device: sda}}},
+		{"media inserted", []imaging.Device{sda, sdb}, []imaging.Device{sda, sdbInserted},
+			[]imaging.DeviceEvent{{Type: imaging.DeviceChanged, Device: sdbInserted}}},
+		{"devices swapped", []imaging.Device{sda, sdb}, []imaging.Device{sdc, sdbInserted},
+			[]imaging.DeviceEvent{
+				{Type: imaging.DeviceRemoved, Device: sda},
+				{Type: imaging.DeviceAdded, Device: sdc},
+				{Type: imaging.DeviceChanged, Device: sdbInserted},
+			}},
+		{"from nothing", nil, []imaging.Device{sda},
+			[]imaging.DeviceEvent{{Type: imaging.DeviceAdded, Device: sda}}},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			events := imaging.DiffDevices(testCase.old, testCase.new)
+			if !reflect.DeepEqual(events, testCase.expected) {
+				t.Errorf("expected events %+v, got %+v", testCase.expected, events)
+			}
+		})
+	}
+}
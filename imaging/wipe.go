@@ -0,0 +1,275 @@
+package imaging
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// WipeMode is how a device is wiped by [WipeDevice].
+type WipeMode int
+
+const (
+	// WipeZero overwrites the whole device with zeros.
+	WipeZero WipeMode = iota
+	// WipeRandom overwrites the whole device with random data.
+	WipeRandom
+	// WipeQuick only zeroes the start and end of the device and of each partition on it, which
+	// contain the partition tables (including the GPT backup at the end of the device) and the
+	// signatures of filesystems. The data itself is left on the device, but it appears empty.
+	WipeQuick
+	// WipeDiscard discards every block of the device (e.g. TRIM on SD cards and SSDs), securely if
+	// the device supports it, on Linux only. Validating it fails on devices which don't read
+	// discarded blocks back as zeros.
+	WipeDiscard
+)
+
+func (m WipeMode) String() string {
+	switch m {
+	case WipeRandom:
+		return "random"
+	case WipeQuick:
+		return "quick"
+	case WipeDiscard:
+		return "discard"
+	}
+	return "zero"
+}
+
+// ParseWipeMode parses a [WipeMode] from its name, either zero, random, quick or discard.
+func ParseWipeMode(mode string) (WipeMode, error) {
+	for _, m := range []WipeMode{WipeZero, WipeRandom, WipeQuick, WipeDiscard} {
+		if m.String() == mode {
+			return m, nil
+		}
+	}
+	return WipeZero, fmt.Errorf("invalid wipe mode %s, expected zero, random, quick or discard", mode)
+}
+
+// quickWipeSize is the size zeroed at the start and end of the device and each partition by
+// [WipeQuick]. It covers the MBR and both GPT partition tables with 512 or 4096 byte sectors, as
+// well as the signatures of filesystems, LUKS and RAID members.
+const quickWipeSize = 1024 * 1024
+
+// ErrUnknownDeviceSize is returned by [WipeDevice] if the size of the device can't be determined.
+var ErrUnknownDeviceSize = errors.New("the size of the device could not be determined")
+
+// Wipe describes how a device was wiped by [WipeDevice], to validate it with [ValidateWipe].
+type Wipe struct {
+	Mode WipeMode
+	// Ranges are the offsets of the start and end of each range of the device which was zeroed
+	// (or discarded). They are empty for [WipeRandom].
+	Ranges [][2]int
+	// Hashes are the hashes of the random data written to the device, for [WipeRandom].
+	Hashes *BlockHashes
+	// Secure is true if the device was discarded with a secure discard, for [WipeDiscard].
+	Secure bool
+}
+
+// WipeDevice wipes the device with the given mode, stopping early if the context is cancelled,
+// in which case a [*CancelledError] is returned. Progress is reported according to the given
+// [CopyOptions], whose Checksum, Hashes and Sparse are ignored.
+func WipeDevice(ctx context.Context, of string, mode WipeMode, opts CopyOptions) (*Wipe, error) {
+	dest, file, err := openDestination(of, opts.DirectIO)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size := deviceSize(file)
+	if size <= 0 {
+		size = listedDeviceSize(of)
+	}
+	if size <= 0 {
+		return nil, ErrUnknownDeviceSize
+	}
+
+	opts.Checksum, opts.Hashes = nil, nil
+	progress := opts.Progress
+	if progress != nil {
+		opts.Progress = func(p Progress) {
+			p.Total = size
+			progress(p)
+		}
+	}
+	startTime := time.Now()
+	done := func(bytes int) {
+		if progress != nil {
+			progress(Progress{Bytes: bytes, Total: bytes, Duration: time.Since(startTime), Done: true})
+		}
+	}
+
+	wipe := &Wipe{Mode: mode}
+	switch mode {
+	case WipeZero:
+		wipe.Ranges = [][2]int{{0, size}}
+		err = WriteImage(ctx, io.LimitReader(zeroReader{}, int64(size)), dest, opts)
+	case WipeRandom:
+		wipe.Hashes = &BlockHashes{}
+		opts.Hashes = wipe.Hashes
+		err = WriteImage(ctx, io.LimitReader(rand.Reader, int64(size)), dest, opts)
+	case WipeQuick:
+		// The device is opened write-only, so the partition table is read through another handle.
+		device, err := openFile(of, os.O_RDONLY, 0, "destination")
+		if err != nil {
+			return nil, err
+		}
+		wipe.Ranges = quickWipeRanges(device, size)
+		device.Close()
+		wiped := 0
+		for _, r := range wipe.Ranges {
+			if ctx.Err() != nil {
+				return nil, &CancelledError{Bytes: wiped}
+			} else if err := zeroRange(dest.(io.WriterAt), r[0], r[1]-r[0]); err != nil {
+				return nil, fmt.Errorf("encountered error while writing to dest! %w", err)
+			}
+			wiped += r[1] - r[0]
+		}
+		if opts.Sync != SyncNone {
+			if err := syncWriter(dest); err != nil {
+				return nil, fmt.Errorf("failed to sync writes to disk! %w", err)
+			}
+		}
+		done(wiped)
+	case WipeDiscard:
+		wipe.Ranges = [][2]int{{0, size}}
+		wipe.Secure = secureDiscardFile(file) == nil
+		if !wipe.Secure {
+			if err = discardFile(file); err != nil {
+				return nil, fmt.Errorf("failed to discard the device! %w", err)
+			}
+		}
+		done(size)
+	default:
+		err = fmt.Errorf("invalid wipe mode %d", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wipe, nil
+}
+
+// quickWipeRanges returns the ranges of the device zeroed by [WipeQuick], which are the start and
+// end of the device, and of each partition in its partition table, if it has one.
+func quickWipeRanges(device io.ReaderAt, size int) [][2]int {
+	regions := [][2]int{{0, size}}
+	if partitions, err := partitionRanges(device); err == nil {
+		regions = append(regions, partitions...)
+	}
+	var ranges [][2]int
+	for _, region := range regions {
+		start, end := min(region[0], size), min(region[1], size)
+		ranges = append(ranges, [2]int{start, min(end, start+quickWipeSize)})
+		ranges = append(ranges, [2]int{max(start, end-quickWipeSize), end})
+	}
+	slices.SortFunc(ranges, func(a, b [2]int) int { return a[0] - b[0] })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if r[0] >= r[1] {
+			continue
+		} else if len(merged) > 0 && r[0] <= merged[len(merged)-1][1] {
+			merged[len(merged)-1][1] = max(merged[len(merged)-1][1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// listedDeviceSize returns the size of a device from the list of devices, for raw disks on macOS
+// and Windows whose size can't be found by seeking to their end, or -1 if it isn't listed.
+func listedDeviceSize(of string) int {
+	devices, err := GetAllDevices(SystemPlatform)
+	if err != nil {
+		return -1
+	}
+	for _, device := range devices {
+		if device.Name == of {
+			return device.Bytes
+		}
+	}
+	return -1
+}
+
+// zeroReader is an endless source of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// ValidateDeviceWipe checks if the block device was wiped, see [ValidateWipe].
+func ValidateDeviceWipe(ctx context.Context, of string, wipe *Wipe, opts CopyOptions) error {
+	dest, err := openFile(of, os.O_RDONLY|os.O_EXCL, os.ModePerm, "destination")
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return ValidateWipe(ctx, dest, wipe, opts)
+}
+
+// ValidateWipe checks if the ranges of dest which were wiped are zeroed, or match the hashes of
+// the random data written to it, stopping early if the context is cancelled, in which case a
+// [*CancelledError] is returned. If they don't, a [*ValidationError] is returned.
+func ValidateWipe(ctx context.Context, dest io.ReaderAt, wipe *Wipe, opts CopyOptions) error {
+	if wipe.Hashes != nil {
+		return ValidateHashes(ctx, io.NewSectionReader(dest, 0, int64(wipe.Hashes.Size)), wipe.Hashes, opts)
+	}
+	bs := opts.blockSize()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	startTime := time.Now()
+	size := 0
+	for _, r := range wipe.Ranges {
+		size += r[1] - r[0]
+	}
+	progress := func(total int, done bool) Progress {
+		return Progress{Bytes: total, Total: size, Duration: time.Since(startTime), Done: done}
+	}
+	var total int
+	var mismatch *ValidationError
+	buf := alignedBuffer(bs)
+	for _, r := range wipe.Ranges {
+		for offset := r[0]; offset < r[1]; {
+			if ctx.Err() != nil {
+				return &CancelledError{Bytes: total}
+			}
+			n, err := dest.ReadAt(buf[:min(bs, r[1]-offset)], int64(offset))
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("encountered error while validating device! %w", err)
+			} else if n < min(bs, r[1]-offset) { // The device ran out of data before the end of the range.
+				if mismatch == nil {
+					mismatch = &ValidationError{Offset: offset + n, BlockSize: bs}
+				}
+				mismatch.Truncated = true
+				return mismatch
+			}
+			if blocks, first := nonZeroBlocks(buf[:n], offset, bs); blocks > 0 {
+				if mismatch == nil {
+					mismatch = &ValidationError{Offset: first, BlockSize: bs}
+				}
+				mismatch.MismatchedBlocks += blocks
+			}
+			offset += n
+			total += n
+			select {
+			case <-ticker.C:
+				if opts.Progress != nil {
+					opts.Progress(progress(total, false))
+				}
+			default:
+			}
+		}
+	}
+	if mismatch != nil {
+		return mismatch
+	} else if opts.Progress != nil {
+		opts.Progress(progress(total, true))
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseWipeMode(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []WipeMode{WipeZero, WipeRandom, WipeQuick, WipeDiscard} {
+		if parsed, err := ParseWipeMode(mode.String()); err != nil || parsed != mode {
+			t.Errorf("expected %s to parse, got %v and error %v", mode, parsed, err)
+		}
+	}
+	if _, err := ParseWipeMode("shred"); err == nil {
+		t.Errorf("expected error for invalid wipe mode")
+	}
+}
+
+func TestQuickWipeRanges(t *testing.T) {
+	t.Parallel()
+	const mib = 1024 * 1024
+	device := make([]byte, 16*mib)
+	// The first partition spans 1-5 MiB, and the second 5-5.5 MiB.
+	copy(device, generateMBR([3]int{0x83, 2048, 8192}, [3]int{0x0c, 10240, 1024}))
+	ranges := quickWipeRanges(bytes.NewReader(device), len(device))
+	expected := [][2]int{{0, 2 * mib}, {4 * mib, 5*mib + mib/2}, {15 * mib, 16 * mib}}
+	if len(ranges) != len(expected) {
+		t.Fatalf("expected ranges %v, got %v", expected, ranges)
+	}
+	for i := range ranges {
+		if ranges[i] != expected[i] {
+			t.Errorf("expected ranges %v, got %v", expected, ranges)
+		}
+	}
+}
+
+func TestWipeDevice(t *testing.T) {
+	t.Parallel()
+	const size = 4*1024*1024 + 512
+	testCases := []struct {
+		mode  WipeMode
+		wiped func(device []byte) bool
+	}{
+		{WipeZero, func(device []byte) bool { return bytes.Equal(device, make([]byte, size)) }},
+		{WipeRandom, func(device []byte) bool { return !bytes.Equal(device[:4096], make([]byte, 4096)) }},
+		{WipeQuick, func(device []byte) bool {
+			return bytes.Equal(device[:1024*1024], make([]byte, 1024*1024)) &&
+				bytes.Equal(device[size-1024*1024:], make([]byte, 1024*1024))
+		}},
+		{WipeDiscard, func(device []byte) bool { return bytes.Equal(device, make([]byte, size)) }},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.mode.String(), func(t *testing.T) {
+			t.Parallel()
+			if testCase.mode == WipeDiscard && runtime.GOOS != "linux" {
+				t.Skip("discarding is only supported on Linux")
+			}
+			original := make([]byte, size)
+			if _, err := rand.Read(original); err != nil {
+				t.Fatalf("Failed to read random data: %v", err)
+			}
+			device := filepath.Join(t.TempDir(), "device.img")
+			os.WriteFile(device, original, 0644)
+
+			var final Progress
+			wipe, err := WipeDevice(context.Background(), device, testCase.mode, CopyOptions{
+				BlockSize: 1024 * 1024,
+				Progress:  func(p Progress) { final = p },
+			})
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			} else if !final.Done || final.Bytes != final.Total {
+				t.Errorf("expected final progress, got %+v", final)
+			}
+			wiped, _ := os.ReadFile(device)
+			if len(wiped) != size || !testCase.wiped(wiped) || bytes.Equal(wiped, original) {
+				t.Errorf("expected device to be wiped")
+			} else if err := ValidateDeviceWipe(context.Background(), device, wipe, CopyOptions{}); err != nil {
+				t.Errorf("expected wipe to be validated, got %v", err)
+			}
+
+			// Validation fails once data is written over the wiped device.
+			file, _ := os.OpenFile(device, os.O_WRONLY, 0644)
+			file.WriteAt([]byte("data"), 1000)
+			file.Close()
+			var errValidation *ValidationError
+			err = ValidateDeviceWipe(context.Background(), device, wipe, CopyOptions{})
+			if !errors.As(err, &errValidation) {
+				t.Errorf("expected ValidationError, got %v", err)
+			} else if errValidation.MismatchedBlocks != 1 {
+				t.Errorf("expected 1 mismatched block, got %d", errValidation.MismatchedBlocks)
+			}
+		})
+	}
+}
+
+func TestWipeDeviceQuickPartitions(t *testing.T) {
+	t.Parallel()
+	const mib = 1024 * 1024
+	original := make([]byte, 16*mib)
+	if _, err := rand.Read(original); err != nil {
+		t.Fatalf("Failed to read random data: %v", err)
+	}
+	// The partitions start at 2 MiB and 8 MiB, past what is wiped at the start of the device.
+	copy(original, generateMBR([3]int{0x83, 4096, 8192}, [3]int{0x0c, 16384, 8192}))
+	device := filepath.Join(t.TempDir(), "device.img")
+	os.WriteFile(device, original, 0644)
+
+	wipe, err := WipeDevice(context.Background(), device, WipeQuick, CopyOptions{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	wiped, _ := os.ReadFile(device)
+	for _, start := range []int{0, 2 * mib, 8 * mib} {
+		if !bytes.Equal(wiped[start:start+mib], make([]byte, mib)) {
+			t.Errorf("expected the start of the region at %d to be wiped", start)
+		}
+	}
+	if !bytes.Equal(wiped[3*mib:5*mib], original[3*mib:5*mib]) {
+		t.Errorf("expected the data in the partitions to be left as-is")
+	} else if err := ValidateDeviceWipe(context.Background(), device, wipe, CopyOptions{}); err != nil {
+		t.Errorf("expected wipe to be validated, got %v", err)
+	}
+}
+
+func TestWipeDeviceCancelled(t *testing.T) {
+	t.Parallel()
+	device := filepath.Join(t.TempDir(), "device.img")
+	os.WriteFile(device, make([]byte, 1024*1024), 0644)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := WipeDevice(ctx, device, WipeZero, CopyOptions{}); !errors.Is(err, ErrCancelled) {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+}
@@ -3,12 +3,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"io"
-	"log"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +19,7 @@ import (
 	_ "embed"
 
 	"github.com/retrixe/imprint/app"
+	"github.com/retrixe/imprint/flasher"
 	"github.com/retrixe/imprint/imaging"
 	"github.com/sqweek/dialog"
 	webview "github.com/webview/webview_go"
@@ -51,6 +55,56 @@ var versionFlag = flag.Bool("version", false, "Show version")
 var flashFlagSet = flag.NewFlagSet("flash", flag.ExitOnError)
 var useSystemDdFlag = flashFlagSet.Bool("use-system-dd", false, "Use dd executable from OS to flash disk images")
 var skipValidationFlag = flashFlagSet.Bool("skip-validation", false, "Skip validation of written image")
+var compareImageFlag = flashFlagSet.Bool("compare-image", false, "Validate by comparing the device with the disk image, instead of hashes of the written data")
+var directIOFlag = flashFlagSet.Bool("direct-io", false, "Write to the device bypassing the page cache (Linux only)")
+var bsFlag = flashFlagSet.String("bs", "4M", "Size of each read and write, up to 64M, with an optional K or M suffix (not with --use-system-dd)")
+var syncFlag = flashFlagSet.String("sync", "end", "When to sync writes to the device, either end, periodic or none (not with --use-system-dd)")
+var bmapFlag = flashFlagSet.String("bmap", "", "Block map of the disk image to write only mapped blocks, detected next to the image by default")
+var noBmapFlag = flashFlagSet.Bool("no-bmap", false, "Write the whole disk image even if a bmap file is next to it")
+var sparseFlag = flashFlagSet.String("sparse", "off", "Handle holes in sparse images or unmapped blocks, either off, skip, zero or discard")
+var entryFlag = flashFlagSet.String("entry", "", "Disk image to flash from a zip archive, if it contains multiple")
+var progressFlag = flashFlagSet.String("progress", "text", "Format of progress output, either text or json")
+var checksumFlag = flashFlagSet.String("checksum", "", "Expected checksum of the disk image, e.g. sha256:<hex>")
+var checksumFileFlag = flashFlagSet.String("checksum-file", "", "Checksum file listing the disk image, e.g. SHA256SUMS")
+var verifySignatureFlag = flashFlagSet.Bool("verify-signature", false, "Verify the OpenPGP signature of the checksum file, or the disk image without one")
+var keyringFlag = flashFlagSet.String("keyring", "", "OpenPGP keyring with the keys trusted to sign disk images, for --verify-signature")
+var allowUnverifiedFlag = flashFlagSet.Bool("allow-unverified", false, "Flash even if the OpenPGP signature is missing or invalid")
+
+var verifyFlagSet = flag.NewFlagSet("verify", flag.ExitOnError)
+var verifyEntryFlag = verifyFlagSet.String("entry", "", "Disk image to verify against from a zip archive, if it contains multiple")
+var verifyProgressFlag = verifyFlagSet.String("progress", "text", "Format of progress output, either text or json")
+var verifyChecksumFlag = verifyFlagSet.String("checksum", "", "Expected checksum of the disk image, e.g. sha256:<hex>")
+var verifySizeFlag = verifyFlagSet.Int("size", 0, "Size of the disk image in bytes, to verify the device against --checksum without it")
+
+var backupFlagSet = flag.NewFlagSet("backup", flag.ExitOnError)
+var backupPartitionsFlag = backupFlagSet.Bool("partitions-only", false, "Only back up the device up to the end of its last partition (not with GPT)")
+var backupBsFlag = backupFlagSet.String("bs", "4M", "Size of each read, up to 64M, with an optional K or M suffix")
+var backupProgressFlag = backupFlagSet.String("progress", "text", "Format of progress output, either text or json")
+
+var cloneFlagSet = flag.NewFlagSet("clone", flag.ExitOnError)
+var cloneSkipValidationFlag = cloneFlagSet.Bool("skip-validation", false, "Skip validation of the cloned targets")
+var cloneDirectIOFlag = cloneFlagSet.Bool("direct-io", false, "Write to the targets bypassing the page cache (Linux only)")
+var cloneBsFlag = cloneFlagSet.String("bs", "4M", "Size of each read and write, up to 64M, with an optional K or M suffix")
+var cloneSyncFlag = cloneFlagSet.String("sync", "end", "When to sync writes to the targets, either end, periodic or none")
+var cloneProgressFlag = cloneFlagSet.String("progress", "text", "Format of progress output, either text or json")
+
+var wipeFlagSet = flag.NewFlagSet("wipe", flag.ExitOnError)
+var wipeModeFlag = wipeFlagSet.String("mode", "zero", "How to wipe the device, either zero, random, quick or discard")
+var wipeVerifyFlag = wipeFlagSet.Bool("verify", false, "Verify that the device was wiped after wiping it")
+var wipeDirectIOFlag = wipeFlagSet.Bool("direct-io", false, "Write to the device bypassing the page cache (Linux only)")
+var wipeBsFlag = wipeFlagSet.String("bs", "4M", "Size of each write, up to 64M, with an optional K or M suffix")
+var wipeSyncFlag = wipeFlagSet.String("sync", "end", "When to sync writes to the device, either end, periodic or none")
+var wipeProgressFlag = wipeFlagSet.String("progress", "text", "Format of progress output, either text or json")
+
+var restoreFlagSet = flag.NewFlagSet("restore", flag.ExitOnError)
+var restoreFsFlag = restoreFlagSet.String("fs", "exfat", "Filesystem of the partition, either exfat or fat32")
+var restoreLabelFlag = restoreFlagSet.String("label", "", "Label of the partition, up to 11 characters long")
+var restoreTableFlag = restoreFlagSet.String("table", "mbr", "Partition table of the device, either mbr or gpt")
+var restoreProgressFlag = restoreFlagSet.String("progress", "text", "Format of progress output, either text or json")
+
+var listFlagSet = flag.NewFlagSet("list", flag.ExitOnError)
+var listJsonFlag = listFlagSet.Bool("json", false, "Print devices as JSON")
+var listAllFlag = listFlagSet.Bool("all", false, "Include devices which can't be flashed to, and why")
 
 func init() {
 	flag.Usage = func() {
@@ -58,14 +112,493 @@ func init() {
 		println("\nWithout any specified command or options, the Imprint GUI will start.")
 		println("\nAvailable commands:")
 		println("  flash       Flash a disk image to a specific device.")
+		println("  verify      Verify a device against a disk image, without writing to it.")
+		println("  backup      Back up a device into a disk image file.")
+		println("  clone       Clone a device to one or more other devices.")
+		println("  wipe        Wipe all data from a device.")
+		println("  restore     Restore a device to a normal drive with a single partition.")
+		println("  list        List devices available to flash to.")
 		println("\nOptions:")
 		flag.PrintDefaults()
 	}
 	flashFlagSet.Usage = func() {
-		println("Usage: imprint flash [options] <disk image file> <device path>")
+		println("Usage: imprint flash [options] <disk image file> <device path>...")
+		println("\nWith several devices, the disk image is read once and written to every device. A device")
+		println("which fails does not stop the others.")
 		println("\nOptions:")
 		flashFlagSet.PrintDefaults()
 	}
+	verifyFlagSet.Usage = func() {
+		println("Usage: imprint verify [options] <disk image file> <device path>")
+		println("       imprint verify [options] --checksum <algorithm:hex> --size <bytes> <device path>")
+		println("\nWithout the disk image, the first --size bytes of the device are verified against --checksum.")
+		println("\nOptions:")
+		verifyFlagSet.PrintDefaults()
+	}
+	backupFlagSet.Usage = func() {
+		println("Usage: imprint backup [options] <device path> <output file>")
+		println("\nThe output is compressed if its extension is .gz, .xz or .zst.")
+		println("\nOptions:")
+		backupFlagSet.PrintDefaults()
+	}
+	cloneFlagSet.Usage = func() {
+		println("Usage: imprint clone [options] <source device> <target device>...")
+		println("\nThe source device is read once, up to the end of its last partition, and written to every")
+		println("target. A target which fails does not stop the others.")
+		println("\nOptions:")
+		cloneFlagSet.PrintDefaults()
+	}
+	wipeFlagSet.Usage = func() {
+		println("Usage: imprint wipe [options] <device path>")
+		println("\nModes:")
+		println("  zero        Overwrite the whole device with zeros.")
+		println("  random      Overwrite the whole device with random data.")
+		println("  quick       Only wipe the partition tables and filesystem signatures.")
+		println("  discard     Discard every block of the device, securely if supported (Linux only).")
+		println("\nOptions:")
+		wipeFlagSet.PrintDefaults()
+	}
+	restoreFlagSet.Usage = func() {
+		println("Usage: imprint restore [options] <device path>")
+		println("\nAll data on the device is lost, and it is formatted with a single partition spanning it.")
+		println("\nOptions:")
+		restoreFlagSet.PrintDefaults()
+	}
+	listFlagSet.Usage = func() {
+		println("Usage: imprint list [options]")
+		println("\nExits with code 0 if any devices can be flashed to, 2 if none can, and 1 on error.")
+		println("\nOptions:")
+		listFlagSet.PrintDefaults()
+	}
+}
+
+// flashOptions are the options the GUI passes when flashing, in addition to the image and device.
+type flashOptions struct {
+	Checksum     string `json:"checksum"`
+	ChecksumFile string `json:"checksumFile"`
+	// Keyring enables verifying OpenPGP signatures against it, if not empty.
+	Keyring         string `json:"keyring"`
+	AllowUnverified bool   `json:"allowUnverified"`
+}
+
+// flags returns the flags to pass to `imprint flash` for these options.
+func (opts flashOptions) flags() ([]string, error) {
+	var flags []string
+	if opts.ChecksumFile != "" {
+		flags = append(flags, "--checksum-file="+opts.ChecksumFile)
+	} else if opts.Checksum != "" {
+		if _, err := imaging.ParseChecksum(opts.Checksum); err != nil {
+			return nil, err
+		}
+		flags = append(flags, "--checksum="+opts.Checksum)
+	}
+	if opts.Keyring != "" {
+		flags = append(flags, "--verify-signature", "--keyring="+opts.Keyring)
+	}
+	if opts.AllowUnverified {
+		flags = append(flags, "--allow-unverified")
+	}
+	return flags, nil
+}
+
+// sourceChecksum returns the expected checksum of the disk image passed with --checksum or
+// --checksum-file, or nil if neither was passed. With --verify-signature, the signature of the
+// checksum file (or the disk image) is verified first, and only the signed checksum is trusted.
+func sourceChecksum(reporter *app.ProgressReporter, image string) (*imaging.Checksum, error) {
+	if *checksumFlag != "" && *checksumFileFlag != "" {
+		return nil, errors.New("only one of --checksum and --checksum-file can be passed")
+	} else if *verifySignatureFlag && *keyringFlag == "" {
+		return nil, errors.New("--keyring must be passed with --verify-signature")
+	} else if *verifySignatureFlag {
+		checksum, _, err := app.VerifySignature(image, *checksumFileFlag, *keyringFlag)
+		if *allowUnverifiedFlag &&
+			(errors.Is(err, imaging.ErrSignatureMissing) || errors.Is(err, imaging.ErrSignatureInvalid)) {
+			reporter.Warning(err) // Fall back to the unsigned checksum, if any.
+		} else if err != nil || checksum != nil {
+			return checksum, err
+		}
+	}
+	if *checksumFlag != "" {
+		return imaging.ParseChecksum(*checksumFlag)
+	} else if *checksumFileFlag != "" {
+		return imaging.ReadChecksumFile(*checksumFileFlag, image)
+	}
+	return nil, nil
+}
+
+// sourceBmap returns the bmap passed with --bmap, or detected next to the disk image, or created
+// from the holes in the disk image with --sparse, or nil if there is none or --no-bmap was passed.
+func sourceBmap(image string) (*imaging.Bmap, error) {
+	if *noBmapFlag && *bmapFlag != "" {
+		return nil, errors.New("only one of --bmap and --no-bmap can be passed")
+	} else if *noBmapFlag {
+		return nil, nil
+	} else if *bmapFlag != "" {
+		return imaging.ReadBmap(*bmapFlag)
+	} else if path := imaging.FindBmapFile(image); path != "" {
+		return imaging.ReadBmap(path)
+	} else if *sparseFlag != imaging.SparseOff.String() {
+		return imaging.SparseBmap(image)
+	}
+	return nil, nil
+}
+
+// flashDevices flashes the disk image passed to `imprint flash` to every target device.
+func flashDevices(ctx context.Context, reporter *app.ProgressReporter, image string, targets []string) error {
+	blockSize, err := imaging.ParseBlockSize(*bsFlag)
+	if err != nil {
+		return err
+	}
+	syncPolicy, err := imaging.ParseSyncPolicy(*syncFlag)
+	if err != nil {
+		return err
+	}
+	sparseMode, err := imaging.ParseSparseMode(*sparseFlag)
+	if err != nil {
+		return err
+	}
+	checksum, err := sourceChecksum(reporter, image)
+	if err != nil {
+		return err
+	}
+	useSystemDd := useSystemDdFlag != nil && *useSystemDdFlag
+	var bmap *imaging.Bmap
+	// Detected bmaps are ignored with several devices, which don't support them, and the
+	// flasher warns that --bmap and --sparse are ignored.
+	if !useSystemDd && (len(targets) == 1 || *bmapFlag != "") {
+		if bmap, err = sourceBmap(image); err != nil {
+			return err
+		}
+	}
+	if useSystemDd && len(targets) > 1 {
+		return errors.New("only one device can be flashed to using the system dd")
+	} else if useSystemDd {
+		return flashWithSystemDd(ctx, reporter, image, targets[0], checksum)
+	}
+	f, err := flasher.New(flasher.Options{
+		Source:        image,
+		Entry:         *entryFlag,
+		Targets:       targets,
+		BlockSize:     blockSize,
+		Sync:          syncPolicy,
+		Verify:        skipValidationFlag == nil || !*skipValidationFlag,
+		CompareSource: *compareImageFlag,
+		DirectIO:      *directIOFlag,
+		Checksum:      checksum,
+		Bmap:          bmap,
+		Sparse:        sparseMode,
+		AllowRegularFile: slices.ContainsFunc(targets, func(target string) bool {
+			return strings.HasSuffix(target, "debug.iso")
+		}),
+		OnEvent: reporter.Event,
+	})
+	if err != nil {
+		return err
+	}
+	return f.Run(ctx)
+}
+
+// flashWithSystemDd flashes a disk image using the dd executable from the OS, going through the
+// same phases as [flasher.Flasher]. The checksum, if any, is verified while validating, since the
+// disk image isn't read by Imprint while writing it.
+func flashWithSystemDd(ctx context.Context, reporter *app.ProgressReporter, image string, device string, checksum *imaging.Checksum) error {
+	totalPhases := 3
+	if skipValidationFlag != nil && *skipValidationFlag {
+		totalPhases = 2
+	}
+	if checksum != nil && totalPhases == 2 {
+		return errors.New("checksums cannot be verified using the system dd when validation is skipped")
+	}
+	reporter.Phase(int(flasher.PhaseUnmount), totalPhases, flasher.PhaseUnmount.String())
+	if strings.HasSuffix(device, "debug.iso") {
+		reporter.Warning(imaging.ErrNotBlockDevice)
+	} else if err := imaging.CheckDeviceWritable(device); err != nil {
+		return err
+	} else if err := imaging.UnmountDevice(device); err != nil {
+		return err
+	}
+	reporter.Phase(int(flasher.PhaseWrite), totalPhases, flasher.PhaseWrite.String())
+	src, err := imaging.OpenSourceImage(image, *entryFlag)
+	if err != nil {
+		return err
+	}
+	src.Close()
+	if src.Compression != imaging.CompressionNone {
+		return errors.New("compressed disk images cannot be flashed using the system dd")
+	} else if err := imaging.RunDd(ctx, image, device); err != nil {
+		return err
+	}
+	if skipValidationFlag == nil || !*skipValidationFlag {
+		reporter.Phase(int(flasher.PhaseValidate), totalPhases, flasher.PhaseValidate.String())
+		return imaging.ValidateDiskImageEntry(ctx, image, *entryFlag, device, imaging.CopyOptions{
+			Progress: reporter.Progress("validated"),
+			Checksum: checksum,
+		})
+	}
+	return nil
+}
+
+// verifyDevice verifies the device passed to `imprint verify` against the disk image, or against
+// --checksum if the disk image isn't passed. If the image is passed with --checksum, the image
+// file is verified against the checksum as well.
+func verifyDevice(ctx context.Context, reporter *app.ProgressReporter, args []string) error {
+	var checksum *imaging.Checksum
+	if *verifyChecksumFlag != "" {
+		var err error
+		if checksum, err = imaging.ParseChecksum(*verifyChecksumFlag); err != nil {
+			return err
+		}
+	}
+	opts := imaging.CopyOptions{Progress: reporter.Progress("validated"), Checksum: checksum}
+	reporter.Phase(1, 1, flasher.PhaseValidate.String())
+	if len(args) == 1 {
+		return imaging.ValidateDeviceChecksum(ctx, args[0], *verifySizeFlag, checksum, opts)
+	}
+	return imaging.ValidateDiskImageEntry(ctx, args[0], *verifyEntryFlag, args[1], opts)
+}
+
+// backupDevice backs up the device passed to `imprint backup` into the output file, returning the
+// checksum of the output file.
+func backupDevice(ctx context.Context, reporter *app.ProgressReporter, device string, output string) (*imaging.Checksum, error) {
+	blockSize, err := imaging.ParseBlockSize(*backupBsFlag)
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	if *backupPartitionsFlag {
+		file, err := os.Open(device)
+		if err != nil {
+			return nil, err
+		}
+		size, err = imaging.PartitionTableEnd(file)
+		gpt := imaging.HasGPT(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		} else if gpt {
+			// The backup GPT at the end of the device would be missing from the backup.
+			return nil, errors.New("--partitions-only is not supported on devices with a GPT partition table")
+		}
+	}
+	opts := imaging.CopyOptions{BlockSize: blockSize, Progress: reporter.Progress("read")}
+	reporter.Phase(1, 1, "Backing up disk to image.")
+	return imaging.BackupDevice(ctx, device, output, size, opts)
+}
+
+// cloneDevice clones the source device passed to `imprint clone` to every target device.
+func cloneDevice(ctx context.Context, reporter *app.ProgressReporter, source string, targets []string) error {
+	blockSize, err := imaging.ParseBlockSize(*cloneBsFlag)
+	if err != nil {
+		return err
+	}
+	syncPolicy, err := imaging.ParseSyncPolicy(*cloneSyncFlag)
+	if err != nil {
+		return err
+	}
+	return flasher.Clone(ctx, flasher.CloneOptions{
+		Source:    source,
+		Targets:   targets,
+		BlockSize: blockSize,
+		Sync:      syncPolicy,
+		DirectIO:  *cloneDirectIOFlag,
+		Verify:    !*cloneSkipValidationFlag,
+		AllowRegularFile: slices.ContainsFunc(targets, func(target string) bool {
+			return strings.HasSuffix(target, "debug.iso")
+		}),
+		OnEvent: reporter.Event,
+	})
+}
+
+// wipeDevice wipes the device passed to `imprint wipe`, going through the same phases as
+// [flasher.Flasher], and validating the wipe with --verify.
+func wipeDevice(ctx context.Context, reporter *app.ProgressReporter, device string) error {
+	mode, err := imaging.ParseWipeMode(*wipeModeFlag)
+	if err != nil {
+		return err
+	}
+	blockSize, err := imaging.ParseBlockSize(*wipeBsFlag)
+	if err != nil {
+		return err
+	}
+	syncPolicy, err := imaging.ParseSyncPolicy(*wipeSyncFlag)
+	if err != nil {
+		return err
+	}
+	totalPhases := 2
+	if *wipeVerifyFlag {
+		totalPhases = 3
+	}
+	reporter.Phase(int(flasher.PhaseUnmount), totalPhases, flasher.PhaseUnmount.String())
+	if strings.HasSuffix(device, "debug.iso") {
+		reporter.Warning(imaging.ErrNotBlockDevice)
+	} else if err := imaging.CheckDeviceWritable(device); err != nil {
+		return err
+	} else if err := imaging.UnmountDevice(device); err != nil {
+		return err
+	}
+	reporter.Phase(int(flasher.PhaseWrite), totalPhases, "Wiping disk.")
+	wipe, err := imaging.WipeDevice(ctx, device, mode, imaging.CopyOptions{
+		BlockSize: blockSize,
+		Sync:      syncPolicy,
+		DirectIO:  *wipeDirectIOFlag,
+		Progress:  reporter.Progress("wiped"),
+	})
+	if err != nil {
+		return err
+	} else if mode == imaging.WipeDiscard && !wipe.Secure {
+		reporter.Warning(errors.New("the device does not support secure discards, it was discarded normally"))
+	}
+	if *wipeVerifyFlag {
+		reporter.Phase(int(flasher.PhaseValidate), totalPhases, "Validating wiped disk.")
+		return imaging.ValidateDeviceWipe(ctx, device, wipe, imaging.CopyOptions{
+			BlockSize: blockSize,
+			Progress:  reporter.Progress("validated"),
+		})
+	}
+	return nil
+}
+
+// restoreDevice restores the device passed to `imprint restore` to a normal drive, going through
+// the same phases as [flasher.Flasher], without validation.
+func restoreDevice(ctx context.Context, reporter *app.ProgressReporter, device string) error {
+	filesystem, err := imaging.ParseFilesystem(*restoreFsFlag)
+	if err != nil {
+		return err
+	}
+	table, err := imaging.ParsePartitionTable(*restoreTableFlag)
+	if err != nil {
+		return err
+	}
+	reporter.Phase(int(flasher.PhaseUnmount), 2, flasher.PhaseUnmount.String())
+	if strings.HasSuffix(device, "debug.iso") {
+		reporter.Warning(imaging.ErrNotBlockDevice)
+	} else if err := imaging.CheckDeviceWritable(device); err != nil {
+		return err
+	} else if err := imaging.UnmountDevice(device); err != nil {
+		return err
+	}
+	reporter.Phase(int(flasher.PhaseWrite), 2, "Formatting disk.")
+	sectorSize := 0
+	if devices, err := imaging.GetAllDevices(imaging.SystemPlatform); err == nil {
+		if i := slices.IndexFunc(devices, func(d imaging.Device) bool { return d.Name == device }); i >= 0 {
+			sectorSize = devices[i].LogicalSectorSize
+		}
+	}
+	return imaging.RestoreDevice(ctx, device, imaging.RestoreOptions{
+		Filesystem: filesystem,
+		Table:      table,
+		Label:      *restoreLabelFlag,
+		SectorSize: sectorSize,
+	})
+}
+
+// subcommand is a subcommand which operates on devices, run with [runSubcommand].
+type subcommand struct {
+	flags *flag.FlagSet
+	// progress is the --progress flag of the subcommand, either text or json.
+	progress *string
+	// validArgs returns whether the positional arguments are valid.
+	validArgs func(args []string) bool
+	// files returns the indices of the positional arguments which are files, such as disk images,
+	// if not nil. The others are devices.
+	files func(args []string) []int
+	// pathFlags are the names of the options which are files, such as bmap files.
+	pathFlags []string
+	run       func(ctx context.Context, reporter *app.ProgressReporter, args []string) error
+	// done reports that the subcommand completed successfully, or is [app.ProgressReporter.Done]
+	// if nil.
+	done func(reporter *app.ProgressReporter, args []string)
+}
+
+// runSubcommand parses the options and arguments of a subcommand, and runs it, exiting with code 1
+// if it fails. Like every subcommand, options must be passed before the arguments. If any of its
+// devices can only be opened with elevated privileges, it is run again with them instead.
+func runSubcommand(cmd subcommand) {
+	cmd.flags.Parse(os.Args[2:])
+	args := cmd.flags.Args()
+	// Options after the arguments would otherwise be taken as devices by commands taking several.
+	misplacedOptions := slices.ContainsFunc(args, func(arg string) bool { return strings.HasPrefix(arg, "-") })
+	if misplacedOptions || !cmd.validArgs(args) || (*cmd.progress != "text" && *cmd.progress != "json") {
+		if misplacedOptions {
+			println("Error: options must be passed before the arguments.")
+		}
+		cmd.flags.Usage()
+		os.Exit(1)
+	}
+	var files []int
+	if cmd.files != nil {
+		files = cmd.files(args)
+	}
+	for i, arg := range args {
+		if !slices.Contains(files, i) && needsElevation(arg) {
+			elevated, err := elevatedArgs(cmd.flags, cmd.pathFlags, args, files...)
+			exitCode := 1
+			if err == nil {
+				exitCode, err = app.RunElevated(imaging.SystemPlatform, elevated...)
+			}
+			if err != nil {
+				println("Error: " + err.Error())
+			}
+			os.Exit(exitCode)
+		}
+	}
+
+	var reporter *app.ProgressReporter
+	if *cmd.progress == "json" {
+		reporter = app.NewProgressReporter(os.Stdout, true)
+	} else {
+		reporter = app.NewProgressReporter(os.Stderr, false)
+		reporter.SetCommand(cmd.flags.Name())
+	}
+	// The GUI cancels by writing "stop" to stdin, since it can't kill elevated processes.
+	ctx, cancel := imaging.WithStopInput(context.Background(), os.Stdin)
+	defer cancel()
+	if err := cmd.run(ctx, reporter, args); err != nil {
+		reporter.Error(err)
+		cancel()
+		os.Exit(1)
+	} else if cmd.done != nil {
+		cmd.done(reporter, args)
+	} else {
+		reporter.Done()
+	}
+}
+
+// elevatedArgs returns the arguments to run this command again with elevated privileges. Since
+// pkexec runs it in the home directory of root, the options in pathFlags and the positional
+// arguments at the given indices (e.g. disk images and output files) are made absolute paths, so
+// they are found where the user meant.
+func elevatedArgs(flags *flag.FlagSet, pathFlags []string, args []string, paths ...int) ([]string, error) {
+	elevated := []string{flags.Name()}
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if slices.Contains(pathFlags, f.Name) && value != "" && err == nil {
+			value, err = filepath.Abs(value)
+		}
+		elevated = append(elevated, "--"+f.Name+"="+value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, arg := range args {
+		if slices.Contains(paths, i) {
+			if arg, err = filepath.Abs(arg); err != nil {
+				return nil, err
+			}
+		}
+		elevated = append(elevated, arg)
+	}
+	return elevated, nil
+}
+
+// needsElevation returns whether reading from the device requires elevated privileges.
+func needsElevation(device string) bool {
+	file, err := os.Open(device)
+	if err == nil {
+		file.Close()
+	}
+	return errors.Is(err, fs.ErrPermission) && !app.IsElevated(imaging.SystemPlatform)
 }
 
 func main() {
@@ -74,51 +607,110 @@ func main() {
 		println("imprint version v" + version)
 		return
 	} else if len(os.Args) >= 2 && os.Args[1] == "flash" {
-		log.SetFlags(0)
-		log.SetOutput(os.Stderr)
-		log.SetPrefix("[flash] ")
-		flashFlagSet.Parse(os.Args[2:])
-		args := flashFlagSet.Args()
-		if len(args) != 2 {
-			flashFlagSet.Usage()
-			os.Exit(1)
-		}
-
-		totalPhases := "3"
-		if skipValidationFlag != nil && *skipValidationFlag {
-			totalPhases = "2"
-		}
-		log.Println("Phase 1/" + totalPhases + ": Unmounting disk.")
-		if err := imaging.UnmountDevice(args[0]); err != nil {
-			log.Println(err)
-			if !strings.HasSuffix(args[1], "debug.iso") {
-				os.Exit(1)
-			}
+		runSubcommand(subcommand{
+			flags:     flashFlagSet,
+			progress:  progressFlag,
+			validArgs: func(args []string) bool { return len(args) >= 2 },
+			files:     func(args []string) []int { return []int{0} },
+			pathFlags: []string{"bmap", "checksum-file", "keyring"},
+			run: func(ctx context.Context, reporter *app.ProgressReporter, args []string) error {
+				err := flashDevices(ctx, reporter, args[0], args[1:])
+				if len(args) > 2 {
+					reporter.TargetSummary(args[1:], err)
+				}
+				return err
+			},
+		})
+		return
+	} else if len(os.Args) >= 2 && os.Args[1] == "verify" {
+		runSubcommand(subcommand{
+			flags:    verifyFlagSet,
+			progress: verifyProgressFlag,
+			validArgs: func(args []string) bool {
+				return len(args) == 2 || (len(args) == 1 && *verifyChecksumFlag != "" && *verifySizeFlag > 0)
+			},
+			files: func(args []string) []int {
+				if len(args) == 2 {
+					return []int{0}
+				}
+				return nil
+			},
+			run: verifyDevice,
+		})
+		return
+	} else if len(os.Args) >= 2 && os.Args[1] == "backup" {
+		var checksum *imaging.Checksum
+		runSubcommand(subcommand{
+			flags:     backupFlagSet,
+			progress:  backupProgressFlag,
+			validArgs: func(args []string) bool { return len(args) == 2 },
+			files:     func(args []string) []int { return []int{1} },
+			run: func(ctx context.Context, reporter *app.ProgressReporter, args []string) (err error) {
+				checksum, err = backupDevice(ctx, reporter, args[0], args[1])
+				if err == nil {
+					err = app.ChownToInvokingUser(imaging.SystemPlatform, args[1])
+				}
+				return err
+			},
+			done: func(reporter *app.ProgressReporter, args []string) {
+				reporter.DoneWithChecksum(args[1], checksum)
+			},
+		})
+		return
+	} else if len(os.Args) >= 2 && os.Args[1] == "clone" {
+		runSubcommand(subcommand{
+			flags:     cloneFlagSet,
+			progress:  cloneProgressFlag,
+			validArgs: func(args []string) bool { return len(args) >= 2 },
+			run: func(ctx context.Context, reporter *app.ProgressReporter, args []string) error {
+				err := cloneDevice(ctx, reporter, args[0], args[1:])
+				reporter.TargetSummary(args[1:], err)
+				return err
+			},
+		})
+		return
+	} else if len(os.Args) >= 2 && os.Args[1] == "wipe" {
+		runSubcommand(subcommand{
+			flags:     wipeFlagSet,
+			progress:  wipeProgressFlag,
+			validArgs: func(args []string) bool { return len(args) == 1 },
+			run: func(ctx context.Context, reporter *app.ProgressReporter, args []string) error {
+				return wipeDevice(ctx, reporter, args[0])
+			},
+		})
+		return
+	} else if len(os.Args) >= 2 && os.Args[1] == "restore" {
+		runSubcommand(subcommand{
+			flags:     restoreFlagSet,
+			progress:  restoreProgressFlag,
+			validArgs: func(args []string) bool { return len(args) == 1 },
+			run: func(ctx context.Context, reporter *app.ProgressReporter, args []string) error {
+				return restoreDevice(ctx, reporter, args[0])
+			},
+		})
+		return
+	} else if len(os.Args) >= 2 && os.Args[1] == "list" {
+		listFlagSet.Parse(os.Args[2:])
+		if listFlagSet.NArg() != 0 {
+			listFlagSet.Usage()
+			os.Exit(app.ListExitError)
 		}
-		log.Println("Phase 2/" + totalPhases + ": Writing ISO to disk.")
-		if useSystemDdFlag != nil && *useSystemDdFlag {
-			err := imaging.RunDd(args[0], args[1])
-			if err != nil {
-				log.Fatalln(err)
-			}
-		} else {
-			err := imaging.WriteDiskImage(args[0], args[1])
-			if errors.Is(err, imaging.ErrReadWriteMismatch) {
-				log.Fatalln("Read/write mismatch! Is the dest too small!")
-			} else if err != nil {
-				log.Fatalln(imaging.CapitalizeString(err.Error()))
-			}
+		devices, err := imaging.GetAllDevices(imaging.SystemPlatform)
+		if err != nil {
+			println("Error: " + err.Error())
+			os.Exit(app.ListExitError)
 		}
-		if skipValidationFlag == nil || !*skipValidationFlag {
-			log.Println("Phase 3/" + totalPhases + ": Validating written image on disk.")
-			err := imaging.ValidateDiskImage(args[0], args[1])
-			if errors.Is(err, imaging.ErrDeviceValidationFailed) {
-				log.Fatalln("Read/write mismatch! Validation of image failed. It is unsafe to boot this device.")
-			} else if err != nil {
-				log.Fatalln(imaging.CapitalizeString(err.Error()))
-			}
+		exitCode := app.ListExitCode(devices)
+		if !*listAllFlag {
+			devices = slices.DeleteFunc(devices, func(device imaging.Device) bool {
+				return device.ExcludedReason != ""
+			})
 		}
-		return
+		if err := app.PrintDevices(os.Stdout, devices, *listJsonFlag); err != nil {
+			println("Error: " + err.Error())
+			os.Exit(app.ListExitError)
+		}
+		os.Exit(exitCode)
 	} else if len(os.Args) >= 2 {
 		flag.Usage()
 		os.Exit(1)
@@ -129,7 +721,7 @@ func main() {
 	}
 	w = webview.New(debug)
 	defer w.Destroy()
-	w.SetSize(640, 320, webview.HintNone)
+	w.SetSize(640, 360, webview.HintNone)
 	w.SetTitle("Imprint " + version)
 
 	// Bind a function to inject JavaScript and CSS via webview.Eval.
@@ -139,7 +731,7 @@ func main() {
 	})
 
 	// Bind a function to request refresh of devices attached.
-	w.Bind("refreshDevices", func() {
+	refreshDevices := func() {
 		devices, err := imaging.GetDevices(imaging.SystemPlatform)
 		if err != nil {
 			w.Eval("setDialogReact(" + ParseToJsString("Error: "+err.Error()) + ")")
@@ -156,18 +748,15 @@ func main() {
 				})
 			}
 		}
-		jsonifiedDevices := make([]string, len(devices))
-		for index, device := range devices {
-			base := strconv.Itoa(device.Bytes) + " " + device.Name
-			if device.Model == "" {
-				jsonifiedDevices[index] = ParseToJsString(base + " (" + device.Size + ")")
-			} else {
-				jsonifiedDevices[index] = ParseToJsString(base + " (" + device.Model + ", " + device.Size + ")")
-			}
+		jsonifiedDevices, err := json.Marshal(devices)
+		if err != nil {
+			w.Eval("setDialogReact(" + ParseToJsString("Error: "+err.Error()) + ")")
+			return
 		}
 		// Call setDevicesReact.
-		w.Eval("setDevicesReact([" + strings.Join(jsonifiedDevices, ", ") + "])")
-	})
+		w.Eval("setDevicesReact(" + string(jsonifiedDevices) + ")")
+	}
+	w.Bind("refreshDevices", refreshDevices)
 
 	// Bind a function to prompt for file.
 	w.Bind("promptForFile", func() {
@@ -175,7 +764,7 @@ func main() {
 		if err != nil {
 			homedir = "/"
 		}
-		filename, err := dialog.File().Title("Select image to flash").SetStartDir(homedir).Filter("Disk image file", "raw", "iso", "img", "dmg").Load()
+		filename, err := dialog.File().Title("Select image to flash").SetStartDir(homedir).Filter("Disk image file", imaging.ImageExtensions...).Load()
 		if err != nil && err.Error() != "Cancelled" {
 			w.Eval("setDialogReact(" + ParseToJsString("Error: "+err.Error()) + ")")
 			return
@@ -191,12 +780,80 @@ func main() {
 		}
 	})
 
+	// Bind a function to detect the checksum of a disk image from a checksum file next to it.
+	w.Bind("detectChecksum", func(file string) {
+		if checksumFile, checksum := imaging.FindChecksumFile(file); checksum != nil {
+			w.Eval("setChecksumReact(" + ParseToJsString(file) + ", " + ParseToJsString(checksum.String()) +
+				", " + ParseToJsString(checksumFile) + ")")
+		}
+	})
+
+	// Bind a function to prompt for the OpenPGP keyring to verify signatures against.
+	w.Bind("promptForKeyring", func() {
+		filename, err := dialog.File().Title("Select OpenPGP keyring").Filter("OpenPGP keyring", "asc", "gpg", "pgp", "key").Load()
+		if err != nil && err.Error() != "Cancelled" {
+			w.Eval("setDialogReact(" + ParseToJsString("Error: "+err.Error()) + ")")
+		} else if err == nil {
+			w.Eval("setKeyringReact(" + ParseToJsString(filename) + ")")
+		}
+	})
+
+	// Bind a function to verify the OpenPGP signature of a disk image (or its checksum file).
+	w.Bind("checkSignature", func(file string, checksumFile string, keyring string) {
+		go func() { // Verifying the signature of a disk image requires reading all of it.
+			_, signer, err := app.VerifySignature(file, checksumFile, keyring)
+			status, _ := json.Marshal(app.SignatureStatusOf(signer, err))
+			w.Dispatch(func() {
+				w.Eval("setSignatureReact(" + ParseToJsString(file) + ", " + ParseToJsString(checksumFile) +
+					", " + string(status) + ")")
+			})
+		}()
+	})
+
 	// Bind flashing.
+	// The mutex guards inputPipe, cancelled, flashingDevices and disconnected, which are used by
+	// the bindings and the device watcher on different goroutines.
 	var inputPipe io.WriteCloser
 	var cancelled bool = false
+	var flashingDevices []string     // The devices being flashed to, or empty if there are none.
+	var disconnected map[string]bool // The devices which were removed while flashing several.
 	var mutex sync.Mutex
-	w.Bind("flash", func(file string, device string, deviceSize int) {
+	stopFlash := func(result string) {
+		mutex.Lock()
+		err := errors.New("nothing is being flashed")
+		if inputPipe != nil {
+			_, err = inputPipe.Write([]byte("stop\n"))
+		}
+		if err == nil {
+			cancelled = true
+		}
+		mutex.Unlock()
+		if err != nil {
+			w.Dispatch(func() { w.Eval("setProgressReact(\"Error occurred when cancelling.\")") })
+		} else {
+			w.Dispatch(func() { w.Eval("setProgressReact(" + ParseToJsString(result) + ")") })
+		}
+	}
+	w.Bind("flash", func(file string, devices []imaging.Device, opts flashOptions) {
+		mutex.Lock()
 		cancelled = false
+		mutex.Unlock()
+		flags, err := opts.flags()
+		if err != nil {
+			w.Eval("setDialogReact(" + ParseToJsString("Error: "+imaging.CapitalizeString(err.Error())) + ")")
+			return
+		} else if len(devices) == 0 {
+			w.Eval("setDialogReact(" + ParseToJsString("Error: Select a device to flash the image to!") + ")")
+			return
+		}
+		connected, err := imaging.GetAllDevices(imaging.SystemPlatform)
+		for _, device := range devices {
+			if err == nil && !strings.HasSuffix(device.Name, "debug.iso") &&
+				!slices.ContainsFunc(connected, func(d imaging.Device) bool { return d.Name == device.Name }) {
+				w.Eval("setDialogReact(" + ParseToJsString("Error: The selected device "+device.Name+" was disconnected!") + ")")
+				return
+			}
+		}
 		stat, err := os.Stat(file)
 		if err != nil {
 			w.Eval("setDialogReact(" + ParseToJsString("Error: "+err.Error()) + ")")
@@ -204,61 +861,190 @@ func main() {
 		} else if !stat.Mode().IsRegular() {
 			w.Eval("setDialogReact(" + ParseToJsString("Error: Select a regular file!") + ")")
 			return
-		} else if stat.Size() > int64(deviceSize) {
-			w.Eval("setDialogReact(" + ParseToJsString("Error: The disk image is too big to fit on the selected drive!") + ")")
+		}
+		image, err := imaging.OpenSourceImage(file, "")
+		if err != nil {
+			w.Eval("setDialogReact(" + ParseToJsString("Error: "+imaging.CapitalizeString(err.Error())) + ")")
 			return
 		}
-		fileSizeStr := strconv.Itoa(int(stat.Size()))
-		channel, stdin, err := app.CopyConvert(file, device)
-		inputPipe = stdin
+		image.Close()
+		// The uncompressed size of some compressed images is unknown, but it's at least as big.
+		imageSize := image.Size
+		if image.UncompressedSize >= 0 {
+			imageSize = image.UncompressedSize
+		}
+		targets := make([]string, len(devices))
+		for i, device := range devices {
+			if imageSize > device.Bytes {
+				w.Eval("setDialogReact(" + ParseToJsString("Error: The disk image is too big to fit on "+device.Name+"!") + ")")
+				return
+			}
+			targets[i] = device.Name
+		}
+		fileSizeStr := strconv.Itoa(image.UncompressedSize)
+		compressedProgress := func(bytes int) string {
+			if image.Compression == imaging.CompressionNone {
+				return ""
+			}
+			return ", compressedBytes: " + strconv.Itoa(bytes) + ", compressedTotal: " + strconv.Itoa(image.Size)
+		}
+		channel, stdin, err := app.CopyConvert(file, targets, flags...)
 		if err != nil {
 			w.Eval("setDialogReact(" + ParseToJsString("Error: "+err.Error()) + ")")
 			return
 		}
+		mutex.Lock()
+		inputPipe = stdin
+		flashingDevices = targets
+		disconnected = make(map[string]bool)
+		mutex.Unlock()
 		// Show progress instantly.
 		w.Eval("setProgressReact({ bytes: 0, total: " + fileSizeStr + ", speed: '0 MB/s', " +
-			"phase: 'Phase 0: Initiating flash process.' })")
+			"phase: 'Phase 0: Initiating flash process.'" + compressedProgress(0) + " })")
 		go (func() {
+			defer func() {
+				mutex.Lock()
+				inputPipe, flashingDevices = nil, nil
+				mutex.Unlock()
+			}()
 			result := "Done!"
+			phase := ""
+			failed := make(map[string]bool)
+			// Devices which were disconnected are shown as failed by the device watcher.
+			isFailed := func(target string) bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return failed[target] || disconnected[target]
+			}
+			targetsFailed := false
+			setTargetProgress := func(target string, progress string) {
+				w.Dispatch(func() {
+					w.Eval("setTargetProgressReact(" + ParseToJsString(target) + ", " + progress + ")")
+				})
+			}
 			for {
 				progress, ok := <-channel
 				mutex.Lock()
-				if cancelled {
-					defer mutex.Unlock()
+				if cancelled && ok {
+					mutex.Unlock()
+					continue // Drain remaining progress so the flash process can exit.
+				} else if cancelled {
+					mutex.Unlock()
 					return
 				}
 				mutex.Unlock()
 				if ok {
 					if progress.Error != nil { // Error is always the last emitted.
 						result = progress.Error.Error()
+						targetsFailed = app.ErrorCodeOf(progress.Error) == app.ErrorCodeTargetsFailed
+					} else if progress.TargetError != "" && !isFailed(progress.Target) {
+						failed[progress.Target] = true
+						setTargetProgress(progress.Target, "{ error: "+ParseToJsString(progress.TargetError)+" }")
+					} else if progress.Target != "" && progress.Warning != "" {
+						println("Warning: " + progress.Target + ": " + progress.Warning)
+					} else if progress.Target != "" && !isFailed(progress.Target) {
+						setTargetProgress(progress.Target, "{ bytes: "+strconv.Itoa(progress.Bytes)+
+							", speed: "+ParseToJsString(progress.Speed)+" }")
 					} else {
+						if progress.Warning != "" {
+							println("Warning: " + progress.Warning)
+						}
+						if len(targets) > 1 && progress.Phase != phase { // Reset progress for the new phase.
+							for _, target := range targets {
+								if !isFailed(target) {
+									setTargetProgress(target, "{ bytes: 0, speed: '0 MB/s' }")
+								}
+							}
+						}
+						phase = progress.Phase
 						w.Dispatch(func() {
 							w.Eval("setProgressReact({ bytes: " + strconv.Itoa(progress.Bytes) +
 								", total: " + fileSizeStr +
 								", speed: " + ParseToJsString(progress.Speed) +
-								", phase: " + ParseToJsString(progress.Phase) + " })")
+								", phase: " + ParseToJsString(progress.Phase) +
+								compressedProgress(progress.SourceBytes) + " })")
 						})
 					}
 				} else {
 					break
 				}
 			}
+			// With several devices, those which didn't fail succeeded unless flashing failed as a whole.
+			if len(targets) > 1 && (result == "Done!" || targetsFailed) {
+				for _, target := range targets {
+					if !isFailed(target) {
+						setTargetProgress(target, "{ done: true }")
+					}
+				}
+			}
 			w.Dispatch(func() { w.Eval("setProgressReact(" + ParseToJsString(result) + ")") })
 		})()
 	})
 
-	w.Bind("cancelFlash", func() {
-		_, err := inputPipe.Write([]byte("stop\n"))
+	w.Bind("cancelFlash", func() { stopFlash("Cancelled the operation!") })
+
+	// Bind restoring a flashed device to a normal drive with a single partition.
+	w.Bind("restore", func(device imaging.Device, filesystem string, label string) {
+		connected, err := imaging.GetAllDevices(imaging.SystemPlatform)
+		if err == nil && !strings.HasSuffix(device.Name, "debug.iso") &&
+			!slices.ContainsFunc(connected, func(d imaging.Device) bool { return d.Name == device.Name }) {
+			w.Eval("setFormattingReact(false)")
+			w.Eval("setDialogReact(" + ParseToJsString("Error: The selected device "+device.Name+" was disconnected!") + ")")
+			return
+		}
+		channel, stdin, err := app.Restore(device.Name, "--fs="+filesystem, "--label="+label)
 		if err != nil {
-			w.Dispatch(func() { w.Eval("setProgressReact(\"Error occurred when cancelling.\")") })
-		} else {
-			mutex.Lock()
-			defer mutex.Unlock()
-			cancelled = true
-			w.Dispatch(func() { w.Eval("setProgressReact(\"Cancelled the operation!\")") })
+			w.Eval("setFormattingReact(false)")
+			w.Eval("setDialogReact(" + ParseToJsString("Error: "+err.Error()) + ")")
+			return
 		}
+		go (func() {
+			defer stdin.Close()
+			result := "Formatted " + device.Name + " successfully!"
+			for progress := range channel {
+				if progress.Error != nil {
+					result = "Error: " + imaging.CapitalizeString(progress.Error.Error())
+				} else if progress.Warning != "" {
+					println("Warning: " + progress.Warning)
+				}
+			}
+			w.Dispatch(func() {
+				w.Eval("setFormattingReact(false)")
+				w.Eval("setDialogReact(" + ParseToJsString(result) + ")")
+				refreshDevices()
+			})
+		})()
 	})
 
+	// Push hotplugged devices to the GUI, and stop flashing if the device being flashed is removed.
+	// When flashing several devices, the others continue, and the removed device is shown as failed.
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	if events, err := imaging.WatchDevices(watchCtx); err != nil {
+		println("Warning: Unable to watch for device changes: " + err.Error())
+	} else {
+		go func() {
+			for event := range events {
+				mutex.Lock()
+				devices := flashingDevices
+				mutex.Unlock()
+				if len(devices) == 0 {
+					w.Dispatch(refreshDevices)
+				} else if event.Type == imaging.DeviceRemoved && len(devices) == 1 && event.Device.Name == devices[0] {
+					stopFlash("The device was disconnected while flashing!")
+				} else if event.Type == imaging.DeviceRemoved && slices.Contains(devices, event.Device.Name) {
+					mutex.Lock()
+					disconnected[event.Device.Name] = true
+					mutex.Unlock()
+					message := ParseToJsString("The device was disconnected while flashing!")
+					w.Dispatch(func() {
+						w.Eval("setTargetProgressReact(" + ParseToJsString(event.Device.Name) + ", { error: " + message + " })")
+					})
+				}
+			}
+		}()
+	}
+
 	if overrideUrl != "" {
 		w.Navigate(overrideUrl)
 	} else {
@@ -1,5 +1,5 @@
 import { DialogContent, DialogTitle, Modal, ModalClose, ModalDialog } from '@mui/joy'
-import { useEffect, useState } from 'react'
+import { useEffect, useRef, useState } from 'react'
 
 import MainScreen from './screens/MainScreen'
 import ProgressScreen from './screens/ProgressScreen'
@@ -10,18 +10,68 @@ import * as styles from './App.module.scss'
 const App = (): React.JSX.Element => {
   // useColorScheme().setMode('dark')
   const [file, setFile] = useState('')
-  const [device, setDevice] = useState<string | null>(null)
-  const [devices, setDevices] = useState<string[]>([])
+  const [checksum, setChecksum] = useState('')
+  const [detected, setDetected] = useState({ checksum: '', checksumFile: '' })
+  const [keyring, setKeyring] = useState('')
+  const [signature, setSignature] = useState<SignatureStatus | null>(null)
+  const [selected, setSelected] = useState<Device[]>([])
+  const [devices, setDevices] = useState<Device[]>([])
   const [dialog, setDialog] = useState('')
   const [progress, setProgress] = useState<Progress | string | null>(null)
+  const [targets, setTargets] = useState<Record<string, TargetProgress>>({})
+  const [formatting, setFormatting] = useState(false)
+  // Devices are pushed whenever they are hotplugged, so keep the selection if it's still present.
+  const selectedRef = useRef(selected)
+  useEffect(() => {
+    selectedRef.current = selected
+  }, [selected])
+  // Auto-detect the checksum from a SHA256SUMS (or similar) file next to the disk image.
+  const fileRef = useRef(file)
+  useEffect(() => {
+    fileRef.current = file
+    setChecksum('')
+    setDetected({ checksum: '', checksumFile: '' })
+    if (file !== '') globalThis.detectChecksum(file)
+  }, [file])
+  // The detected checksum file is only used (and its signature verified) if the checksum is kept.
+  const checksumFile = checksum.trim() === detected.checksum ? detected.checksumFile : ''
+  const checksumFileRef = useRef(checksumFile)
+  useEffect(() => {
+    checksumFileRef.current = checksumFile
+    setSignature(null)
+    if (file !== '' && keyring !== '') globalThis.checkSignature(file, checksumFile, keyring)
+  }, [file, checksumFile, keyring])
   useEffect(() => {
     globalThis.setFileReact = setFile
     globalThis.setDevicesReact = devices => {
       setDevices(devices)
-      setDevice(null)
+      const selected = selectedRef.current
+      if (selected.length === 0) return
+      const updated = selected
+        .map(selected => devices.find(device => device.name === selected.name))
+        .filter(device => device !== undefined)
+      setSelected(updated)
+      if (updated.length !== selected.length) {
+        setDialog('Error: The selected device was disconnected!')
+      }
+    }
+    globalThis.setChecksumReact = (file, checksum, checksumFile) => {
+      if (file !== fileRef.current) return
+      setChecksum(checksum)
+      setDetected({ checksum, checksumFile })
+    }
+    globalThis.setKeyringReact = setKeyring
+    globalThis.setSignatureReact = (file, checksumFile, status) => {
+      if (file === fileRef.current && checksumFile === checksumFileRef.current) setSignature(status)
     }
     globalThis.setDialogReact = setDialog
     globalThis.setProgressReact = setProgress
+    globalThis.setTargetProgressReact = (device, progress) =>
+      setTargets(targets => ({
+        ...targets,
+        [device]: { bytes: 0, speed: '0 MB/s', ...targets[device], ...progress },
+      }))
+    globalThis.setFormattingReact = setFormatting
     globalThis.refreshDevices()
   }, [])
 
@@ -41,21 +91,31 @@ const App = (): React.JSX.Element => {
           <MainScreen
             file={file}
             setFile={setFile}
-            device={device}
-            setDevice={setDevice}
+            checksum={checksum}
+            setChecksum={setChecksum}
+            checksumFile={checksumFile}
+            keyring={keyring}
+            signature={signature}
+            selected={selected}
+            setSelected={setSelected}
             devices={devices}
             setDialog={setDialog}
+            formatting={formatting}
+            setFormatting={setFormatting}
           />
         )}
-        {progress !== null && (
+        {progress !== null && selected.length > 0 && (
           <ProgressScreen
-            device={device ?? ''}
+            devices={selected}
             file={file}
             progress={progress}
+            targets={targets}
             onExit={() => {
               setFile('')
-              setDevice(null)
+              selectedRef.current = []
+              setSelected([])
               setProgress(null)
+              setTargets({})
               globalThis.refreshDevices()
             }}
           />
@@ -0,0 +1,26 @@
+// Returns a short label for a device, e.g. "/dev/sdb (SanDisk Cruzer, 2.0 GB)".
+export const getDeviceLabel = (device: Device): string => {
+  const model = [device.vendor, device.model].filter(Boolean).join(' ')
+  const label =
+    model === '' ? `${device.name} (${device.size})` : `${device.name} (${model}, ${device.size})`
+  return device.readOnly ? `${label} [read-only]` : label
+}
+
+// Returns lines describing a device in detail, to tell apart otherwise identical devices.
+export const getDeviceDetails = (device: Device): string[] => {
+  const details: string[] = []
+  const identity = [
+    device.transport?.toUpperCase(),
+    device.serial !== undefined ? `serial ${device.serial}` : undefined,
+  ].filter(Boolean)
+  if (identity.length > 0) details.push(identity.join(', '))
+  if (device.byIdPath !== undefined) details.push(device.byIdPath)
+  for (const partition of device.partitions ?? []) {
+    let line = partition.name
+    if (partition.label !== undefined) line += ` "${partition.label}"`
+    if (partition.fsType !== undefined) line += ` (${partition.fsType})`
+    if (partition.mountpoints !== undefined) line += ` mounted at ${partition.mountpoints.join(', ')}`
+    details.push(line)
+  }
+  return details
+}
@@ -5,20 +5,78 @@ import App from './App'
 
 declare global {
   // Exports from Go app process.
-  var flash: (filePath: string, devicePath: string, deviceSize: number) => void
+  var flash: (filePath: string, devices: Device[], options: FlashOptions) => void
   var cancelFlash: () => void
   var promptForFile: () => void
   var refreshDevices: () => void
+  var detectChecksum: (filePath: string) => void
+  var promptForKeyring: () => void
+  var checkSignature: (filePath: string, checksumFile: string, keyring: string) => void
+  var restore: (device: Device, filesystem: Filesystem, label: string) => void
   // Export React state to the global scope.
   var setFileReact: (file: string) => void
-  var setDevicesReact: (devices: string[]) => void
+  var setDevicesReact: (devices: Device[]) => void
+  var setChecksumReact: (filePath: string, checksum: string, checksumFile: string) => void
+  var setKeyringReact: (keyring: string) => void
+  var setSignatureReact: (filePath: string, checksumFile: string, status: SignatureStatus) => void
   var setDialogReact: (dialog: string) => void
   var setProgressReact: (progress: Progress | string | null) => void
+  var setTargetProgressReact: (device: string, progress: Partial<TargetProgress>) => void
+  var setFormattingReact: (formatting: boolean) => void
+  // Mirrors imaging.Device and imaging.Partition in Go.
+  interface Device {
+    name: string
+    model: string
+    size: string
+    bytes: number
+    removable: boolean
+    readOnly: boolean
+    vendor?: string
+    serial?: string
+    transport?: string
+    logicalSectorSize?: number
+    physicalSectorSize?: number
+    byIdPath?: string
+    partitions?: Partition[]
+  }
+  interface Partition {
+    name: string
+    label?: string
+    fsType?: string
+    bytes: number
+    mountpoints?: string[]
+  }
+  // Mirrors flashOptions in Go.
+  interface FlashOptions {
+    checksum: string
+    checksumFile: string
+    keyring: string
+    allowUnverified: boolean
+  }
+  // Mirrors imaging.Filesystem in Go.
+  type Filesystem = 'exfat' | 'fat32'
+  // Mirrors app.SignatureStatus in Go.
+  interface SignatureStatus {
+    status: 'verified' | 'missing' | 'invalid' | 'error'
+    message: string
+  }
   interface Progress {
     bytes: number
     total: number
     speed: string
     phase: string
+    // Only present when flashing a compressed image, since progress is tracked against it.
+    compressedBytes?: number
+    compressedTotal?: number
+  }
+  // The progress of each device when flashing several devices at once.
+  interface TargetProgress {
+    bytes: number
+    speed: string
+    // Set once the device fails, while the other devices continue.
+    error?: string
+    // Set once flashing is done, for devices which succeeded.
+    done?: boolean
   }
 }
 
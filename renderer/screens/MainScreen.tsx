@@ -1,7 +1,9 @@
 import {
   Button,
+  Chip,
   DialogContent,
   DialogTitle,
+  Input,
   Modal,
   ModalClose,
   ModalDialog,
@@ -10,47 +12,153 @@ import {
   Textarea,
   Typography,
 } from '@mui/joy'
-import { useState } from 'react'
+import { useEffect, useState } from 'react'
 
+import { getDeviceDetails, getDeviceLabel } from '../devices'
 import * as styles from './MainScreen.module.scss'
 
 const MainScreen = ({
   file,
   setFile,
-  device,
-  setDevice,
+  checksum,
+  setChecksum,
+  checksumFile,
+  keyring,
+  signature,
+  selected,
+  setSelected,
   devices,
   setDialog,
+  formatting,
+  setFormatting,
 }: {
   file: string
   setFile: React.Dispatch<React.SetStateAction<string>>
-  device: string | null
-  setDevice: React.Dispatch<React.SetStateAction<string | null>>
-  devices: string[]
+  checksum: string
+  setChecksum: React.Dispatch<React.SetStateAction<string>>
+  checksumFile: string
+  keyring: string
+  signature: SignatureStatus | null
+  selected: Device[]
+  setSelected: React.Dispatch<React.SetStateAction<Device[]>>
+  devices: Device[]
   setDialog: React.Dispatch<React.SetStateAction<string>>
+  formatting: boolean
+  setFormatting: React.Dispatch<React.SetStateAction<boolean>>
 }): React.JSX.Element => {
   const [confirm, setConfirm] = useState(false)
+  const [format, setFormat] = useState(false)
+  const [filesystem, setFilesystem] = useState<Filesystem>('exfat')
+  const [label, setLabel] = useState('')
+  // Don't let the user confirm flashing (or formatting) a device which was just disconnected.
+  useEffect(() => {
+    setConfirm(false)
+    setFormat(false)
+  }, [selected.length])
   const onFileInputChange: React.ChangeEventHandler<HTMLTextAreaElement> = event =>
     setFile(event.target.value.replace(/\n/g, ''))
   const onFlashClick = (): void => {
-    if (device === null) return setDialog('Error: Select a device to flash the image to!')
+    if (selected.length === 0) return setDialog('Error: Select a device to flash the image to!')
     if (file === '') return setDialog('Error: Select a disk image to flash to device!')
+    const readOnly = selected.find(device => device.readOnly)
+    if (readOnly !== undefined) {
+      return setDialog(
+        `Error: The selected device ${readOnly.name} is read-only or write-protected! ` +
+          'If it is an SD card, check the lock switch on its side.',
+      )
+    }
     setConfirm(true)
   }
+  // Flashing an unverified image requires confirming the warning in the confirmation dialog.
+  const unverified = keyring !== '' && signature?.status !== 'verified'
   const onFlashConfirm = (): void => {
-    if (device === null || file === '') return
+    if (selected.length === 0 || file === '') return
     setConfirm(false)
-    globalThis.flash(file, device.split(' ')[1], +device.split(' ')[0])
+    globalThis.flash(file, selected, {
+      checksum: checksum.trim(),
+      checksumFile,
+      keyring,
+      allowUnverified: unverified,
+    })
+  }
+
+  const onFormatClick = (): void => {
+    if (selected.length !== 1) return setDialog('Error: Select a single device to format!')
+    if (selected[0].readOnly) {
+      return setDialog(
+        `Error: The selected device ${selected[0].name} is read-only or write-protected! ` +
+          'If it is an SD card, check the lock switch on its side.',
+      )
+    }
+    setFormat(true)
+  }
+  const onFormatConfirm = (): void => {
+    if (selected.length !== 1) return
+    setFormat(false)
+    setFormatting(true)
+    globalThis.restore(selected[0], filesystem, label.trim())
   }
 
   return (
     <>
+      <Modal open={format} onClose={() => setFormat(false)}>
+        <ModalDialog>
+          <ModalClose variant='soft' />
+          <DialogTitle>Format drive</DialogTitle>
+          <DialogContent>
+            Restore {selected.length === 1 && getDeviceLabel(selected[0])} to a normal drive with a
+            single partition. This operation will WIPE ALL DATA on it!
+            <div className={styles['format-form']}>
+              <Select
+                value={filesystem}
+                onChange={(_, value) => value !== null && setFilesystem(value)}
+              >
+                <Option value='exfat'>exFAT (recommended, files over 4 GB)</Option>
+                <Option value='fat32'>FAT32 (older devices, e.g. TVs and car stereos)</Option>
+              </Select>
+              <Input
+                placeholder='Label (optional)'
+                value={label}
+                onChange={event => setLabel(event.target.value)}
+                slotProps={{ input: { maxLength: 11 } }}
+              />
+            </div>
+          </DialogContent>
+          <Button color='danger' onClick={onFormatConfirm}>
+            Format
+          </Button>
+        </ModalDialog>
+      </Modal>
       <Modal open={confirm} onClose={() => setConfirm(false)}>
         <ModalDialog>
           <ModalClose variant='soft' />
           <DialogTitle>Do you want to continue?</DialogTitle>
           <DialogContent>
-            This operation will WIPE ALL DATA from: {device?.substring(device.indexOf(' ') + 1)}.
+            This operation will WIPE ALL DATA from:{' '}
+            {selected.length === 1 && `${getDeviceLabel(selected[0])}.`}
+            {selected.map(device => (
+              <div key={device.name}>
+                {selected.length > 1 && (
+                  <Typography level='title-sm'>{getDeviceLabel(device)}</Typography>
+                )}
+                {getDeviceDetails(device).map(detail => (
+                  <Typography key={detail} level='body-sm'>
+                    {detail}
+                  </Typography>
+                ))}
+              </div>
+            ))}
+            {checksum.trim() !== '' && (
+              <Typography level='body-sm'>
+                The disk image will be verified against {checksum.trim()} while flashing.
+              </Typography>
+            )}
+            {unverified && (
+              <Typography level='body-sm' color='danger'>
+                Warning: The OpenPGP signature of the disk image could not be verified!{' '}
+                {signature?.message}
+              </Typography>
+            )}
           </DialogContent>
           <Button color='danger' onClick={onFlashConfirm}>
             Proceed
@@ -72,35 +180,88 @@ const MainScreen = ({
           onChange={onFileInputChange}
         />
       </div>
+      <Input
+        placeholder='Checksum (optional), e.g. sha256:e3b0c442...'
+        className={styles['checksum-input']}
+        value={checksum}
+        onChange={event => setChecksum(event.target.value)}
+      />
+      <div className={styles['signature-container']}>
+        <SignatureBadge keyring={keyring} signature={signature} />
+        <Button size='sm' variant='plain' onClick={() => globalThis.promptForKeyring()}>
+          {keyring === '' ? 'Select keyring' : 'Change keyring'}
+        </Button>
+      </div>
       <br />
-      <Typography>Step 2: Select the device to flash to.</Typography>
+      <Typography>Step 2: Select the devices to flash to.</Typography>
       <div className={styles['select-container']}>
         <Select
+          multiple
           className={styles['full-width']}
-          placeholder='Select a device'
-          value={device}
+          placeholder='Select one or more devices'
+          value={selected.map(device => device.name)}
           required
-          onChange={(_, value) => setDevice(value)}
+          onChange={(_, value) =>
+            setSelected(devices.filter(device => value.includes(device.name)))
+          }
         >
           {devices.map(device => (
-            <Option key={device} value={device}>
-              {device.substring(device.indexOf(' ') + 1)}
+            <Option key={device.name} value={device.name}>
+              {getDeviceLabel(device)}
             </Option>
           ))}
         </Select>
         <Button onClick={() => globalThis.refreshDevices()} variant='soft'>
           Refresh
         </Button>
+        <Button onClick={onFormatClick} variant='soft' color='neutral' loading={formatting}>
+          Format
+        </Button>
       </div>
 
       <br />
       <div className={styles['flash-progress-container']}>
         {/* TODO: Add Settings dialog to disable validation and toggle dark mode. */}
         <div className={styles['full-width']} />
-        <Button onClick={onFlashClick}>Flash</Button>
+        <Button onClick={onFlashClick} disabled={formatting}>
+          Flash
+        </Button>
       </div>
     </>
   )
 }
 
+const SignatureBadge = ({
+  keyring,
+  signature,
+}: {
+  keyring: string
+  signature: SignatureStatus | null
+}): React.JSX.Element => {
+  if (keyring === '') {
+    return <Chip variant='soft'>Signature not checked</Chip>
+  } else if (signature === null) {
+    return <Chip variant='soft'>Checking signature...</Chip>
+  } else if (signature.status === 'verified') {
+    return (
+      <Chip variant='soft' color='success'>
+        Signed by {signature.message}
+      </Chip>
+    )
+  }
+  return (
+    <Chip
+      variant='soft'
+      color={signature.status === 'invalid' ? 'danger' : 'warning'}
+      title={signature.message}
+    >
+      {signature.status === 'invalid'
+        ? 'Invalid signature'
+        : signature.status === 'missing'
+          ? 'No signature found'
+          : 'Signature not verified'}
+    </Chip>
+  )
+}
+
 export default MainScreen
@@ -11,6 +11,7 @@ import {
 import JSBI from 'jsbi'
 import { useEffect, useState } from 'react'
 
+import { getDeviceLabel } from '../devices'
 import * as styles from './ProgressScreen.module.scss'
 
 function bytesToString(bytes: number, binaryPowers = false): string {
@@ -35,15 +36,21 @@ function bytesToString(bytes: number, binaryPowers = false): string {
   }
 }
 
+function percentOf(bytes: number, total: number): JSBI {
+  return JSBI.divide(JSBI.multiply(JSBI.BigInt(bytes), JSBI.BigInt(100)), JSBI.BigInt(total))
+}
+
 const ProgressScreen = ({
   progress,
-  device,
+  devices,
   file,
+  targets,
   onExit,
 }: {
   progress: Progress | string
-  device: string
+  devices: Device[]
   file: string
+  targets: Record<string, TargetProgress>
   onExit: () => void
 }): React.JSX.Element => {
   const [confirm, setConfirm] = useState(false)
@@ -53,14 +60,18 @@ const ProgressScreen = ({
   const inProgress = typeof progress === 'object'
   const progressPercent =
     !isError && !isDone
-      ? JSBI.divide(
-          JSBI.multiply(JSBI.BigInt(progress.bytes), JSBI.BigInt(100)),
-          JSBI.BigInt(progress.total),
-        )
+      ? progress.compressedBytes !== undefined && progress.compressedTotal !== undefined
+        ? percentOf(progress.compressedBytes, progress.compressedTotal)
+        : percentOf(progress.bytes, progress.total)
       : JSBI.BigInt(0)
+  // The uncompressed size of some compressed images cannot be determined up-front.
+  const progressTotal =
+    inProgress && progress.total >= 0 ? bytesToString(progress.total) : 'unknown size'
 
   const sourceImage = file.replace('\\', '/').split('/').pop()
-  const targetDisk = device.substring(device.indexOf(' ') + 1)
+  const targetDisk = devices.map(getDeviceLabel).join(', ')
+  // When flashing several devices, the progress and result of each device is shown separately.
+  const multiple = devices.length > 1
   const onDismiss = (): void => {
     if (isError || isDone) onExit()
     else setConfirm(true)
@@ -76,7 +87,7 @@ const ProgressScreen = ({
           <ModalClose variant='soft' />
           <DialogTitle>Do you want to cancel flashing?</DialogTitle>
           <DialogContent>
-            This will render the device {device.substring(device.indexOf(' ') + 1)} unusable.
+            This will render the {multiple ? 'devices' : 'device'} {targetDisk} unusable.
             <br />
             You must reformat the device to use it again.
           </DialogContent>
@@ -86,29 +97,47 @@ const ProgressScreen = ({
         </ModalDialog>
       </Modal>
       <Typography gutterBottom level='h3' color={isError ? 'danger' : undefined}>
-        {isDone && 'Completed flashing ISO to disk!'}
+        {isDone && `Completed flashing ISO to ${multiple ? 'disks' : 'disk'}!`}
         {isError && 'Error occurred while flashing ISO to disk!'}
         {inProgress && progress.phase}
       </Typography>
-      <LinearProgress
-        sx={{ mb: '0.8em' }}
-        color={isError ? 'danger' : undefined}
-        determinate={!isError}
-        value={inProgress ? JSBI.toNumber(progressPercent) : isDone ? 100 : undefined}
-      />
+      {!multiple && (
+        <LinearProgress
+          sx={{ mb: '0.8em' }}
+          color={isError ? 'danger' : undefined}
+          determinate={!isError}
+          value={inProgress ? JSBI.toNumber(progressPercent) : isDone ? 100 : undefined}
+        />
+      )}
       {!isDone && (
         <Typography level='title-lg' gutterBottom color={isError ? 'danger' : undefined}>
-          {inProgress
+          {inProgress && !multiple
             ? `${progressPercent.toString()}% \
-(${bytesToString(progress.bytes)} / ${bytesToString(progress.total)}) — ${progress.speed}`
-            : progress}
+(${bytesToString(progress.bytes)} / ${progressTotal}) — ${progress.speed}`
+            : inProgress
+              ? `Flashing ${devices.length} disks (${progressTotal})`
+              : progress.split('\n')[0]}
         </Typography>
       )}
       <Typography gutterBottom>
         <strong>Source Image:</strong> {sourceImage}
-        <br />
-        <strong>Target Disk:</strong> {targetDisk}
+        {!multiple && (
+          <>
+            <br />
+            <strong>Target Disk:</strong> {targetDisk}
+          </>
+        )}
       </Typography>
+      {multiple &&
+        devices.map(device => (
+          <TargetProgressRow
+            key={device.name}
+            device={device}
+            target={targets[device.name]}
+            total={inProgress ? progress.total : -1}
+            failed={isError}
+          />
+        ))}
       {inProgress && (
         <Typography gutterBottom color='warning'>
           <strong>Note:</strong> Do not remove the external drive or shut down the computer during
@@ -130,4 +159,42 @@ const ProgressScreen = ({
   )
 }
 
+// Shows the progress of a single device when flashing several devices at once.
+const TargetProgressRow = ({
+  device,
+  target,
+  total,
+  failed,
+}: {
+  device: Device
+  target?: TargetProgress
+  total: number
+  // Flashing failed or was cancelled, so devices which aren't done didn't succeed.
+  failed: boolean
+}): React.JSX.Element => {
+  const error = target?.error ?? (failed && target?.done !== true ? 'Not completed.' : undefined)
+  const done = error === undefined && target?.done === true
+  const bytes = target?.bytes ?? 0
+  const percent = total > 0 ? percentOf(bytes, total) : JSBI.BigInt(0)
+  const color = error !== undefined ? 'danger' : done ? 'success' : undefined
+  return (
+    <div>
+      <Typography level='title-sm'>{getDeviceLabel(device)}</Typography>
+      <LinearProgress
+        sx={{ my: '0.4em' }}
+        color={color}
+        determinate={error !== undefined || done || total > 0}
+        value={error !== undefined || done ? 100 : JSBI.toNumber(percent)}
+      />
+      <Typography level='body-sm' gutterBottom color={color}>
+        {error !== undefined
+          ? `Failed: ${error}`
+          : done
+            ? 'Succeeded.'
+            : `${percent.toString()}% (${bytesToString(bytes)}) — ${target?.speed ?? '0 MB/s'}`}
+      </Typography>
+    </div>
+  )
+}
+
 export default ProgressScreen